@@ -0,0 +1,251 @@
+package terrarium
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Account is a registered identity that users may log in to.
+type Account struct {
+	// Name of the account as it was registered.
+	Name string `json:"name"`
+
+	// bcrypt hash of the account's password.
+	PasswordHash string `json:"password_hash"`
+
+	// SHA-256 fingerprints of TLS client certificates (lowercase hex) that may
+	// log in to the account using SASL EXTERNAL.
+	CertFPs []string `json:"certfps,omitempty"`
+
+	// Other nicks grouped to the account. Like the account name, these nicks
+	// are protected when NickServ is enabled.
+	Nicks []string `json:"nicks,omitempty"`
+
+	// When the account was registered. Unix time. If two servers each have an
+	// account with the same name, the older registration wins.
+	RegisteredTS int64 `json:"registered_ts,omitempty"`
+}
+
+// loadAccounts reads the accounts store. The store is a JSON array of
+// accounts.
+//
+// If the file does not exist we start with no accounts.
+//
+// The returned map is keyed by canonicalized account name.
+func loadAccounts(file string) (map[string]*Account, error) {
+	accounts := map[string]*Account{}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return accounts, nil
+		}
+		return nil, errors.Wrap(err, "error reading accounts")
+	}
+
+	var accountList []*Account
+	if err := json.Unmarshal(buf, &accountList); err != nil {
+		return nil, errors.Wrap(err, "error parsing accounts")
+	}
+
+	for _, account := range accountList {
+		if len(account.Name) == 0 {
+			return nil, errors.New("account is missing a name")
+		}
+
+		name := canonicalizeNick(account.Name)
+		if _, exists := accounts[name]; exists {
+			return nil, errors.Errorf("duplicate account: %s", account.Name)
+		}
+
+		for i, certFP := range account.CertFPs {
+			account.CertFPs[i] = strings.ToLower(certFP)
+		}
+
+		accounts[name] = account
+	}
+
+	return accounts, nil
+}
+
+// saveAccounts writes our accounts to the accounts store. We call this whenever
+// NickServ changes them.
+func (cb *Catbox) saveAccounts() {
+	if cb.Config.AccountsFile == "" {
+		return
+	}
+
+	accountList := make([]*Account, 0, len(cb.Accounts))
+	for _, account := range cb.Accounts {
+		accountList = append(accountList, account)
+	}
+	sort.Slice(accountList, func(i, j int) bool {
+		return canonicalizeNick(accountList[i].Name) <
+			canonicalizeNick(accountList[j].Name)
+	})
+
+	buf, err := json.MarshalIndent(accountList, "", "  ")
+	if err != nil {
+		cb.noticeOpers(SnomaskGeneral, fmt.Sprintf("Unable to encode accounts: %s",
+			err))
+		return
+	}
+
+	if err := writeFileAtomic(cb.Config.AccountsFile, buf); err != nil {
+		cb.noticeOpers(SnomaskGeneral, fmt.Sprintf("Unable to save accounts: %s",
+			err))
+	}
+}
+
+// checkPassword tells whether the password is the account's password.
+//
+// This is slow. See checkPasswordAsync().
+func (a *Account) checkPassword(password string) bool {
+	return checkPasswordHash(a.PasswordHash, password)
+}
+
+// checkPasswordHash tells whether a password matches a bcrypt hash.
+func checkPasswordHash(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// passwordCheck is the result of checking a password outside the server
+// goroutine.
+type passwordCheck struct {
+	OK bool
+
+	// What to do with the result. The server goroutine calls it.
+	Done func(ok bool)
+}
+
+// checkPasswordAsync runs work in another goroutine and then calls done with
+// its result on the server goroutine. work checks or hashes a password.
+// bcrypt is slow on purpose. If we ran it on the server goroutine, anyone
+// could hold up the whole server by sending password after password.
+//
+// Clients get one check at a time. If one is in progress, we return false and
+// do nothing.
+//
+// If the client goes away in the meantime, we don't call done. Otherwise it
+// must check whatever it relies on is still true.
+func (c *LocalClient) checkPasswordAsync(work func() bool,
+	done func(ok bool)) bool {
+	if c.PasswordCheckPending {
+		return false
+	}
+	c.PasswordCheckPending = true
+
+	cb := c.Catbox
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+
+		cb.newEvent(Event{
+			Type:          PasswordCheckedEvent,
+			Client:        c,
+			PasswordCheck: &passwordCheck{OK: work(), Done: done},
+		})
+	}()
+
+	return true
+}
+
+// passwordChecked hands the result of a password check to whoever asked for
+// it.
+func (cb *Catbox) passwordChecked(c *LocalClient, check *passwordCheck) {
+	c.PasswordCheckPending = false
+
+	// They may have gone away while we checked.
+	lc, isClient := cb.LocalClients[c.ID]
+	lu, isUser := cb.LocalUsers[c.ID]
+	if (!isClient || lc != c) && (!isUser || lu.LocalClient != c) {
+		return
+	}
+
+	check.Done(check.OK)
+
+	// Now handle anything they sent while we checked. It may start another
+	// check, in which case we hold the rest again.
+	held := c.HeldMessages
+	c.HeldMessages = nil
+	for _, m := range held {
+		cb.messageFromClient(c, m)
+	}
+}
+
+// hasNick tells whether the nick is grouped to the account. The account name
+// itself does not count.
+func (a *Account) hasNick(nick string) bool {
+	for _, n := range a.Nicks {
+		if canonicalizeNick(n) == canonicalizeNick(nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeNick ungroups a nick from the account. Returns false if the nick was
+// not grouped to it.
+func (a *Account) removeNick(nick string) bool {
+	for i, n := range a.Nicks {
+		if canonicalizeNick(n) != canonicalizeNick(nick) {
+			continue
+		}
+		a.Nicks = append(a.Nicks[:i], a.Nicks[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// hasCertFP tells whether the certificate fingerprint may log in to the
+// account.
+func (a *Account) hasCertFP(certFP string) bool {
+	for _, fp := range a.CertFPs {
+		if fp == certFP {
+			return true
+		}
+	}
+	return false
+}
+
+// Look up an account by name. Returns nil if there is no such account.
+func (cb *Catbox) getAccount(name string) *Account {
+	return cb.Accounts[canonicalizeNick(name)]
+}
+
+// Look up the account that owns a nick. A nick is owned by the account with the
+// same name or the account it is grouped to. Returns nil if no account owns it.
+func (cb *Catbox) accountForNick(nick string) *Account {
+	if account := cb.getAccount(nick); account != nil {
+		return account
+	}
+
+	for _, account := range cb.Accounts {
+		if account.hasNick(nick) {
+			return account
+		}
+	}
+	return nil
+}
+
+// Look up the account a certificate fingerprint may log in to. Returns nil if
+// there is none.
+func (cb *Catbox) getAccountByCertFP(certFP string) *Account {
+	if len(certFP) == 0 {
+		return nil
+	}
+
+	for _, account := range cb.Accounts {
+		if account.hasCertFP(certFP) {
+			return account
+		}
+	}
+	return nil
+}
@@ -11,15 +11,28 @@ import (
 type Args struct {
 	ConfigFile string
 	ListenFD   int
+
+	// If set, compare these two state dumps rather than run the server.
+	DiffStateFiles []string
 }
 
 func GetArgs() *Args {
 	configFile := flag.String("conf", "", "Configuration file.")
 	fd := flag.Int("listen-fd", -1,
 		"File descriptor with listening port to use (optional).")
+	diffState := flag.Bool("diff-state", false,
+		"Compare the two state dumps (from DUMPSTATE) given as arguments and exit.")
 
 	flag.Parse()
 
+	if *diffState {
+		if flag.NArg() != 2 {
+			printUsage(fmt.Errorf("you must provide two state dumps to compare"))
+			return nil
+		}
+		return &Args{DiffStateFiles: flag.Args()}
+	}
+
 	if len(*configFile) == 0 {
 		printUsage(fmt.Errorf("you must provide a configuration file"))
 		return nil
@@ -38,6 +51,83 @@ func GetArgs() *Args {
 	}
 }
 
+// CtlArgs are command line arguments to terrarium ctl.
+type CtlArgs struct {
+	// Path to the control socket.
+	Socket string
+
+	// The command to send and its arguments.
+	Command []string
+}
+
+// GetCtlArgs parses the arguments to terrarium ctl. args are those after ctl.
+//
+// Give either the socket or the configuration file that names it.
+func GetCtlArgs(args []string) *CtlArgs {
+	flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	configFile := flags.String("conf", "", "Configuration file.")
+	socket := flags.String("socket", "", "Control socket.")
+
+	usage := func(err error) {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)                                                     // nolint: gas
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s ctl <arguments> <command> [arguments]\n", os.Args[0]) // nolint: gas
+		_, _ = fmt.Fprintf(os.Stderr,                                                                  // nolint: gas
+			"Commands: rehash, restart, die, kline, unkline, connect, squit, users, dumpstate\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		usage(err)
+		return nil
+	}
+
+	if flags.NArg() == 0 {
+		usage(fmt.Errorf("you must provide a command"))
+		return nil
+	}
+
+	if *socket == "" {
+		if *configFile == "" {
+			usage(fmt.Errorf("you must provide the control socket or a configuration file"))
+			return nil
+		}
+
+		s, err := ControlSocketFromConfig(*configFile)
+		if err != nil {
+			usage(err)
+			return nil
+		}
+		*socket = s
+	}
+
+	return &CtlArgs{
+		Socket:  *socket,
+		Command: flags.Args(),
+	}
+}
+
+// MkpasswdArgs are command line arguments to terrarium mkpasswd.
+type MkpasswdArgs struct {
+	// The bcrypt cost. 0 means the default.
+	Cost int
+}
+
+// GetMkpasswdArgs parses the arguments to terrarium mkpasswd. args are those
+// after mkpasswd.
+func GetMkpasswdArgs(args []string) *MkpasswdArgs {
+	flags := flag.NewFlagSet("mkpasswd", flag.ContinueOnError)
+	cost := flags.Int("cost", 0, "bcrypt cost (optional).")
+
+	if err := flags.Parse(args); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)                                    // nolint: gas
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s mkpasswd <arguments>\n", os.Args[0]) // nolint: gas
+		flags.PrintDefaults()
+		return nil
+	}
+
+	return &MkpasswdArgs{Cost: *cost}
+}
+
 func printUsage(err error) {
 	_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)                           // nolint: gas
 	_, _ = fmt.Fprintf(os.Stderr, "Usage: %s <arguments>\n", os.Args[0]) // nolint: gas
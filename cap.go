@@ -0,0 +1,316 @@
+package terrarium
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// IRCv3 client capabilities we support.
+//
+// See https://ircv3.net/specs/core/capability-negotiation
+const (
+	capAccountNotify = "account-notify"
+	capAwayNotify    = "away-notify"
+	capCapNotify     = "cap-notify"
+	capMultiPrefix   = "multi-prefix"
+	capSASL          = "sasl"
+	capServerTime    = "server-time"
+)
+
+// availableCaps tells what capabilities we offer right now. The key is the
+// capability name and the value is its value, if any. We show values only to
+// clients that sent CAP LS 302.
+//
+// What we offer may change on rehash. If it does, we tell clients that have
+// cap-notify.
+func (cb *Catbox) availableCaps() map[string]string {
+	caps := map[string]string{
+		capAccountNotify: "",
+		capAwayNotify:    "",
+		capCapNotify:     "",
+		capMultiPrefix:   "",
+		capServerTime:    "",
+	}
+
+	// We can only authenticate if we have accounts.
+	if cb.Accounts != nil {
+		caps[capSASL] = cb.saslMechanisms()
+	}
+
+	return caps
+}
+
+// capsString builds a space separated list of capabilities for use in a CAP
+// reply. The list is sorted so our replies are stable.
+func capsString(caps map[string]string, withValues bool) string {
+	names := make([]string, 0, len(caps))
+	for name, value := range caps {
+		if withValues && value != "" {
+			names = append(names, name+"="+value)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// hasCap tells whether the client negotiated the given capability.
+func (c *LocalClient) hasCap(name string) bool {
+	_, exists := c.Caps[name]
+	return exists
+}
+
+// setCap enables or disables a capability for the client.
+//
+// server-time is special as the writer goroutine needs to know about it. It
+// reads the flag atomically.
+func (c *LocalClient) setCap(name string, enabled bool) {
+	if enabled {
+		c.Caps[name] = struct{}{}
+	} else {
+		delete(c.Caps, name)
+	}
+
+	if name == capServerTime {
+		var flag int32
+		if enabled {
+			flag = 1
+		}
+		atomic.StoreInt32(&c.ServerTime, flag)
+	}
+}
+
+// Send a reply during CAP or SASL negotiation. We can't use messageFromServer as
+// the client may or may not be registered. nick is what to use as the target.
+func (c *LocalClient) capReply(nick, command string, params []string) {
+	c.maybeQueueMessage(irc.Message{
+		Prefix:  c.Catbox.Config.ServerName,
+		Command: command,
+		Params:  append([]string{nick}, params...),
+	})
+}
+
+// capCommand handles the CAP command. Clients may negotiate capabilities both
+// before and after registration. If they start negotiating before registering,
+// we hold off completing registration until they send CAP END.
+//
+// nick is the client's nick, or * if it does not have one yet.
+func (c *LocalClient) capCommand(m irc.Message, nick string) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		c.capReply(nick, "461", []string{m.Command, "Not enough parameters"})
+		return
+	}
+
+	// We are still a LocalClient in the LocalClients map until we register.
+	_, preReg := c.Catbox.LocalClients[c.ID]
+
+	subCommand := strings.ToUpper(m.Params[0])
+
+	if subCommand == "LS" {
+		if preReg {
+			c.CapNegotiating = true
+		}
+
+		if len(m.Params) > 1 {
+			version, err := strconv.Atoi(m.Params[1])
+			if err == nil && version >= 302 {
+				c.CapVersion = 302
+				// Clients speaking 302 have cap-notify implicitly.
+				c.setCap(capCapNotify, true)
+			}
+		}
+
+		c.capReply(nick, "CAP", []string{"LS",
+			capsString(c.Catbox.availableCaps(), c.CapVersion >= 302)})
+		return
+	}
+
+	if subCommand == "LIST" {
+		enabled := map[string]string{}
+		for name := range c.Caps {
+			enabled[name] = ""
+		}
+		c.capReply(nick, "CAP", []string{"LIST", capsString(enabled, false)})
+		return
+	}
+
+	if subCommand == "REQ" {
+		c.capReqCommand(m, nick, preReg)
+		return
+	}
+
+	if subCommand == "END" {
+		if !preReg || !c.CapNegotiating {
+			return
+		}
+		c.CapNegotiating = false
+
+		// If they already sent NICK and USER then we can now complete
+		// registration.
+		if len(c.PreRegDisplayNick) > 0 && len(c.PreRegUser) > 0 {
+			c.registerUser()
+		}
+		return
+	}
+
+	// 410 ERR_INVALIDCAPCMD
+	c.capReply(nick, "410", []string{m.Params[0], "Invalid CAP command"})
+}
+
+// capReqCommand handles CAP REQ. The request is atomic: Either we enable or
+// disable everything requested (ACK), or nothing (NAK).
+func (c *LocalClient) capReqCommand(m irc.Message, nick string, preReg bool) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		c.capReply(nick, "461", []string{m.Command, "Not enough parameters"})
+		return
+	}
+
+	if preReg {
+		c.CapNegotiating = true
+	}
+
+	requested := strings.Fields(m.Params[1])
+	if len(requested) == 0 {
+		c.capReply(nick, "CAP", []string{"NAK", m.Params[1]})
+		return
+	}
+
+	available := c.Catbox.availableCaps()
+	for _, req := range requested {
+		name := strings.TrimPrefix(req, "-")
+		if _, exists := available[name]; !exists {
+			c.capReply(nick, "CAP", []string{"NAK", m.Params[1]})
+			return
+		}
+
+		// 302 clients may not turn off cap-notify.
+		if req == "-"+capCapNotify && c.CapVersion >= 302 {
+			c.capReply(nick, "CAP", []string{"NAK", m.Params[1]})
+			return
+		}
+	}
+
+	for _, req := range requested {
+		if strings.HasPrefix(req, "-") {
+			c.setCap(req[1:], false)
+			continue
+		}
+		c.setCap(req, true)
+	}
+
+	c.capReply(nick, "CAP", []string{"ACK", m.Params[1]})
+}
+
+// Build the tag we prefix to lines we send to clients that have server-time.
+func serverTimeTag(t time.Time) string {
+	return "@time=" + t.UTC().Format("2006-01-02T15:04:05.000Z") + " "
+}
+
+// notifyCapChanges tells local users with cap-notify about capabilities that
+// became available (CAP NEW) or went away (CAP DEL). We call this when what we
+// offer may have changed, such as after a rehash.
+func (cb *Catbox) notifyCapChanges(oldCaps, newCaps map[string]string) {
+	added := map[string]string{}
+	for name, value := range newCaps {
+		if _, exists := oldCaps[name]; !exists {
+			added[name] = value
+		}
+	}
+
+	removed := map[string]string{}
+	for name := range oldCaps {
+		if _, exists := newCaps[name]; !exists {
+			removed[name] = ""
+		}
+	}
+
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	for _, lu := range cb.LocalUsers {
+		// Capabilities that went away are disabled whether they hear about it or
+		// not.
+		for name := range removed {
+			if lu.hasCap(name) {
+				lu.setCap(name, false)
+			}
+		}
+
+		if !lu.hasCap(capCapNotify) {
+			continue
+		}
+
+		if len(added) > 0 {
+			lu.messageFromServer("CAP", []string{lu.User.DisplayNick, "NEW",
+				capsString(added, lu.CapVersion >= 302)})
+		}
+		if len(removed) > 0 {
+			lu.messageFromServer("CAP", []string{lu.User.DisplayNick, "DEL",
+				capsString(removed, false)})
+		}
+	}
+}
+
+// messageLocalUsersWithCap sends a message to each local user that shares a
+// channel with the user and has the given capability. Each user hears it only
+// once. The user itself does not hear it.
+func (cb *Catbox) messageLocalUsersWithCap(user *User, capName string,
+	m irc.Message) {
+	told := map[TS6UID]struct{}{user.UID: {}}
+
+	for _, channel := range user.Channels {
+		for memberUID := range channel.Members {
+			if _, exists := told[memberUID]; exists {
+				continue
+			}
+
+			member := cb.Users[memberUID]
+			if !member.isLocal() || !member.LocalUser.hasCap(capName) {
+				continue
+			}
+			told[memberUID] = struct{}{}
+
+			member.LocalUser.maybeQueueMessage(m)
+		}
+	}
+}
+
+// notifyAway tells local users with away-notify that the user went away or
+// came back. We call this after changing the user's away message.
+func (cb *Catbox) notifyAway(user *User) {
+	params := []string{}
+	if len(user.AwayMessage) > 0 {
+		params = append(params, user.AwayMessage)
+	}
+
+	cb.messageLocalUsersWithCap(user, capAwayNotify, irc.Message{
+		Prefix:  user.nickUhost(),
+		Command: "AWAY",
+		Params:  params,
+	})
+}
+
+// notifyAccount tells local users with account-notify that the user logged in
+// to or out of an account. We call this after changing the user's account.
+func (cb *Catbox) notifyAccount(user *User) {
+	// * means they logged out.
+	account := user.Account
+	if len(account) == 0 {
+		account = "*"
+	}
+
+	cb.messageLocalUsersWithCap(user, capAccountNotify, irc.Message{
+		Prefix:  user.nickUhost(),
+		Command: "ACCOUNT",
+		Params:  []string{account},
+	})
+}
@@ -0,0 +1,104 @@
+package terrarium
+
+import (
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestCapsString(t *testing.T) {
+	tests := []struct {
+		Caps       map[string]string
+		WithValues bool
+		Output     string
+	}{
+		{
+			map[string]string{},
+			false,
+			"",
+		},
+		{
+			map[string]string{"server-time": "", "away-notify": ""},
+			false,
+			"away-notify server-time",
+		},
+		{
+			map[string]string{"sasl": "PLAIN", "cap-notify": ""},
+			false,
+			"cap-notify sasl",
+		},
+		{
+			map[string]string{"sasl": "PLAIN", "cap-notify": ""},
+			true,
+			"cap-notify sasl=PLAIN",
+		},
+	}
+
+	for _, test := range tests {
+		output := capsString(test.Caps, test.WithValues)
+		if output != test.Output {
+			t.Errorf("capsString(%v, %v) = %s, wanted %s", test.Caps,
+				test.WithValues, output, test.Output)
+		}
+	}
+}
+
+func TestCapReqCommand(t *testing.T) {
+	tests := []struct {
+		Request    string
+		CapVersion int
+		Reply      string
+		Caps       []string
+	}{
+		{"server-time multi-prefix", 0, "ACK", []string{"multi-prefix",
+			"server-time"}},
+		{"server-time bogus", 0, "NAK", nil},
+		{"", 0, "NAK", nil},
+		{"-cap-notify", 0, "ACK", nil},
+		{"-cap-notify", 302, "NAK", []string{"cap-notify"}},
+	}
+
+	for _, test := range tests {
+		c := &LocalClient{
+			ID:         1,
+			WriteChan:  make(chan irc.Message, 10),
+			Caps:       map[string]struct{}{},
+			CapVersion: test.CapVersion,
+			Catbox: &Catbox{
+				Config:       &Config{ServerName: "irc.example.com"},
+				LocalClients: map[uint64]*LocalClient{},
+			},
+		}
+		c.Catbox.LocalClients[c.ID] = c
+		if test.CapVersion >= 302 {
+			c.setCap(capCapNotify, true)
+		}
+
+		c.capCommand(irc.Message{
+			Command: "CAP",
+			Params:  []string{"REQ", test.Request},
+		}, "*")
+
+		reply := <-c.WriteChan
+		if len(reply.Params) != 3 || reply.Params[1] != test.Reply {
+			t.Errorf("CAP REQ %s = %v, wanted %s", test.Request, reply.Params,
+				test.Reply)
+			continue
+		}
+
+		if len(c.Caps) != len(test.Caps) {
+			t.Errorf("CAP REQ %s enabled %d caps, wanted %d", test.Request,
+				len(c.Caps), len(test.Caps))
+			continue
+		}
+		for _, name := range test.Caps {
+			if !c.hasCap(name) {
+				t.Errorf("CAP REQ %s did not enable %s", test.Request, name)
+			}
+		}
+
+		if !c.CapNegotiating {
+			t.Errorf("CAP REQ %s did not hold registration", test.Request)
+		}
+	}
+}
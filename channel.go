@@ -1,6 +1,38 @@
 package terrarium
 
-import "github.com/horgh/irc"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// The modes we support that have no parameter: No colour (+c), invite only
+// (+i), moderated (+m), no external messages (+n), secret (+s), and only ops
+// may set the topic (+t).
+const channelSimpleModes = "cimnst"
+
+// The longest channel key we allow.
+const maxChannelKeyLength = 23
+
+// The list modes we support: Bans (+b), ban exceptions (+e), and invite
+// exceptions (+I).
+const channelListModes = "beI"
+
+// The most masks we allow in each of a channel's lists.
+const maxChannelListLength = 50
+
+// ListMask is an entry in one of a channel's lists.
+type ListMask struct {
+	// nick!user@host mask.
+	Mask string
+
+	// Who set it. nick!user@host or a server name.
+	SetBy string
+
+	// When it was set. Unix time.
+	SetTS int64
+}
 
 // Channel holds everything to do with a channel.
 type Channel struct {
@@ -14,6 +46,9 @@ type Channel struct {
 	// Ops tracks users who have ops in the channel.
 	Ops map[TS6UID]*User
 
+	// Voices tracks users who have voice in the channel.
+	Voices map[TS6UID]*User
+
 	// Current topic. May be blank.
 	Topic string
 
@@ -23,9 +58,19 @@ type Channel struct {
 	// The person who set the topic. nick!user@host
 	TopicSetter string
 
-	// Modes set on the channel.
+	// Modes set on the channel. Only those without parameters (see
+	// channelSimpleModes).
 	Modes map[byte]struct{}
 
+	// Channel key (+k). Blank if there is none.
+	Key string
+
+	// Member limit (+l). 0 if there is none.
+	Limit int
+
+	// List mode (see channelListModes) to the masks in that list.
+	Lists map[byte][]ListMask
+
 	// Channel TS. Changes on channel creation (or if another server tells us
 	// a different TS).
 	TS int64
@@ -37,6 +82,126 @@ func (c *Channel) userHasOps(u *User) bool {
 	return exists
 }
 
+// Check if a user has voice in the channel.
+func (c *Channel) userHasVoice(u *User) bool {
+	_, exists := c.Voices[u.UID]
+	return exists
+}
+
+// memberPrefix builds the prefix to show before a member's nick in NAMES and
+// WHO replies. If multiPrefix is true (the client has the multi-prefix
+// capability) we show every prefix the member has, highest first. Otherwise we
+// show only the highest.
+func (c *Channel) memberPrefix(u *User, multiPrefix bool) string {
+	prefix := ""
+	if c.userHasOps(u) {
+		prefix += "@"
+	}
+	if c.userHasVoice(u) {
+		prefix += "+"
+	}
+
+	if !multiPrefix && len(prefix) > 1 {
+		return prefix[:1]
+	}
+	return prefix
+}
+
+// hasMode tells whether one of the channel's simple modes (e.g., +n) is set.
+func (c *Channel) hasMode(mode byte) bool {
+	_, exists := c.Modes[mode]
+	return exists
+}
+
+// setMode sets or unsets one of the channel's simple modes. Returns false if
+// that made no change.
+func (c *Channel) setMode(mode byte, enabled bool) bool {
+	if c.hasMode(mode) == enabled {
+		return false
+	}
+
+	if enabled {
+		c.Modes[mode] = struct{}{}
+	} else {
+		delete(c.Modes, mode)
+	}
+	return true
+}
+
+// modesString builds the channel's modes (e.g., +nsk) along with the parameters
+// of those modes (e.g., the key).
+func (c *Channel) modesString() (string, []string) {
+	modes := "+"
+	for _, mode := range []byte(channelSimpleModes) {
+		if c.hasMode(mode) {
+			modes += string(mode)
+		}
+	}
+
+	var params []string
+	if len(c.Key) > 0 {
+		modes += "k"
+		params = append(params, c.Key)
+	}
+	if c.Limit > 0 {
+		modes += "l"
+		params = append(params, fmt.Sprintf("%d", c.Limit))
+	}
+
+	return modes, params
+}
+
+// Add a mask to one of the channel's lists. Returns false if the mask is
+// already in the list.
+func (c *Channel) addListMask(mode byte, mask, setBy string, setTS int64) bool {
+	for _, listMask := range c.Lists[mode] {
+		if strings.EqualFold(listMask.Mask, mask) {
+			return false
+		}
+	}
+
+	if c.Lists == nil {
+		c.Lists = make(map[byte][]ListMask)
+	}
+
+	c.Lists[mode] = append(c.Lists[mode], ListMask{
+		Mask:  mask,
+		SetBy: setBy,
+		SetTS: setTS,
+	})
+	return true
+}
+
+// Remove a mask from one of the channel's lists. Returns the mask as we had it
+// stored, or blank if it was not in the list.
+func (c *Channel) removeListMask(mode byte, mask string) string {
+	for i, listMask := range c.Lists[mode] {
+		if !strings.EqualFold(listMask.Mask, mask) {
+			continue
+		}
+
+		c.Lists[mode] = append(c.Lists[mode][:i], c.Lists[mode][i+1:]...)
+		return listMask.Mask
+	}
+	return ""
+}
+
+// Check whether the user matches any mask in one of the channel's lists.
+func (c *Channel) listMatches(mode byte, u *User) bool {
+	for _, listMask := range c.Lists[mode] {
+		if u.matchesHostmask(listMask.Mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the user is banned from the channel. They are if they match a
+// ban and do not match a ban exception.
+func (c *Channel) isBanned(u *User) bool {
+	return c.listMatches('b', u) && !c.listMatches('e', u)
+}
+
 // Remove a user from the channel.
 func (c *Channel) removeUser(u *User) {
 	_, exists := c.Members[u.UID]
@@ -49,6 +214,11 @@ func (c *Channel) removeUser(u *User) {
 		delete(c.Ops, u.UID)
 	}
 
+	_, exists = c.Voices[u.UID]
+	if exists {
+		delete(c.Voices, u.UID)
+	}
+
 	_, exists = u.Channels[c.Name]
 	if exists {
 		delete(u.Channels, c.Name)
@@ -68,71 +238,179 @@ func (c *Channel) removeOps(u *User) {
 	}
 }
 
-// Remove all modes from the channel, and all ops/voices.
+// Grant a user voice.
+func (c *Channel) grantVoice(u *User) {
+	c.Voices[u.UID] = u
+}
+
+// Remove voice from a user.
+func (c *Channel) removeVoice(u *User) {
+	_, exists := c.Voices[u.UID]
+	if exists {
+		delete(c.Voices, u.UID)
+	}
+}
+
+// setStatus grants or removes a member's status: ops (o) or voice (v).
+// Returns false if that made no change.
+func (c *Channel) setStatus(u *User, mode byte, grant bool) bool {
+	if mode == 'o' {
+		if c.userHasOps(u) == grant {
+			return false
+		}
+		if grant {
+			c.grantOps(u)
+		} else {
+			c.removeOps(u)
+		}
+		return true
+	}
+
+	if c.userHasVoice(u) == grant {
+		return false
+	}
+	if grant {
+		c.grantVoice(u)
+	} else {
+		c.removeVoice(u)
+	}
+	return true
+}
+
+// Remove all modes from the channel, its lists, and all ops/voices.
 //
 // This informs local users about the mode changes, but no one else.
 func (c *Channel) clearModes(cb *Catbox) {
 	// Build all the messages we need prior to sending.
 	var msgs []irc.Message
 
-	// Clear things like +ns
+	// Clear things like +ns, as well as the key and limit.
 
-	modeStr := ""
+	modeStr, _ := c.modesString()
+	modeStr = strings.TrimPrefix(modeStr, "+")
+	var modeParams []string
+	if len(c.Key) > 0 {
+		modeParams = append(modeParams, c.Key)
+	}
 	for k := range c.Modes {
 		delete(c.Modes, k)
-		modeStr += string(k)
 	}
+	c.Key = ""
+	c.Limit = 0
 	if len(modeStr) > 0 {
 		msgs = append(msgs, irc.Message{
 			Prefix:  cb.Config.ServerName,
 			Command: "MODE",
-			Params:  []string{c.Name, "-" + modeStr},
+			Params:  append([]string{c.Name, "-" + modeStr}, modeParams...),
 		})
 	}
 
-	// Clear ops.
+	// Clear lists (+b, etc).
+
+	for _, mode := range []byte(channelListModes) {
+		var masks []string
+		for _, listMask := range c.Lists[mode] {
+			masks = append(masks, listMask.Mask)
+		}
+		delete(c.Lists, mode)
+
+		msgs = append(msgs, c.unsetModeMessages(cb, mode, masks)...)
+	}
+
+	// Clear ops and voices.
 
 	var ops []string
-	for _, op := range c.Ops {
+	for uid, op := range c.Ops {
 		ops = append(ops, op.DisplayNick)
+		delete(c.Ops, uid)
+	}
+	msgs = append(msgs, c.unsetModeMessages(cb, 'o', ops)...)
+
+	var voices []string
+	for uid, voice := range c.Voices {
+		voices = append(voices, voice.DisplayNick)
+		delete(c.Voices, uid)
+	}
+	msgs = append(msgs, c.unsetModeMessages(cb, 'v', voices)...)
 
-		if len(ops) == ChanModesPerCommand {
-			modeStr := "-"
-			for i := 0; i < ChanModesPerCommand; i++ {
-				modeStr += "o"
-			}
+	// Fire off the messages.
+	for _, msg := range msgs {
+		cb.messageLocalUsersOnChannel(c, msg)
+	}
+}
+
+// bmaskMessages builds the BMASK messages that tell a server the masks in one
+// of the channel's lists. We split the masks across as many messages as we
+// need to stay within the maximum line length.
+//
+// :<SID> BMASK <channel TS> <channel> <type> :<space separated masks>
+func (c *Channel) bmaskMessages(sid TS6SID, mode byte) []irc.Message {
+	newMessage := func(masks string) irc.Message {
+		return irc.Message{
+			Prefix:  string(sid),
+			Command: "BMASK",
+			Params: []string{
+				fmt.Sprintf("%d", c.TS),
+				c.Name,
+				string(mode),
+				masks,
+			},
+		}
+	}
 
-			params := []string{c.Name, modeStr}
-			params = append(params, ops...)
+	// Determine the size of the message without any masks. The blank last
+	// parameter encodes as " :".
+	baseEncoded, err := newMessage("").Encode()
+	if err != nil {
+		return nil
+	}
+	baseSize := len(baseEncoded)
 
-			msgs = append(msgs, irc.Message{
-				Prefix:  cb.Config.ServerName,
-				Command: "MODE",
-				Params:  params,
-			})
+	var msgs []irc.Message
+	masks := ""
+	for _, listMask := range c.Lists[mode] {
+		if len(masks) > 0 &&
+			baseSize+len(masks)+1+len(listMask.Mask) > irc.MaxLineLength {
+			msgs = append(msgs, newMessage(masks))
+			masks = ""
+		}
 
-			ops = nil
+		if len(masks) > 0 {
+			masks += " "
 		}
+		masks += listMask.Mask
 	}
 
-	if len(ops) > 0 {
-		modeStr := "-"
-		for range ops {
-			modeStr += "o"
+	if len(masks) > 0 {
+		msgs = append(msgs, newMessage(masks))
+	}
+
+	return msgs
+}
+
+// unsetModeMessages builds MODE messages that remove a mode that takes a
+// parameter (e.g., -o). There is one mode change per parameter. We include up
+// to ChanModesPerCommand in each message.
+func (c *Channel) unsetModeMessages(cb *Catbox, mode byte,
+	params []string) []irc.Message {
+	var msgs []irc.Message
+
+	for len(params) > 0 {
+		count := len(params)
+		if count > ChanModesPerCommand {
+			count = ChanModesPerCommand
 		}
 
-		params := []string{c.Name, modeStr}
-		params = append(params, ops...)
+		msgParams := []string{c.Name, "-" + strings.Repeat(string(mode), count)}
+		msgParams = append(msgParams, params[:count]...)
+		params = params[count:]
 
 		msgs = append(msgs, irc.Message{
 			Prefix:  cb.Config.ServerName,
 			Command: "MODE",
-			Params:  params,
+			Params:  msgParams,
 		})
 	}
 
-	// Fire off the messages.
-	for _, msg := range msgs {
-		cb.messageLocalUsersOnChannel(c, msg)
-	}
+	return msgs
 }
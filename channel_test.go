@@ -0,0 +1,179 @@
+package terrarium
+
+import "testing"
+
+func TestChannelIsBanned(t *testing.T) {
+	user := &User{
+		DisplayNick: "alice",
+		Username:    "alice",
+		Hostname:    "example.com",
+	}
+
+	tests := []struct {
+		name   string
+		lists  map[byte][]string
+		output bool
+	}{
+		{
+			name:   "no bans",
+			lists:  map[byte][]string{},
+			output: false,
+		},
+		{
+			name:   "matching ban",
+			lists:  map[byte][]string{'b': {"*!*@example.com"}},
+			output: true,
+		},
+		{
+			name:   "ban on another host",
+			lists:  map[byte][]string{'b': {"*!*@example.org"}},
+			output: false,
+		},
+		{
+			name:   "ban is case insensitive",
+			lists:  map[byte][]string{'b': {"ALICE!*@*"}},
+			output: true,
+		},
+		{
+			name: "matching ban and exception",
+			lists: map[byte][]string{
+				'b': {"*!*@example.com"},
+				'e': {"alice!*@*"},
+			},
+			output: false,
+		},
+		{
+			name: "matching ban and other exception",
+			lists: map[byte][]string{
+				'b': {"*!*@example.com"},
+				'e': {"bob!*@*"},
+			},
+			output: true,
+		},
+		{
+			name: "invite exceptions do not exempt from bans",
+			lists: map[byte][]string{
+				'b': {"*!*@example.com"},
+				'I': {"alice!*@*"},
+			},
+			output: true,
+		},
+	}
+
+	for _, test := range tests {
+		channel := &Channel{Name: "#test"}
+		for mode, masks := range test.lists {
+			for _, mask := range masks {
+				if !channel.addListMask(mode, mask, "server", 0) {
+					t.Fatalf("%s: unable to add mask %s", test.name, mask)
+				}
+			}
+		}
+
+		output := channel.isBanned(user)
+		if output != test.output {
+			t.Errorf("%s: isBanned() = %v, wanted %v", test.name, output,
+				test.output)
+		}
+	}
+}
+
+func TestChannelListMasks(t *testing.T) {
+	channel := &Channel{Name: "#test"}
+
+	if !channel.addListMask('b', "*!*@example.com", "alice", 1) {
+		t.Fatalf("unable to add mask")
+	}
+	if channel.addListMask('b', "*!*@EXAMPLE.COM", "alice", 1) {
+		t.Errorf("added duplicate mask")
+	}
+
+	if mask := channel.removeListMask('b', "*!*@Example.com"); mask !=
+		"*!*@example.com" {
+		t.Errorf("removeListMask() = %s, wanted *!*@example.com", mask)
+	}
+	if mask := channel.removeListMask('b', "*!*@example.com"); mask != "" {
+		t.Errorf("removeListMask() = %s, wanted blank", mask)
+	}
+}
+
+func TestChannelModesString(t *testing.T) {
+	tests := []struct {
+		channel *Channel
+		modes   string
+		params  []string
+	}{
+		{
+			channel: &Channel{Modes: map[byte]struct{}{}},
+			modes:   "+",
+		},
+		{
+			channel: &Channel{Modes: map[byte]struct{}{'s': {}, 'n': {}, 't': {}}},
+			modes:   "+nst",
+		},
+		{
+			channel: &Channel{
+				Modes: map[byte]struct{}{'i': {}},
+				Key:   "secret",
+				Limit: 10,
+			},
+			modes:  "+ikl",
+			params: []string{"secret", "10"},
+		},
+	}
+
+	for _, test := range tests {
+		modes, params := test.channel.modesString()
+		if modes != test.modes {
+			t.Errorf("modesString() = %s, wanted %s", modes, test.modes)
+			continue
+		}
+		if len(params) != len(test.params) {
+			t.Errorf("modesString() params = %v, wanted %v", params, test.params)
+			continue
+		}
+		for i := range params {
+			if params[i] != test.params[i] {
+				t.Errorf("modesString() params = %v, wanted %v", params, test.params)
+				break
+			}
+		}
+	}
+}
+
+func TestChannelMemberPrefix(t *testing.T) {
+	user := &User{UID: "000AAAAAA"}
+
+	tests := []struct {
+		ops         bool
+		voice       bool
+		multiPrefix bool
+		output      string
+	}{
+		{false, false, false, ""},
+		{true, false, false, "@"},
+		{false, true, false, "+"},
+		{true, true, false, "@"},
+		{true, true, true, "@+"},
+		{false, true, true, "+"},
+	}
+
+	for _, test := range tests {
+		channel := &Channel{
+			Ops:    map[TS6UID]*User{},
+			Voices: map[TS6UID]*User{},
+		}
+		if test.ops && !channel.setStatus(user, 'o', true) {
+			t.Fatalf("setStatus(o) made no change")
+		}
+		if test.voice && !channel.setStatus(user, 'v', true) {
+			t.Fatalf("setStatus(v) made no change")
+		}
+
+		output := channel.memberPrefix(user, test.multiPrefix)
+		if output != test.output {
+			t.Errorf("memberPrefix(ops=%v, voice=%v, %v) = %s, wanted %s", test.ops,
+				test.voice, test.multiPrefix, output, test.output)
+		}
+	}
+}
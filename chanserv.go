@@ -0,0 +1,431 @@
+package terrarium
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/horgh/irc"
+	"github.com/pkg/errors"
+)
+
+// The nick our built-in channel service answers to. Users may not take it
+// while channel registration is enabled.
+const chanServNick = "ChanServ"
+
+// RegisteredChannel is a channel whose state we keep while it is empty, and
+// through restarts. When someone joins it again we restore it.
+type RegisteredChannel struct {
+	// Name of the channel. Canonicalized.
+	Name string `json:"name"`
+
+	// Account that registered the channel.
+	Founder string `json:"founder"`
+
+	// Accounts that get ops when they join. The founder always does.
+	Access []string `json:"access,omitempty"`
+
+	// Channel TS. This is when the channel was created.
+	TS int64 `json:"ts"`
+
+	Topic       string `json:"topic,omitempty"`
+	TopicTS     int64  `json:"topic_ts,omitempty"`
+	TopicSetter string `json:"topic_setter,omitempty"`
+
+	// Simple modes (see channelSimpleModes). e.g. nst
+	Modes string `json:"modes,omitempty"`
+
+	Key   string `json:"key,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+
+	// List mode (see channelListModes) to the masks in that list.
+	Lists map[string][]ListMask `json:"lists,omitempty"`
+}
+
+// loadRegisteredChannels reads the registered channels store. The store is a
+// JSON array of channels.
+//
+// If the file does not exist we start with no registered channels.
+//
+// The returned map is keyed by canonicalized channel name.
+func loadRegisteredChannels(file string) (map[string]*RegisteredChannel,
+	error) {
+	channels := map[string]*RegisteredChannel{}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return channels, nil
+		}
+		return nil, errors.Wrap(err, "error reading registered channels")
+	}
+
+	var channelList []*RegisteredChannel
+	if err := json.Unmarshal(buf, &channelList); err != nil {
+		return nil, errors.Wrap(err, "error parsing registered channels")
+	}
+
+	for _, rc := range channelList {
+		name := canonicalizeChannel(rc.Name)
+		if !isValidChannel(name) {
+			return nil, errors.Errorf("invalid channel name: %s", rc.Name)
+		}
+		if _, exists := channels[name]; exists {
+			return nil, errors.Errorf("duplicate channel: %s", rc.Name)
+		}
+		if len(rc.Founder) == 0 {
+			return nil, errors.Errorf("channel is missing a founder: %s", rc.Name)
+		}
+
+		rc.Name = name
+		channels[name] = rc
+	}
+
+	return channels, nil
+}
+
+// saveRegisteredChannels writes our registered channels to their store. We
+// call this whenever they change.
+func (cb *Catbox) saveRegisteredChannels() {
+	if cb.Config.ChannelsFile == "" {
+		return
+	}
+
+	channelList := make([]*RegisteredChannel, 0, len(cb.RegisteredChannels))
+	for _, rc := range cb.RegisteredChannels {
+		channelList = append(channelList, rc)
+	}
+	sort.Slice(channelList, func(i, j int) bool {
+		return channelList[i].Name < channelList[j].Name
+	})
+
+	buf, err := json.MarshalIndent(channelList, "", "  ")
+	if err != nil {
+		cb.noticeOpers(SnomaskGeneral, fmt.Sprintf(
+			"Unable to encode registered channels: %s", err))
+		return
+	}
+
+	if err := writeFileAtomic(cb.Config.ChannelsFile, buf); err != nil {
+		cb.noticeOpers(SnomaskGeneral, fmt.Sprintf(
+			"Unable to save registered channels: %s", err))
+	}
+}
+
+// chanServEnabled tells whether users may register channels.
+func (cb *Catbox) chanServEnabled() bool {
+	return cb.RegisteredChannels != nil && cb.Accounts != nil
+}
+
+// isServiceNick tells whether the nick is one of our built-in services. Users
+// may not use these nicks.
+func (cb *Catbox) isServiceNick(nick string) bool {
+	if cb.nickServEnabled() && isNickServNick(nick) {
+		return true
+	}
+	return cb.chanServEnabled() &&
+		canonicalizeNick(nick) == canonicalizeNick(chanServNick)
+}
+
+// hasAccess tells whether the account gets ops in the channel.
+func (rc *RegisteredChannel) hasAccess(account string) bool {
+	if len(account) == 0 {
+		return false
+	}
+
+	if canonicalizeNick(rc.Founder) == canonicalizeNick(account) {
+		return true
+	}
+
+	for _, a := range rc.Access {
+		if canonicalizeNick(a) == canonicalizeNick(account) {
+			return true
+		}
+	}
+	return false
+}
+
+// remember records the channel's current TS, topic, modes, and lists.
+func (rc *RegisteredChannel) remember(channel *Channel) {
+	rc.TS = channel.TS
+	rc.Topic = channel.Topic
+	rc.TopicTS = channel.TopicTS
+	rc.TopicSetter = channel.TopicSetter
+
+	rc.Modes = ""
+	for _, mode := range []byte(channelSimpleModes) {
+		if channel.hasMode(mode) {
+			rc.Modes += string(mode)
+		}
+	}
+	rc.Key = channel.Key
+	rc.Limit = channel.Limit
+
+	rc.Lists = map[string][]ListMask{}
+	for mode, masks := range channel.Lists {
+		if len(masks) == 0 {
+			continue
+		}
+		rc.Lists[string(mode)] = append([]ListMask{}, masks...)
+	}
+}
+
+// restore applies what we remember to a channel we just created.
+func (rc *RegisteredChannel) restore(channel *Channel) {
+	if rc.TS > 0 {
+		channel.TS = rc.TS
+	}
+
+	channel.Topic = rc.Topic
+	channel.TopicTS = rc.TopicTS
+	channel.TopicSetter = rc.TopicSetter
+
+	for _, mode := range []byte(rc.Modes) {
+		if strings.IndexByte(channelSimpleModes, mode) == -1 {
+			continue
+		}
+		channel.setMode(mode, true)
+	}
+	channel.Key = rc.Key
+	channel.Limit = rc.Limit
+
+	for mode, masks := range rc.Lists {
+		if len(mode) != 1 || !strings.Contains(channelListModes, mode) {
+			continue
+		}
+		for _, listMask := range masks {
+			channel.addListMask(mode[0], listMask.Mask, listMask.SetBy,
+				listMask.SetTS)
+		}
+	}
+}
+
+// rememberChannel updates the channel's registration, if it has one, to match
+// its current state. We call this after its topic or modes change.
+func (cb *Catbox) rememberChannel(channel *Channel) {
+	rc, exists := cb.RegisteredChannels[channel.Name]
+	if !exists {
+		return
+	}
+
+	rc.remember(channel)
+	cb.saveRegisteredChannels()
+}
+
+// Send the user a NOTICE from ChanServ.
+func (u *LocalUser) chanServReply(text string) {
+	u.serviceReply(chanServNick, text)
+}
+
+// chanServCommand handles a request to ChanServ. The user may send it with
+// CHANSERV (or CS), or by messaging ChanServ.
+//
+// args is the request split into words. e.g. REGISTER #example
+func (u *LocalUser) chanServCommand(args []string) {
+	if !u.Catbox.chanServEnabled() {
+		// 421 ERR_UNKNOWNCOMMAND
+		u.messageFromServer("421", []string{"CHANSERV", "Unknown command"})
+		return
+	}
+
+	if len(args) == 0 {
+		u.chanServReply("Commands are REGISTER, DROP, and ACCESS.")
+		return
+	}
+
+	subCommand := strings.ToUpper(args[0])
+	args = args[1:]
+
+	if subCommand == "HELP" {
+		u.chanServReply("REGISTER <channel>: Register a channel you have ops in.")
+		u.chanServReply("DROP <channel>: Remove a channel's registration.")
+		u.chanServReply(
+			"ACCESS <channel> <ADD|DEL|LIST> [account]: Manage who gets ops.")
+		return
+	}
+
+	if subCommand != "REGISTER" && subCommand != "DROP" &&
+		subCommand != "ACCESS" {
+		u.chanServReply(fmt.Sprintf("Unknown command %s. Try HELP.", subCommand))
+		return
+	}
+
+	if len(args) == 0 {
+		u.chanServReply(fmt.Sprintf("Usage: %s <channel>", subCommand))
+		return
+	}
+	channelName := canonicalizeChannel(args[0])
+	args = args[1:]
+
+	if len(u.User.Account) == 0 {
+		u.chanServReply(fmt.Sprintf("You must identify to %s first.",
+			nickServNick))
+		return
+	}
+
+	if subCommand == "REGISTER" {
+		u.chanServRegister(channelName)
+		return
+	}
+
+	rc, exists := u.Catbox.RegisteredChannels[channelName]
+	if !exists {
+		u.chanServReply(fmt.Sprintf("%s is not registered.", channelName))
+		return
+	}
+
+	if subCommand == "DROP" {
+		if canonicalizeNick(rc.Founder) != canonicalizeNick(u.User.Account) &&
+			!u.hasPrivilege(PrivServices) {
+			u.chanServReply("Only the founder may do that.")
+			return
+		}
+
+		delete(u.Catbox.RegisteredChannels, channelName)
+		u.Catbox.saveRegisteredChannels()
+		u.chanServReply(fmt.Sprintf("%s is no longer registered.", channelName))
+		return
+	}
+
+	u.chanServAccess(rc, args)
+}
+
+// Register a channel. The user must have ops in it. They become its founder.
+func (u *LocalUser) chanServRegister(channelName string) {
+	if _, exists := u.Catbox.RegisteredChannels[channelName]; exists {
+		u.chanServReply(fmt.Sprintf("%s is already registered.", channelName))
+		return
+	}
+
+	channel, exists := u.Catbox.Channels[channelName]
+	if !exists || !u.User.onChannel(channel) {
+		u.chanServReply(fmt.Sprintf("You are not on %s.", channelName))
+		return
+	}
+
+	if !channel.userHasOps(u.User) {
+		u.chanServReply(fmt.Sprintf("You must have ops in %s.", channelName))
+		return
+	}
+
+	rc := &RegisteredChannel{
+		Name:    channel.Name,
+		Founder: u.User.Account,
+	}
+	rc.remember(channel)
+	u.Catbox.RegisteredChannels[channel.Name] = rc
+	u.Catbox.saveRegisteredChannels()
+
+	u.chanServReply(fmt.Sprintf("%s is now registered to %s.", channel.Name,
+		rc.Founder))
+}
+
+// Show or change a channel's access list. Only the founder may change it.
+//
+// ACCESS <channel> <ADD|DEL|LIST> [account]
+func (u *LocalUser) chanServAccess(rc *RegisteredChannel, args []string) {
+	if len(args) == 0 {
+		u.chanServReply("Usage: ACCESS <channel> <ADD|DEL|LIST> [account]")
+		return
+	}
+	action := strings.ToUpper(args[0])
+
+	if action == "LIST" {
+		if !rc.hasAccess(u.User.Account) && !u.hasPrivilege(PrivServices) {
+			u.chanServReply("You do not have access to that channel.")
+			return
+		}
+
+		u.chanServReply(fmt.Sprintf("Founder of %s: %s", rc.Name, rc.Founder))
+		for _, account := range rc.Access {
+			u.chanServReply(fmt.Sprintf("Access on %s: %s", rc.Name, account))
+		}
+		return
+	}
+
+	if action != "ADD" && action != "DEL" {
+		u.chanServReply("Usage: ACCESS <channel> <ADD|DEL|LIST> [account]")
+		return
+	}
+
+	if len(args) < 2 {
+		u.chanServReply(fmt.Sprintf("Usage: ACCESS <channel> %s <account>",
+			action))
+		return
+	}
+
+	if canonicalizeNick(rc.Founder) != canonicalizeNick(u.User.Account) {
+		u.chanServReply("Only the founder may do that.")
+		return
+	}
+
+	if action == "ADD" {
+		account := u.Catbox.getAccount(args[1])
+		if account == nil {
+			u.chanServReply(fmt.Sprintf("There is no account %s.", args[1]))
+			return
+		}
+
+		if rc.hasAccess(account.Name) {
+			u.chanServReply(fmt.Sprintf("%s already has access to %s.",
+				account.Name, rc.Name))
+			return
+		}
+
+		rc.Access = append(rc.Access, account.Name)
+		u.Catbox.saveRegisteredChannels()
+		u.chanServReply(fmt.Sprintf("%s now has access to %s.", account.Name,
+			rc.Name))
+		return
+	}
+
+	for i, account := range rc.Access {
+		if canonicalizeNick(account) != canonicalizeNick(args[1]) {
+			continue
+		}
+
+		rc.Access = append(rc.Access[:i], rc.Access[i+1:]...)
+		u.Catbox.saveRegisteredChannels()
+		u.chanServReply(fmt.Sprintf("%s no longer has access to %s.", account,
+			rc.Name))
+		return
+	}
+
+	u.chanServReply(fmt.Sprintf("%s does not have access to %s.", args[1],
+		rc.Name))
+}
+
+// opOnJoin gives the user ops if they just joined a registered channel they
+// have access to. We tell local users in the channel and all servers.
+func (u *LocalUser) opOnJoin(channel *Channel) {
+	rc, exists := u.Catbox.RegisteredChannels[channel.Name]
+	if !exists || !rc.hasAccess(u.User.Account) {
+		return
+	}
+
+	if !channel.setStatus(u.User, 'o', true) {
+		return
+	}
+
+	u.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
+		Prefix:  u.Catbox.Config.ServerName,
+		Command: "MODE",
+		Params:  []string{channel.Name, "+o", u.User.DisplayNick},
+	})
+
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.Catbox.Config.TS6SID),
+			Command: "TMODE",
+			Params: []string{
+				fmt.Sprintf("%d", channel.TS),
+				channel.Name,
+				"+o",
+				string(u.User.UID),
+			},
+		})
+	}
+}
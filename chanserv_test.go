@@ -0,0 +1,135 @@
+package terrarium
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegisteredChannelHasAccess(t *testing.T) {
+	rc := &RegisteredChannel{
+		Name:    "#test",
+		Founder: "horgh",
+		Access:  []string{"Will"},
+	}
+
+	tests := []struct {
+		Account string
+		Output  bool
+	}{
+		{"horgh", true},
+		{"HORGH", true},
+		{"will", true},
+		{"other", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		output := rc.hasAccess(test.Account)
+		if output != test.Output {
+			t.Errorf("hasAccess(%s) = %v, wanted %v", test.Account, output,
+				test.Output)
+		}
+	}
+}
+
+func TestRegisteredChannelRememberRestore(t *testing.T) {
+	channel := &Channel{
+		Name:        "#test",
+		Modes:       map[byte]struct{}{'n': {}, 't': {}},
+		Key:         "secret",
+		Limit:       10,
+		Topic:       "hi there",
+		TopicTS:     200,
+		TopicSetter: "horgh!~horgh@example.com",
+		TS:          100,
+	}
+	channel.addListMask('b', "*!*@bad.example.com", "horgh", 150)
+
+	rc := &RegisteredChannel{Name: "#test", Founder: "horgh"}
+	rc.remember(channel)
+
+	if rc.Modes != "nt" {
+		t.Errorf("remember() modes = %s, wanted nt", rc.Modes)
+	}
+
+	restored := &Channel{
+		Name:  "#test",
+		Modes: make(map[byte]struct{}),
+		TS:    300,
+	}
+	rc.restore(restored)
+
+	modes, params := restored.modesString()
+	if modes != "+ntkl" || len(params) != 2 || params[0] != "secret" ||
+		params[1] != "10" {
+		t.Errorf("restore() modes = %s %v, wanted +ntkl [secret 10]", modes,
+			params)
+	}
+
+	if restored.TS != 100 {
+		t.Errorf("restore() TS = %d, wanted 100", restored.TS)
+	}
+
+	if restored.Topic != channel.Topic || restored.TopicTS != channel.TopicTS ||
+		restored.TopicSetter != channel.TopicSetter {
+		t.Errorf("restore() topic = %s %d %s, wanted %s %d %s", restored.Topic,
+			restored.TopicTS, restored.TopicSetter, channel.Topic, channel.TopicTS,
+			channel.TopicSetter)
+	}
+
+	bans := restored.Lists['b']
+	if len(bans) != 1 || bans[0].Mask != "*!*@bad.example.com" ||
+		bans[0].SetBy != "horgh" || bans[0].SetTS != 150 {
+		t.Errorf("restore() bans = %+v, wanted the ban we remembered", bans)
+	}
+}
+
+func TestLoadRegisteredChannels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terrarium-channels-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "channels.json")
+
+	channels, err := loadRegisteredChannels(file)
+	if err != nil {
+		t.Fatalf("loadRegisteredChannels() with no file failed: %s", err)
+	}
+	if len(channels) != 0 {
+		t.Fatalf("loadRegisteredChannels() with no file = %d channels, wanted 0",
+			len(channels))
+	}
+
+	cb := &Catbox{
+		Config: &Config{ChannelsFile: file},
+		RegisteredChannels: map[string]*RegisteredChannel{
+			"#test": {Name: "#test", Founder: "horgh", TS: 100, Modes: "nt",
+				Lists: map[string][]ListMask{
+					"b": {{Mask: "*!*@bad.example.com", SetBy: "horgh", SetTS: 150}},
+				},
+			},
+		},
+	}
+	cb.saveRegisteredChannels()
+
+	channels, err = loadRegisteredChannels(file)
+	if err != nil {
+		t.Fatalf("loadRegisteredChannels() failed: %s", err)
+	}
+
+	rc, exists := channels["#test"]
+	if !exists {
+		t.Fatalf("loadRegisteredChannels() did not load #test")
+	}
+
+	if rc.Founder != "horgh" || rc.TS != 100 || rc.Modes != "nt" ||
+		len(rc.Lists["b"]) != 1 {
+		t.Errorf("loadRegisteredChannels() = %+v, wanted what we saved", rc)
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"i2pgit.org/idk/terrarium"
@@ -13,11 +17,51 @@ func main() {
 	log.SetFlags(log.Ldate | log.Ltime)
 	log.SetOutput(os.Stdout)
 
+	// terrarium ctl talks to a running server's control socket.
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		ctlArgs := terrarium.GetCtlArgs(os.Args[2:])
+		if ctlArgs == nil {
+			os.Exit(1)
+		}
+		if err := terrarium.RunControlCommand(ctlArgs.Socket, ctlArgs.Command,
+			os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// terrarium mkpasswd hashes a password for opers.conf or servers.conf.
+	if len(os.Args) > 1 && os.Args[1] == "mkpasswd" {
+		mkpasswdArgs := terrarium.GetMkpasswdArgs(os.Args[2:])
+		if mkpasswdArgs == nil {
+			os.Exit(1)
+		}
+		if err := mkpasswd(mkpasswdArgs.Cost); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	args := terrarium.GetArgs()
 	if args == nil {
 		os.Exit(1)
 	}
 
+	if len(args.DiffStateFiles) == 2 {
+		diffs, err := terrarium.DiffStateFiles(args.DiffStateFiles[0],
+			args.DiffStateFiles[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, diff := range diffs {
+			fmt.Println(diff)
+		}
+		if len(diffs) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	binPath, err := filepath.Abs(os.Args[0])
 	if err != nil {
 		log.Fatalf("Unable to determine absolute path to binary: %s: %s",
@@ -29,6 +73,11 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Send anything logged through the log package to our logger. It adds the
+	// time itself.
+	log.SetFlags(0)
+	log.SetOutput(cb.Logger)
+
 	if err := cb.Start(args.ListenFD); err != nil {
 		log.Fatal(err)
 	}
@@ -53,3 +102,22 @@ func main() {
 
 	log.Printf("Server shutdown cleanly.")
 }
+
+// mkpasswd reads a password from stdin and prints its hash.
+func mkpasswd(cost int) error {
+	_, _ = fmt.Fprint(os.Stderr, "Password: ")
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("unable to read password: %s", err)
+	}
+
+	hash, err := terrarium.HashPassword(strings.TrimRight(password, "\r\n"),
+		cost)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hash)
+	return nil
+}
@@ -1,6 +1,8 @@
 package terrarium
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"strings"
@@ -23,6 +25,17 @@ type Config struct {
 	ListenI2PTLS string
 	SAMAddress   string
 
+	// Where we keep our I2P keys. They decide our destination. Keys for links
+	// to servers over I2P go beside it.
+	I2PKeysFile string
+
+	// Where we keep the keys for our I2P+TLS listener. It has a destination of
+	// its own.
+	I2PTLSKeysFile string
+
+	// Settings for the I2P tunnels we create.
+	I2PTunnel I2PTunnelConfig
+
 	// Description of server. This shows in WHOIS, etc.
 	ServerInfo string
 
@@ -44,8 +57,52 @@ type Config struct {
 
 	AdminEmail string
 
-	// Oper name to password.
-	Opers map[string]string
+	// Path to the file where we save K-Lines so they survive restarts. If
+	// blank, K-Lines last only as long as we run.
+	KLinesFile string
+
+	// Path to the file where we save destination bans so they survive
+	// restarts. If blank, they last only as long as we run.
+	DestBansFile string
+
+	// Path to the accounts store. If blank, there are no accounts and we don't
+	// offer SASL.
+	AccountsFile string
+
+	// Path to the registered channels store. If blank, users may not register
+	// channels.
+	ChannelsFile string
+
+	// Path to a Unix socket for administering the server. If blank, we don't
+	// open one.
+	ControlSocket string
+
+	// Address to serve metrics on over HTTP, e.g. 127.0.0.1:9100. If blank, we
+	// don't serve them.
+	MetricsListen string
+
+	// Path to a file to log to. If blank, we log to stdout.
+	LogFile string
+
+	// Log format: text or json.
+	LogFormat string
+
+	// We log messages at this level and above.
+	LogLevel LogLevel
+
+	// Categories of log messages we also send to operators.
+	LogOperCategories map[LogCategory]struct{}
+
+	// Whether users may register and protect nicks through our built-in
+	// NickServ. It requires an accounts store.
+	NickServ bool
+
+	// Period of time a user may use a registered nick before identifying. After
+	// this we change their nick.
+	NickGracePeriod time.Duration
+
+	// Oper name to its definition.
+	Opers map[string]*OperConfig
 
 	// Server name to its link information.
 	Servers map[string]*ServerDefinition
@@ -59,8 +116,19 @@ type ServerDefinition struct {
 	Name     string
 	Hostname string
 	Port     int
-	Pass     string
-	TLS      bool
+
+	// The password we send to the server.
+	SendPass string
+
+	// The password the server must send us. A bcrypt hash or the password
+	// itself.
+	AcceptPass string
+
+	TLS bool
+
+	// If set, the server must use a TLS certificate with this SHA-256
+	// fingerprint (lowercase hex).
+	CertFP string
 }
 
 // UserConfig defines settings about users. Matched by usermask and hostmask.
@@ -121,6 +189,35 @@ func checkAndParseConfig(file string) (*Config, error) {
 		c.SAMAddress = m["sam-address"]
 	}
 
+	// Earlier versions kept the keys where the sam3 helper put them: the
+	// listener's name with .i2p.private appended. Default to that so our
+	// destination doesn't change.
+	c.I2PKeysFile = c.ListenI2P + i2pKeysSuffix
+	if m["i2p-keys-file"] != "" {
+		c.I2PKeysFile = m["i2p-keys-file"]
+	}
+
+	c.I2PTLSKeysFile = c.ListenI2PTLS + i2pKeysSuffix
+	if m["i2p-tls-keys-file"] != "" {
+		c.I2PTLSKeysFile = m["i2p-tls-keys-file"]
+	}
+
+	// Each I2P listener is a session of its own. The SAM bridge won't have two
+	// with the same name or destination.
+	if c.ListenI2P != "-1" && c.ListenI2PTLS != "-1" {
+		if c.ListenI2P == c.ListenI2PTLS {
+			return nil, fmt.Errorf("listen-i2p and listen-i2p-tls must differ")
+		}
+		if c.I2PKeysFile == c.I2PTLSKeysFile {
+			return nil, fmt.Errorf("i2p-keys-file and i2p-tls-keys-file must differ")
+		}
+	}
+
+	c.I2PTunnel, err = parseI2PTunnelConfig(m)
+	if err != nil {
+		return nil, err
+	}
+
 	if m["certificate-file"] != "" {
 		c.CertificateFile = m["certificate-file"]
 	}
@@ -181,13 +278,18 @@ func checkAndParseConfig(file string) (*Config, error) {
 	// opers.conf.
 
 	if m["opers-config"] != "" {
-		opers, err := config.ReadStringMap(m["opers-config"])
+		opersMap, err := config.ReadStringMap(m["opers-config"])
 		if err != nil {
 			return nil, fmt.Errorf("unable to load opers config: %s", err)
 		}
+
+		opers, err := parseOpersConfig(opersMap)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse opers config: %s", err)
+		}
 		c.Opers = opers
 	} else {
-		c.Opers = map[string]string{}
+		c.Opers = map[string]*OperConfig{}
 	}
 
 	// servers.conf.
@@ -239,15 +341,86 @@ func checkAndParseConfig(file string) (*Config, error) {
 
 	c.AdminEmail = m["admin-email"]
 
+	c.KLinesFile = m["klines-file"]
+
+	c.DestBansFile = m["dest-bans-file"]
+
+	c.AccountsFile = m["accounts-file"]
+
+	if m["nickserv"] != "" {
+		c.NickServ, err = strconv.ParseBool(m["nickserv"])
+		if err != nil {
+			return nil, fmt.Errorf("nickserv is not valid: %s", err)
+		}
+	}
+	if c.NickServ && c.AccountsFile == "" {
+		return nil, fmt.Errorf("nickserv requires an accounts file")
+	}
+
+	c.ControlSocket = m["control-socket"]
+
+	c.MetricsListen = m["metrics-listen"]
+
+	c.LogFile = m["log-file"]
+
+	c.LogFormat = "text"
+	if m["log-format"] != "" {
+		if m["log-format"] != "text" && m["log-format"] != "json" {
+			return nil, fmt.Errorf("log-format must be text or json")
+		}
+		c.LogFormat = m["log-format"]
+	}
+
+	c.LogLevel = LogInfo
+	if m["log-level"] != "" {
+		c.LogLevel, err = parseLogLevel(m["log-level"])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.LogOperCategories = make(map[LogCategory]struct{})
+	for _, s := range strings.Split(m["log-oper-categories"], ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		category, err := parseLogCategory(s)
+		if err != nil {
+			return nil, err
+		}
+		c.LogOperCategories[category] = struct{}{}
+	}
+
+	c.ChannelsFile = m["channels-file"]
+	if c.ChannelsFile != "" && c.AccountsFile == "" {
+		return nil, fmt.Errorf("channels-file requires an accounts file")
+	}
+
+	c.NickGracePeriod = 60 * time.Second
+	if m["nick-grace-period"] != "" {
+		c.NickGracePeriod, err = time.ParseDuration(m["nick-grace-period"])
+		if err != nil {
+			return nil, fmt.Errorf("nick grace period is in invalid format: %s",
+				err)
+		}
+	}
+
 	return c, nil
 }
 
 // Parse the value side of a server definition from the servers config.
 // Format:
-// <hostname>,<port>,<password>,<tls: 1 or 0>
+// <hostname>,<port>,<send password>,<tls: 1 or 0>[,<accept password>[,<certfp>]]
+//
+// We send the send password. The server must send us the accept password. It
+// may be a bcrypt hash. Without an accept password we expect the send password
+// back.
+//
+// With a certificate fingerprint, the server's TLS certificate must have it.
 func parseLink(name, s string) (*ServerDefinition, error) {
 	pieces := strings.Split(s, ",")
-	if len(pieces) != 4 {
+	if len(pieces) < 4 || len(pieces) > 6 {
 		return nil, fmt.Errorf("unexpected number of fields")
 	}
 
@@ -262,20 +435,57 @@ func parseLink(name, s string) (*ServerDefinition, error) {
 		return nil, fmt.Errorf("invalid port: %s: %s", pieces[1], err)
 	}
 
-	pass := strings.TrimSpace(pieces[2])
-	if len(pass) == 0 {
+	sendPass := strings.TrimSpace(pieces[2])
+	if len(sendPass) == 0 {
 		return nil, fmt.Errorf("you must specify a password")
 	}
+	if isPasswordHash(sendPass) {
+		return nil, fmt.Errorf(
+			"the send password must not be a hash. The other server needs it")
+	}
+
+	acceptPass := sendPass
+	if len(pieces) >= 5 {
+		acceptPass = strings.TrimSpace(pieces[4])
+		if len(acceptPass) == 0 {
+			return nil, fmt.Errorf("you must specify an accept password")
+		}
+	}
+
+	certFP := ""
+	if len(pieces) == 6 {
+		fp, err := parseCertFP(pieces[5])
+		if err != nil {
+			return nil, err
+		}
+		certFP = fp
+	}
 
 	return &ServerDefinition{
-		Name:     name,
-		Hostname: hostname,
-		Port:     int(port),
-		Pass:     pass,
-		TLS:      pieces[3] == "1",
+		Name:       name,
+		Hostname:   hostname,
+		Port:       int(port),
+		SendPass:   sendPass,
+		AcceptPass: acceptPass,
+		TLS:        strings.TrimSpace(pieces[3]) == "1",
+		CertFP:     certFP,
 	}, nil
 }
 
+// parseCertFP parses a SHA-256 certificate fingerprint from a config. We
+// accept hex in either case, with or without colons between bytes, and return
+// lowercase hex without colons. That is how we record clients' fingerprints.
+func parseCertFP(s string) (string, error) {
+	fp := strings.ToLower(strings.Replace(strings.TrimSpace(s), ":", "", -1))
+	if len(fp) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid certificate fingerprint: %s", s)
+	}
+	if _, err := hex.DecodeString(fp); err != nil {
+		return "", fmt.Errorf("invalid certificate fingerprint: %s", s)
+	}
+	return fp, nil
+}
+
 // Parse the value part of a user config line.
 // This is a comma separated value.
 // A line looks like so:
@@ -0,0 +1,391 @@
+package terrarium
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/pkg/errors"
+)
+
+// How long a control client has to send its command.
+const controlReadTimeout = 10 * time.Second
+
+// The longest we wait before accepting again after Accept fails.
+const controlAcceptMaxDelay = time.Second
+
+// controlRequest is a command from the control socket. The server goroutine
+// runs it and sends the result on Reply.
+type controlRequest struct {
+	// The command and its arguments.
+	Args []string
+
+	// The output of the command, or an error. It must be buffered so the server
+	// goroutine never blocks sending to it.
+	Reply chan controlReply
+}
+
+// controlReply is the result of a command from the control socket.
+type controlReply struct {
+	Lines []string
+	Error error
+}
+
+// listenControl opens the control socket. Anyone who can connect to it can
+// administer the server, so only the owner may use it.
+func (cb *Catbox) listenControl() error {
+	// A socket file left behind by an earlier run would stop us listening.
+	if err := os.Remove(cb.Config.ControlSocket); err != nil &&
+		!os.IsNotExist(err) {
+		return errors.Wrap(err, "unable to remove old control socket")
+	}
+
+	// Only our user may connect. Create the socket that way rather than changing
+	// its permissions after, as someone could connect in between.
+	oldUmask := syscall.Umask(0177)
+	ln, err := net.Listen("unix", cb.Config.ControlSocket)
+	syscall.Umask(oldUmask)
+	if err != nil {
+		return errors.Wrap(err, "unable to listen on control socket")
+	}
+
+	cb.ControlListener = ln
+	return nil
+}
+
+// acceptControlConnections accepts connections to the control socket. Each
+// gets its own goroutine.
+func (cb *Catbox) acceptControlConnections() {
+	defer cb.WG.Done()
+
+	// If Accept keeps failing, such as when we're out of file descriptors, wait
+	// a little longer each time rather than spinning.
+	var delay time.Duration
+
+	for {
+		conn, err := cb.ControlListener.Accept()
+		if err != nil {
+			if cb.isShuttingDown() {
+				break
+			}
+			cb.logf(LogWarn, LogGeneral, "Failed to accept control connection: %s",
+				err)
+
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+			if delay > controlAcceptMaxDelay {
+				delay = controlAcceptMaxDelay
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		cb.WG.Add(1)
+		go cb.handleControlConnection(conn)
+	}
+
+	cb.logf(LogInfo, LogGeneral, "Control connection accepter shutting down.")
+}
+
+// handleControlConnection reads one command from a control client, passes it to
+// the server goroutine, and writes back the result.
+//
+// The command is a single line: The command name and its arguments separated
+// by spaces. We reply with any output, one line at a time, then a final line:
+// OK if the command succeeded, or ERROR followed by why it failed.
+func (cb *Catbox) handleControlConnection(conn net.Conn) {
+	defer cb.WG.Done()
+	defer func() {
+		if err := conn.Close(); err != nil {
+			cb.logf(LogWarn, LogGeneral, "Error closing control connection: %s", err)
+		}
+	}()
+
+	if err := conn.SetReadDeadline(time.Now().Add(controlReadTimeout)); err != nil {
+		cb.logf(LogWarn, LogGeneral, "Unable to set control connection deadline: %s",
+			err)
+		return
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && err != io.EOF {
+		cb.logf(LogWarn, LogGeneral, "Error reading control command: %s", err)
+		return
+	}
+
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		_, _ = fmt.Fprintf(conn, "ERROR no command given\n")
+		return
+	}
+
+	req := &controlRequest{
+		Args:  args,
+		Reply: make(chan controlReply, 1),
+	}
+	cb.newEvent(Event{Type: ControlEvent, Control: req})
+
+	var reply controlReply
+	select {
+	case reply = <-req.Reply:
+	case <-cb.ShutdownChan:
+		// Commands such as die shut us down after replying.
+		select {
+		case reply = <-req.Reply:
+		default:
+			reply = controlReply{Error: fmt.Errorf("server shutting down")}
+		}
+	}
+
+	for _, l := range reply.Lines {
+		if _, err := fmt.Fprintf(conn, "%s\n", l); err != nil {
+			cb.logf(LogWarn, LogGeneral, "Error writing to control connection: %s", err)
+			return
+		}
+	}
+
+	if reply.Error != nil {
+		_, _ = fmt.Fprintf(conn, "ERROR %s\n", reply.Error)
+		return
+	}
+	_, _ = fmt.Fprintf(conn, "OK\n")
+}
+
+// controlCommand runs a command from the control socket. Only the server
+// goroutine may call this.
+func (cb *Catbox) controlCommand(req *controlRequest) {
+	lines, err := cb.runControlCommand(strings.ToLower(req.Args[0]),
+		req.Args[1:])
+	req.Reply <- controlReply{Lines: lines, Error: err}
+
+	// We shut down only after replying so the client hears the result.
+	command := strings.ToLower(req.Args[0])
+	if err == nil && command == "restart" {
+		cb.restart(nil)
+	}
+	if err == nil && command == "die" {
+		cb.noticeOpers(SnomaskGeneral, "Shutting down (control socket).")
+		cb.shutdown()
+	}
+}
+
+// runControlCommand carries out a control command. It returns lines of output
+// for the client.
+func (cb *Catbox) runControlCommand(command string,
+	args []string) ([]string, error) {
+	if command == "rehash" {
+		cb.rehash(nil)
+		return nil, nil
+	}
+
+	// These happen in controlCommand() after we reply.
+	if command == "restart" || command == "die" {
+		return nil, nil
+	}
+
+	if command == "kline" {
+		return nil, cb.controlKLine(args)
+	}
+
+	if command == "unkline" {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: unkline <user@host>")
+		}
+
+		pieces := strings.Split(args[0], "@")
+		if len(pieces) != 2 {
+			return nil, fmt.Errorf("bad mask: %s", args[0])
+		}
+
+		if !cb.removeKLine(pieces[0], pieces[1], cb.Config.ServerName) {
+			return nil, fmt.Errorf("no K-Line for %s", args[0])
+		}
+
+		for _, server := range cb.LocalServers {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(cb.Config.TS6SID),
+				Command: "ENCAP",
+				Params:  []string{"*", "UNKLINE", pieces[0], pieces[1]},
+			})
+		}
+		return nil, nil
+	}
+
+	if command == "connect" {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: connect <server name>")
+		}
+
+		linkInfo, exists := cb.Config.Servers[args[0]]
+		if !exists {
+			return nil, fmt.Errorf("no such server: %s", args[0])
+		}
+
+		if cb.isLinkedToServer(args[0]) {
+			return nil, fmt.Errorf("already linked to %s", args[0])
+		}
+
+		cb.connectToServer(linkInfo)
+		return nil, nil
+	}
+
+	if command == "squit" {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("usage: squit <server name> [reason]")
+		}
+
+		server := cb.getServerByName(args[0])
+		if server == nil {
+			return nil, fmt.Errorf("no such server: %s", args[0])
+		}
+
+		// We can only delink servers linked to us. Only operators can ask a remote
+		// server to delink.
+		if !server.isLocal() {
+			return nil, fmt.Errorf("%s is not linked to us", server.Name)
+		}
+
+		reason := "No reason given"
+		if len(args) > 1 {
+			reason = strings.Join(args[1:], " ")
+		}
+		server.LocalServer.quit(fmt.Sprintf("SQUIT (control socket): %s", reason))
+		return nil, nil
+	}
+
+	if command == "users" {
+		var lines []string
+		for _, user := range cb.dumpState().Users {
+			line := fmt.Sprintf("%s %s@%s %s %s", user.Nick, user.Username,
+				user.Hostname, user.UID, user.Server)
+			if len(user.Account) > 0 {
+				line += " " + user.Account
+			}
+			lines = append(lines, line)
+		}
+		return lines, nil
+	}
+
+	if command == "dumpstate" {
+		buf, err := json.MarshalIndent(cb.dumpState(), "", "  ")
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to encode state")
+		}
+		return strings.Split(string(buf), "\n"), nil
+	}
+
+	return nil, fmt.Errorf("unknown command: %s", command)
+}
+
+// controlKLine adds a K-Line from the control socket. We apply it and tell all
+// servers.
+//
+// kline [duration in minutes] <user@host> <reason>
+func (cb *Catbox) controlKLine(args []string) error {
+	var duration time.Duration
+	if len(args) > 0 {
+		if minutes, err := strconv.ParseInt(args[0], 10, 32); err == nil {
+			duration = time.Duration(minutes) * time.Minute
+			args = args[1:]
+		}
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("usage: kline [minutes] <user@host> <reason>")
+	}
+
+	pieces := strings.Split(args[0], "@")
+	if len(pieces) != 2 || !isValidUserMask(pieces[0]) ||
+		!isValidHostMask(pieces[1]) {
+		return fmt.Errorf("bad mask: %s", args[0])
+	}
+
+	if cb.hasKLine(pieces[0], pieces[1]) {
+		return fmt.Errorf("already K-Lined: %s", args[0])
+	}
+
+	reason := strings.Join(args[1:], " ")
+	now := time.Now()
+
+	kline := KLine{
+		UserMask: pieces[0],
+		HostMask: pieces[1],
+		Reason:   reason,
+		Setter:   cb.Config.ServerName,
+		SetTime:  now,
+	}
+	if duration > 0 {
+		kline.ExpireTime = now.Add(duration)
+	}
+
+	for _, server := range cb.LocalServers {
+		server.maybeQueueMessage(kline.encapMessage(string(cb.Config.TS6SID), now))
+	}
+
+	cb.addAndApplyKLine(kline, cb.Config.ServerName, reason)
+	return nil
+}
+
+// RunControlCommand sends a command to a running server's control socket. It
+// writes the command's output to out.
+//
+// This is what terrarium ctl uses.
+func RunControlCommand(socket string, args []string, out io.Writer) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to control socket")
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err := fmt.Fprintf(conn, "%s\n", strings.Join(args, " ")); err != nil {
+		return errors.Wrap(err, "unable to send command")
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "OK" {
+			return nil
+		}
+		if strings.HasPrefix(line, "ERROR ") {
+			return errors.New(strings.TrimPrefix(line, "ERROR "))
+		}
+
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "error reading reply")
+	}
+	return errors.New("connection closed without a reply")
+}
+
+// ControlSocketFromConfig finds the control socket in a configuration file.
+func ControlSocketFromConfig(configFile string) (string, error) {
+	cfg, err := checkAndParseConfig(configFile)
+	if err != nil {
+		return "", err
+	}
+
+	if cfg.ControlSocket == "" {
+		return "", errors.New("control-socket is not set")
+	}
+	return cfg.ControlSocket, nil
+}
@@ -0,0 +1,72 @@
+package terrarium
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunControlCommandErrors(t *testing.T) {
+	cb := &Catbox{Config: &Config{ServerName: "irc.example.com"}}
+
+	tests := []struct {
+		Args  string
+		Error string
+	}{
+		{"bogus", "unknown command: bogus"},
+		{"kline", "usage: kline [minutes] <user@host> <reason>"},
+		{"kline 5 *@example.com", "usage: kline [minutes] <user@host> <reason>"},
+		{"kline 5 example.com bad", "bad mask: example.com"},
+		{"unkline", "usage: unkline <user@host>"},
+		{"unkline example.com", "bad mask: example.com"},
+		{"connect", "usage: connect <server name>"},
+		{"connect irc2.example.com", "no such server: irc2.example.com"},
+		{"squit", "usage: squit <server name> [reason]"},
+	}
+
+	for _, test := range tests {
+		args := strings.Fields(test.Args)
+		_, err := cb.runControlCommand(args[0], args[1:])
+		if err == nil {
+			t.Errorf("runControlCommand(%s) succeeded, wanted error %s", test.Args,
+				test.Error)
+			continue
+		}
+
+		if err.Error() != test.Error {
+			t.Errorf("runControlCommand(%s) = %s, wanted %s", test.Args, err,
+				test.Error)
+		}
+	}
+}
+
+func TestListenControl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terrarium-control-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "control.sock")
+
+	cb := &Catbox{Config: &Config{ControlSocket: file}}
+	if err := cb.listenControl(); err != nil {
+		t.Fatalf("listenControl() failed: %s", err)
+	}
+	defer func() {
+		_ = cb.ControlListener.Close()
+	}()
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("error checking control socket: %s", err)
+	}
+
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("control socket permissions = %o, wanted 600", fi.Mode().Perm())
+	}
+}
@@ -0,0 +1,233 @@
+package terrarium
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/pkg/errors"
+)
+
+// DestBan bans an I2P destination. K-Lines match user@host, but users
+// connecting over I2P all have cloaked hosts. A destination ban stops a
+// destination registering no matter what it calls itself.
+type DestBan struct {
+	// The destination's base32 address, <hash>.b32.i2p.
+	Destination string `json:"destination"`
+
+	Reason string `json:"reason"`
+
+	// Who set it. A nick or a server name.
+	Setter string `json:"setter"`
+
+	// When we added it.
+	SetTime time.Time `json:"set_time"`
+
+	// When it expires. Zero if it is permanent.
+	ExpireTime time.Time `json:"expire_time"`
+}
+
+// isExpired tells whether a temporary destination ban has expired.
+func (d DestBan) isExpired(now time.Time) bool {
+	return banExpired(d.ExpireTime, now)
+}
+
+// durationString describes how long the ban lasts, for use in notices.
+func (d DestBan) durationString() string {
+	return banDurationString(d.ExpireTime)
+}
+
+// Build an ENCAP DESTBAN message to tell servers about a destination ban.
+//
+// :<source> ENCAP * DESTBAN <duration in seconds> <destination> :<reason>
+func (d DestBan) encapMessage(source string, now time.Time) irc.Message {
+	return irc.Message{
+		Prefix:  source,
+		Command: "ENCAP",
+		Params: []string{
+			"*",
+			"DESTBAN",
+			fmt.Sprintf("%d", banRemainingSeconds(d.ExpireTime, now)),
+			d.Destination,
+			d.Reason,
+		},
+	}
+}
+
+// Build an ENCAP DESTBANINFO message. Like KLINEINFO, it tells servers who set
+// a ban and when. We send it after the ban during burst.
+//
+// :<source> ENCAP * DESTBANINFO <destination> <set time> :<setter>
+func (d DestBan) infoMessage(source string) irc.Message {
+	return irc.Message{
+		Prefix:  source,
+		Command: "ENCAP",
+		Params: []string{
+			"*",
+			"DESTBANINFO",
+			d.Destination,
+			fmt.Sprintf("%d", d.SetTime.Unix()),
+			d.Setter,
+		},
+	}
+}
+
+// loadDestBans reads destination bans we saved. The file is a JSON array of
+// bans, like the K-Lines file.
+//
+// If the file does not exist we start with no bans. We drop any that expired
+// while we were not running.
+func loadDestBans(file string) ([]DestBan, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []DestBan{}, nil
+		}
+		return nil, errors.Wrap(err, "error reading destination bans")
+	}
+
+	var bans []DestBan
+	if err := json.Unmarshal(buf, &bans); err != nil {
+		return nil, errors.Wrap(err, "error parsing destination bans")
+	}
+
+	now := time.Now()
+	activeBans := []DestBan{}
+	for _, ban := range bans {
+		if ban.isExpired(now) {
+			continue
+		}
+		activeBans = append(activeBans, ban)
+	}
+
+	return activeBans, nil
+}
+
+// saveDestBans writes our destination bans to their file, if we have one. We
+// call this whenever they change.
+func (cb *Catbox) saveDestBans() {
+	if cb.Config.DestBansFile == "" {
+		return
+	}
+
+	buf, err := json.MarshalIndent(cb.DestBans, "", "  ")
+	if err != nil {
+		cb.noticeOpers(SnomaskKLines, fmt.Sprintf(
+			"Unable to encode destination bans: %s", err))
+		return
+	}
+
+	if err := writeFileAtomic(cb.Config.DestBansFile, buf); err != nil {
+		cb.noticeOpers(SnomaskKLines, fmt.Sprintf(
+			"Unable to save destination bans: %s", err))
+	}
+}
+
+// getDestBan finds the ban on a destination. nil if it is not banned.
+func (cb *Catbox) getDestBan(destination string) *DestBan {
+	for i := range cb.DestBans {
+		if cb.DestBans[i].Destination == destination {
+			return &cb.DestBans[i]
+		}
+	}
+	return nil
+}
+
+// Store a destination ban, and then check if any local users are connecting
+// from the destination. If so, cut them off and notify opers.
+//
+// This function does not propagate to any other servers.
+func (cb *Catbox) addAndApplyDestBan(ban DestBan, source string) {
+	if cb.getDestBan(ban.Destination) != nil {
+		cb.noticeOpers(SnomaskKLines, fmt.Sprintf(
+			"Ignoring duplicate destination ban for [%s] from %s", ban.Destination,
+			source))
+		return
+	}
+
+	cb.DestBans = append(cb.DestBans, ban)
+	cb.saveDestBans()
+
+	cb.noticeOpers(SnomaskKLines, fmt.Sprintf(
+		"%s added destination ban for [%s] [%s] (%s)", source, ban.Destination,
+		ban.Reason, ban.durationString()))
+
+	quitReason := fmt.Sprintf("Connection closed: %s", ban.Reason)
+
+	for _, user := range cb.LocalUsers {
+		if user.Conn.I2PDest != ban.Destination {
+			continue
+		}
+
+		user.quit(quitReason, true)
+
+		cb.noticeOpers(SnomaskKLines, fmt.Sprintf(
+			"User disconnected due to destination ban: %s", user.User.DisplayNick))
+	}
+}
+
+func (cb *Catbox) removeDestBan(destination, source string) bool {
+	idx := -1
+	for i, ban := range cb.DestBans {
+		if ban.Destination == destination {
+			idx = i
+			break
+		}
+	}
+
+	if idx == -1 {
+		cb.noticeOpers(SnomaskKLines, fmt.Sprintf(
+			"Not removing destination ban for [%s] (not found)", destination))
+		return false
+	}
+
+	cb.DestBans = append(cb.DestBans[:idx], cb.DestBans[idx+1:]...)
+	cb.saveDestBans()
+
+	cb.noticeOpers(SnomaskKLines, fmt.Sprintf(
+		"%s removed destination ban for [%s]", source, destination))
+
+	return true
+}
+
+// updateDestBanSetter records who set a destination ban and when, as another
+// server tells us. We keep whichever record is older, as with K-Lines.
+func (cb *Catbox) updateDestBanSetter(destination, setter string,
+	setTime time.Time) {
+	ban := cb.getDestBan(destination)
+	if ban == nil || !setTime.Before(ban.SetTime) {
+		return
+	}
+
+	ban.Setter = setter
+	ban.SetTime = setTime
+	cb.saveDestBans()
+}
+
+// expireDestBans removes temporary destination bans that have expired.
+//
+// Each server expires them itself, so we don't tell other servers.
+func (cb *Catbox) expireDestBans() {
+	now := time.Now()
+
+	activeBans := []DestBan{}
+	for _, ban := range cb.DestBans {
+		if !ban.isExpired(now) {
+			activeBans = append(activeBans, ban)
+			continue
+		}
+
+		cb.noticeOpers(SnomaskKLines, fmt.Sprintf(
+			"Temporary destination ban for [%s] expired", ban.Destination))
+	}
+
+	if len(activeBans) == len(cb.DestBans) {
+		return
+	}
+
+	cb.DestBans = activeBans
+	cb.saveDestBans()
+}
@@ -0,0 +1,153 @@
+package terrarium
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseI2PDestination(t *testing.T) {
+	dest := i2pBase64.EncodeToString(bytes.Repeat([]byte{0xfb, 0xff, 0x01}, 129))
+	b32, err := i2pDestination(i2pAddr(dest))
+	if err != nil {
+		t.Fatalf("i2pDestination() failed: %s", err)
+	}
+	hash := strings.TrimSuffix(b32, ".b32.i2p")
+
+	tests := []struct {
+		Input   string
+		Output  string
+		Success bool
+	}{
+		{b32, b32, true},
+		{hash, b32, true},
+		{strings.ToUpper(b32), b32, true},
+		{dest, b32, true},
+		{hash[1:], "", false},
+		{"1" + hash[1:], "", false},
+		{"abcd", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		output, err := parseI2PDestination(test.Input)
+		if !test.Success {
+			if err == nil {
+				t.Errorf("parseI2PDestination(%s) succeeded, wanted error",
+					test.Input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseI2PDestination(%s) failed: %s", test.Input, err)
+			continue
+		}
+		if output != test.Output {
+			t.Errorf("parseI2PDestination(%s) = %s, wanted %s", test.Input, output,
+				test.Output)
+		}
+	}
+}
+
+func TestLoadDestBans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terrarium-destbans-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "destbans.json")
+
+	bans, err := loadDestBans(file)
+	if err != nil {
+		t.Fatalf("loadDestBans() with no file failed: %s", err)
+	}
+	if len(bans) != 0 {
+		t.Fatalf("loadDestBans() with no file = %d bans, wanted 0", len(bans))
+	}
+
+	now := time.Now()
+
+	cb := &Catbox{
+		Config:     &Config{DestBansFile: file},
+		LocalUsers: map[uint64]*LocalUser{},
+		Opers:      map[TS6UID]*User{},
+	}
+
+	cb.addAndApplyDestBan(DestBan{Destination: "permanent.b32.i2p",
+		Setter: "horgh", SetTime: now}, "horgh")
+	cb.addAndApplyDestBan(DestBan{Destination: "temporary.b32.i2p",
+		Setter: "horgh", SetTime: now, ExpireTime: now.Add(time.Hour)}, "horgh")
+	cb.addAndApplyDestBan(DestBan{Destination: "temporary.b32.i2p",
+		Setter: "will", SetTime: now}, "will")
+	cb.addAndApplyDestBan(DestBan{Destination: "expired.b32.i2p",
+		Setter: "horgh", SetTime: now, ExpireTime: now.Add(-time.Hour)}, "horgh")
+	cb.addAndApplyDestBan(DestBan{Destination: "removed.b32.i2p",
+		Setter: "horgh", SetTime: now}, "horgh")
+
+	if !cb.removeDestBan("removed.b32.i2p", "horgh") {
+		t.Errorf("removeDestBan() = false, wanted true")
+	}
+	if cb.removeDestBan("removed.b32.i2p", "horgh") {
+		t.Errorf("removeDestBan() of a missing ban = true, wanted false")
+	}
+
+	bans, err = loadDestBans(file)
+	if err != nil {
+		t.Fatalf("loadDestBans() failed: %s", err)
+	}
+
+	if len(bans) != 2 {
+		t.Fatalf("loadDestBans() = %d bans, wanted 2", len(bans))
+	}
+
+	for i, destination := range []string{"permanent.b32.i2p",
+		"temporary.b32.i2p"} {
+		if bans[i].Destination != destination || bans[i].Setter != "horgh" {
+			t.Errorf("loadDestBans() ban %d = %+v, wanted destination %s", i,
+				bans[i], destination)
+		}
+	}
+}
+
+func TestUpdateDestBanSetter(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Hour)
+
+	tests := []struct {
+		setter     string
+		setTime    time.Time
+		wantSetter string
+		wantTime   time.Time
+	}{
+		{"horgh", earlier, "horgh", earlier},
+		// We keep the older record.
+		{"horgh", now.Add(time.Hour), "irc.example.com", now},
+		{"horgh", now, "irc.example.com", now},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{
+			Config: &Config{},
+			DestBans: []DestBan{
+				{Destination: "example.b32.i2p", Setter: "irc.example.com",
+					SetTime: now},
+			},
+		}
+
+		cb.updateDestBanSetter("example.b32.i2p", test.setter, test.setTime)
+
+		ban := cb.DestBans[0]
+		if ban.Setter != test.wantSetter || !ban.SetTime.Equal(test.wantTime) {
+			t.Errorf("updateDestBanSetter(%s, %s) = %s %s, wanted %s %s",
+				test.setter, test.setTime, ban.Setter, ban.SetTime, test.wantSetter,
+				test.wantTime)
+		}
+	}
+}
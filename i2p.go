@@ -0,0 +1,84 @@
+package terrarium
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The network name of I2P addresses. SAM connections have these as their
+// remote address.
+const i2pNetwork = "I2P"
+
+// The smallest an I2P destination can be in bytes.
+const i2pMinDestinationSize = 387
+
+// I2P's base64 alphabet. It uses - and ~ rather than + and /.
+var i2pBase64 = base64.NewEncoding(
+	"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-~")
+
+// I2P's base32 alphabet is the standard one in lowercase, without padding.
+var i2pBase32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").
+	WithPadding(base32.NoPadding)
+
+// isI2PAddr says whether an address is an I2P destination.
+func isI2PAddr(addr net.Addr) bool {
+	return addr != nil && addr.Network() == i2pNetwork
+}
+
+// i2pDestination gets the base32 address (<hash>.b32.i2p) of an I2P peer. The
+// address's string form is its full destination in base64. The base32 address
+// is the hash of the destination.
+func i2pDestination(addr net.Addr) (string, error) {
+	s := addr.String()
+	if strings.HasSuffix(s, ".b32.i2p") {
+		return s, nil
+	}
+
+	dest, err := i2pBase64.DecodeString(s)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid I2P destination")
+	}
+
+	sum := sha256.Sum256(dest)
+	return i2pBase32.EncodeToString(sum[:]) + ".b32.i2p", nil
+}
+
+// parseI2PDestination parses a destination an operator gives us. It may be a
+// base32 address, with or without .b32.i2p, or a full base64 destination. We
+// return the base32 address, as we record for clients.
+func parseI2PDestination(s string) (string, error) {
+	hash := strings.TrimSuffix(strings.ToLower(s), ".b32.i2p")
+	if len(hash) == i2pBase32.EncodedLen(sha256.Size) {
+		if _, err := i2pBase32.DecodeString(hash); err != nil {
+			return "", fmt.Errorf("invalid I2P destination: %s", s)
+		}
+		return hash + ".b32.i2p", nil
+	}
+
+	// Short strings that happen to decode as base64 are mistakes.
+	if len(s) < i2pBase64.EncodedLen(i2pMinDestinationSize) {
+		return "", fmt.Errorf("invalid I2P destination: %s", s)
+	}
+
+	return i2pDestination(i2pAddr(s))
+}
+
+// i2pAddr is an I2P destination as a net.Addr.
+type i2pAddr string
+
+func (a i2pAddr) Network() string { return i2pNetwork }
+func (a i2pAddr) String() string  { return string(a) }
+
+// i2pCloak makes the hostname we show for a user connecting over I2P. The
+// same destination always gets the same cloak, so bans and the like work, but
+// the cloak doesn't reveal the destination.
+func i2pCloak(dest string) string {
+	sum := sha256.Sum256([]byte(dest))
+	return fmt.Sprintf("%x.i2p", sum[:8])
+}
@@ -0,0 +1,88 @@
+package terrarium
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeI2PConn is a connection from an I2P peer.
+type fakeI2PConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c fakeI2PConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestI2PDestination(t *testing.T) {
+	// A destination is 387 bytes or more. Its base64 form uses - and ~.
+	dest := i2pBase64.EncodeToString(bytes.Repeat([]byte{0xfb, 0xff, 0x01}, 129))
+	if !strings.ContainsAny(dest, "-~") {
+		t.Fatalf("destination %s does not use the I2P alphabet", dest)
+	}
+
+	b32, err := i2pDestination(i2pAddr(dest))
+	if err != nil {
+		t.Fatalf("i2pDestination() failed: %s", err)
+	}
+	if len(b32) != 52+len(".b32.i2p") || !strings.HasSuffix(b32, ".b32.i2p") ||
+		strings.ToLower(b32) != b32 {
+		t.Errorf("i2pDestination() = %s, wanted a lowercase base32 address", b32)
+	}
+
+	tests := []struct {
+		Addr    string
+		Output  string
+		Success bool
+	}{
+		{dest, b32, true},
+		{b32, b32, true},
+		{"not+base64", "", false},
+	}
+
+	for _, test := range tests {
+		output, err := i2pDestination(i2pAddr(test.Addr))
+		if !test.Success {
+			if err == nil {
+				t.Errorf("i2pDestination(%s) succeeded, wanted error", test.Addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("i2pDestination(%s) failed: %s", test.Addr, err)
+			continue
+		}
+		if output != test.Output {
+			t.Errorf("i2pDestination(%s) = %s, wanted %s", test.Addr, output,
+				test.Output)
+		}
+	}
+
+	cloak := i2pCloak(b32)
+	if cloak != i2pCloak(b32) || cloak == i2pCloak("x"+b32) ||
+		strings.Contains(cloak, b32[:16]) || !isValidHostname(cloak) {
+		t.Errorf("i2pCloak(%s) = %s, wanted a deterministic hostname", b32, cloak)
+	}
+
+	c1, c2 := net.Pipe()
+	defer func() {
+		_ = c1.Close()
+		_ = c2.Close()
+	}()
+
+	conn, err := NewConn(fakeI2PConn{Conn: c1, remote: i2pAddr(dest)},
+		time.Second)
+	if err != nil {
+		t.Fatalf("NewConn() failed: %s", err)
+	}
+	if conn.I2PDest != b32 || conn.IP != nil {
+		t.Errorf("NewConn() = %s/%s, wanted %s and no IP", conn.I2PDest, conn.IP,
+			b32)
+	}
+
+	if _, err := NewConn(c2, time.Second); err == nil {
+		t.Errorf("NewConn() of a pipe succeeded, wanted error")
+	}
+}
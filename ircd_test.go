@@ -154,12 +154,32 @@ func TestUserMatchesMask(t *testing.T) {
 			output:        true,
 		},
 
+		{
+			inputUser:     User{Username: "test", Hostname: "127.0.0.1"},
+			inputUserMask: "TEST",
+			inputHostMask: "127.0.0.1",
+			output:        true,
+		},
+
 		{
 			inputUser:     User{Username: "test", Hostname: "127.0.0.1"},
 			inputUserMask: "*tst",
 			inputHostMask: "127.0.0.1",
 			output:        false,
 		},
+		// Masks must match the whole string.
+		{
+			inputUser:     User{Username: "test", Hostname: "127.0.0.1"},
+			inputUserMask: "tes",
+			inputHostMask: "127.0.0.1",
+			output:        false,
+		},
+		{
+			inputUser:     User{Username: "test", Hostname: "127.0.0.10"},
+			inputUserMask: "test",
+			inputHostMask: "127.0.0.1",
+			output:        false,
+		},
 	}
 
 	for _, test := range tests {
@@ -171,6 +191,52 @@ func TestUserMatchesMask(t *testing.T) {
 	}
 }
 
+func TestNormalizeMask(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"nick", "nick!*@*"},
+		{"nick!user", "nick!user@*"},
+		{"user@host", "*!user@host"},
+		{"nick!user@host", "nick!user@host"},
+		{"*!*@host", "*!*@host"},
+		{"@host", "*!*@host"},
+		{"nick!@", "nick!*@*"},
+	}
+
+	for _, test := range tests {
+		output := normalizeMask(test.input)
+		if output != test.output {
+			t.Errorf("normalizeMask(%s) = %s, wanted %s", test.input, output,
+				test.output)
+		}
+	}
+}
+
+func TestStripColours(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"hi there", "hi there"},
+		{"\x02bold\x02 text", "bold text"},
+		{"\x034red", "red"},
+		{"\x0304,12red on blue\x03 plain", "red on blue plain"},
+		{"\x03,5comma", ",5comma"},
+		{"\x031234", "34"},
+		{"\x1funderline\x0f", "underline"},
+	}
+
+	for _, test := range tests {
+		output := stripColours(test.input)
+		if output != test.output {
+			t.Errorf("stripColours(%q) = %q, wanted %q", test.input, output,
+				test.output)
+		}
+	}
+}
+
 func TestParseAndResolveUmodeChanges(t *testing.T) {
 	tests := []struct {
 		inputModes         string
@@ -284,6 +350,30 @@ func TestParseAndResolveUmodeChanges(t *testing.T) {
 			outputUnknownModes: map[byte]struct{}{},
 			success:            true,
 		},
+		{
+			inputCurrentModes:  map[byte]struct{}{'o': {}},
+			inputModes:         "+s",
+			outputSetModes:     map[byte]struct{}{'s': {}},
+			outputUnsetModes:   map[byte]struct{}{},
+			outputUnknownModes: map[byte]struct{}{},
+			success:            true,
+		},
+		{
+			inputCurrentModes:  map[byte]struct{}{'i': {}},
+			inputModes:         "+s",
+			outputSetModes:     map[byte]struct{}{},
+			outputUnsetModes:   map[byte]struct{}{},
+			outputUnknownModes: map[byte]struct{}{},
+			success:            true,
+		},
+		{
+			inputCurrentModes:  map[byte]struct{}{'o': {}, 's': {}},
+			inputModes:         "-o+s",
+			outputSetModes:     map[byte]struct{}{},
+			outputUnsetModes:   map[byte]struct{}{'o': {}, 's': {}},
+			outputUnknownModes: map[byte]struct{}{},
+			success:            true,
+		},
 	}
 
 	for _, test := range tests {
@@ -0,0 +1,75 @@
+package terrarium
+
+import "fmt"
+
+// The most tokens we send in a single RPL_ISUPPORT (005) message.
+const maxISupportTokensPerMessage = 13
+
+// isupportTokens builds the tokens we advertise in RPL_ISUPPORT (005). These
+// tell clients about features and limits of the server.
+//
+// Some of these come from the configuration, so they may change on rehash. If
+// they do, we send RPL_ISUPPORT again.
+//
+// See https://modern.ircdocs.horse/#rplisupport-005
+func (cb *Catbox) isupportTokens() []string {
+	return []string{
+		// canonicalizeNick treats []\ as the lowercase of {}|, but not ~ as the
+		// lowercase of ^.
+		"CASEMAPPING=strict-rfc1459",
+		// List modes, modes that always take a parameter, modes that take a
+		// parameter only when set, and modes that never take a parameter.
+		fmt.Sprintf("CHANMODES=%s,k,l,%s", channelListModes, channelSimpleModes),
+		fmt.Sprintf("CHANNELLEN=%d", maxChannelLength),
+		"CHANTYPES=#",
+		"ELIST=" + elistExtensions,
+		"EXCEPTS=e",
+		"INVEX=I",
+		fmt.Sprintf("KICKLEN=%d", maxKickLength),
+		fmt.Sprintf("MAXLIST=%s:%d", channelListModes, maxChannelListLength),
+		fmt.Sprintf("MODES=%d", ChanModesPerCommand),
+		fmt.Sprintf("NICKLEN=%d", cb.Config.MaxNickLength),
+		// Status modes (o, v) and the prefixes we show for them in NAMES and WHO.
+		"PREFIX=(ov)@+",
+		fmt.Sprintf("TOPICLEN=%d", maxTopicLength),
+	}
+}
+
+// sendISupport sends the user RPL_ISUPPORT (005). We split the tokens across
+// as many messages as we need.
+func (u *LocalUser) sendISupport() {
+	tokens := u.Catbox.isupportTokens()
+
+	for len(tokens) > 0 {
+		count := len(tokens)
+		if count > maxISupportTokensPerMessage {
+			count = maxISupportTokensPerMessage
+		}
+
+		params := append([]string{}, tokens[:count]...)
+		params = append(params, "are supported by this server")
+		tokens = tokens[count:]
+
+		// 005 RPL_ISUPPORT
+		u.messageFromServer("005", params)
+	}
+}
+
+// notifyISupportChanges sends RPL_ISUPPORT (005) to all local users again if
+// what we advertise changed. We call this after a rehash.
+func (cb *Catbox) notifyISupportChanges(oldTokens []string) {
+	newTokens := cb.isupportTokens()
+
+	changed := len(oldTokens) != len(newTokens)
+	for i := 0; !changed && i < len(newTokens); i++ {
+		changed = oldTokens[i] != newTokens[i]
+	}
+
+	if !changed {
+		return
+	}
+
+	for _, lu := range cb.LocalUsers {
+		lu.sendISupport()
+	}
+}
@@ -0,0 +1,49 @@
+package terrarium
+
+import (
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestSendISupport(t *testing.T) {
+	u := &LocalUser{
+		LocalClient: &LocalClient{
+			WriteChan: make(chan irc.Message, 10),
+			Catbox: &Catbox{
+				Config: &Config{ServerName: "irc.example.com", MaxNickLength: 15},
+			},
+		},
+		User: &User{DisplayNick: "alice"},
+	}
+
+	u.sendISupport()
+
+	select {
+	case m := <-u.WriteChan:
+		if m.Command != "005" {
+			t.Fatalf("command = %s, wanted 005", m.Command)
+		}
+		if m.Params[0] != "alice" {
+			t.Errorf("target = %s, wanted alice", m.Params[0])
+		}
+		if m.Params[len(m.Params)-1] != "are supported by this server" {
+			t.Errorf("last parameter = %s", m.Params[len(m.Params)-1])
+		}
+		if len(m.Params) > maxISupportTokensPerMessage+2 {
+			t.Errorf("too many tokens: %d", len(m.Params)-2)
+		}
+
+		found := false
+		for _, param := range m.Params {
+			if param == "NICKLEN=15" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("NICKLEN=15 not found in %v", m.Params)
+		}
+	default:
+		t.Fatalf("no message sent")
+	}
+}
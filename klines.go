@@ -0,0 +1,205 @@
+package terrarium
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/pkg/errors"
+)
+
+// isExpired tells whether a temporary K-Line has expired.
+func (k KLine) isExpired(now time.Time) bool {
+	return banExpired(k.ExpireTime, now)
+}
+
+// durationString describes how long the K-Line lasts, for use in notices.
+func (k KLine) durationString() string {
+	return banDurationString(k.ExpireTime)
+}
+
+// remainingSeconds tells how many seconds the K-Line has left. This is what
+// we send as the duration in ENCAP KLINE. 0 means it is permanent.
+func (k KLine) remainingSeconds(now time.Time) int64 {
+	return banRemainingSeconds(k.ExpireTime, now)
+}
+
+// banExpired tells whether a ban expiring at the given time has expired. A
+// zero expiry time means the ban is permanent.
+func banExpired(expireTime, now time.Time) bool {
+	return !expireTime.IsZero() && !now.Before(expireTime)
+}
+
+// banDurationString describes how long a ban expiring at the given time lasts.
+func banDurationString(expireTime time.Time) string {
+	if expireTime.IsZero() {
+		return "permanent"
+	}
+	return fmt.Sprintf("expires %s", expireTime.UTC().Format(time.RFC3339))
+}
+
+// banRemainingSeconds tells how many seconds a ban expiring at the given time
+// has left. 0 means it is permanent.
+func banRemainingSeconds(expireTime, now time.Time) int64 {
+	if expireTime.IsZero() {
+		return 0
+	}
+
+	seconds := int64(expireTime.Sub(now).Seconds())
+	// Don't send 0 for a temporary ban as it would become permanent.
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// Build an ENCAP KLINE message to tell servers about a K-Line.
+//
+// :<source> ENCAP * KLINE <duration in seconds> <user mask> <host mask>
+// :<reason>
+func (k KLine) encapMessage(source string, now time.Time) irc.Message {
+	return irc.Message{
+		Prefix:  source,
+		Command: "ENCAP",
+		Params: []string{
+			"*",
+			"KLINE",
+			fmt.Sprintf("%d", k.remainingSeconds(now)),
+			k.UserMask,
+			k.HostMask,
+			k.Reason,
+		},
+	}
+}
+
+// Build an ENCAP KLINEINFO message. This tells servers who set a K-Line and
+// when. We send it after the K-Line during burst, as ENCAP KLINE has no room
+// for it. Other ircds ignore it.
+//
+// :<source> ENCAP * KLINEINFO <user mask> <host mask> <set time> :<setter>
+//
+// The set time is a Unix timestamp.
+func (k KLine) infoMessage(source string) irc.Message {
+	return irc.Message{
+		Prefix:  source,
+		Command: "ENCAP",
+		Params: []string{
+			"*",
+			"KLINEINFO",
+			k.UserMask,
+			k.HostMask,
+			fmt.Sprintf("%d", k.SetTime.Unix()),
+			k.Setter,
+		},
+	}
+}
+
+// loadKLines reads K-Lines we saved. The file is a JSON array of K-Lines.
+//
+// If the file does not exist we start with no K-Lines. We drop any that
+// expired while we were not running.
+func loadKLines(file string) ([]KLine, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []KLine{}, nil
+		}
+		return nil, errors.Wrap(err, "error reading K-Lines")
+	}
+
+	var klines []KLine
+	if err := json.Unmarshal(buf, &klines); err != nil {
+		return nil, errors.Wrap(err, "error parsing K-Lines")
+	}
+
+	now := time.Now()
+	activeKLines := []KLine{}
+	for _, kline := range klines {
+		if kline.isExpired(now) {
+			continue
+		}
+		activeKLines = append(activeKLines, kline)
+	}
+
+	return activeKLines, nil
+}
+
+// saveKLines writes our K-Lines to the K-Lines file, if we have one. We call
+// this whenever they change.
+func (cb *Catbox) saveKLines() {
+	if cb.Config.KLinesFile == "" {
+		return
+	}
+
+	buf, err := json.MarshalIndent(cb.KLines, "", "  ")
+	if err != nil {
+		cb.noticeOpers(SnomaskKLines, fmt.Sprintf("Unable to encode K-Lines: %s",
+			err))
+		return
+	}
+
+	if err := writeFileAtomic(cb.Config.KLinesFile, buf); err != nil {
+		cb.noticeOpers(SnomaskKLines, fmt.Sprintf("Unable to save K-Lines: %s", err))
+	}
+}
+
+// hasKLine tells whether we have a K-Line on exactly this mask.
+func (cb *Catbox) hasKLine(userMask, hostMask string) bool {
+	for _, kline := range cb.KLines {
+		if kline.UserMask == userMask && kline.HostMask == hostMask {
+			return true
+		}
+	}
+	return false
+}
+
+// updateKLineSetter records who set a K-Line and when, as another server tells
+// us. When we learn of a K-Line during burst, we first record the server that
+// told us as its setter. We keep whichever record is older. That is the
+// original.
+func (cb *Catbox) updateKLineSetter(userMask, hostMask, setter string,
+	setTime time.Time) {
+	for i := range cb.KLines {
+		kline := &cb.KLines[i]
+		if kline.UserMask != userMask || kline.HostMask != hostMask {
+			continue
+		}
+
+		if !setTime.Before(kline.SetTime) {
+			return
+		}
+
+		kline.Setter = setter
+		kline.SetTime = setTime
+		cb.saveKLines()
+		return
+	}
+}
+
+// expireKLines removes temporary K-Lines that have expired.
+//
+// Each server expires K-Lines itself, so we don't tell other servers.
+func (cb *Catbox) expireKLines() {
+	now := time.Now()
+
+	activeKLines := []KLine{}
+	for _, kline := range cb.KLines {
+		if !kline.isExpired(now) {
+			activeKLines = append(activeKLines, kline)
+			continue
+		}
+
+		cb.noticeOpers(SnomaskKLines, fmt.Sprintf(
+			"Temporary K-Line for [%s@%s] expired", kline.UserMask, kline.HostMask))
+	}
+
+	if len(activeKLines) == len(cb.KLines) {
+		return
+	}
+
+	cb.KLines = activeKLines
+	cb.saveKLines()
+}
@@ -0,0 +1,150 @@
+package terrarium
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKLineRemainingSeconds(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		KLine  KLine
+		Output int64
+	}{
+		{KLine{}, 0},
+		{KLine{ExpireTime: now.Add(time.Hour)}, 3600},
+		{KLine{ExpireTime: now.Add(time.Millisecond)}, 1},
+		{KLine{ExpireTime: now.Add(-time.Hour)}, 1},
+	}
+
+	for _, test := range tests {
+		output := test.KLine.remainingSeconds(now)
+		if output != test.Output {
+			t.Errorf("remainingSeconds(%s) = %d, wanted %d", test.KLine.ExpireTime,
+				output, test.Output)
+		}
+	}
+}
+
+// K-Lines match the whole username and hostname. Masks used to match anywhere
+// in them, so a K-Line on *@example.com also hit the hosts marked below.
+func TestKLineMatching(t *testing.T) {
+	kline := KLine{UserMask: "*", HostMask: "example.com"}
+
+	tests := []struct {
+		Hostname string
+		Output   bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.COM", true},
+		{"notexample.com", false},          // Used to match.
+		{"example.com.example.org", false}, // Used to match.
+		{"example.org", false},
+	}
+
+	for _, test := range tests {
+		u := &User{Username: "alice", Hostname: test.Hostname}
+		output := u.matchesMask(kline.UserMask, kline.HostMask)
+		if output != test.Output {
+			t.Errorf("K-Line %s@%s matches %s = %v, wanted %v", kline.UserMask,
+				kline.HostMask, test.Hostname, output, test.Output)
+		}
+	}
+
+	// A K-Line on a username works the same way.
+	kline = KLine{UserMask: "bob", HostMask: "*"}
+	u := &User{Username: "bobby", Hostname: "example.com"}
+	if u.matchesMask(kline.UserMask, kline.HostMask) {
+		t.Errorf("K-Line bob@* matches bobby, wanted no match")
+	}
+}
+
+func TestLoadKLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terrarium-klines-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "klines.json")
+
+	klines, err := loadKLines(file)
+	if err != nil {
+		t.Fatalf("loadKLines() with no file failed: %s", err)
+	}
+	if len(klines) != 0 {
+		t.Fatalf("loadKLines() with no file = %d K-Lines, wanted 0", len(klines))
+	}
+
+	now := time.Now()
+
+	cb := &Catbox{
+		Config: &Config{KLinesFile: file},
+		KLines: []KLine{
+			{UserMask: "*", HostMask: "permanent", Setter: "horgh", SetTime: now},
+			{UserMask: "*", HostMask: "temporary", Setter: "horgh", SetTime: now,
+				ExpireTime: now.Add(time.Hour)},
+			{UserMask: "*", HostMask: "expired", Setter: "horgh", SetTime: now,
+				ExpireTime: now.Add(-time.Hour)},
+		},
+	}
+	cb.saveKLines()
+
+	klines, err = loadKLines(file)
+	if err != nil {
+		t.Fatalf("loadKLines() failed: %s", err)
+	}
+
+	if len(klines) != 2 {
+		t.Fatalf("loadKLines() = %d K-Lines, wanted 2", len(klines))
+	}
+
+	for i, hostMask := range []string{"permanent", "temporary"} {
+		if klines[i].HostMask != hostMask || klines[i].Setter != "horgh" {
+			t.Errorf("loadKLines() K-Line %d = %+v, wanted host mask %s", i,
+				klines[i], hostMask)
+		}
+	}
+}
+
+func TestUpdateKLineSetter(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Hour)
+
+	tests := []struct {
+		setter     string
+		setTime    time.Time
+		wantSetter string
+		wantTime   time.Time
+	}{
+		{"horgh", earlier, "horgh", earlier},
+		// We keep the older record.
+		{"horgh", now.Add(time.Hour), "irc.example.com", now},
+		{"horgh", now, "irc.example.com", now},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{
+			Config: &Config{},
+			KLines: []KLine{
+				{UserMask: "*", HostMask: "example.com", Setter: "irc.example.com",
+					SetTime: now},
+			},
+		}
+
+		cb.updateKLineSetter("*", "example.com", test.setter, test.setTime)
+
+		kline := cb.KLines[0]
+		if kline.Setter != test.wantSetter || !kline.SetTime.Equal(test.wantTime) {
+			t.Errorf("updateKLineSetter(%s, %s) = %s %s, wanted %s %s",
+				test.setter, test.setTime, kline.Setter, kline.SetTime,
+				test.wantSetter, test.wantTime)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package terrarium
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// listFilter holds the conditions a channel must meet to show in a LIST reply.
+//
+// We support these ELIST extensions:
+// - M: Mask search. e.g., #foo*
+// - N: Negative mask search. e.g., !#foo*
+// - T: Topic age search. e.g., T<60 (topic set less than 60 minutes ago) or T>60
+//   (set more than 60 minutes ago).
+// - U: User count search. e.g., >5 (more than 5 users) or <5
+type listFilter struct {
+	// Channel names must match one of these, if there are any.
+	Masks []*regexp.Regexp
+
+	// Channel names must match none of these.
+	NegativeMasks []*regexp.Regexp
+
+	// More than this many users. -1 if there is no minimum.
+	MinUsers int
+
+	// Fewer than this many users. -1 if there is no maximum.
+	MaxUsers int
+
+	// The topic must be set within this many minutes. -1 if there is no
+	// condition.
+	TopicNewerThan int
+
+	// The topic must be set more than this many minutes ago. -1 if there is no
+	// condition.
+	TopicOlderThan int
+}
+
+// The ELIST extensions we support. We advertise this in RPL_ISUPPORT.
+const elistExtensions = "MNTU"
+
+// newListFilter makes a filter that matches every channel.
+func newListFilter() *listFilter {
+	return &listFilter{
+		MinUsers:       -1,
+		MaxUsers:       -1,
+		TopicNewerThan: -1,
+		TopicOlderThan: -1,
+	}
+}
+
+// parseListFilter parses the comma separated conditions given to LIST. Returns
+// false if any is invalid.
+func parseListFilter(s string) (*listFilter, bool) {
+	filter := newListFilter()
+
+	for _, condition := range strings.Split(s, ",") {
+		condition = strings.TrimSpace(condition)
+		if len(condition) == 0 {
+			continue
+		}
+
+		if condition[0] == '>' || condition[0] == '<' {
+			n, err := strconv.Atoi(condition[1:])
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			if condition[0] == '>' {
+				filter.MinUsers = n
+			} else {
+				filter.MaxUsers = n
+			}
+			continue
+		}
+
+		if len(condition) > 2 && (condition[0] == 'T' || condition[0] == 't') &&
+			(condition[1] == '<' || condition[1] == '>') {
+			n, err := strconv.Atoi(condition[2:])
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			if condition[1] == '<' {
+				filter.TopicNewerThan = n
+			} else {
+				filter.TopicOlderThan = n
+			}
+			continue
+		}
+
+		negative := false
+		if condition[0] == '!' {
+			negative = true
+			condition = condition[1:]
+		}
+
+		re, err := maskToRegex(canonicalizeChannel(condition))
+		if err != nil {
+			return nil, false
+		}
+
+		if negative {
+			filter.NegativeMasks = append(filter.NegativeMasks, re)
+		} else {
+			filter.Masks = append(filter.Masks, re)
+		}
+	}
+
+	return filter, true
+}
+
+// matches tells whether the channel meets the filter's conditions.
+func (f *listFilter) matches(channel *Channel, now time.Time) bool {
+	if len(f.Masks) > 0 {
+		found := false
+		for _, re := range f.Masks {
+			if re.MatchString(channel.Name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, re := range f.NegativeMasks {
+		if re.MatchString(channel.Name) {
+			return false
+		}
+	}
+
+	if f.MinUsers != -1 && len(channel.Members) <= f.MinUsers {
+		return false
+	}
+	if f.MaxUsers != -1 && len(channel.Members) >= f.MaxUsers {
+		return false
+	}
+
+	if f.TopicNewerThan != -1 || f.TopicOlderThan != -1 {
+		// A channel with no topic never matches a topic condition.
+		if len(channel.Topic) == 0 {
+			return false
+		}
+
+		topicAge := now.Sub(time.Unix(channel.TopicTS, 0))
+
+		if f.TopicNewerThan != -1 &&
+			topicAge >= time.Duration(f.TopicNewerThan)*time.Minute {
+			return false
+		}
+		if f.TopicOlderThan != -1 &&
+			topicAge <= time.Duration(f.TopicOlderThan)*time.Minute {
+			return false
+		}
+	}
+
+	return true
+}
+
+// LIST shows channels and their topics.
+// Parameters: [<filter>]
+//
+// Secret channels (+s) show only to their members and to operators.
+func (u *LocalUser) listCommand(m irc.Message) {
+	filter := newListFilter()
+	if len(m.Params) > 0 {
+		var ok bool
+		filter, ok = parseListFilter(m.Params[0])
+		if !ok {
+			// There's no error numeric for this. An invalid filter matches nothing.
+			// 323 RPL_LISTEND
+			u.messageFromServer("323", []string{"End of /LIST"})
+			return
+		}
+	}
+
+	// 321 RPL_LISTSTART
+	u.messageFromServer("321", []string{"Channel", "Users  Name"})
+
+	var channels []*Channel
+	now := time.Now()
+	for _, channel := range u.Catbox.Channels {
+		if channel.hasMode('s') && !u.User.onChannel(channel) &&
+			!u.hasPrivilege(PrivOperspy) {
+			continue
+		}
+
+		if !filter.matches(channel, now) {
+			continue
+		}
+
+		channels = append(channels, channel)
+	}
+
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+
+	for _, channel := range channels {
+		// 322 RPL_LIST
+		u.messageFromServer("322", []string{
+			channel.Name,
+			strconv.Itoa(len(channel.Members)),
+			channel.Topic,
+		})
+	}
+
+	// 323 RPL_LISTEND
+	u.messageFromServer("323", []string{"End of /LIST"})
+}
@@ -0,0 +1,64 @@
+package terrarium
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListFilter(t *testing.T) {
+	now := time.Now()
+
+	channel := &Channel{
+		Name: "#i2p-dev",
+		Members: map[TS6UID]struct{}{
+			"000AAAAAA": {},
+			"000AAAAAB": {},
+			"000AAAAAC": {},
+		},
+		Topic:   "hi",
+		TopicTS: now.Add(-30 * time.Minute).Unix(),
+	}
+
+	tests := []struct {
+		input  string
+		valid  bool
+		output bool
+	}{
+		{"", true, true},
+		{"#i2p*", true, true},
+		{"#I2P*", true, true},
+		{"#tor*", true, false},
+		{"#tor*,#i2p*", true, true},
+		{"!#i2p*", true, false},
+		{"!#tor*", true, true},
+		{">2", true, true},
+		{">3", true, false},
+		{"<4", true, true},
+		{"<3", true, false},
+		{"T<60", true, true},
+		{"T<10", true, false},
+		{"T>10", true, true},
+		{"T>60", true, false},
+		{"#i2p*,>1,<10,T>10", true, true},
+		{">abc", false, false},
+		{"T<", true, false},
+	}
+
+	for _, test := range tests {
+		filter, ok := parseListFilter(test.input)
+		if ok != test.valid {
+			t.Errorf("parseListFilter(%s) valid = %v, wanted %v", test.input, ok,
+				test.valid)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		output := filter.matches(channel, now)
+		if output != test.output {
+			t.Errorf("parseListFilter(%s).matches() = %v, wanted %v", test.input,
+				output, test.output)
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package terrarium
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/horgh/irc"
@@ -41,6 +44,26 @@ type LocalClient struct { // nolint: maligned
 	// If we hit a defined threshold, kill the connection.
 	PreRegisterMessageCount int
 
+	// IRCv3 capabilities the client negotiated. These carry over when the
+	// client registers as a user.
+	Caps map[string]struct{}
+
+	// Whether the client started CAP negotiation before registering. If so, we
+	// don't complete registration until it sends CAP END.
+	CapNegotiating bool
+
+	// The CAP version the client told us it speaks in CAP LS. 0 if it did not
+	// say.
+	CapVersion int
+
+	// Whether the client has server-time. The writer goroutine reads this, so
+	// access it atomically.
+	ServerTime int32
+
+	// The SHA-256 fingerprint of the client's TLS certificate as lowercase hex.
+	// Blank if they are not using TLS or did not present a certificate.
+	CertFP string
+
 	// Info client may send us before we complete its registration and promote it
 	// to a user or server.
 
@@ -53,6 +76,22 @@ type LocalClient struct { // nolint: maligned
 	PreRegUser     string
 	PreRegRealName string
 
+	// The account the client authenticated to with SASL.
+	PreRegAccount string
+
+	// SASL authentication in progress. The mechanism the client chose and the
+	// payload it has sent so far.
+	SASLMechanism string
+	SASLBuffer    string
+
+	// Whether we are checking a password for them outside the server
+	// goroutine. They get one check at a time.
+	PasswordCheckPending bool
+
+	// Messages they sent before registering while we checked a password. We
+	// handle them once we have the result. See passwordChecked().
+	HeldMessages []irc.Message
+
 	// Server info
 
 	// PASS arguments.
@@ -79,12 +118,26 @@ type LocalClient struct { // nolint: maligned
 
 // MaxAllowedPreRegisterMessageCount defines how many messages a client may send
 // us before registration before we consider them abusive and cut them off.
-const MaxAllowedPreRegisterMessageCount = 10
+//
+// CAP negotiation and SASL authentication take several messages, so this is
+// not as tight as it could be otherwise.
+const MaxAllowedPreRegisterMessageCount = 20
+
+// MaxHeldServerMessages defines how many messages we hold from a server while
+// we check its link password. A server sends its whole burst right after
+// SERVER without waiting for us, so this is as large as our send queue.
+const MaxHeldServerMessages = 32768
 
 // NewLocalClient creates a LocalClient
-func NewLocalClient(cb *Catbox, id uint64, conn net.Conn) *LocalClient {
+func NewLocalClient(cb *Catbox, id uint64, conn net.Conn) (*LocalClient,
+	error) {
+	c, err := NewConn(conn, cb.Config.DeadTime)
+	if err != nil {
+		return nil, err
+	}
+
 	return &LocalClient{
-		Conn: NewConn(conn, cb.Config.DeadTime),
+		Conn: c,
 		ID:   id,
 
 		// Buffered channel. We don't want to block sending to the client from the
@@ -95,13 +148,28 @@ func NewLocalClient(cb *Catbox, id uint64, conn net.Conn) *LocalClient {
 		ConnectionStartTime: time.Now(),
 		Catbox:              cb,
 		PreRegCapabs:        make(map[string]struct{}),
-	}
+		Caps:                make(map[string]struct{}),
+	}, nil
 }
 
 func (c *LocalClient) String() string {
 	return fmt.Sprintf("%d %s", c.ID, c.Conn.RemoteAddr())
 }
 
+// Determine if the client is connected over I2P.
+func (c *LocalClient) isI2P() bool {
+	return c.Conn.I2PDest != ""
+}
+
+// address is where the client is connecting from: Their IP, or their I2P
+// address if they are connected over I2P.
+func (c *LocalClient) address() string {
+	if c.isI2P() {
+		return c.Conn.I2PDest
+	}
+	return c.Conn.IP.String()
+}
+
 // Determine if the client is using a TLS connection or not.
 func (c *LocalClient) isTLS() bool {
 	_, ok := c.Conn.conn.(*tls.Conn)
@@ -109,28 +177,36 @@ func (c *LocalClient) isTLS() bool {
 }
 
 // If the client is using a TLS connection, then this function gets its TLS
-// version and ciphersuite as human readable strings.
+// version and ciphersuite as human readable strings. It also gets the SHA-256
+// fingerprint of the client's certificate as lowercase hex. This is blank if
+// the client did not present a certificate.
 //
 // We run the client/server handshake if it has not been run yet.
-func (c *LocalClient) getTLSState() (string, string, error) {
+func (c *LocalClient) getTLSState() (string, string, string, error) {
 	tlsConn, ok := c.Conn.conn.(*tls.Conn)
 	if !ok {
-		return "", "", fmt.Errorf("client is not connected with TLS")
+		return "", "", "", fmt.Errorf("client is not connected with TLS")
 	}
 
 	// Handshake() will read. If we don't have a timeout, we can get stuck here.
 	if err := c.Conn.conn.SetDeadline(time.Now().Add(c.Conn.ioWait)); err != nil {
-		return "", "", fmt.Errorf("error setting deadline: %s", err)
+		return "", "", "", fmt.Errorf("error setting deadline: %s", err)
 	}
 
 	if err := tlsConn.Handshake(); err != nil {
-		return "", "", fmt.Errorf("TLS handshake failed: %s", err)
+		return "", "", "", fmt.Errorf("TLS handshake failed: %s", err)
 	}
 
 	state := tlsConn.ConnectionState()
 
+	certFP := ""
+	if len(state.PeerCertificates) > 0 {
+		sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+		certFP = hex.EncodeToString(sum[:])
+	}
+
 	return tlsVersionToString(state.Version),
-		cipherSuiteToString(state.CipherSuite), nil
+		cipherSuiteToString(state.CipherSuite), certFP, nil
 }
 
 // Send a message to the client. We send it to its write channel, which in turn
@@ -166,10 +242,10 @@ func (c *LocalClient) readLoop() {
 
 		buf, err := c.Conn.Read()
 		if err != nil {
-			log.Printf("Client %s: Read problem: %s", c, err)
+			c.Catbox.logf(LogInfo, LogClient, "Client %s: Read problem: %s", c, err)
 			// Debug concerns with missing quit messages.
 			if buf != "" {
-				c.Catbox.noticeOpers(fmt.Sprintf("Read error but have [%s]",
+				c.Catbox.noticeOpers(SnomaskDebug, fmt.Sprintf("Read error but have [%s]",
 					strings.TrimSpace(buf)))
 			}
 			c.Catbox.newEvent(Event{Type: DeadClientEvent, Client: c, Error: err})
@@ -178,8 +254,8 @@ func (c *LocalClient) readLoop() {
 
 		message, err := irc.ParseMessage(buf)
 		if err != nil {
-			c.Catbox.noticeOpers(fmt.Sprintf("Invalid message from client %s: %s", c,
-				err))
+			c.Catbox.noticeOpers(SnomaskDebug, fmt.Sprintf(
+				"Invalid message from client %s: %s", c, err))
 
 			if err != irc.ErrTruncated {
 				// Should we reply to the client? This silently ignores malformed
@@ -195,7 +271,7 @@ func (c *LocalClient) readLoop() {
 		})
 	}
 
-	log.Printf("Client %s: Reader shutting down.", c)
+	c.Catbox.logf(LogDebug, LogClient, "Client %s: Reader shutting down.", c)
 }
 
 // writeLoop endlessly reads from the client's channel, encodes each message,
@@ -232,15 +308,20 @@ Loop:
 
 			buf, err := message.Encode()
 			if err != nil {
-				c.Catbox.noticeOpers(fmt.Sprintf(
+				c.Catbox.noticeOpers(SnomaskDebug, fmt.Sprintf(
 					"Trying to send invalid message to client %s: %s", c, err))
 				if err != irc.ErrTruncated {
 					continue
 				}
 			}
 
+			if atomic.LoadInt32(&c.ServerTime) == 1 {
+				buf = serverTimeTag(time.Now()) + buf
+			}
+
 			if err := c.Conn.Write(buf); err != nil {
-				log.Printf("Client %s: Write problem: %s: %s", c, buf, err)
+				c.Catbox.logf(LogInfo, LogClient, "Client %s: Write problem: %s: %s", c,
+					buf, err)
 				// Don't kill the client immediately. Give a chance for us to read
 				// anything from it.
 				time.Sleep(5 * time.Second)
@@ -253,10 +334,11 @@ Loop:
 	}
 
 	if err := c.Conn.Close(); err != nil {
-		log.Printf("Client %s: Problem closing connection: %s", c, err)
+		c.Catbox.logf(LogWarn, LogClient, "Client %s: Problem closing connection: %s",
+			c, err)
 	}
 
-	log.Printf("Client %s: Writer shutting down.", c)
+	c.Catbox.logf(LogDebug, LogClient, "Client %s: Writer shutting down.", c)
 }
 
 // quit means the client is quitting. Tell it why and clean up.
@@ -272,6 +354,8 @@ func (c *LocalClient) quit(msg string) {
 	close(c.WriteChan)
 
 	delete(c.Catbox.LocalClients, c.ID)
+
+	c.Catbox.Metrics.RegistrationFailures++
 }
 
 // Upgrade a LocalClient to a LocalUser.
@@ -296,9 +380,14 @@ func (c *LocalClient) registerUser() {
 	// sure it does not start with ":" as that cannot be encoded. Consider IPv6
 	// IPs such as "::1". TS6 specifies that with these we prepend a "0". e.g.,
 	// "0::1".
-	ip := c.Conn.IP.String()
-	if ip[0] == ':' {
-		ip = "0" + ip
+	//
+	// Users connected over I2P have no IP. They get "0" like a spoof.
+	ip := "0"
+	if !c.isI2P() {
+		ip = c.Conn.IP.String()
+		if ip[0] == ':' {
+			ip = "0" + ip
+		}
 	}
 
 	hostname := ip
@@ -317,6 +406,7 @@ func (c *LocalClient) registerUser() {
 		RealName:    c.PreRegRealName,
 		Channels:    make(map[string]*Channel),
 		LocalUser:   lu,
+		Account:     c.PreRegAccount,
 	}
 
 	lu.User = u
@@ -353,12 +443,26 @@ func (c *LocalClient) registerUser() {
 
 		c.quit(fmt.Sprintf("Connection closed: %s", kline.Reason))
 
-		c.Catbox.noticeLocalOpers(fmt.Sprintf(
+		c.Catbox.noticeLocalOpers(SnomaskKLines, fmt.Sprintf(
 			"Rejecting user registration for %s!%s@%s. KLined: %s",
 			u.DisplayNick, u.Username, u.Hostname, kline.Reason))
 		return
 	}
 
+	// Check if their I2P destination is banned. Users not connected over I2P
+	// have no destination.
+	if ban := c.Catbox.getDestBan(c.Conn.I2PDest); ban != nil && c.isI2P() {
+		// 465 ERR_YOUREBANNEDCREEP
+		lu.messageFromServer("465", []string{"You are banned from this server"})
+
+		c.quit(fmt.Sprintf("Connection closed: %s", ban.Reason))
+
+		c.Catbox.noticeLocalOpers(SnomaskKLines, fmt.Sprintf(
+			"Rejecting user registration for %s!%s@%s (%s). Destination banned: %s",
+			u.DisplayNick, u.Username, u.Hostname, c.Conn.I2PDest, ban.Reason))
+		return
+	}
+
 	uid, err := lu.makeTS6UID(lu.ID)
 	if err != nil {
 		log.Fatal(err)
@@ -395,13 +499,16 @@ func (c *LocalClient) registerUser() {
 		lu.Catbox.Config.ServerName,
 		lu.Catbox.version(),
 		// User modes we support.
-		"ioC",
+		"ioCs",
 		// Channel modes we support.
-		"nos",
+		"Ibceiklmnostv",
 	})
 
+	lu.sendISupport()
+
 	c.Catbox.updateCounters()
 	c.Catbox.ConnectionCount++
+	c.Catbox.Metrics.countTLSVersion(c)
 
 	lu.lusersCommand()
 	lu.motdCommand()
@@ -442,23 +549,24 @@ func (c *LocalClient) registerUser() {
 			Command: "CLICONN",
 			Params:  []string{c.Catbox.Config.ServerName, u.IP},
 		})
+
+		// If they logged in with SASL, tell servers their account.
+		if len(u.Account) > 0 {
+			server.maybeQueueMessage(suMessage(c.Catbox.Config.TS6SID, u))
+		}
 	}
 
 	// Tell local operators.
 	// Remote operators can know as their server will receive a UID command, so
 	// their server can tell them upon receipt of that.
-	for _, oper := range c.Catbox.Opers {
-		if !oper.isLocal() {
-			continue
-		}
-		_, exists := oper.Modes['C']
-		if !exists {
-			continue
-		}
-		oper.LocalUser.serverNotice(fmt.Sprintf("CLICONN %s %s %s %s %s (%s)",
-			u.DisplayNick, u.Username, u.Hostname, u.IP, u.RealName,
-			c.Catbox.Config.ServerName))
-	}
+	//
+	// Local operators see the real I2P address of users connected over I2P.
+	c.Catbox.sendSnomaskNotice(SnomaskConnects,
+		fmt.Sprintf("CLICONN %s %s %s %s %s (%s)", u.DisplayNick, u.Username,
+			u.Hostname, c.address(), u.RealName, c.Catbox.Config.ServerName))
+
+	// If they're on a registered nick, they must identify.
+	lu.checkNickProtection()
 }
 
 // Send an IRC message to a client. Appears to be from the server.
@@ -520,7 +628,7 @@ func (c *LocalClient) registerServer() {
 
 	linkNotice := ""
 	if c.isTLS() {
-		tlsVersion, tlsCipherSuite, err := c.getTLSState()
+		tlsVersion, tlsCipherSuite, _, err := c.getTLSState()
 		if err != nil {
 			c.quit(fmt.Sprintf("Unable to determine TLS information: %s", err))
 			return
@@ -534,8 +642,9 @@ func (c *LocalClient) registerServer() {
 	}
 
 	c.Catbox.ConnectionCount++
+	c.Catbox.Metrics.countTLSVersion(c)
 
-	newLS.Catbox.noticeOpers(linkNotice)
+	newLS.Catbox.noticeOpers(SnomaskLinks, linkNotice)
 
 	newLS.sendBurst()
 
@@ -593,7 +702,11 @@ func (c *LocalClient) sendServerIntro(pass string) {
 		// http://www.leeh.co.uk/ircd/encap.txt
 		// TB means support for topic burst. We send/receive TB commands during
 		// burst which tells the topics in channels.
-		Params: []string{"QS ENCAP TB"},
+		// EX and IE mean support for ban exceptions (+e) and invite exceptions
+		// (+I). We send/receive them in BMASK commands during burst.
+		// SAVE means support for the SAVE command. We use it to change the nick
+		// of a user to their UID rather than killing them.
+		Params: []string{"QS ENCAP EX IE TB SAVE"},
 	})
 
 	// SERVER <name> <hopcount> <description>
@@ -610,6 +723,21 @@ func (c *LocalClient) sendServerIntro(pass string) {
 
 // The client sent us a message. Deal with it.
 func (c *LocalClient) handleMessage(m irc.Message) {
+	// What they send next may depend on the password we're checking. For
+	// example, a server sends SVINFO right after SERVER. Wait for the result.
+	if c.PasswordCheckPending {
+		maxHeld := MaxAllowedPreRegisterMessageCount
+		if c.GotSERVER {
+			maxHeld = MaxHeldServerMessages
+		}
+		if len(c.HeldMessages) >= maxHeld {
+			c.quit("Too many messages")
+			return
+		}
+		c.HeldMessages = append(c.HeldMessages, m)
+		return
+	}
+
 	// Clients SHOULD NOT (section 2.3) send a prefix.
 	if m.Prefix != "" {
 		c.quit("No prefix permitted")
@@ -624,9 +752,19 @@ func (c *LocalClient) handleMessage(m irc.Message) {
 		return
 	}
 
-	// Non-RFC command that appears to be widely supported. Just ignore it for
-	// now.
+	// IRCv3 capability negotiation.
 	if m.Command == "CAP" {
+		nick := "*"
+		if len(c.PreRegDisplayNick) > 0 {
+			nick = c.PreRegDisplayNick
+		}
+		c.capCommand(m, nick)
+		return
+	}
+
+	// SASL authentication.
+	if m.Command == "AUTHENTICATE" {
+		c.authenticateCommand(m)
 		return
 	}
 
@@ -740,6 +878,12 @@ func (c *LocalClient) nickCommand(m irc.Message) {
 		return
 	}
 
+	if c.Catbox.isServiceNick(nick) {
+		// 432 ERR_ERRONEUSNICKNAME
+		c.messageFromServer("432", []string{nick, "Erroneous nickname"})
+		return
+	}
+
 	nickCanon := canonicalizeNick(nick)
 
 	// Nick must be unique.
@@ -758,8 +902,9 @@ func (c *LocalClient) nickCommand(m irc.Message) {
 	// We don't reply during registration (we don't have enough info, no uhost
 	// anyway).
 
-	// If we have USER done already, then we're done registration.
-	if len(c.PreRegUser) > 0 {
+	// If we have USER done already, then we're done registration. Unless they
+	// are negotiating capabilities. Then we wait for CAP END.
+	if len(c.PreRegUser) > 0 && !c.CapNegotiating {
 		c.registerUser()
 	}
 }
@@ -805,8 +950,9 @@ func (c *LocalClient) userCommand(m irc.Message) {
 	}
 	c.PreRegRealName = realName
 
-	// If we have a nick, then we're done registration.
-	if len(c.PreRegDisplayNick) > 0 {
+	// If we have a nick, then we're done registration. Unless they are
+	// negotiating capabilities. Then we wait for CAP END.
+	if len(c.PreRegDisplayNick) > 0 && !c.CapNegotiating {
 		c.registerUser()
 	}
 }
@@ -935,9 +1081,8 @@ func (c *LocalClient) serverCommand(m irc.Message) {
 		return
 	}
 
-	// At this point we should have a password from the PASS command. Check it.
-	if linkInfo.Pass != c.PreRegPass {
-		c.quit("Bad password")
+	if linkInfo.CertFP != "" && linkInfo.CertFP != c.CertFP {
+		c.quit("Bad certificate")
 		return
 	}
 
@@ -953,11 +1098,47 @@ func (c *LocalClient) serverCommand(m irc.Message) {
 		return
 	}
 
-	c.PreRegServerName = serverName
-	c.PreRegServerDesc = m.Params[2]
+	// At this point we should have a password from the PASS command. Check it.
+	// It may be a bcrypt hash, so check outside the server goroutine.
+	acceptPass := linkInfo.AcceptPass
+	password := c.PreRegPass
+	description := m.Params[2]
 
 	c.GotSERVER = true
 
+	started := c.checkPasswordAsync(
+		func() bool { return checkPassword(acceptPass, password) },
+		func(ok bool) {
+			if !ok {
+				c.quit("Bad password")
+				return
+			}
+			c.serverPasswordChecked(serverName, description)
+		},
+	)
+	if !started {
+		c.quit("Already checking a password")
+	}
+}
+
+// serverPasswordChecked finishes SERVER once we accepted the server's
+// password.
+func (c *LocalClient) serverPasswordChecked(serverName, description string) {
+	// Things may have changed while we checked.
+	linkInfo, exists := c.Catbox.Config.Servers[serverName]
+	if !exists {
+		c.quit("I don't know you")
+		return
+	}
+
+	if c.Catbox.isLinkedToServer(serverName) {
+		c.quit("I'm already linked to you!")
+		return
+	}
+
+	c.PreRegServerName = serverName
+	c.PreRegServerDesc = description
+
 	// Reply. Our reply differs depending on whether we initiated the link.
 
 	// If they initiated the link, then we reply with PASS/CAPAB/SERVER.
@@ -965,7 +1146,7 @@ func (c *LocalClient) serverCommand(m irc.Message) {
 	// instead.
 
 	if !c.SentSERVER {
-		c.sendServerIntro(linkInfo.Pass)
+		c.sendServerIntro(linkInfo.SendPass)
 
 		return
 	}
@@ -2,7 +2,6 @@ package terrarium
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 	"time"
@@ -91,7 +90,7 @@ func (s *LocalServer) quit(msg string) {
 		})
 	}
 
-	s.Catbox.noticeLocalOpers(fmt.Sprintf("Server %s delinked: %s",
+	s.Catbox.noticeLocalOpers(SnomaskLinks, fmt.Sprintf("Server %s delinked: %s",
 		s.Server.Name, msg))
 }
 
@@ -137,7 +136,7 @@ func (s *LocalServer) serverSplitCleanUp(lostServer *Server) {
 			continue
 		}
 
-		log.Printf("Losing user %s", user)
+		s.Catbox.logf(LogDebug, LogClient, "Losing user %s", user)
 
 		// This user is gone.
 
@@ -160,7 +159,7 @@ func (s *LocalServer) serverSplitCleanUp(lostServer *Server) {
 
 	// Forget all lost servers.
 	for _, server := range lostServers {
-		log.Printf("Losing server %s", server)
+		s.Catbox.logNotice(LogInfo, LogLink, "Losing server %s", server)
 		if server.isLocal() {
 			delete(s.Catbox.LocalServers, server.LocalServer.ID)
 		}
@@ -255,6 +254,11 @@ func (s *LocalServer) sendBurst() {
 			},
 		})
 
+		// Send their account if they are logged in to one.
+		if len(user.Account) > 0 {
+			s.maybeQueueMessage(suMessage(onServer, user))
+		}
+
 		// Send AWAY if they are away.
 		if len(user.AwayMessage) == 0 {
 			continue
@@ -276,18 +280,22 @@ func (s *LocalServer) sendBurst() {
 
 		// First make a message with what is common to all messages so that we can
 		// determine the base length.
+		modeStr, modeParams := channel.modesString()
+		sjoinParams := []string{
+			fmt.Sprintf("%d", channel.TS),
+			channel.Name,
+			modeStr,
+		}
+		sjoinParams = append(sjoinParams, modeParams...)
+		// UIDs go in the last parameter. As it is blank, encoding will turn it
+		// into " :" for us. This is acceptable.
+		sjoinParams = append(sjoinParams, "")
+		uidsIndex := len(sjoinParams) - 1
+
 		sjoinMessage := irc.Message{
 			Prefix:  string(s.Catbox.Config.TS6SID),
 			Command: "SJOIN",
-			Params: []string{
-				fmt.Sprintf("%d", channel.TS),
-				channel.Name,
-				// Currently we only support +ns.
-				"+ns",
-				// UIDs go in the last parameter. As it is blank, encoding will turn it
-				// into " :" for us. This is acceptable.
-				"",
-			},
+			Params:  sjoinParams,
 		}
 
 		// If encoding the prefix truncates then we have a big problem. We won't be
@@ -308,9 +316,7 @@ func (s *LocalServer) sendBurst() {
 			uidStr := string(uid)
 
 			// Send with ops and/or voice prefix.
-			if channel.userHasOps(member) {
-				uidStr = "@" + uidStr
-			}
+			uidStr = channel.memberPrefix(member, true) + uidStr
 
 			// Assume the first may fit.
 			if len(uids) == 0 {
@@ -322,7 +328,7 @@ func (s *LocalServer) sendBurst() {
 			// start a new list.
 			// +1 to account for a space.
 			if baseSize+len(uids)+1+len(uidStr) > irc.MaxLineLength {
-				sjoinMessage.Params[3] = uids
+				sjoinMessage.Params[uidsIndex] = uids
 				s.maybeQueueMessage(sjoinMessage)
 				uids = "" + uidStr
 				continue
@@ -333,23 +339,73 @@ func (s *LocalServer) sendBurst() {
 		}
 
 		if len(uids) > 0 {
-			sjoinMessage.Params[3] = uids
+			sjoinMessage.Params[uidsIndex] = uids
 			s.maybeQueueMessage(sjoinMessage)
 		}
 
-		// If they support the TB capab then send them TB commands. This tells them
-		// the topic for each channel.
-		if s.Server.hasCapability("TB") && len(channel.Topic) > 0 {
-			s.maybeQueueMessage(irc.Message{
-				Prefix:  string(s.Catbox.Config.TS6SID),
-				Command: "TB",
-				Params: []string{
-					channel.Name,
-					fmt.Sprintf("%d", channel.TopicTS),
-					channel.TopicSetter,
-					channel.Topic,
-				},
-			})
+		s.sendChannelState(channel)
+	}
+
+	// Tell it about our K-Lines so it enforces the network's bans. These go in
+	// ENCAP KLINE, same as when an oper sets one.
+	now := time.Now()
+	for _, kline := range s.Catbox.KLines {
+		if kline.isExpired(now) {
+			continue
+		}
+		s.maybeQueueMessage(kline.encapMessage(string(s.Catbox.Config.TS6SID),
+			now))
+		s.maybeQueueMessage(kline.infoMessage(string(s.Catbox.Config.TS6SID)))
+	}
+
+	// Likewise for destination bans.
+	for _, ban := range s.Catbox.DestBans {
+		if ban.isExpired(now) {
+			continue
+		}
+		s.maybeQueueMessage(ban.encapMessage(string(s.Catbox.Config.TS6SID),
+			now))
+		s.maybeQueueMessage(ban.infoMessage(string(s.Catbox.Config.TS6SID)))
+	}
+
+	// Tell it about our accounts if NickServ manages them.
+	if s.Catbox.nickServEnabled() {
+		for _, msg := range s.Catbox.nickServBurst() {
+			s.maybeQueueMessage(msg)
+		}
+	}
+}
+
+// sendChannelState tells the server a channel's topic and lists. We send this
+// after SJOIN.
+func (s *LocalServer) sendChannelState(channel *Channel) {
+	// If they support the TB capab then send them TB commands. This tells them
+	// the topic for each channel.
+	if s.Server.hasCapability("TB") && len(channel.Topic) > 0 {
+		s.maybeQueueMessage(irc.Message{
+			Prefix:  string(s.Catbox.Config.TS6SID),
+			Command: "TB",
+			Params: []string{
+				channel.Name,
+				fmt.Sprintf("%d", channel.TopicTS),
+				channel.TopicSetter,
+				channel.Topic,
+			},
+		})
+	}
+
+	// Send the channel's lists. We can only send exceptions and invite
+	// exceptions if they support them.
+	for _, mode := range []byte(channelListModes) {
+		if mode == 'e' && !s.Server.hasCapability("EX") {
+			continue
+		}
+		if mode == 'I' && !s.Server.hasCapability("IE") {
+			continue
+		}
+
+		for _, msg := range channel.bmaskMessages(s.Catbox.Config.TS6SID, mode) {
+			s.maybeQueueMessage(msg)
 		}
 	}
 }
@@ -449,6 +505,11 @@ func (s *LocalServer) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "KICK" {
+		s.kickCommand(m)
+		return
+	}
+
 	// ircd-ratbox sends OPERWALL between servers, like WALLOPS
 	if m.Command == "WALLOPS" || m.Command == "OPERWALL" {
 		s.wallopsCommand(m)
@@ -515,6 +576,16 @@ func (s *LocalServer) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "BMASK" {
+		s.bmaskCommand(m)
+		return
+	}
+
+	if m.Command == "SAVE" {
+		s.saveCommand(m)
+		return
+	}
+
 	// 421 ERR_UNKNOWNCOMMAND
 	s.messageFromServer("421", []string{m.Command, "Unknown command"})
 }
@@ -573,7 +644,8 @@ func (s *LocalServer) pingCommand(m irc.Message) {
 			s.GotPING = true
 			if s.GotPONG {
 				s.Bursting = false
-				s.Catbox.noticeOpers(fmt.Sprintf("Burst with %s over.", s.Server.Name))
+				s.Catbox.noticeOpers(SnomaskLinks, fmt.Sprintf("Burst with %s over.",
+					s.Server.Name))
 			}
 		}
 		return
@@ -628,7 +700,8 @@ func (s *LocalServer) pongCommand(m irc.Message) {
 		s.GotPONG = true
 
 		if s.Bursting && s.GotPING {
-			s.Catbox.noticeOpers(fmt.Sprintf("Burst with %s over.", s.Server.Name))
+			s.Catbox.noticeOpers(SnomaskLinks, fmt.Sprintf("Burst with %s over.",
+				s.Server.Name))
 			s.Bursting = false
 		}
 		return
@@ -700,8 +773,10 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 		return
 	}
 
-	if !isValidNick(s.Catbox.Config.MaxNickLength, m.Params[0]) {
-		log.Printf("Invalid nick (%s)", m.Params[0])
+	// A user whose nick was changed to their UID (SAVE) has that as their nick.
+	if m.Params[0] != m.Params[7] &&
+		!isValidNick(s.Catbox.Config.MaxNickLength, m.Params[0]) {
+		s.Catbox.logf(LogWarn, LogLink, "Invalid nick (%s)", m.Params[0])
 		s.quit(fmt.Sprintf("Invalid NICK! (%s)", m.Params[0]))
 		return
 	}
@@ -798,17 +873,9 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 
 	// Tell local operators.
 	if !s.Bursting {
-		for _, oper := range s.Catbox.Opers {
-			if !oper.isLocal() {
-				continue
-			}
-			_, exists := oper.Modes['C']
-			if !exists {
-				continue
-			}
-			oper.LocalUser.serverNotice(fmt.Sprintf("CLICONN %s %s %s %s %s (%s)",
-				u.DisplayNick, u.Username, u.Hostname, u.IP, u.RealName, u.Server.Name))
-		}
+		s.Catbox.sendSnomaskNotice(SnomaskConnects,
+			fmt.Sprintf("CLICONN %s %s %s %s %s (%s)", u.DisplayNick, u.Username,
+				u.Hostname, u.IP, u.RealName, u.Server.Name))
 	}
 
 	s.Catbox.updateCounters()
@@ -884,7 +951,8 @@ func (s *LocalServer) privmsgCommand(m irc.Message) {
 
 	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[0])]
 	if !exists {
-		log.Printf("PRIVMSG to unknown target %s", m.Params[0])
+		s.Catbox.logf(LogDebug, LogGeneral, "PRIVMSG to unknown target %s",
+			m.Params[0])
 		return
 	}
 
@@ -992,8 +1060,8 @@ func (s *LocalServer) sidCommand(m irc.Message) {
 	// We don't need to tell the new server about the servers we are connected to.
 	// They'll be informed by the server they linked to about us.
 
-	s.Catbox.noticeLocalOpers(fmt.Sprintf("%s is introducing server %s",
-		s.Server.Name, newServer.Name))
+	s.Catbox.noticeLocalOpers(SnomaskLinks, fmt.Sprintf(
+		"%s is introducing server %s", s.Server.Name, newServer.Name))
 }
 
 // SJOIN occurs in two contexts:
@@ -1031,15 +1099,13 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 		return
 	}
 
-	// Currently I ignore modes. All channels have the same mode, or we pretend so
-	// anyway.
-
 	channel, channelExists := s.Catbox.Channels[canonicalizeChannel(chanName)]
 	if !channelExists {
 		channel = &Channel{
 			Name:    canonicalizeChannel(chanName),
 			Members: make(map[TS6UID]struct{}),
 			Ops:     make(map[TS6UID]*User),
+			Voices:  make(map[TS6UID]*User),
 			Modes:   make(map[byte]struct{}),
 			TS:      channelTS,
 		}
@@ -1080,19 +1146,48 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 
 	modes := m.Params[2]
 
-	// Apply the simple (+ntski type) modes now.
+	// Mode parameters (such as the key) come after the modes and before the
+	// user list.
+	modeParams := m.Params[3 : len(m.Params)-1]
+
+	// Apply the modes now. These are the simple (+ntsi type) modes as well as
+	// +k and +l.
 	if acceptModes {
 		modeStr := ""
+		var appliedParams []string
 		for _, mode := range modes {
-			if mode != 'n' && mode != 's' {
+			if mode == 'k' || mode == 'l' {
+				if len(modeParams) == 0 {
+					continue
+				}
+				param := modeParams[0]
+				modeParams = modeParams[1:]
+
+				if mode == 'k' {
+					if channel.Key == param {
+						continue
+					}
+					channel.Key = param
+				} else {
+					limit, err := strconv.Atoi(param)
+					if err != nil || limit <= 0 || channel.Limit == limit {
+						continue
+					}
+					channel.Limit = limit
+				}
+
+				modeStr += string(mode)
+				appliedParams = append(appliedParams, param)
 				continue
 			}
 
-			if _, ok := channel.Modes[byte(mode)]; ok {
+			if !strings.ContainsRune(channelSimpleModes, mode) {
 				continue
 			}
 
-			channel.Modes[byte(mode)] = struct{}{}
+			if !channel.setMode(byte(mode), true) {
+				continue
+			}
 			modeStr += string(mode)
 		}
 
@@ -1100,7 +1195,8 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 			s.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
 				Prefix:  sourceServer.Name,
 				Command: "MODE",
-				Params:  []string{channel.Name, "+" + modeStr},
+				Params: append([]string{channel.Name, "+" + modeStr},
+					appliedParams...),
 			})
 		}
 	}
@@ -1114,18 +1210,12 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 	for _, uidRaw := range uidsRaw {
 		// May have op/voice prefix.
 		opped := false
-		//voiced := false
+		voiced := false
 
 		if acceptModes {
-			if uidRaw[0] == '@' {
-				opped = true
-				//if uidRaw[1] == '+' {
-				//	voiced = true
-				//}
-			}
-			//if uidRaw[0] == '+' {
-			//	voiced = true
-			//}
+			prefix := uidRaw[:len(uidRaw)-len(strings.TrimLeft(uidRaw, "@+"))]
+			opped = strings.Contains(prefix, "@")
+			voiced = strings.Contains(prefix, "+")
 		}
 
 		// Done with prefix.
@@ -1135,7 +1225,8 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 		if !exists {
 			// We may not know the user in case of nick collision where we killed.
 			// them and forgot them. Allow this.
-			log.Printf("SJOIN for unknown user %s, ignoring", uidRaw)
+			s.Catbox.logf(LogWarn, LogLink, "SJOIN for unknown user %s, ignoring",
+				uidRaw)
 			if !channelExists {
 				delete(s.Catbox.Channels, channel.Name)
 			}
@@ -1151,6 +1242,9 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 		if opped {
 			channel.grantOps(user)
 		}
+		if voiced {
+			channel.grantVoice(user)
+		}
 
 		// Tell our local users who are in the channel.
 		for memberUID := range channel.Members {
@@ -1172,6 +1266,13 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 					Params:  []string{channel.Name, "+o", user.DisplayNick},
 				})
 			}
+			if voiced {
+				member.LocalUser.maybeQueueMessage(irc.Message{
+					Prefix:  sourceServer.Name,
+					Command: "MODE",
+					Params:  []string{channel.Name, "+v", user.DisplayNick},
+				})
+			}
 		}
 	}
 
@@ -1268,6 +1369,7 @@ func (s *LocalServer) tbCommand(m irc.Message) {
 	channel.Topic = topic
 	channel.TopicSetter = setter
 	channel.TopicTS = topicTS
+	s.Catbox.rememberChannel(channel)
 
 	// Tell our local clients about the topic change.
 	for memberUID := range channel.Members {
@@ -1360,6 +1462,7 @@ func (s *LocalServer) joinCommand(m irc.Message) {
 			Name:    chanName,
 			Members: make(map[TS6UID]struct{}),
 			Ops:     make(map[TS6UID]*User),
+			Voices:  make(map[TS6UID]*User),
 			Modes:   make(map[byte]struct{}),
 			TS:      channelTS,
 		}
@@ -1469,6 +1572,8 @@ func (s *LocalServer) nickCommand(m irc.Message) {
 
 	// Update our records, their nick, and their nick TS.
 
+	s.Catbox.recordWhowas(user)
+
 	delete(s.Catbox.Nicks, canonicalizeNick(user.DisplayNick))
 	s.Catbox.Nicks[canonicalizeNick(nick)] = user.UID
 
@@ -1529,6 +1634,79 @@ func (s *LocalServer) partCommand(m irc.Message) {
 	}
 }
 
+// KICK removes a user from a channel. The target may be a local user.
+// Source: user or server
+// Parameters: <channel> <UID> [comment]
+func (s *LocalServer) kickCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"KICK", "Not enough parameters"})
+		return
+	}
+
+	origin := ""
+	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if exists {
+		origin = sourceUser.nickUhost()
+	}
+	if origin == "" {
+		sourceServer, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+		if exists {
+			origin = sourceServer.Name
+		}
+	}
+
+	if origin == "" {
+		s.quit("Unknown origin (KICK)")
+		return
+	}
+
+	// The user may have quit already, or been killed, if that crossed with the
+	// KICK. Not an error.
+	targetUser, exists := s.Catbox.Users[TS6UID(m.Params[1])]
+	if !exists {
+		s.Catbox.logf(LogWarn, LogLink, "KICK for unknown user %s, ignoring",
+			m.Params[1])
+		return
+	}
+
+	// The channel may be gone, or the user may have left it already, if their
+	// PART or QUIT crossed with the KICK. Not an error.
+	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[0])]
+	if !exists || !targetUser.onChannel(channel) {
+		s.Catbox.logf(LogWarn, LogLink,
+			"KICK for %s from %s but they are not on it, ignoring",
+			targetUser.DisplayNick, m.Params[0])
+		return
+	}
+
+	comment := targetUser.DisplayNick
+	if len(m.Params) >= 3 && len(m.Params[2]) > 0 {
+		comment = m.Params[2]
+	}
+
+	// Tell local members (including the target) before removing them.
+	s.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
+		Prefix:  origin,
+		Command: "KICK",
+		Params:  []string{channel.Name, targetUser.DisplayNick, comment},
+	})
+
+	channel.removeUser(targetUser)
+
+	if len(channel.Members) == 0 {
+		delete(s.Catbox.Channels, channel.Name)
+	}
+
+	// Propagate to all other servers.
+	for _, server := range s.Catbox.LocalServers {
+		if server == s {
+			continue
+		}
+		server.maybeQueueMessage(m)
+	}
+}
+
 func (s *LocalServer) wallopsCommand(m irc.Message) {
 	// Params: <text to send>
 	if len(m.Params) < 1 {
@@ -1653,8 +1831,8 @@ func (s *LocalServer) modeCommand(m irc.Message) {
 				user.Modes[byte(c)] = struct{}{}
 				if c == 'o' {
 					s.Catbox.Opers[user.UID] = user
-					s.Catbox.noticeLocalOpers(fmt.Sprintf("%s@%s became an operator.",
-						user.DisplayNick, user.Server.Name))
+					s.Catbox.noticeLocalOpers(SnomaskGeneral, fmt.Sprintf(
+						"%s@%s became an operator.", user.DisplayNick, user.Server.Name))
 				}
 			} else {
 				_, exists := user.Modes[byte(c)]
@@ -1721,6 +1899,7 @@ func (s *LocalServer) topicCommand(m irc.Message) {
 	channel.Topic = topic
 	channel.TopicTS = time.Now().Unix()
 	channel.TopicSetter = sourceUser.nickUhost()
+	s.Catbox.rememberChannel(channel)
 
 	// Tell local clients who are in the channel about the topic change.
 
@@ -1826,7 +2005,7 @@ func (s *LocalServer) squitCommand(m irc.Message) {
 		server.maybeQueueMessage(m)
 	}
 
-	s.Catbox.noticeLocalOpers(fmt.Sprintf("%s delinked from %s: %s",
+	s.Catbox.noticeLocalOpers(SnomaskLinks, fmt.Sprintf("%s delinked from %s: %s",
 		targetServer.Name, targetServer.LinkedTo.Name, m.Params[1]))
 }
 
@@ -1866,16 +2045,16 @@ func (s *LocalServer) killCommand(m irc.Message) {
 	}
 
 	if len(source) == 0 {
-		s.Catbox.noticeOpers(fmt.Sprintf("Received KILL for %s from unknown source %s",
-			m.Params[0], m.Prefix))
+		s.Catbox.noticeOpers(SnomaskDebug, fmt.Sprintf(
+			"Received KILL for %s from unknown source %s", m.Params[0], m.Prefix))
 		return
 	}
 
 	// Find the targeted user.
 	targetUser, exists := s.Catbox.Users[TS6UID(m.Params[0])]
 	if !exists {
-		s.Catbox.noticeOpers(fmt.Sprintf("Received KILL for unknown user %s (from %s)",
-			m.Params[0], source))
+		s.Catbox.noticeOpers(SnomaskDebug, fmt.Sprintf(
+			"Received KILL for unknown user %s (from %s)", m.Params[0], source))
 		return
 	}
 
@@ -1901,7 +2080,7 @@ func (s *LocalServer) killCommand(m irc.Message) {
 	reason := sourceAndReason[lparen+1 : rparen]
 
 	// Tell our local opers about this.
-	s.Catbox.noticeLocalOpers(
+	s.Catbox.noticeLocalOpers(SnomaskGeneral,
 		fmt.Sprintf("Received KILL message for %s. From %s Path: %s (%s)",
 			targetUser.DisplayNick, source, sourceInfo, reason))
 
@@ -1911,7 +2090,7 @@ func (s *LocalServer) killCommand(m irc.Message) {
 
 	// If it's a local user, kick it off.
 	if targetUser.isLocal() {
-		s.Catbox.noticeOpers(fmt.Sprintf("Killing local user %s",
+		s.Catbox.noticeOpers(SnomaskGeneral, fmt.Sprintf("Killing local user %s",
 			targetUser.DisplayNick))
 		targetUser.LocalUser.quit(quitReason, false)
 	}
@@ -1977,6 +2156,13 @@ func (s *LocalServer) encapCommand(m irc.Message) {
 			Params:  subParams,
 		})
 	}
+	if subCommand == "KLINEINFO" {
+		s.klineInfoCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
 	if subCommand == "UNKLINE" {
 		s.unklineCommand(irc.Message{
 			Prefix:  m.Prefix,
@@ -1984,6 +2170,27 @@ func (s *LocalServer) encapCommand(m irc.Message) {
 			Params:  subParams,
 		})
 	}
+	if subCommand == "DESTBAN" {
+		s.destBanCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "DESTBANINFO" {
+		s.destBanInfoCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "UNDESTBAN" {
+		s.undestBanCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
 	if subCommand == "GCAP" {
 		s.gcapCommand(irc.Message{
 			Prefix:  m.Prefix,
@@ -1991,6 +2198,34 @@ func (s *LocalServer) encapCommand(m irc.Message) {
 			Params:  subParams,
 		})
 	}
+	if subCommand == "SU" {
+		s.suCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "NICKSERV" {
+		s.nickServEncapCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "SNOTE" {
+		s.snoteCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "DUMPSTATE" {
+		s.dumpStateCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		}, m.Params[0])
+	}
 
 	// Propagate everywhere.
 	for _, server := range s.Catbox.LocalServers {
@@ -2005,14 +2240,14 @@ func (s *LocalServer) encapCommand(m irc.Message) {
 //
 // Apply a ban on user@host.
 //
-// Currently this is persistent only for the runtime.
-//
 // Parameters: <duration> <user mask> <host mask> [<reason>]
 // Example (with ENCAP portion dropped):
 // :1SNAAAAAF KLINE 0 * 127.5.5.5 :bye bye
 //
-// At this time we treat all KLINEs as "permanent" for the duration of our run.
-// i.e., we ignore duration.
+// Duration is in seconds. 0 means the K-Line is permanent.
+//
+// We also receive these during burst. This is how a server linking in learns
+// about the network's K-Lines.
 func (s *LocalServer) klineCommand(m irc.Message) {
 	if len(m.Params) < 3 {
 		// 461 ERR_NEEDMOREPARAMS
@@ -2033,21 +2268,42 @@ func (s *LocalServer) klineCommand(m irc.Message) {
 		}
 	}
 	if source == "" {
-		log.Printf("Unknown source for KLINE command")
+		s.Catbox.logNotice(LogWarn, LogKLine, "Unknown source for KLINE command")
+		return
+	}
+
+	seconds, err := strconv.ParseInt(m.Params[0], 10, 64)
+	if err != nil || seconds < 0 {
+		s.Catbox.logNotice(LogWarn, LogKLine, "Invalid KLINE duration from %s: %s",
+			source, m.Params[0])
 		return
 	}
 
-	// I ignore duration at this time. It's permanent.
+	// We commonly hear about K-Lines we already have. For example, both sides
+	// send their K-Lines during burst.
+	if s.Catbox.hasKLine(m.Params[1], m.Params[2]) {
+		s.Catbox.logNotice(LogInfo, LogKLine,
+			"Ignoring duplicate K-Line for [%s@%s] from %s", m.Params[1], m.Params[2],
+			source)
+		return
+	}
 
 	reason := "<No reason given>"
 	if len(m.Params) > 3 {
 		reason = m.Params[3]
 	}
 
+	now := time.Now()
+
 	kline := KLine{
 		UserMask: m.Params[1],
 		HostMask: m.Params[2],
 		Reason:   reason,
+		Setter:   source,
+		SetTime:  now,
+	}
+	if seconds > 0 {
+		kline.ExpireTime = now.Add(time.Duration(seconds) * time.Second)
 	}
 
 	s.Catbox.addAndApplyKLine(kline, source, reason)
@@ -2056,6 +2312,32 @@ func (s *LocalServer) klineCommand(m irc.Message) {
 	// it was propagated there.
 }
 
+// The KLINEINFO command comes only in ENCAP messages. It tells us who set a
+// K-Line and when.
+//
+// Parameters: <user mask> <host mask> <set time> <setter>
+//
+// Servers send it during burst after each K-Line.
+func (s *LocalServer) klineInfoCommand(m irc.Message) {
+	if len(m.Params) < 4 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"KLINEINFO", "Not enough parameters"})
+		return
+	}
+
+	setTime, err := strconv.ParseInt(m.Params[2], 10, 64)
+	if err != nil || setTime <= 0 || len(m.Params[3]) == 0 {
+		s.Catbox.logNotice(LogWarn, LogKLine, "Invalid KLINEINFO from %s: %s",
+			s.Server.Name, strings.Join(m.Params, " "))
+		return
+	}
+
+	s.Catbox.updateKLineSetter(m.Params[0], m.Params[1], m.Params[3],
+		time.Unix(setTime, 0))
+
+	// We don't need to propagate as KLINEINFO comes inside ENCAP.
+}
+
 // UNKLINE <user mask> <host mask>
 func (s *LocalServer) unklineCommand(m irc.Message) {
 	if len(m.Params) < 2 {
@@ -2077,7 +2359,7 @@ func (s *LocalServer) unklineCommand(m irc.Message) {
 		}
 	}
 	if source == "" {
-		log.Printf("Unknown source for UNKLINE command")
+		s.Catbox.logNotice(LogWarn, LogKLine, "Unknown source for UNKLINE command")
 		return
 	}
 
@@ -2090,6 +2372,136 @@ func (s *LocalServer) unklineCommand(m irc.Message) {
 	// We don't need to propagate as UNKLINE comes inside ENCAP.
 }
 
+// The DESTBAN command comes only in ENCAP messages. It bans an I2P
+// destination.
+//
+// Parameters: <duration> <destination> [<reason>]
+// Example (with ENCAP portion dropped):
+// :1SNAAAAAF DESTBAN 0 <hash>.b32.i2p :bye bye
+//
+// Duration is in seconds. 0 means the ban is permanent. Like K-Lines, we also
+// receive these during burst.
+func (s *LocalServer) destBanCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"DESTBAN", "Not enough parameters"})
+		return
+	}
+
+	source := s.encapSourceName(m.Prefix)
+	if source == "" {
+		s.Catbox.logNotice(LogWarn, LogKLine, "Unknown source for DESTBAN command")
+		return
+	}
+
+	seconds, err := strconv.ParseInt(m.Params[0], 10, 64)
+	if err != nil || seconds < 0 {
+		s.Catbox.logNotice(LogWarn, LogKLine,
+			"Invalid DESTBAN duration from %s: %s", source, m.Params[0])
+		return
+	}
+
+	destination, err := parseI2PDestination(m.Params[1])
+	if err != nil {
+		s.Catbox.logNotice(LogWarn, LogKLine, "Invalid DESTBAN from %s: %s",
+			source, err)
+		return
+	}
+
+	// Both sides send their bans during burst.
+	if s.Catbox.getDestBan(destination) != nil {
+		s.Catbox.logNotice(LogInfo, LogKLine,
+			"Ignoring duplicate destination ban for [%s] from %s", destination,
+			source)
+		return
+	}
+
+	reason := "<No reason given>"
+	if len(m.Params) > 2 {
+		reason = m.Params[2]
+	}
+
+	now := time.Now()
+
+	ban := DestBan{
+		Destination: destination,
+		Reason:      reason,
+		Setter:      source,
+		SetTime:     now,
+	}
+	if seconds > 0 {
+		ban.ExpireTime = now.Add(time.Duration(seconds) * time.Second)
+	}
+
+	s.Catbox.addAndApplyDestBan(ban, source)
+
+	// We don't need to propagate. DESTBAN comes inside ENCAP.
+}
+
+// The DESTBANINFO command comes only in ENCAP messages. It tells us who set a
+// destination ban and when.
+//
+// Parameters: <destination> <set time> <setter>
+func (s *LocalServer) destBanInfoCommand(m irc.Message) {
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"DESTBANINFO",
+			"Not enough parameters"})
+		return
+	}
+
+	setTime, err := strconv.ParseInt(m.Params[1], 10, 64)
+	if err != nil || setTime <= 0 || len(m.Params[2]) == 0 {
+		s.Catbox.logNotice(LogWarn, LogKLine, "Invalid DESTBANINFO from %s: %s",
+			s.Server.Name, strings.Join(m.Params, " "))
+		return
+	}
+
+	s.Catbox.updateDestBanSetter(m.Params[0], m.Params[2],
+		time.Unix(setTime, 0))
+
+	// We don't need to propagate as DESTBANINFO comes inside ENCAP.
+}
+
+// UNDESTBAN <destination>
+func (s *LocalServer) undestBanCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"UNDESTBAN", "Not enough parameters"})
+		return
+	}
+
+	source := s.encapSourceName(m.Prefix)
+	if source == "" {
+		s.Catbox.logNotice(LogWarn, LogKLine,
+			"Unknown source for UNDESTBAN command")
+		return
+	}
+
+	destination, err := parseI2PDestination(m.Params[0])
+	if err != nil {
+		s.Catbox.logNotice(LogWarn, LogKLine, "Invalid UNDESTBAN from %s: %s",
+			source, err)
+		return
+	}
+
+	s.Catbox.removeDestBan(destination, source)
+
+	// We don't need to propagate as UNDESTBAN comes inside ENCAP.
+}
+
+// encapSourceName finds the name of the user or server that sent an ENCAP
+// command. Blank if we don't know it.
+func (s *LocalServer) encapSourceName(prefix string) string {
+	if user, exists := s.Catbox.Users[TS6UID(prefix)]; exists {
+		return user.DisplayNick
+	}
+	if server, exists := s.Catbox.Servers[TS6SID(prefix)]; exists {
+		return server.Name
+	}
+	return ""
+}
+
 // Upon link to a server, it tells us about the capabilities of all servers
 // it introduces to us. This comes in this form:
 // :3SN ENCAP * GCAP :QS EX CHW IE GLN KNOCK TB ENCAP SAVE SAVETS_100
@@ -2135,6 +2547,43 @@ func (s *LocalServer) gcapCommand(m irc.Message) {
 	// We don't need to propagate. GCAP comes inside ENCAP. Already propagated.
 }
 
+// SU tells us what account a user is logged in to. It comes only in ENCAP
+// messages.
+//
+// Parameters: <UID> [account]
+// e.g. :1SN ENCAP * SU 1SNAAAAAB :horgh
+//
+// If account is absent or blank, the user logged out.
+func (s *LocalServer) suCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SU", "Not enough parameters"})
+		return
+	}
+
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists {
+		// The user may have quit while this was on its way. Ignore it.
+		s.Catbox.logf(LogWarn, LogLink, "SU for unknown user %s", m.Params[0])
+		return
+	}
+
+	if user.isLocal() {
+		s.quit(fmt.Sprintf("SU for local user %s", user.DisplayNick))
+		return
+	}
+
+	account := ""
+	if len(m.Params) > 1 {
+		account = m.Params[1]
+	}
+
+	user.Account = account
+	s.Catbox.notifyAccount(user)
+
+	// We don't need to propagate. SU comes inside ENCAP. Already propagated.
+}
+
 // Params: <uid> <nick>
 // e.g. :1SNAAAAAB WHOIS 000AAAAAA :horgh
 func (s *LocalServer) whoisCommand(m irc.Message) {
@@ -2146,7 +2595,7 @@ func (s *LocalServer) whoisCommand(m irc.Message) {
 
 	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
 	if !exists {
-		log.Printf("WHOIS from unknown user %s", m.Prefix)
+		s.Catbox.logf(LogWarn, LogLink, "WHOIS from unknown user %s", m.Prefix)
 		return
 	}
 
@@ -2184,19 +2633,20 @@ func (s *LocalServer) numericCommand(m irc.Message) {
 	// Only servers should be sending numerics.
 	sourceServer, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
 	if !exists {
-		log.Printf("Numeric from unknown server %s", m.Prefix)
+		s.Catbox.logf(LogWarn, LogLink, "Numeric from unknown server %s", m.Prefix)
 		return
 	}
 
 	if len(m.Params) == 0 {
-		log.Printf("Numeric with no parameters")
+		s.Catbox.logf(LogWarn, LogLink, "Numeric with no parameters")
 		return
 	}
 
 	// Find the target.
 	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
 	if !exists {
-		log.Printf("Numeric %s for unknown user %s", m.Command, m.Params[0])
+		s.Catbox.logf(LogWarn, LogLink, "Numeric %s for unknown user %s", m.Command,
+			m.Params[0])
 		return
 	}
 
@@ -2259,6 +2709,8 @@ func (s *LocalServer) awayCommand(m irc.Message) {
 		user.AwayMessage = ""
 	}
 
+	s.Catbox.notifyAway(user)
+
 	// Propagate.
 	for _, server := range s.Catbox.LocalServers {
 		if server == s {
@@ -2316,17 +2768,17 @@ func (s *LocalServer) inviteCommand(m irc.Message) {
 
 		// If channel TS indicates the channel is newer than what we know, ignore.
 		if channelTS > channel.TS {
-			s.Catbox.noticeOpers(fmt.Sprintf("INVITE from %s to %s for %s has newer TS",
-				sourceUser.DisplayNick, targetUser.DisplayNick, channel.Name))
+			s.Catbox.noticeOpers(SnomaskDebug, fmt.Sprintf(
+				"INVITE from %s to %s for %s has newer TS", sourceUser.DisplayNick,
+				targetUser.DisplayNick, channel.Name))
 			return
 		}
 	}
 
-	// TODO(horgh): If we had +i we'd have to record the invited user may join
-	// the channel.
-
-	// If it's a local user, tell the user, and that's it.
+	// If it's a local user, record the invite (so they may join if the channel
+	// is +i), tell the user, and that's it.
 	if targetUser.isLocal() {
+		targetUser.LocalUser.Invites[channel.Name] = struct{}{}
 		targetUser.LocalUser.maybeQueueMessage(irc.Message{
 			Prefix:  sourceUser.nickUhost(),
 			Command: "INVITE",
@@ -2380,7 +2832,8 @@ func (s *LocalServer) tmodeCommand(m irc.Message) {
 
 	// Ignore if the TS is newer
 	if channelTS > channel.TS {
-		log.Printf("TMODE for channel %s has newer TS, ignoring", channel.Name)
+		s.Catbox.logf(LogDebug, LogLink,
+			"TMODE for channel %s has newer TS, ignoring", channel.Name)
 		return
 	}
 
@@ -2401,17 +2854,113 @@ func (s *LocalServer) tmodeCommand(m irc.Message) {
 
 	action := '+'
 
+	// Record a mode we applied. The parameter may be blank if the mode has none.
+	recordApplied := func(char rune, param string) {
+		if appliedModesAction != action {
+			appliedModesAction = action
+			appliedModes += string(appliedModesAction)
+		}
+
+		appliedModes += string(char)
+		if len(param) > 0 {
+			appliedModesParams = append(appliedModesParams, param)
+		}
+	}
+
 	for _, char := range m.Params[2] {
 		if char == '+' || char == '-' {
 			action = char
 			continue
 		}
 
-		if char != 'o' {
+		if strings.ContainsRune(channelSimpleModes, char) {
+			if channel.setMode(byte(char), action == '+') {
+				recordApplied(char, "")
+			}
 			continue
 		}
 
-		// +o/-o
+		if char == 'k' {
+			// Servers include a parameter when removing the key as well.
+			if paramIndex >= len(m.Params) {
+				break
+			}
+
+			key := m.Params[paramIndex]
+			paramIndex++
+
+			if action == '-' {
+				if len(channel.Key) > 0 {
+					channel.Key = ""
+					recordApplied(char, key)
+				}
+				continue
+			}
+
+			if channel.Key != key {
+				channel.Key = key
+				recordApplied(char, key)
+			}
+			continue
+		}
+
+		if char == 'l' {
+			if action == '-' {
+				if channel.Limit > 0 {
+					channel.Limit = 0
+					recordApplied(char, "")
+				}
+				continue
+			}
+
+			if paramIndex >= len(m.Params) {
+				break
+			}
+
+			limit, err := strconv.Atoi(m.Params[paramIndex])
+			paramIndex++
+			if err != nil || limit <= 0 {
+				continue
+			}
+
+			if channel.Limit != limit {
+				channel.Limit = limit
+				recordApplied(char, strconv.Itoa(limit))
+			}
+			continue
+		}
+
+		if strings.ContainsRune(channelListModes, char) {
+			// Must have a parameter. A mask.
+			if paramIndex >= len(m.Params) {
+				break
+			}
+
+			// Consume the parameter.
+			mask := m.Params[paramIndex]
+			paramIndex++
+
+			mode := byte(char)
+			if action == '+' {
+				if !channel.addListMask(mode, mask, origin, time.Now().Unix()) {
+					continue
+				}
+			} else {
+				mask = channel.removeListMask(mode, mask)
+				if mask == "" {
+					continue
+				}
+			}
+
+			recordApplied(char, mask)
+			continue
+		}
+
+		if char != 'o' && char != 'v' {
+			continue
+		}
+
+		// +o/-o, +v/-v
 
 		// Must have a parameter.
 
@@ -2433,25 +2982,11 @@ func (s *LocalServer) tmodeCommand(m irc.Message) {
 			break
 		}
 
-		if action == '+' {
-			if channel.userHasOps(targetUser) {
-				continue
-			}
-			channel.grantOps(targetUser)
-		} else {
-			if !channel.userHasOps(targetUser) {
-				continue
-			}
-			channel.removeOps(targetUser)
-		}
-
-		if appliedModesAction != action {
-			appliedModesAction = action
-			appliedModes += string(appliedModesAction)
+		if !channel.setStatus(targetUser, byte(char), action == '+') {
+			continue
 		}
 
-		appliedModes += string(char)
-		appliedModesParams = append(appliedModesParams, targetUser.DisplayNick)
+		recordApplied(char, targetUser.DisplayNick)
 	}
 
 	// It's possible we have more than ChanModesPerCommand to send to the client
@@ -2463,9 +2998,12 @@ func (s *LocalServer) tmodeCommand(m irc.Message) {
 	// But only if there is something to tell.
 
 	if len(appliedModes) > 0 {
+		s.Catbox.rememberChannel(channel)
+
 		userModeParams := []string{channel.Name, appliedModes}
 		userModeParams = append(userModeParams, appliedModesParams...)
-		log.Printf("%v %v", appliedModes, appliedModesParams)
+		s.Catbox.logf(LogDebug, LogLink, "TMODE applied %v %v", appliedModes,
+			appliedModesParams)
 
 		for memberUID := range channel.Members {
 			member := s.Catbox.Users[memberUID]
@@ -2490,3 +3028,91 @@ func (s *LocalServer) tmodeCommand(m irc.Message) {
 		ls.maybeQueueMessage(m)
 	}
 }
+
+// bmaskCommand handles BMASK. Servers send this during burst to tell us the
+// masks in a channel's lists.
+//
+// :<SID> BMASK <channel TS> <channel> <type> :<space separated masks>
+func (s *LocalServer) bmaskCommand(m irc.Message) {
+	if len(m.Params) < 4 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"BMASK", "Not enough parameters"})
+		return
+	}
+
+	sourceServer, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+	if !exists {
+		s.quit("Unknown origin (BMASK)")
+		return
+	}
+
+	channelTS, err := strconv.ParseInt(m.Params[0], 10, 64)
+	if err != nil {
+		s.quit(fmt.Sprintf("Invalid channel TS: %s: %s", m.Params[0], err))
+		return
+	}
+
+	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[1])]
+	if !exists {
+		s.quit("Unknown channel (BMASK)")
+		return
+	}
+
+	if len(m.Params[2]) != 1 ||
+		!strings.Contains(channelListModes, m.Params[2]) {
+		s.quit(fmt.Sprintf("Unknown list type (BMASK): %s", m.Params[2]))
+		return
+	}
+	mode := m.Params[2][0]
+
+	// Ignore if the TS is newer. Their masks lose.
+	if channelTS > channel.TS {
+		s.Catbox.logf(LogDebug, LogLink,
+			"BMASK for channel %s has newer TS, ignoring", channel.Name)
+		return
+	}
+
+	var added []string
+	for _, mask := range strings.Fields(m.Params[3]) {
+		if channel.addListMask(mode, mask, sourceServer.Name,
+			time.Now().Unix()) {
+			added = append(added, mask)
+		}
+	}
+
+	if len(added) > 0 {
+		s.Catbox.rememberChannel(channel)
+	}
+
+	// Tell our local users in the channel.
+	for len(added) > 0 {
+		count := len(added)
+		if count > ChanModesPerCommand {
+			count = ChanModesPerCommand
+		}
+
+		params := []string{channel.Name, "+" + strings.Repeat(string(mode), count)}
+		params = append(params, added[:count]...)
+		added = added[count:]
+
+		s.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
+			Prefix:  sourceServer.Name,
+			Command: "MODE",
+			Params:  params,
+		})
+	}
+
+	// Propagate.
+	for _, ls := range s.Catbox.LocalServers {
+		if ls == s {
+			continue
+		}
+		if mode == 'e' && !ls.Server.hasCapability("EX") {
+			continue
+		}
+		if mode == 'I' && !ls.Server.hasCapability("IE") {
+			continue
+		}
+		ls.maybeQueueMessage(m)
+	}
+}
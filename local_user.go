@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -36,6 +37,28 @@ type LocalUser struct {
 
 	// MessageQueue holds queued messages from the client.
 	MessageQueue []irc.Message
+
+	// Channels (canonicalized names) the user was invited to. An invite lets
+	// them join despite +i or +l. We forget it once they join.
+	Invites map[string]struct{}
+
+	// If they are on a registered nick without identifying, when their grace
+	// period runs out. Zero if they are not.
+	NickEnforceTime time.Time
+
+	// When the grace period runs out for each account (canonicalized name) whose
+	// nicks they used without identifying. We remember it until they identify
+	// to the account, so changing away from a nick and back doesn't give them a
+	// new one.
+	NickDeadlines map[string]time.Time
+
+	// Server notice mask: The types of server notices they want. Only operators
+	// have one. They set it with user mode +s.
+	Snomask map[byte]struct{}
+
+	// The name of the operator definition they used with OPER. It decides their
+	// privileges.
+	OperName string
 }
 
 // NewLocalUser makes a LocalUser from a LocalClient.
@@ -49,6 +72,7 @@ func NewLocalUser(c *LocalClient) *LocalUser {
 		LastMessageTime:  now,
 		MessageCounter:   UserMessageLimit,
 		MessageQueue:     []irc.Message{},
+		Invites:          make(map[string]struct{}),
 	}
 
 	return u
@@ -115,7 +139,7 @@ func (u *LocalUser) messageFromServer(command string, params []string) {
 // join tries to join the client to a channel.
 //
 // We've validated the name is valid and have canonicalized it.
-func (u *LocalUser) join(channelName string) {
+func (u *LocalUser) join(channelName, key string) {
 	// Is the client in the channel already? Ignore it if so.
 	if u.User.onChannel(&Channel{Name: channelName}) {
 		return
@@ -128,14 +152,36 @@ func (u *LocalUser) join(channelName string) {
 			Name:    channelName,
 			Members: make(map[TS6UID]struct{}),
 			Ops:     make(map[TS6UID]*User),
+			Voices:  make(map[TS6UID]*User),
 			Modes:   make(map[byte]struct{}),
 			TS:      time.Now().Unix(),
 		}
 		u.Catbox.Channels[channelName] = channel
-		channel.grantOps(u.User)
-		channel.Modes['n'] = struct{}{}
-		channel.Modes['s'] = struct{}{}
+
+		// If it's registered, it gets back what it had, including its bans, key,
+		// and so on. They apply to this join too. If they keep the user out, the
+		// channel goes away again. Only those with access get ops.
+		rc, registered := u.Catbox.RegisteredChannels[channelName]
+		if registered {
+			rc.restore(channel)
+			if !u.canJoin(channel, key) {
+				delete(u.Catbox.Channels, channelName)
+				return
+			}
+			if rc.hasAccess(u.User.Account) {
+				channel.grantOps(u.User)
+			}
+		} else {
+			channel.grantOps(u.User)
+			channel.Modes['n'] = struct{}{}
+			channel.Modes['s'] = struct{}{}
+		}
+	}
+
+	if channelExists && !u.canJoin(channel, key) {
+		return
 	}
+	delete(u.Invites, channelName)
 
 	// Add them to the channel.
 	channel.Members[u.User.UID] = struct{}{}
@@ -147,9 +193,11 @@ func (u *LocalUser) join(channelName string) {
 	// JOIN comes from the client, to the client.
 	u.messageUser(u.User, "JOIN", []string{channel.Name})
 
-	// If this is a new channel, send them the modes we set by default.
+	// If this is a new channel, send them the modes we set.
+	modeStr, modeParams := channel.modesString()
 	if !channelExists {
-		u.messageFromServer("MODE", []string{channel.Name, "+ns"})
+		u.messageFromServer("MODE", append([]string{channel.Name, modeStr},
+			modeParams...))
 	}
 
 	// It appears RPL_TOPIC is optional, at least ircd-ratbox does always send it.
@@ -166,74 +214,7 @@ func (u *LocalUser) join(channelName string) {
 		})
 	}
 
-	// 353 RPL_NAMREPLY: This tells the client about who is in the channel
-	// (including itself).
-	// Format: :<server> 353 <targetNick> <channel flag> <#channel> :<nicks>
-	// <nicks> is a list of nicknames in the channel. Each is prefixed with @
-	// or + to indicate opped/voiced). Apparently only one or the other.
-
-	// Channel flag: = (public), * (private), @ (secret)
-	// When we have more chan modes (-s / +p) this needs to vary
-	channelFlag := "@"
-
-	// We put as many nicks per line as possible.
-
-	// First build the portion that is common to every NAMREPLY so we can get
-	// its length.
-	namMessage := irc.Message{
-		Prefix:  u.Catbox.Config.ServerName,
-		Command: "353",
-		// Last parameter is where nicks go. We'll have " :" since it's blank
-		// right now (when we encode to determine base size).
-		Params: []string{u.User.DisplayNick, channelFlag, channel.Name, ""},
-	}
-
-	// If encoding the message truncates before we add any nicks, then there is no
-	// point continuing.
-	messageBuf, err := namMessage.Encode()
-	if err != nil {
-		log.Printf("Unable to generate RPL_NAMREPLY: %s", err)
-		return
-	}
-
-	baseSize := len(messageBuf)
-
-	nicks := ""
-	for memberUID := range channel.Members {
-		member := u.Catbox.Users[memberUID]
-
-		// We send the nick with its mode prefix.
-		sendNick := member.DisplayNick
-		if channel.userHasOps(member) {
-			sendNick = "@" + sendNick
-		}
-
-		// Assume 1 nick will always be okay to send.
-		if len(nicks) == 0 {
-			nicks += sendNick
-			continue
-		}
-
-		// If we add another nick, will we be above our line length? If so, fire off
-		// the message and start with the nick in a new list.
-		// +1 for " "
-		if baseSize+len(nicks)+1+len(member.DisplayNick) > irc.MaxLineLength {
-			namMessage.Params[3] = nicks
-			u.maybeQueueMessage(namMessage)
-			nicks = "" + sendNick
-			continue
-		}
-
-		nicks += " " + sendNick
-	}
-
-	if len(nicks) > 0 {
-		namMessage.Params[3] = nicks
-		u.maybeQueueMessage(namMessage)
-	}
-
-	// 366 RPL_ENDOFNAMES: Ends NAMES list.
-	u.messageFromServer("366", []string{channel.Name, "End of NAMES list"})
+	u.sendNames(channel)
 
 	// Tell each member in the channel about the client.
 	// Only local clients. Servers will tell their own clients.
@@ -256,16 +237,19 @@ func (u *LocalUser) join(channelName string) {
 	// If it's a new channel, then use SJOIN. Otherwise JOIN.
 	for _, server := range u.Catbox.LocalServers {
 		if !channelExists {
+			sjoinParams := []string{fmt.Sprintf("%d", channel.TS), channel.Name,
+				modeStr}
+			sjoinParams = append(sjoinParams, modeParams...)
+			sjoinParams = append(sjoinParams,
+				channel.memberPrefix(u.User, true)+string(u.User.UID))
 			server.maybeQueueMessage(irc.Message{
 				Prefix:  string(u.Catbox.Config.TS6SID),
 				Command: "SJOIN",
-				Params: []string{
-					fmt.Sprintf("%d", channel.TS),
-					channel.Name,
-					"+ns",
-					"@" + string(u.User.UID),
-				},
+				Params:  sjoinParams,
 			})
+
+			// A registered channel may have a topic and lists already.
+			server.sendChannelState(channel)
 		} else {
 			server.maybeQueueMessage(irc.Message{
 				Prefix:  string(u.User.UID),
@@ -278,6 +262,10 @@ func (u *LocalUser) join(channelName string) {
 			})
 		}
 	}
+
+	if channelExists {
+		u.opOnJoin(channel)
+	}
 }
 
 // part tries to remove the client from the channel.
@@ -362,7 +350,13 @@ func (u *LocalUser) quit(msg string, propagate bool) {
 	if _, exists := u.Catbox.LocalUsers[u.ID]; !exists {
 		return
 	}
-	log.Printf("Losing user %s", u)
+	u.Catbox.logNotice(LogInfo, LogClient, "Losing user %s", u)
+
+	u.Catbox.sendSnomaskNotice(SnomaskQuits,
+		fmt.Sprintf("Client exiting: %s (%s@%s) [%s] [%s]", u.User.DisplayNick,
+			u.User.Username, u.User.Hostname, msg, u.User.IP))
+
+	u.Catbox.recordWhowas(u.User)
 
 	// Tell all clients the client is in the channel with, and remove the client
 	// from each channel it is in.
@@ -441,6 +435,8 @@ func (u *LocalUser) setAway(message string) {
 		Params:  []string{u.User.DisplayNick, "You have been marked as away"},
 	})
 
+	u.Catbox.notifyAway(u.User)
+
 	// Propagate.
 	for _, server := range u.Catbox.LocalServers {
 		server.maybeQueueMessage(irc.Message{
@@ -471,6 +467,8 @@ func (u *LocalUser) setUnaway() {
 		},
 	})
 
+	u.Catbox.notifyAway(u.User)
+
 	// Propagate.
 	for _, server := range u.Catbox.LocalServers {
 		server.maybeQueueMessage(irc.Message{
@@ -497,11 +495,23 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 	// queue it.
 	if !u.User.isFloodExempt() {
 		if u.MessageCounter == 0 {
-			log.Printf("%s is flooding. Queueing their message.", u.User.DisplayNick)
+			u.Catbox.logNotice(LogWarn, LogFlood,
+				"%s is flooding. Queueing their message.", u.User.DisplayNick)
 			u.MessageQueue = append(u.MessageQueue, m)
+			u.Catbox.Metrics.FloodQueued++
+
+			if len(u.MessageQueue) == 1 {
+				u.Catbox.noticeLocalOpers(SnomaskFloods,
+					fmt.Sprintf("Flood control: Queueing messages from %s (%s@%s)",
+						u.User.DisplayNick, u.User.Username, u.User.Hostname))
+			}
 
 			// Check for overwhelming their queue and disconnect them if so.
 			if len(u.MessageQueue) >= ExcessFloodThreshold {
+				u.Catbox.Metrics.ExcessFloodKills++
+				u.Catbox.noticeLocalOpers(SnomaskFloods,
+					fmt.Sprintf("Excess flood: Disconnecting %s (%s@%s)",
+						u.User.DisplayNick, u.User.Username, u.User.Hostname))
 				u.quit("Excess flood", true)
 				return
 			}
@@ -511,9 +521,17 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		u.MessageCounter--
 	}
 
-	// Non-RFC command that appears to be widely supported. Just ignore it for
-	// now.
+	// IRCv3 capability negotiation. Clients may change their capabilities after
+	// registering.
 	if m.Command == "CAP" {
+		u.capCommand(m, u.User.DisplayNick)
+		return
+	}
+
+	// SASL is only possible before registration.
+	if m.Command == "AUTHENTICATE" {
+		// 462 ERR_ALREADYREGISTRED
+		u.messageFromServer("462", []string{"You may not reregister"})
 		return
 	}
 
@@ -537,6 +555,11 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "KICK" {
+		u.kickCommand(m)
+		return
+	}
+
 	// Per RFC these commands are near identical.
 	if m.Command == "PRIVMSG" || m.Command == "NOTICE" {
 		u.privmsgCommand(m)
@@ -633,6 +656,16 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "DESTBAN" {
+		u.destBanCommand(m)
+		return
+	}
+
+	if m.Command == "UNDESTBAN" {
+		u.undestBanCommand(m)
+		return
+	}
+
 	if m.Command == "STATS" {
 		u.statsCommand(m)
 		return
@@ -683,6 +716,31 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "NAMES" {
+		u.namesCommand(m)
+		return
+	}
+
+	if m.Command == "LIST" {
+		u.listCommand(m)
+		return
+	}
+
+	if m.Command == "NICKSERV" || m.Command == "NS" {
+		u.nickServCommand(strings.Fields(strings.Join(m.Params, " ")))
+		return
+	}
+
+	if m.Command == "DUMPSTATE" {
+		u.dumpStateCommand(m)
+		return
+	}
+
+	if m.Command == "CHANSERV" || m.Command == "CS" {
+		u.chanServCommand(strings.Fields(strings.Join(m.Params, " ")))
+		return
+	}
+
 	// Unknown command. We don't handle it yet anyway.
 	// 421 ERR_UNKNOWNCOMMAND
 	u.messageFromServer("421", []string{m.Command, "Unknown command"})
@@ -711,6 +769,12 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 		return
 	}
 
+	if u.Catbox.isServiceNick(nick) {
+		// 432 ERR_ERRONEUSNICKNAME
+		u.messageFromServer("432", []string{nick, "Erroneous nickname"})
+		return
+	}
+
 	// Ignore the command if it's the exact same as the current nick.
 	// This is a case sensitive comparison.
 	if nick == u.User.DisplayNick {
@@ -731,6 +795,12 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 		}
 	}
 
+	u.Catbox.recordWhowas(u.User)
+
+	u.Catbox.sendSnomaskNotice(SnomaskNicks,
+		fmt.Sprintf("Nick change: From %s to %s (%s@%s)", u.User.DisplayNick,
+			nick, u.User.Username, u.User.Hostname))
+
 	// Free the old nick.
 	delete(u.Catbox.Nicks, oldNickCanon)
 
@@ -782,6 +852,8 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 			Params:  []string{u.User.DisplayNick, fmt.Sprintf("%d", u.User.NickTS)},
 		})
 	}
+
+	u.checkNickProtection()
 }
 
 // The USER command only occurs during connection registration.
@@ -810,12 +882,138 @@ func (u *LocalUser) joinCommand(m irc.Message) {
 	// May have multiple channels in a single command.
 	channels := commaChannelsToChannelNames(m.Params[0])
 
-	// We could support keys.
+	// Keys are in the same order as the channels. Match them up by name as the
+	// channel list we have is not in order.
+	keys := map[string]string{}
+	if len(m.Params) >= 2 {
+		rawKeys := strings.Split(m.Params[1], ",")
+		for i, rawChannelName := range strings.Split(m.Params[0], ",") {
+			if i >= len(rawKeys) {
+				break
+			}
+			keys[canonicalizeChannel(strings.TrimSpace(rawChannelName))] = rawKeys[i]
+		}
+	}
 
 	// Try to join the client to the channels.
 	for _, channelName := range channels {
-		u.join(channelName)
+		u.join(channelName, keys[channelName])
+	}
+}
+
+// sendNames tells the user who is in the channel with RPL_NAMREPLY and
+// RPL_ENDOFNAMES.
+func (u *LocalUser) sendNames(channel *Channel) {
+	// 353 RPL_NAMREPLY: This tells the client about who is in the channel
+	// (including itself).
+	// Format: :<server> 353 <targetNick> <channel flag> <#channel> :<nicks>
+	// <nicks> is a list of nicknames in the channel. Each is prefixed with @
+	// or + to indicate opped/voiced). Only one or the other unless the client
+	// has multi-prefix.
+
+	// Channel flag: = (public), * (private), @ (secret)
+	channelFlag := "="
+	if channel.hasMode('s') {
+		channelFlag = "@"
+	}
+
+	// We put as many nicks per line as possible.
+
+	// First build the portion that is common to every NAMREPLY so we can get
+	// its length.
+	namMessage := irc.Message{
+		Prefix:  u.Catbox.Config.ServerName,
+		Command: "353",
+		// Last parameter is where nicks go. We'll have " :" since it's blank
+		// right now (when we encode to determine base size).
+		Params: []string{u.User.DisplayNick, channelFlag, channel.Name, ""},
+	}
+
+	// If encoding the message truncates before we add any nicks, then there is no
+	// point continuing.
+	messageBuf, err := namMessage.Encode()
+	if err != nil {
+		u.Catbox.logf(LogError, LogGeneral, "Unable to generate RPL_NAMREPLY: %s",
+			err)
+		return
+	}
+
+	baseSize := len(messageBuf)
+
+	nicks := ""
+	for memberUID := range channel.Members {
+		member := u.Catbox.Users[memberUID]
+
+		// We send the nick with its mode prefix.
+		sendNick := channel.memberPrefix(member, u.hasCap(capMultiPrefix)) +
+			member.DisplayNick
+
+		// Assume 1 nick will always be okay to send.
+		if len(nicks) == 0 {
+			nicks += sendNick
+			continue
+		}
+
+		// If we add another nick, will we be above our line length? If so, fire off
+		// the message and start with the nick in a new list.
+		// +1 for " "
+		if baseSize+len(nicks)+1+len(sendNick) > irc.MaxLineLength {
+			namMessage.Params[3] = nicks
+			u.maybeQueueMessage(namMessage)
+			nicks = "" + sendNick
+			continue
+		}
+
+		nicks += " " + sendNick
+	}
+
+	if len(nicks) > 0 {
+		namMessage.Params[3] = nicks
+		u.maybeQueueMessage(namMessage)
+	}
+
+	// 366 RPL_ENDOFNAMES: Ends NAMES list.
+	u.messageFromServer("366", []string{channel.Name, "End of NAMES list"})
+}
+
+// canJoin checks whether the user may join the existing channel. If not, we
+// tell them why.
+//
+// An invite lets them past +i and +l, but not a ban or key.
+func (u *LocalUser) canJoin(channel *Channel, key string) bool {
+	_, invited := u.Invites[channel.Name]
+
+	// Banned? They may still join if they match a ban exception.
+	if channel.isBanned(u.User) {
+		// 474 ERR_BANNEDFROMCHAN
+		u.messageFromServer("474", []string{channel.Name,
+			"Cannot join channel (+b)"})
+		return false
+	}
+
+	// Invite only? They may still join if they match an invite exception.
+	if channel.hasMode('i') && !invited && !channel.listMatches('I', u.User) {
+		// 473 ERR_INVITEONLYCHAN
+		u.messageFromServer("473", []string{channel.Name,
+			"Cannot join channel (+i)"})
+		return false
+	}
+
+	if len(channel.Key) > 0 && key != channel.Key {
+		// 475 ERR_BADCHANNELKEY
+		u.messageFromServer("475", []string{channel.Name,
+			"Cannot join channel (+k)"})
+		return false
+	}
+
+	if channel.Limit > 0 && len(channel.Members) >= channel.Limit && !invited {
+		// 471 ERR_CHANNELISFULL
+		u.messageFromServer("471", []string{channel.Name,
+			"Cannot join channel (+l)"})
+		return false
 	}
+
+	return true
 }
 
 func (u *LocalUser) partCommand(m irc.Message) {
@@ -840,6 +1038,138 @@ func (u *LocalUser) partCommand(m irc.Message) {
 	}
 }
 
+// canSendToChannel checks whether the user may send a message to the channel.
+//
+// Operators and voiced users may always send. Otherwise:
+// - If the channel is +n, they must be on it.
+// - If the channel is +m, they may not send.
+// - They must not be banned.
+func (u *LocalUser) canSendToChannel(channel *Channel) bool {
+	if channel.userHasOps(u.User) || channel.userHasVoice(u.User) {
+		return true
+	}
+
+	if channel.hasMode('n') && !u.User.onChannel(channel) {
+		return false
+	}
+
+	if channel.hasMode('m') {
+		return false
+	}
+
+	return !channel.isBanned(u.User)
+}
+
+// KICK removes users from a channel. You must be a channel operator.
+// Parameters: <channel> <user> *( "," <user> ) [<comment>]
+func (u *LocalUser) kickCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"KICK", "Not enough parameters"})
+		return
+	}
+
+	channelName := canonicalizeChannel(m.Params[0])
+	channel, exists := u.Catbox.Channels[channelName]
+	if !exists {
+		// 403 ERR_NOSUCHCHANNEL
+		u.messageFromServer("403", []string{m.Params[0], "No such channel"})
+		return
+	}
+
+	if !u.User.onChannel(channel) {
+		// 442 ERR_NOTONCHANNEL
+		u.messageFromServer("442", []string{channel.Name,
+			"You're not on that channel"})
+		return
+	}
+
+	if !channel.userHasOps(u.User) {
+		// 482 ERR_CHANOPRIVSNEEDED
+		u.messageFromServer("482", []string{channel.Name,
+			"You're not channel operator"})
+		return
+	}
+
+	comment := u.User.DisplayNick
+	if len(m.Params) >= 3 && len(m.Params[2]) > 0 {
+		comment = m.Params[2]
+	}
+	if len(comment) > maxKickLength {
+		comment = comment[:maxKickLength]
+	}
+
+	for _, nick := range strings.Split(m.Params[1], ",") {
+		if len(nick) == 0 {
+			continue
+		}
+
+		targetUID, exists := u.Catbox.Nicks[canonicalizeNick(nick)]
+		if !exists {
+			// 401 ERR_NOSUCHNICK
+			u.messageFromServer("401", []string{nick, "No such nick/channel"})
+			continue
+		}
+		targetUser := u.Catbox.Users[targetUID]
+
+		if !targetUser.onChannel(channel) {
+			// 441 ERR_USERNOTINCHANNEL
+			u.messageFromServer("441", []string{targetUser.DisplayNick,
+				channel.Name, "They aren't on that channel"})
+			continue
+		}
+
+		// Tell local members (including the target) before removing them.
+		u.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
+			Prefix:  u.User.nickUhost(),
+			Command: "KICK",
+			Params:  []string{channel.Name, targetUser.DisplayNick, comment},
+		})
+
+		for _, server := range u.Catbox.LocalServers {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(u.User.UID),
+				Command: "KICK",
+				Params:  []string{channel.Name, string(targetUser.UID), comment},
+			})
+		}
+
+		channel.removeUser(targetUser)
+
+		// They may have kicked themselves and been the last member.
+		if len(channel.Members) == 0 {
+			delete(u.Catbox.Channels, channel.Name)
+			return
+		}
+	}
+}
+
+// NAMES lists who is in channels.
+// Parameters: [ <channel> *( "," <channel> ) ]
+//
+// We only show members of secret (+s) channels if the user is in the channel.
+// We don't support listing every channel when there is no parameter. We reply
+// with only the end of names.
+func (u *LocalUser) namesCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 366 RPL_ENDOFNAMES
+		u.messageFromServer("366", []string{"*", "End of NAMES list"})
+		return
+	}
+
+	for _, channelName := range commaChannelsToChannelNames(m.Params[0]) {
+		channel, exists := u.Catbox.Channels[channelName]
+		if !exists ||
+			(channel.hasMode('s') && !u.User.onChannel(channel)) {
+			// 366 RPL_ENDOFNAMES
+			u.messageFromServer("366", []string{channelName, "End of NAMES list"})
+			continue
+		}
+
+		u.sendNames(channel)
+	}
+}
+
 // Per RFC 2812, PRIVMSG and NOTICE are essentially the same, so both PRIVMSG
 // and NOTICE use this command function.
 func (u *LocalUser) privmsgCommand(m irc.Message) {
@@ -879,15 +1209,22 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 			return
 		}
 
-		// Are they on it?
-		// Technically we should allow messaging if they aren't on it
-		// depending on the mode.
-		if !u.User.onChannel(channel) {
+		if !u.canSendToChannel(channel) {
 			// 404 ERR_CANNOTSENDTOCHAN
 			u.messageFromServer("404", []string{channelName, "Cannot send to channel"})
 			return
 		}
 
+		// No colours (+c). Strip them rather than refuse the message.
+		if channel.hasMode('c') {
+			msg = stripColours(msg)
+			if len(msg) == 0 {
+				// 412 ERR_NOTEXTTOSEND
+				u.messageFromServer("412", []string{"No text to send"})
+				return
+			}
+		}
+
 		u.LastMessageTime = time.Now()
 
 		// Send to all members of the channel. Except the client itself it seems.
@@ -924,6 +1261,18 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 
 	// We're messaging a nick directly.
 
+	// Our services are not real users. We answer for them.
+	if u.Catbox.isServiceNick(target) {
+		if m.Command == "PRIVMSG" {
+			if isNickServNick(target) {
+				u.nickServCommand(strings.Fields(msg))
+			} else {
+				u.chanServCommand(strings.Fields(msg))
+			}
+		}
+		return
+	}
+
 	nickName := canonicalizeNick(target)
 	if !isValidNick(u.Catbox.Config.MaxNickLength, nickName) {
 		// 401 ERR_NOSUCHNICK
@@ -1092,9 +1441,7 @@ func (u *LocalUser) pingCommand(m irc.Message) {
 }
 
 func (u *LocalUser) dieCommand(m irc.Message) {
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+	if !u.checkPrivilege(PrivDie) {
 		return
 	}
 
@@ -1103,9 +1450,7 @@ func (u *LocalUser) dieCommand(m irc.Message) {
 }
 
 func (u *LocalUser) restartCommand(m irc.Message) {
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+	if !u.checkPrivilege(PrivRestart) {
 		return
 	}
 
@@ -1168,28 +1513,76 @@ func (u *LocalUser) operCommand(m irc.Message) {
 		return
 	}
 
-	// We could require particular user/hostmask per oper.
+	// Check if they gave acceptable permissions. They must come from a host the
+	// operator definition allows.
+	name := m.Params[0]
+	oper, exists := u.Catbox.Config.Opers[name]
+	if !exists || !u.User.matchesMask(oper.UserMask, oper.HostMask) {
+		u.operFailed(name)
+		return
+	}
+
+	// The password may be a bcrypt hash. Check outside the server goroutine. We
+	// check a copy in case a rehash changes the operator meanwhile.
+	check := *oper
+	password := m.Params[1]
+	certFP := u.CertFP
+
+	started := u.checkPasswordAsync(
+		func() bool { return check.checkCredentials(password, certFP) },
+		func(ok bool) {
+			// A rehash may have removed the operator while we checked.
+			oper, exists := u.Catbox.Config.Opers[name]
+			if !ok || !exists {
+				u.operFailed(name)
+				return
+			}
+
+			if u.User.isOperator() {
+				// 381 RPL_YOUREOPER
+				u.messageFromServer("381", []string{"You are already an IRC operator"})
+				return
+			}
 
-	// Check if they gave acceptable permissions.
-	pass, exists := u.Catbox.Config.Opers[m.Params[0]]
-	if !exists || pass != m.Params[1] {
+			u.becomeOper(oper)
+		},
+	)
+	if !started {
 		// 464 ERR_PASSWDMISMATCH
-		u.messageFromServer("464", []string{"Password incorrect"})
-		return
+		u.messageFromServer("464", []string{
+			"I'm still checking your last password. Try again."})
 	}
+}
 
+// operFailed tells the user and operators about a failed OPER attempt.
+func (u *LocalUser) operFailed(name string) {
+	// 464 ERR_PASSWDMISMATCH
+	u.messageFromServer("464", []string{"Password incorrect"})
+	u.Catbox.noticeLocalOpers(SnomaskGeneral,
+		fmt.Sprintf("Failed OPER attempt by %s (%s@%s) as %s",
+			u.User.DisplayNick, u.User.Username, u.User.Hostname, name))
+}
+
+// becomeOper gives the user operator status once they gave the right
+// credentials.
+func (u *LocalUser) becomeOper(oper *OperConfig) {
 	// Give them oper status.
 	u.User.Modes['o'] = struct{}{}
+	u.OperName = oper.Name
 
 	u.Catbox.Opers[u.User.UID] = u.User
 
 	// From themselves to themselves.
-	u.messageUser(u.User, "MODE", []string{u.User.DisplayNick, "+o"})
+	u.messageUser(u.User, "MODE", []string{u.User.DisplayNick, "+os"})
 
 	// 381 RPL_YOUREOPER
 	u.messageFromServer("381", []string{"You are now an IRC operator"})
 
-	// Tell all servers about this mode change.
+	u.setSnomask(applySnomaskChanges(nil, defaultSnomask))
+
+	// Tell all servers about this mode change. Only +o. The server notice mask
+	// (+s) is ours alone: we send server notices only to our own users, and
+	// servers ignore +s when they hear it.
 	for _, server := range u.Catbox.LocalServers {
 		server.maybeQueueMessage(irc.Message{
 			Prefix:  string(u.User.UID),
@@ -1198,8 +1591,11 @@ func (u *LocalUser) operCommand(m irc.Message) {
 		})
 	}
 
-	u.Catbox.noticeLocalOpers(fmt.Sprintf("%s@%s became an operator.",
-		u.User.DisplayNick, u.Catbox.Config.ServerName))
+	u.Catbox.noticeLocalOpers(SnomaskGeneral,
+		fmt.Sprintf("%s@%s became an operator (%s, class %s).", u.User.DisplayNick,
+			u.Catbox.Config.ServerName, oper.Name, oper.Class))
+
+	u.serverNotice(fmt.Sprintf("Your privileges: %s", oper.privilegesString()))
 }
 
 // MODE command applies either to nicknames or to channels.
@@ -1228,7 +1624,11 @@ func (u *LocalUser) modeCommand(m irc.Message) {
 	targetUID, exists := u.Catbox.Nicks[canonicalizeNick(target)]
 	if exists {
 		targetUser := u.Catbox.Users[targetUID]
-		u.userModeCommand(targetUser, modes)
+		params := []string{}
+		if len(m.Params) > 2 {
+			params = append(params, m.Params[2:]...)
+		}
+		u.userModeCommand(targetUser, modes, params)
 		return
 	}
 
@@ -1253,7 +1653,10 @@ func (u *LocalUser) modeCommand(m irc.Message) {
 // +i/-i (invisible, actually doesn't change anything for this server, but)
 // +o/-o (operator)
 // +C/-C (must be +o to alter) (client connection notices)
-func (u *LocalUser) userModeCommand(targetUser *User, modes string) {
+// +s/-s (must be +o to alter) (server notices). +s takes the server notice
+// mask, e.g. +s +cf-q.
+func (u *LocalUser) userModeCommand(targetUser *User, modes string,
+	params []string) {
 	// They can only change their own mode.
 	if targetUser.LocalUser != u {
 		// 502 ERR_USERSDONTMATCH
@@ -1265,9 +1668,16 @@ func (u *LocalUser) userModeCommand(targetUser *User, modes string) {
 	if len(modes) == 0 {
 		// 221 RPL_UMODEIS
 		u.messageFromServer("221", []string{u.User.modesString()})
+		if len(u.Snomask) > 0 {
+			// 008 RPL_SNOMASK
+			u.messageFromServer("008", []string{snomaskString(u.Snomask),
+				"Server notice mask"})
+		}
 		return
 	}
 
+	_, hadSnomask := u.User.Modes['s']
+
 	setModes, unsetModes, unknownModes, err := parseAndResolveUmodeChanges(modes,
 		u.User.Modes)
 	if err != nil {
@@ -1276,12 +1686,44 @@ func (u *LocalUser) userModeCommand(targetUser *User, modes string) {
 		return
 	}
 
+	// Server notice mask. Setting +s without a mask gives the default one. If they
+	// already have +s, +s with a mask changes it.
+	_, settingSnomask := setModes['s']
+	_, unsettingSnomask := unsetModes['s']
+	if settingSnomask {
+		changes := defaultSnomask
+		if len(params) > 0 {
+			changes = params[0]
+		}
+		u.Snomask = applySnomaskChanges(nil, changes)
+	}
+	if hadSnomask && !unsettingSnomask && len(params) > 0 &&
+		strings.Contains(modes, "s") {
+		u.Snomask = applySnomaskChanges(u.Snomask, params[0])
+		if len(u.Snomask) == 0 {
+			unsetModes['s'] = struct{}{}
+		} else {
+			// 008 RPL_SNOMASK
+			u.messageFromServer("008", []string{snomaskString(u.Snomask),
+				"Server notice mask"})
+		}
+	}
+	// parseAndResolveUmodeChanges() already set +s on the user. Take it back if
+	// their mask ended up empty, e.g. MODE nick +s -c.
+	if settingSnomask && len(u.Snomask) == 0 {
+		delete(setModes, 's')
+		delete(u.User.Modes, 's')
+	}
+
 	// Apply changes and build the mode string.
 	setModeStr := ""
 	for mode := range setModes {
 		if mode == 'o' {
 			u.Catbox.Opers[u.User.UID] = u.User
 		}
+		if mode == 's' {
+			u.setSnomask(u.Snomask)
+		}
 		u.User.Modes[mode] = struct{}{}
 		setModeStr += string(mode)
 	}
@@ -1290,6 +1732,9 @@ func (u *LocalUser) userModeCommand(targetUser *User, modes string) {
 		if mode == 'o' {
 			delete(u.Catbox.Opers, u.User.UID)
 		}
+		if mode == 's' {
+			u.Snomask = nil
+		}
 		delete(u.User.Modes, mode)
 		unsetModeStr += string(mode)
 	}
@@ -1339,21 +1784,22 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 	}
 
 	// No modes? Send back the channel's modes.
-	// Always send back +ns. That's only I support right now.
 	if len(modes) == 0 {
+		modeStr, modeParams := channel.modesString()
 		// 324 RPL_CHANNELMODEIS
-		u.messageFromServer("324", []string{channel.Name, "+ns"})
+		u.messageFromServer("324", append([]string{channel.Name, modeStr},
+			modeParams...))
 		// 329 RPL_CREATIONTIME. Not standard but oft used.
 		u.messageFromServer("329", []string{channel.Name,
 			fmt.Sprintf("%d", channel.TS)})
 		return
 	}
 
-	// Listing bans. I don't support bans at this time. Say that there are none.
-	if modes == "b" || modes == "+b" {
-		// 368 RPL_ENDOFBANLIST
-		u.messageFromServer("368", []string{channel.Name,
-			"End of channel ban list"})
+	// Listing one of the lists (e.g., bans).
+	listMode := strings.TrimPrefix(modes, "+")
+	if len(listMode) == 1 && strings.Contains(channelListModes, listMode) &&
+		len(params) == 0 {
+		u.channelListCommand(channel, listMode[0])
 		return
 	}
 
@@ -1368,7 +1814,10 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 
 	// Apply mode changes we support.
 	// Currently I support:
-	// - +o/-o
+	// - +o/-o, +v/-v
+	// - +b/-b, +e/-e, +I/-I
+	// - +k/-k, +l/-l
+	// - +c/-c, +i/-i, +m/-m, +n/-n, +s/-s, +t/-t
 	// Also generate the information we need to send to our local users and to
 	// servers.
 
@@ -1389,6 +1838,23 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 	appliedParamsUser := []string{}
 	appliedParamsServer := []string{}
 
+	// Record a mode we applied. The parameters may be blank if the mode has
+	// none. Users and servers may see different parameters (nick vs. UID).
+	recordApplied := func(char rune, userParam, serverParam string) {
+		if appliedModesAction != action {
+			appliedModesAction = action
+			appliedModes += string(appliedModesAction)
+		}
+
+		appliedModes += string(char)
+		if len(userParam) > 0 {
+			appliedParamsUser = append(appliedParamsUser, userParam)
+			appliedParamsServer = append(appliedParamsServer, serverParam)
+		}
+
+		modesApplied++
+	}
+
 	// Track what parameter we're on (of those presented).
 	// i.e., if we had "+oo u1 u2", then we start out at index 0 pointing
 	// to u1, then index 1 indicating u2.
@@ -1404,11 +1870,115 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 			continue
 		}
 
-		if char != 'o' {
+		if strings.ContainsRune(channelSimpleModes, char) {
+			if !channel.setMode(byte(char), action == '+') {
+				continue
+			}
+			recordApplied(char, "", "")
+			continue
+		}
+
+		if char == 'k' {
+			if action == '-' {
+				// The key is optional when removing it. Consume it if it's there.
+				if paramIndex < len(params) {
+					paramIndex++
+				}
+
+				if len(channel.Key) == 0 {
+					continue
+				}
+				channel.Key = ""
+				recordApplied(char, "*", "*")
+				continue
+			}
+
+			// Must have a parameter. The key.
+			if paramIndex >= len(params) {
+				break
+			}
+
+			// Consume the parameter.
+			key := params[paramIndex]
+			paramIndex++
+
+			if !isValidChannelKey(key) || channel.Key == key {
+				continue
+			}
+			channel.Key = key
+			recordApplied(char, key, key)
 			continue
 		}
 
-		// +o/-o
+		if char == 'l' {
+			if action == '-' {
+				if channel.Limit == 0 {
+					continue
+				}
+				channel.Limit = 0
+				recordApplied(char, "", "")
+				continue
+			}
+
+			// Must have a parameter. The limit.
+			if paramIndex >= len(params) {
+				break
+			}
+
+			// Consume the parameter.
+			limit, err := strconv.Atoi(params[paramIndex])
+			paramIndex++
+			if err != nil || limit <= 0 || channel.Limit == limit {
+				continue
+			}
+			channel.Limit = limit
+			recordApplied(char, strconv.Itoa(limit), strconv.Itoa(limit))
+			continue
+		}
+
+		if strings.ContainsRune(channelListModes, char) {
+			// Must have a parameter. A mask.
+			if paramIndex >= len(params) {
+				break
+			}
+
+			// Consume the parameter.
+			mask := normalizeMask(params[paramIndex])
+			paramIndex++
+
+			if !isValidListMask(mask) {
+				continue
+			}
+
+			mode := byte(char)
+			if action == '+' {
+				if len(channel.Lists[mode]) >= maxChannelListLength {
+					// 478 ERR_BANLISTFULL
+					u.messageFromServer("478", []string{channel.Name, mask,
+						"Channel list is full"})
+					continue
+				}
+				if !channel.addListMask(mode, mask, u.User.nickUhost(),
+					time.Now().Unix()) {
+					continue
+				}
+			} else {
+				// Use the mask as we have it stored, as it may differ in case.
+				mask = channel.removeListMask(mode, mask)
+				if mask == "" {
+					continue
+				}
+			}
+
+			recordApplied(char, mask, mask)
+			continue
+		}
+
+		if char != 'o' && char != 'v' {
+			continue
+		}
+
+		// +o/-o, +v/-v
 
 		// Must have a parameter. A nick.
 		if paramIndex >= len(params) {
@@ -1432,28 +2002,11 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 
 		// Looks okay to do this.
 
-		if action == '+' {
-			if channel.userHasOps(targetUser) {
-				break
-			}
-			channel.grantOps(targetUser)
-		} else {
-			if !channel.userHasOps(targetUser) {
-				break
-			}
-			channel.removeOps(targetUser)
-		}
-
-		if appliedModesAction != action {
-			appliedModesAction = action
-			appliedModes += string(appliedModesAction)
+		if !channel.setStatus(targetUser, byte(char), action == '+') {
+			break
 		}
 
-		appliedModes += string(char)
-		appliedParamsUser = append(appliedParamsUser, targetUser.DisplayNick)
-		appliedParamsServer = append(appliedParamsServer, string(targetUser.UID))
-
-		modesApplied++
+		recordApplied(char, targetUser.DisplayNick, string(targetUser.UID))
 	}
 
 	// If we didn't apply any changes, then we're done.
@@ -1461,6 +2014,8 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 		return
 	}
 
+	u.Catbox.rememberChannel(channel)
+
 	// Tell all local users in the channel about the mode changes.
 
 	userModeParams := []string{channel.Name, appliedModes}
@@ -1498,6 +2053,43 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 	}
 }
 
+// channelListCommand sends the user the entries in one of the channel's lists.
+//
+// Anyone in the channel may see the ban list. Only operators may see the
+// exception lists.
+func (u *LocalUser) channelListCommand(channel *Channel, mode byte) {
+	// Numerics for each entry, and for the end of the list.
+	entryNumeric := "367"
+	endNumeric := "368"
+	endText := "End of channel ban list"
+	if mode == 'e' {
+		entryNumeric = "348"
+		endNumeric = "349"
+		endText = "End of channel exception list"
+	}
+	if mode == 'I' {
+		entryNumeric = "346"
+		endNumeric = "347"
+		endText = "End of channel invite list"
+	}
+
+	if mode != 'b' && !channel.userHasOps(u.User) {
+		// 482 ERR_CHANOPRIVSNEEDED
+		u.messageFromServer("482", []string{channel.Name,
+			"You're not channel operator"})
+		return
+	}
+
+	for _, listMask := range channel.Lists[mode] {
+		// 367 RPL_BANLIST, 348 RPL_EXCEPTLIST, 346 RPL_INVITELIST
+		u.messageFromServer(entryNumeric, []string{channel.Name, listMask.Mask,
+			listMask.SetBy, fmt.Sprintf("%d", listMask.SetTS)})
+	}
+
+	// 368 RPL_ENDOFBANLIST, 349 RPL_ENDOFEXCEPTLIST, 347 RPL_ENDOFINVITELIST
+	u.messageFromServer(endNumeric, []string{channel.Name, endText})
+}
+
 func (u *LocalUser) whoCommand(m irc.Message) {
 	if len(m.Params) < 1 {
 		// 461 ERR_NEEDMOREPARAMS
@@ -1550,9 +2142,7 @@ func (u *LocalUser) whoCommand(m irc.Message) {
 			mode += "*"
 		}
 
-		if channel.userHasOps(member) {
-			mode += "@"
-		}
+		mode += channel.memberPrefix(member, u.hasCap(capMultiPrefix))
 
 		serverName := u.Catbox.Config.ServerName
 		if member.isRemote() {
@@ -1579,10 +2169,7 @@ func (u *LocalUser) whoCommand(m irc.Message) {
 // that lets opers see things regular users cannot.
 // In this case, I want to send the WHO result of all users to the oper.
 func (u *LocalUser) operspyWhoCommand(m irc.Message) {
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{
-			"Permission Denied- You're not an IRC operator"})
+	if !u.checkPrivilege(PrivOperspy) {
 		return
 	}
 
@@ -1623,7 +2210,7 @@ func (u *LocalUser) operspyWhoCommand(m irc.Message) {
 	// 315 RPL_ENDOFWHO
 	u.messageFromServer("315", []string{"*", "End of WHO list"})
 
-	u.Catbox.noticeOpers(fmt.Sprintf("%s used OPERSPY WHO !*",
+	u.Catbox.noticeOpers(SnomaskGeneral, fmt.Sprintf("%s used OPERSPY WHO !*",
 		u.User.DisplayNick))
 }
 
@@ -1674,13 +2261,19 @@ func (u *LocalUser) topicCommand(m irc.Message) {
 		topic = topic[:maxTopicLength]
 	}
 
-	// TODO: When we support channel mode +t we will need additional logic.
+	if channel.hasMode('t') && !channel.userHasOps(u.User) {
+		// 482 ERR_CHANOPRIVSNEEDED
+		u.messageFromServer("482", []string{channel.Name,
+			"You're not channel operator"})
+		return
+	}
 
 	// Set new topic.
 
 	channel.Topic = topic
 	channel.TopicTS = time.Now().Unix()
 	channel.TopicSetter = u.User.nickUhost()
+	u.Catbox.rememberChannel(channel)
 
 	// Tell all members of the channel, including the client.
 	// Only local clients. We tell remote users by telling all servers.
@@ -1707,9 +2300,7 @@ func (u *LocalUser) topicCommand(m irc.Message) {
 //
 // I implement CONNECT differently than RFC 2812. Only a single parameter.
 func (u *LocalUser) connectCommand(m irc.Message) {
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+	if !u.checkPrivilege(PrivConnect) {
 		return
 	}
 
@@ -1780,9 +2371,7 @@ func (u *LocalUser) wallopsCommand(m irc.Message) {
 		return
 	}
 
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+	if !u.checkPrivilege(PrivWallops) {
 		return
 	}
 
@@ -1816,9 +2405,7 @@ func (u *LocalUser) killCommand(m irc.Message) {
 		return
 	}
 
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+	if !u.checkPrivilege(PrivKill) {
 		return
 	}
 
@@ -1844,7 +2431,7 @@ func (u *LocalUser) killCommand(m irc.Message) {
 //
 // Propagate it to all servers.
 //
-// At this time we support only permanent (locally anyway) klines.
+// Duration is in minutes. If it is absent or 0, the K-Line is permanent.
 func (u *LocalUser) klineCommand(m irc.Message) {
 	// Parameters: [duration] <user@host> <reason>
 	if len(m.Params) < 2 {
@@ -1853,13 +2440,11 @@ func (u *LocalUser) klineCommand(m irc.Message) {
 		return
 	}
 
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+	if !u.checkPrivilege(PrivKLine) {
 		return
 	}
 
-	duration := "0"
+	var duration time.Duration
 	uhost := ""
 	reason := ""
 
@@ -1868,7 +2453,12 @@ func (u *LocalUser) klineCommand(m irc.Message) {
 		log.Fatalf("KLine duration regex: %s", err)
 	}
 	if match {
-		duration = m.Params[0]
+		minutes, err := strconv.ParseInt(m.Params[0], 10, 32)
+		if err != nil {
+			u.serverNotice(fmt.Sprintf("Invalid duration: %s", m.Params[0]))
+			return
+		}
+		duration = time.Duration(minutes) * time.Minute
 
 		if len(m.Params) < 3 {
 			// 461 ERR_NEEDMOREPARAMS
@@ -1900,10 +2490,17 @@ func (u *LocalUser) klineCommand(m irc.Message) {
 	userMask := pieces[0]
 	hostMask := pieces[1]
 
+	now := time.Now()
+
 	kline := KLine{
 		UserMask: userMask,
 		HostMask: hostMask,
 		Reason:   reason,
+		Setter:   u.User.DisplayNick,
+		SetTime:  now,
+	}
+	if duration > 0 {
+		kline.ExpireTime = now.Add(duration)
 	}
 
 	// Propagate.
@@ -1911,18 +2508,7 @@ func (u *LocalUser) klineCommand(m irc.Message) {
 	// Do this before applying K-Line locally for the hopefully rare scenario
 	// that the user K-Lines himself.
 	for _, server := range u.Catbox.LocalServers {
-		server.maybeQueueMessage(irc.Message{
-			Prefix:  string(u.User.UID),
-			Command: "ENCAP",
-			Params: []string{
-				"*",
-				"KLINE",
-				duration,
-				userMask,
-				hostMask,
-				reason,
-			},
-		})
+		server.maybeQueueMessage(kline.encapMessage(string(u.User.UID), now))
 	}
 
 	u.Catbox.addAndApplyKLine(kline, u.User.DisplayNick, reason)
@@ -1936,9 +2522,7 @@ func (u *LocalUser) unklineCommand(m irc.Message) {
 		return
 	}
 
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+	if !u.checkPrivilege(PrivKLine) {
 		return
 	}
 
@@ -1968,8 +2552,107 @@ func (u *LocalUser) unklineCommand(m irc.Message) {
 	}
 }
 
+// Ban an I2P destination and cut off any local users connecting from it.
+//
+// Propagate it to all servers.
+//
+// Duration is in minutes. If it is absent or 0, the ban is permanent. Anyone
+// who may K-Line may ban destinations.
+func (u *LocalUser) destBanCommand(m irc.Message) {
+	// Parameters: [duration] <destination> <reason>
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"DESTBAN", "Not enough parameters"})
+		return
+	}
+
+	if !u.checkPrivilege(PrivKLine) {
+		return
+	}
+
+	var duration time.Duration
+	params := m.Params
+
+	if minutes, err := strconv.ParseInt(params[0], 10, 32); err == nil {
+		if minutes < 0 {
+			u.serverNotice(fmt.Sprintf("Invalid duration: %s", params[0]))
+			return
+		}
+		duration = time.Duration(minutes) * time.Minute
+
+		if len(params) < 3 {
+			// 461 ERR_NEEDMOREPARAMS
+			u.messageFromServer("461", []string{"DESTBAN", "Not enough parameters"})
+			return
+		}
+		params = params[1:]
+	}
+
+	destination, err := parseI2PDestination(params[0])
+	if err != nil {
+		// 415 ERR_BADMASK
+		u.messageFromServer("415", []string{params[0], "Bad I2P destination"})
+		return
+	}
+
+	now := time.Now()
+
+	ban := DestBan{
+		Destination: destination,
+		Reason:      params[1],
+		Setter:      u.User.DisplayNick,
+		SetTime:     now,
+	}
+	if duration > 0 {
+		ban.ExpireTime = now.Add(duration)
+	}
+
+	// Propagate before applying locally in case the user bans themself.
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(ban.encapMessage(string(u.User.UID), now))
+	}
+
+	u.Catbox.addAndApplyDestBan(ban, u.User.DisplayNick)
+}
+
+func (u *LocalUser) undestBanCommand(m irc.Message) {
+	// Parameters: <destination>
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"UNDESTBAN", "Not enough parameters"})
+		return
+	}
+
+	if !u.checkPrivilege(PrivKLine) {
+		return
+	}
+
+	destination, err := parseI2PDestination(m.Params[0])
+	if err != nil {
+		// 415 ERR_BADMASK
+		u.messageFromServer("415", []string{m.Params[0], "Bad I2P destination"})
+		return
+	}
+
+	u.Catbox.removeDestBan(destination, u.User.DisplayNick)
+
+	// Propagate.
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "ENCAP",
+			Params: []string{
+				"*",
+				"UNDESTBAN",
+				destination,
+			},
+		})
+	}
+}
+
 // I support the following queries right now:
 // k/K - Show K-Lines
+// d/D - Show destination bans
 // I do not support remote STATS yet.
 func (u *LocalUser) statsCommand(m irc.Message) {
 	if len(m.Params) == 0 {
@@ -1979,14 +2662,17 @@ func (u *LocalUser) statsCommand(m irc.Message) {
 	}
 
 	query := m.Params[0]
-	if query != "k" && query != "K" {
+	if query != "k" && query != "K" && query != "d" && query != "D" {
 		u.messageFromServer("NOTICE", []string{"Unknown stats query"})
 		return
 	}
 
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+	if !u.checkPrivilege(PrivStats) {
+		return
+	}
+
+	if query == "d" || query == "D" {
+		u.statsDestBans()
 		return
 	}
 
@@ -1999,13 +2685,18 @@ func (u *LocalUser) statsCommand(m irc.Message) {
 		// RFC 2812 declines to say.
 		// ircd-ratbox says:
 		// K <host> * <username> <reason>
-		// I use ratbox's.
+		// I use ratbox's. Like ratbox, temporary K-Lines show as k.
+		kind := "K"
+		if !kline.ExpireTime.IsZero() {
+			kind = "k"
+		}
 		u.messageFromServer("216", []string{
-			"K",
+			kind,
 			kline.HostMask,
 			"*",
 			kline.UserMask,
-			kline.Reason,
+			fmt.Sprintf("%s (set by %s at %s, %s)", kline.Reason, kline.Setter,
+				kline.SetTime.UTC().Format(time.RFC3339), kline.durationString()),
 		})
 	}
 
@@ -2013,12 +2704,33 @@ func (u *LocalUser) statsCommand(m irc.Message) {
 	u.messageFromServer("219", []string{"K", "End of /STATS report"})
 }
 
+// statsDestBans replies to STATS d with our destination bans.
+func (u *LocalUser) statsDestBans() {
+	for _, ban := range u.Catbox.DestBans {
+		// 225 RPL_STATSDLINE
+		// ircd-ratbox says:
+		// D <host> :<reason>
+		// As with K-Lines, temporary bans show as d.
+		kind := "D"
+		if !ban.ExpireTime.IsZero() {
+			kind = "d"
+		}
+		u.messageFromServer("225", []string{
+			kind,
+			ban.Destination,
+			fmt.Sprintf("%s (set by %s at %s, %s)", ban.Reason, ban.Setter,
+				ban.SetTime.UTC().Format(time.RFC3339), ban.durationString()),
+		})
+	}
+
+	// 219 RPL_ENDOFSTATS
+	u.messageFromServer("219", []string{"D", "End of /STATS report"})
+}
+
 // Reload config.
 // No parameters.
 func (u *LocalUser) rehashCommand(m irc.Message) {
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+	if !u.checkPrivilege(PrivRehash) {
 		return
 	}
 
@@ -2125,8 +2837,10 @@ func (u *LocalUser) timeCommand(m irc.Message) {
 }
 
 // WHOWAS is to look up previously used nick information.
-// I choose to not really implement it. Instead we always reply in the negative.
+// We reply with what we remember of users who used the nick, most recent
+// first. If count is given and positive, we send at most that many.
 func (u *LocalUser) whowasCommand(m irc.Message) {
+	// Parameters: <nick> [count]
 	if len(m.Params) == 0 {
 		// 461 ERR_NEEDMOREPARAMS
 		u.messageFromServer("461", []string{"WHOWAS", "Not enough parameters"})
@@ -2135,19 +2849,33 @@ func (u *LocalUser) whowasCommand(m irc.Message) {
 
 	nick := m.Params[0]
 
-	// 406 ERR_WASNOSUCHNICK
-	u.maybeQueueMessage(irc.Message{
-		Prefix:  u.Catbox.Config.ServerName,
-		Command: "406",
-		Params:  []string{u.User.DisplayNick, nick, "There was no such nickname"},
-	})
+	count := 0
+	if len(m.Params) > 1 {
+		n, err := strconv.Atoi(m.Params[1])
+		if err == nil {
+			count = n
+		}
+	}
+
+	entries := u.Catbox.getWhowas(nick, count)
+	if len(entries) == 0 {
+		// 406 ERR_WASNOSUCHNICK
+		u.messageFromServer("406", []string{nick, "There was no such nickname"})
+	}
+
+	for _, entry := range entries {
+		// 314 RPL_WHOWASUSER
+		u.messageFromServer("314", []string{entry.Nick, entry.Username,
+			entry.Hostname, "*", entry.RealName})
+
+		// 312 RPL_WHOISSERVER. For WHOWAS the last parameter is when they signed
+		// off.
+		u.messageFromServer("312", []string{entry.Nick, entry.ServerName,
+			entry.SignoffTime.UTC().Format(time.RFC1123)})
+	}
 
 	// 369 RPL_ENDOFWHOWAS
-	u.maybeQueueMessage(irc.Message{
-		Prefix:  u.Catbox.Config.ServerName,
-		Command: "369",
-		Params:  []string{u.User.DisplayNick, nick, "End of WHOWAS"},
-	})
+	u.messageFromServer("369", []string{nick, "End of WHOWAS"})
 }
 
 // Set yourself away by including a message.
@@ -2165,9 +2893,10 @@ func (u *LocalUser) awayCommand(m irc.Message) {
 // Invite a user to a channel.
 // Parameters: <nick> <channel>
 // You must be on the channel.
-// If the channel is +i, you must have ops. Actually when we have ops, it is
-// probably better to always require ops to invite.
+// You must have ops. Strictly this is only necessary if the channel is +i, but
+// it is probably better to always require ops to invite.
 // If the nick is on the channel, error.
+// The invite lets the user join despite +i or +l.
 func (u *LocalUser) inviteCommand(m irc.Message) {
 	if len(m.Params) < 2 {
 		// 461 ERR_NEEDMOREPARAMS
@@ -2229,6 +2958,7 @@ func (u *LocalUser) inviteCommand(m irc.Message) {
 
 	// Send an invite message.
 	if targetUser.isLocal() {
+		targetUser.LocalUser.Invites[channel.Name] = struct{}{}
 		targetUser.LocalUser.maybeQueueMessage(irc.Message{
 			Prefix:  u.User.nickUhost(),
 			Command: "INVITE",
@@ -2275,9 +3005,7 @@ func (u *LocalUser) opmeCommand(m irc.Message) {
 		return
 	}
 
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+	if !u.checkPrivilege(PrivOpme) {
 		return
 	}
 
@@ -2324,8 +3052,8 @@ func (u *LocalUser) opmeCommand(m irc.Message) {
 	}
 
 	// Tell operators.
-	u.Catbox.noticeOpers(fmt.Sprintf("%s used OPME in %s", u.User.DisplayNick,
-		channel.Name))
+	u.Catbox.noticeOpers(SnomaskGeneral, fmt.Sprintf("%s used OPME in %s",
+		u.User.DisplayNick, channel.Name))
 }
 
 func (u *LocalUser) squitCommand(m irc.Message) {
@@ -2340,10 +3068,7 @@ func (u *LocalUser) squitCommand(m irc.Message) {
 		reason = m.Params[1]
 	}
 
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{
-			"Permission Denied- You're not an IRC operator"})
+	if !u.checkPrivilege(PrivSquit) {
 		return
 	}
 
@@ -0,0 +1,268 @@
+package terrarium
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LogLevel is how important a log message is.
+type LogLevel int
+
+const (
+	// LogDebug is for messages useful only when tracking down a problem.
+	LogDebug LogLevel = iota
+
+	// LogInfo is for normal events.
+	LogInfo
+
+	// LogWarn is for things that went wrong but that we recovered from.
+	LogWarn
+
+	// LogError is for failures.
+	LogError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogDebug: "debug",
+	LogInfo:  "info",
+	LogWarn:  "warn",
+	LogError: "error",
+}
+
+func (l LogLevel) String() string {
+	if name, exists := logLevelNames[l]; exists {
+		return name
+	}
+	return fmt.Sprintf("level%d", int(l))
+}
+
+// parseLogLevel parses a level name such as info.
+func parseLogLevel(s string) (LogLevel, error) {
+	for level, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return LogInfo, fmt.Errorf("invalid log level: %s", s)
+}
+
+// LogCategory says what part of the server a log message is about.
+type LogCategory string
+
+const (
+	// LogGeneral is for anything without a more specific category.
+	LogGeneral LogCategory = "general"
+
+	// LogLink is for server links.
+	LogLink LogCategory = "link"
+
+	// LogClient is for client connections and registration.
+	LogClient LogCategory = "client"
+
+	// LogKLine is for K-Lines.
+	LogKLine LogCategory = "kline"
+
+	// LogFlood is for flood control.
+	LogFlood LogCategory = "flood"
+
+	// LogOper is for operator notices and commands.
+	LogOper LogCategory = "oper"
+)
+
+var logCategories = []LogCategory{LogGeneral, LogLink, LogClient, LogKLine,
+	LogFlood, LogOper}
+
+// parseLogCategory parses a category name such as link.
+func parseLogCategory(s string) (LogCategory, error) {
+	for _, c := range logCategories {
+		if strings.EqualFold(s, string(c)) {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("invalid log category: %s", s)
+}
+
+// Logger writes log messages as text or JSON to stdout or a file.
+//
+// Any goroutine may use it.
+type Logger struct {
+	mutex sync.Mutex
+
+	level LogLevel
+	json  bool
+
+	// The file we write to. Blank for stdout.
+	path string
+	file *os.File
+
+	out io.Writer
+}
+
+// jsonLogEntry is a log message in the JSON format.
+type jsonLogEntry struct {
+	Time     string `json:"time"`
+	Level    string `json:"level"`
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// NewLogger creates a logger using the log settings in a config.
+func NewLogger(cfg *Config) (*Logger, error) {
+	l := &Logger{out: os.Stdout}
+	if err := l.configure(cfg); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// configure applies the log settings in a config. If the file changed, we
+// switch to it.
+func (l *Logger) configure(cfg *Config) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.level = cfg.LogLevel
+	l.json = cfg.LogFormat == "json"
+
+	if cfg.LogFile == l.path && (l.file != nil || l.path == "") {
+		return nil
+	}
+
+	l.path = cfg.LogFile
+	return l.open()
+}
+
+// Reopen closes and reopens our log file. This is for log rotation: Move the
+// file out of the way and send SIGHUP.
+func (l *Logger) Reopen() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.open()
+}
+
+// open opens the log file. The caller must hold the mutex.
+func (l *Logger) open() error {
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Unable to close log file: %s\n", err)
+		}
+		l.file = nil
+	}
+
+	if l.path == "" {
+		l.out = os.Stdout
+		return nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		// Don't lose messages while the problem gets fixed.
+		l.out = os.Stdout
+		return errors.Wrap(err, "unable to open log file")
+	}
+
+	l.file = f
+	l.out = f
+	return nil
+}
+
+// enabled says whether we log messages at the given level.
+func (l *Logger) enabled(level LogLevel) bool {
+	if l == nil {
+		return level >= LogInfo
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return level >= l.level
+}
+
+// Log writes a message.
+func (l *Logger) Log(level LogLevel, category LogCategory, msg string) {
+	// Tests create servers without a logger.
+	if l == nil {
+		log.Print(msg)
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if level < l.level {
+		return
+	}
+
+	_, _ = io.WriteString(l.out, l.format(time.Now(), level, category, msg))
+}
+
+// format turns a message into a line of output.
+//
+// The text format is the same as the log package's for normal messages: The
+// date, time, and message. We show the level if it is not info and the category
+// if it is not general.
+func (l *Logger) format(t time.Time, level LogLevel, category LogCategory,
+	msg string) string {
+	if l.json {
+		buf, err := json.Marshal(jsonLogEntry{
+			Time:     t.Format(time.RFC3339),
+			Level:    level.String(),
+			Category: string(category),
+			Message:  msg,
+		})
+		if err == nil {
+			return string(buf) + "\n"
+		}
+	}
+
+	prefix := ""
+	if level != LogInfo {
+		prefix += strings.ToUpper(level.String()) + " "
+	}
+	if category != LogGeneral {
+		prefix += string(category) + ": "
+	}
+
+	return fmt.Sprintf("%s %s%s\n", t.Format("2006/01/02 15:04:05"), prefix, msg)
+}
+
+// Write logs a general info message. This lets us be the log package's output.
+func (l *Logger) Write(p []byte) (int, error) {
+	l.Log(LogInfo, LogGeneral, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// logf logs a message. Any goroutine may call this.
+func (cb *Catbox) logf(level LogLevel, category LogCategory, format string,
+	args ...interface{}) {
+	cb.Logger.Log(level, category, fmt.Sprintf(format, args...))
+}
+
+// logNotice logs a message and, if its category is one we send to operators
+// (log-oper-categories), notices our operators too. They see it if their server
+// notice mask includes the category's character.
+//
+// Only the server goroutine may call this.
+func (cb *Catbox) logNotice(level LogLevel, category LogCategory,
+	format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	cb.Logger.Log(level, category, msg)
+
+	if !cb.Logger.enabled(level) {
+		return
+	}
+	if _, exists := cb.Config.LogOperCategories[category]; !exists {
+		return
+	}
+	cb.sendSnomaskNotice(logCategorySnomasks[category],
+		fmt.Sprintf("%s: %s", category, msg))
+}
@@ -0,0 +1,106 @@
+package terrarium
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestLoggerFormat(t *testing.T) {
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		JSON     bool
+		Level    LogLevel
+		Category LogCategory
+		Message  string
+		Output   string
+	}{
+		{false, LogInfo, LogGeneral, "terrarium started",
+			"2020/01/02 03:04:05 terrarium started\n"},
+		{false, LogWarn, LogLink, "Disconnecting from server irc2",
+			"2020/01/02 03:04:05 WARN link: Disconnecting from server irc2\n"},
+		{false, LogInfo, LogFlood, "horgh is flooding",
+			"2020/01/02 03:04:05 flood: horgh is flooding\n"},
+		{true, LogError, LogKLine, `bad "mask"`,
+			`{"time":"2020-01-02T03:04:05Z","level":"error","category":"kline","message":"bad \"mask\""}` + "\n"},
+	}
+
+	for _, test := range tests {
+		l := &Logger{json: test.JSON}
+		output := l.format(when, test.Level, test.Category, test.Message)
+		if output != test.Output {
+			t.Errorf("format(%s, %s, %s) = %q, wanted %q", test.Level,
+				test.Category, test.Message, output, test.Output)
+		}
+	}
+
+	// The test harness looks for this.
+	startedRE := regexp.MustCompile(
+		`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} terrarium started$`)
+	l := &Logger{}
+	output := l.format(when, LogInfo, LogGeneral, "terrarium started")
+	if !startedRE.MatchString(output[:len(output)-1]) {
+		t.Errorf("started message %q does not match %s", output, startedRE)
+	}
+}
+
+func TestLoggerReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terrarium-log-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "terrarium.log")
+
+	l, err := NewLogger(&Config{LogFile: file, LogLevel: LogInfo})
+	if err != nil {
+		t.Fatalf("NewLogger() failed: %s", err)
+	}
+
+	l.Log(LogInfo, LogGeneral, "before")
+	l.Log(LogDebug, LogGeneral, "hidden")
+
+	rotated := file + ".1"
+	if err := os.Rename(file, rotated); err != nil {
+		t.Fatalf("error renaming log file: %s", err)
+	}
+
+	if err := l.Reopen(); err != nil {
+		t.Fatalf("Reopen() failed: %s", err)
+	}
+
+	l.Log(LogInfo, LogGeneral, "after")
+
+	tests := []struct {
+		File     string
+		Contains string
+		Lacks    string
+	}{
+		{rotated, "before", "after"},
+		{file, "after", "before"},
+		{rotated, "before", "hidden"},
+	}
+
+	for _, test := range tests {
+		buf, err := ioutil.ReadFile(test.File)
+		if err != nil {
+			t.Fatalf("error reading %s: %s", test.File, err)
+		}
+
+		if !regexp.MustCompile(test.Contains).Match(buf) {
+			t.Errorf("%s = %q, wanted it to contain %s", test.File, buf,
+				test.Contains)
+		}
+		if regexp.MustCompile(test.Lacks).Match(buf) {
+			t.Errorf("%s = %q, wanted it to not contain %s", test.File, buf,
+				test.Lacks)
+		}
+	}
+}
@@ -4,9 +4,9 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -19,10 +19,6 @@ import (
 	"github.com/pkg/errors"
 )
 
-import (
-	"github.com/eyedeekay/sam3/helper"
-)
-
 // Catbox holds the state for this local server.
 // I put everything global to a server in an instance of struct rather than
 // have global variables.
@@ -68,6 +64,21 @@ type Catbox struct {
 	// Active K:Lines (bans).
 	KLines []KLine
 
+	// Active I2P destination bans.
+	DestBans []DestBan
+
+	// Registered accounts. Canonicalized account name to Account. nil if we
+	// don't have an accounts store.
+	Accounts map[string]*Account
+
+	// Registered channels. Canonicalized channel name to its registration. nil
+	// if we don't have a registered channels store.
+	RegisteredChannels map[string]*RegisteredChannel
+
+	// History of users who quit or changed nick, for WHOWAS. Canonicalized nick
+	// to its history.
+	Whowas map[string]*whowasRing
+
 	// When we close this channel, this indicates that we're shutting down.
 	// Other goroutines can check if this channel is closed.
 	ShutdownChan chan struct{}
@@ -90,6 +101,12 @@ type Catbox struct {
 	// connections (which is what it was in the past).
 	ConnectionCount int
 
+	// Counters we serve on the metrics listener.
+	Metrics *Metrics
+
+	// Where we write log messages.
+	Logger *Logger
+
 	// Our TLS configuration.
 	TLSConfig        *tls.Config
 	Certificate      *tls.Certificate
@@ -100,8 +117,13 @@ type Catbox struct {
 	TLSListener net.Listener
 
 	// I2P Streaming and I2P+TLS listeners.
-	I2PListener    net.Listener
-	I2PListenerTLS net.Listener
+	I2PTunnels []*i2pTunnel
+
+	// Control socket listener. nil if we don't have one.
+	ControlListener net.Listener
+
+	// HTTP server for metrics. nil if we don't have one.
+	MetricsServer *http.Server
 
 	// WaitGroup to ensure all goroutines clean up before we end.
 	WG sync.WaitGroup
@@ -122,10 +144,19 @@ type Catbox struct {
 // KLine holds a kline (a ban).
 type KLine struct {
 	// Together we have <usermask>@<hostmask>
-	UserMask string
-	HostMask string
+	UserMask string `json:"user_mask"`
+	HostMask string `json:"host_mask"`
+
+	Reason string `json:"reason"`
+
+	// Who set it. A nick or a server name.
+	Setter string `json:"setter"`
+
+	// When we added it.
+	SetTime time.Time `json:"set_time"`
 
-	Reason string
+	// When it expires. Zero if it is permanent.
+	ExpireTime time.Time `json:"expire_time"`
 }
 
 // Message tells us the message and its destination. It primarily exists so that
@@ -156,6 +187,18 @@ type Event struct {
 	// If we have an error associated with the event, such as in the case of
 	// some DeadClientEvents, populate it here.
 	Error error
+
+	// The command for a ControlEvent.
+	Control *controlRequest
+
+	// Where to send the output of a MetricsEvent.
+	Metrics chan []byte
+
+	// The message for an OperNoticeEvent.
+	Notice string
+
+	// The result of a PasswordCheckedEvent.
+	PasswordCheck *passwordCheck
 }
 
 // EventType is a type of event we can tell the server about.
@@ -184,6 +227,18 @@ const ( // nolint: deadcode
 
 	// RestartEvent tells the server to restart.
 	RestartEvent
+
+	// ControlEvent means a command arrived on the control socket.
+	ControlEvent
+
+	// MetricsEvent means someone asked the metrics listener for metrics.
+	MetricsEvent
+
+	// OperNoticeEvent means another goroutine wants to tell opers something.
+	OperNoticeEvent
+
+	// PasswordCheckedEvent means we finished checking a client's password.
+	PasswordCheckedEvent
 )
 
 // UserMessageLimit defines a cap on how many messages a user may send at once.
@@ -218,6 +273,9 @@ func NewCatbox(configFile string) (*Catbox, error) {
 		Servers:      make(map[TS6SID]*Server),
 		Channels:     make(map[string]*Channel),
 		KLines:       []KLine{},
+		DestBans:     []DestBan{},
+		Whowas:       make(map[string]*whowasRing),
+		Metrics:      newMetrics(),
 
 		// shutdown() closes this channel.
 		ShutdownChan: make(chan struct{}),
@@ -232,13 +290,58 @@ func NewCatbox(configFile string) (*Catbox, error) {
 	}
 	cb.Config = cfg
 
-	if cb.Config.ListenPortTLS != "-1" || cb.Config.CertificateFile != "" ||
-		cb.Config.KeyFile != "" {
+	logger, err := NewLogger(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cb.Logger = logger
+
+	if cb.Config.KLinesFile != "" {
+		klines, err := loadKLines(cb.Config.KLinesFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load K-Lines: %s", err)
+		}
+		cb.KLines = klines
+	}
+
+	if cb.Config.DestBansFile != "" {
+		bans, err := loadDestBans(cb.Config.DestBansFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load destination bans: %s", err)
+		}
+		cb.DestBans = bans
+	}
+
+	if cb.Config.AccountsFile != "" {
+		accounts, err := loadAccounts(cb.Config.AccountsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load accounts: %s", err)
+		}
+		cb.Accounts = accounts
+	}
+
+	if cb.Config.ChannelsFile != "" {
+		channels, err := loadRegisteredChannels(cb.Config.ChannelsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load registered channels: %s", err)
+		}
+		cb.RegisteredChannels = channels
+	}
+
+	if cb.Config.ListenPortTLS != "-1" || cb.Config.ListenI2PTLS != "-1" ||
+		cb.Config.CertificateFile != "" || cb.Config.KeyFile != "" {
 		cb.CertificateMutex = &sync.RWMutex{}
 		tlsConfig := &tls.Config{
 			GetCertificate:           cb.getCertificate,
 			PreferServerCipherSuites: true,
 			SessionTicketsDisabled:   true,
+			// Ask for a client certificate so users can authenticate with SASL
+			// EXTERNAL or OPER with it, and so servers can prove who they are. We
+			// don't require one.
+			ClientAuth: tls.RequestClientCert,
+			// Present our certificate when we link to a server. It may require a
+			// certificate fingerprint.
+			GetClientCertificate: cb.getClientCertificate,
 			// It would be nice to be able to be more restrictive on ciphers, but in
 			// practice many clients do not support the strictest.
 			//CipherSuites: []uint16{
@@ -270,6 +373,19 @@ func (cb *Catbox) getCertificate(
 	return cb.Certificate, nil
 }
 
+// Return our certificate when a server we connect to asks for one. If we don't
+// have one we present none.
+func (cb *Catbox) getClientCertificate(
+	info *tls.CertificateRequestInfo,
+) (*tls.Certificate, error) {
+	cb.CertificateMutex.RLock()
+	defer cb.CertificateMutex.RUnlock()
+	if cb.Certificate == nil {
+		return &tls.Certificate{}, nil
+	}
+	return cb.Certificate, nil
+}
+
 // Load the certificate and key from files.
 func (cb *Catbox) loadCertificate() error {
 	if cb.Config.CertificateFile == "" || cb.Config.KeyFile == "" {
@@ -336,47 +452,29 @@ func (cb *Catbox) Start(listenFD int) error {
 		go cb.acceptConnections(cb.TLSListener)
 	}
 
-	// I2P Listener
-	if cb.Config.ListenI2P != "-1" {
-		ln, err := sam.I2PListener(cb.Config.ListenI2P, cb.Config.SAMAddress, cb.Config.ListenI2P)
-		if err != nil {
+	// I2P listeners.
+	for _, t := range cb.newI2PListeners() {
+		if err := cb.startI2PListener(t,
+			cb.i2pAddressHelperHosts(t.name)); err != nil {
 			return fmt.Errorf("unable to listen (I2P): %s", err)
 		}
-		cb.I2PListener = ln
-		err = ioutil.WriteFile(cb.Config.ListenI2P+".i2paddresshelper", []byte("http://"+cb.Config.ListenI2P+"/?i2paddresshelper="+cb.I2PListener.Addr().String()), 0644)
-		if err != nil {
-			return fmt.Errorf("unable to write I2P addresshelper link to file: %s", err)
-		}
-		if strings.HasSuffix(cb.Config.ServerName, ".i2p") {
-			err = ioutil.WriteFile(cb.Config.ServerName+".i2paddresshelper", []byte("http://"+cb.Config.ServerName+"/?i2paddresshelper="+cb.I2PListener.Addr().String()), 0644)
-			if err != nil {
-				return fmt.Errorf("unable to write I2P addresshelper link to file: %s", err)
-			}
+	}
+
+	// Control socket.
+	if cb.Config.ControlSocket != "" {
+		if err := cb.listenControl(); err != nil {
+			return err
 		}
+
 		cb.WG.Add(1)
-		go cb.acceptConnections(cb.Listener)
+		go cb.acceptControlConnections()
 	}
 
-	// I2P Listener with TLS
-	if cb.Config.ListenI2PTLS != "-1" {
-		ln, err := sam.I2PListener(cb.Config.ListenI2P, cb.Config.SAMAddress, cb.Config.ListenI2P)
-		if err != nil {
-			return fmt.Errorf("unable to listen (I2P): %s", err)
-		}
-		tlsln := tls.NewListener(ln, cb.TLSConfig)
-		cb.I2PListenerTLS = tlsln
-		err = ioutil.WriteFile(cb.Config.ListenI2P+".i2paddresshelper", []byte("http://"+cb.Config.ListenI2P+"?i2paddresshelper="+cb.I2PListener.Addr().String()), 0644)
-		if err != nil {
-			return fmt.Errorf("unable to write I2P addresshelper link to file: %s", err)
+	// Metrics listener.
+	if cb.Config.MetricsListen != "" {
+		if err := cb.listenMetrics(); err != nil {
+			return err
 		}
-		if strings.HasSuffix(cb.Config.ServerName, ".i2p") {
-			err = ioutil.WriteFile(cb.Config.ServerName+".i2paddresshelper", []byte("http://"+cb.Config.ServerName+"?i2paddresshelper="+cb.I2PListener.Addr().String()), 0644)
-			if err != nil {
-				return fmt.Errorf("unable to write I2P addresshelper link to file: %s", err)
-			}
-		}
-		cb.WG.Add(1)
-		go cb.acceptConnections(cb.Listener)
 	}
 
 	// Alarm is a goroutine to wake up this one periodically so we can do things
@@ -397,16 +495,20 @@ func (cb *Catbox) Start(listenFD int) error {
 			select {
 			case sig := <-signalChan:
 				if sig == syscall.SIGHUP {
-					log.Printf("Received SIGHUP signal, rehashing")
+					cb.logf(LogInfo, LogGeneral, "Received SIGHUP signal, rehashing")
+					// Reopen the log file in case it was rotated.
+					if err := cb.Logger.Reopen(); err != nil {
+						cb.logf(LogError, LogGeneral, "Unable to reopen log file: %s", err)
+					}
 					cb.newEvent(Event{Type: RehashEvent})
 					break
 				}
 				if sig == syscall.SIGUSR1 {
-					log.Printf("Received SIGUSR1 signal, restarting")
+					cb.logf(LogInfo, LogGeneral, "Received SIGUSR1 signal, restarting")
 					cb.newEvent(Event{Type: RestartEvent})
 					break
 				}
-				log.Printf("Received unknown signal!")
+				cb.logf(LogWarn, LogGeneral, "Received unknown signal!")
 			case <-cb.ShutdownChan:
 				signal.Stop(signalChan)
 				// After Stop() we're guaranteed we will receive no more on the channel,
@@ -414,13 +516,13 @@ func (cb *Catbox) Start(listenFD int) error {
 				close(signalChan)
 				for range signalChan {
 				}
-				log.Printf("Signal listener shutting down.")
+				cb.logf(LogInfo, LogGeneral, "Signal listener shutting down.")
 				return
 			}
 		}
 	}()
 
-	log.Printf("terrarium started")
+	cb.logf(LogInfo, LogGeneral, "terrarium started")
 	cb.eventLoop()
 
 	// We don't need to drain any channels. None close that will have any
@@ -441,7 +543,7 @@ func (cb *Catbox) eventLoop() {
 		// promoted to a different client type (LocalUser, LocalServer).
 		case evt := <-cb.ToServerChan:
 			if evt.Type == NewClientEvent {
-				log.Printf("New client connection: %s", evt.Client)
+				cb.logNotice(LogInfo, LogClient, "New client connection: %s", evt.Client)
 				cb.LocalClients[evt.Client.ID] = evt.Client
 				continue
 			}
@@ -466,21 +568,8 @@ func (cb *Catbox) eventLoop() {
 			}
 
 			if evt.Type == MessageFromClientEvent {
-				lc, exists := cb.LocalClients[evt.Client.ID]
-				if exists {
-					lc.handleMessage(evt.Message)
-					continue
-				}
-				lu, exists := cb.LocalUsers[evt.Client.ID]
-				if exists {
-					lu.handleMessage(evt.Message)
-					continue
-				}
-				ls, exists := cb.LocalServers[evt.Client.ID]
-				if exists {
-					ls.handleMessage(evt.Message)
-					continue
-				}
+				cb.Metrics.countMessage(evt.Message.Command)
+				cb.messageFromClient(evt.Client, evt.Message)
 				continue
 			}
 
@@ -488,6 +577,9 @@ func (cb *Catbox) eventLoop() {
 				cb.checkAndPingClients()
 				cb.connectToServers()
 				cb.floodControl()
+				cb.expireKLines()
+				cb.expireDestBans()
+				cb.enforceNicks()
 				continue
 			}
 
@@ -501,6 +593,26 @@ func (cb *Catbox) eventLoop() {
 				continue
 			}
 
+			if evt.Type == ControlEvent {
+				cb.controlCommand(evt.Control)
+				continue
+			}
+
+			if evt.Type == MetricsEvent {
+				evt.Metrics <- cb.writeMetrics()
+				continue
+			}
+
+			if evt.Type == OperNoticeEvent {
+				cb.noticeOpers(SnomaskGeneral, evt.Notice)
+				continue
+			}
+
+			if evt.Type == PasswordCheckedEvent {
+				cb.passwordChecked(evt.Client, evt.PasswordCheck)
+				continue
+			}
+
 			log.Fatalf("Unexpected event: %d", evt.Type)
 		case <-cb.ShutdownChan:
 			return
@@ -508,6 +620,25 @@ func (cb *Catbox) eventLoop() {
 	}
 }
 
+// messageFromClient passes a message from a client to whatever the client is
+// now: unregistered, a user, or a server.
+func (cb *Catbox) messageFromClient(c *LocalClient, m irc.Message) {
+	lc, exists := cb.LocalClients[c.ID]
+	if exists {
+		lc.handleMessage(m)
+		return
+	}
+	lu, exists := cb.LocalUsers[c.ID]
+	if exists {
+		lu.handleMessage(m)
+		return
+	}
+	ls, exists := cb.LocalServers[c.ID]
+	if exists {
+		ls.handleMessage(m)
+	}
+}
+
 // Given a DeadClientEvent's error, translate that to a QUIT message.
 //
 // This is only appropriate for users.
@@ -554,7 +685,7 @@ func (cb *Catbox) errorToQuitMessage(err error) string {
 
 // shutdown starts server shutdown.
 func (cb *Catbox) shutdown() {
-	log.Printf("Server shutdown initiated.")
+	cb.logf(LogInfo, LogGeneral, "Server shutdown initiated.")
 
 	// Closing ShutdownChan indicates to other goroutines that we're shutting
 	// down.
@@ -562,13 +693,29 @@ func (cb *Catbox) shutdown() {
 
 	if cb.Listener != nil {
 		if err := cb.Listener.Close(); err != nil {
-			log.Printf("Error closing plaintext listener: %s", err)
+			cb.logf(LogWarn, LogGeneral, "Error closing plaintext listener: %s", err)
 		}
 	}
 
 	if cb.TLSListener != nil {
 		if err := cb.TLSListener.Close(); err != nil {
-			log.Printf("Error closing TLS listener: %s", err)
+			cb.logf(LogWarn, LogGeneral, "Error closing TLS listener: %s", err)
+		}
+	}
+
+	for _, t := range cb.I2PTunnels {
+		t.close()
+	}
+
+	if cb.ControlListener != nil {
+		if err := cb.ControlListener.Close(); err != nil {
+			cb.logf(LogWarn, LogGeneral, "Error closing control socket: %s", err)
+		}
+	}
+
+	if cb.MetricsServer != nil {
+		if err := cb.MetricsServer.Close(); err != nil {
+			cb.logf(LogWarn, LogGeneral, "Error closing metrics listener: %s", err)
 		}
 	}
 
@@ -616,14 +763,14 @@ func (cb *Catbox) acceptConnections(listener net.Listener) {
 
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %s", err)
+			cb.logf(LogWarn, LogClient, "Failed to accept connection: %s", err)
 			continue
 		}
 
 		cb.introduceClient(conn)
 	}
 
-	log.Printf("Connection accepter shutting down.")
+	cb.logf(LogInfo, LogGeneral, "Connection accepter shutting down.")
 }
 
 // introduceClient sets up a client we just accepted.
@@ -638,7 +785,13 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 
 		id := cb.getClientID()
 
-		client := NewLocalClient(cb, id, conn)
+		client, err := NewLocalClient(cb, id, conn)
+		if err != nil {
+			cb.logf(LogWarn, LogClient, "Rejecting connection from %s: %s",
+				conn.RemoteAddr(), err)
+			_ = conn.Close() // nolint: gosec
+			return
+		}
 
 		cb.WG.Add(1)
 		go client.writeLoop()
@@ -649,16 +802,17 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 		)
 
 		if client.isTLS() {
-			tlsVersion, tlsCipherSuite, err := client.getTLSState()
+			tlsVersion, tlsCipherSuite, certFP, err := client.getTLSState()
 			if err != nil {
-				log.Printf("Client %s: %s", client, err)
+				cb.logf(LogWarn, LogClient, "Client %s: %s", client, err)
 				close(client.WriteChan)
 				return
 			}
+			client.CertFP = certFP
 
 			if tlsVersion != "TLS 1.2" && tlsVersion != "TLS 1.3" {
-				cb.noticeOpers(fmt.Sprintf("Rejecting client %s using %s",
-					client.Conn.IP, tlsVersion))
+				cb.noticeOpers(SnomaskConnects, fmt.Sprintf("Rejecting client %s using %s",
+					client.address(), tlsVersion))
 				// Send ERROR and start up the writer to try to let them get it. Don't
 				// bother recording the client or starting the reader. We don't care.
 				client.messageFromServer("ERROR",
@@ -675,14 +829,20 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 			)
 		}
 
-		sendAuthNotice(client, "*** Looking up your hostname...")
-
-		hostname := lookupHostname(context.TODO(), client.Conn.IP)
-		if len(hostname) > 0 {
-			sendAuthNotice(client, "*** Found your hostname")
-			client.Hostname = hostname
+		// There's no DNS for I2P peers. Show a cloak of their destination.
+		if client.isI2P() {
+			client.Hostname = i2pCloak(client.Conn.I2PDest)
+			sendAuthNotice(client, "*** Connected over I2P. Your host is cloaked")
 		} else {
-			sendAuthNotice(client, "*** Couldn't look up your hostname")
+			sendAuthNotice(client, "*** Looking up your hostname...")
+
+			hostname := lookupHostname(context.TODO(), client.Conn.IP)
+			if len(hostname) > 0 {
+				sendAuthNotice(client, "*** Found your hostname")
+				client.Hostname = hostname
+			} else {
+				sendAuthNotice(client, "*** Couldn't look up your hostname")
+			}
 		}
 
 		// Inform the main server goroutine about the client.
@@ -739,7 +899,7 @@ func (cb *Catbox) alarm() {
 		cb.newEvent(Event{Type: WakeUpEvent})
 	}
 
-	log.Printf("Alarm shutting down.")
+	cb.logf(LogInfo, LogGeneral, "Alarm shutting down.")
 }
 
 // checkAndPingClients looks at each connected client.
@@ -1004,19 +1164,20 @@ func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
 
 		if linkInfo.TLS {
 			if strings.HasSuffix(linkInfo.Hostname, ".i2p") {
-				cb.noticeOpers(fmt.Sprintf("Connecting to %s with I2P and TLS...", linkInfo.Name))
+				cb.noticeOpers(SnomaskLinks, fmt.Sprintf(
+					"Connecting to %s with I2P and TLS...", linkInfo.Name))
 
-				cb.noticeOpers(fmt.Sprintf("Connecting to %s with I2P...",
+				cb.noticeOpers(SnomaskLinks, fmt.Sprintf("Connecting to %s with I2P...",
 					linkInfo.Name))
-				I2PSession, err := sam.I2PStreamSession(cb.Config.ListenI2P+"-tls-"+linkInfo.Hostname, cb.Config.SAMAddress, cb.Config.ListenI2P+"-tls-"+linkInfo.Hostname)
+				conn, err = cb.dialI2P(cb.Config.ListenI2P+"-tls-"+linkInfo.Hostname,
+					cb.Config.i2pLinkKeysFile("tls-"+linkInfo.Hostname),
+					linkInfo.Hostname)
 				if err == nil {
-					conn, err = I2PSession.Dial("tcp", linkInfo.Hostname)
-					if err == nil {
-						conn = tls.Client(conn, cb.TLSConfig)
-					}
+					conn = tls.Client(conn, cb.TLSConfig)
 				}
 			} else {
-				cb.noticeOpers(fmt.Sprintf("Connecting to %s with TLS...", linkInfo.Name))
+				cb.noticeOpers(SnomaskLinks, fmt.Sprintf("Connecting to %s with TLS...",
+					linkInfo.Name))
 
 				dialer := &net.Dialer{
 					Timeout: cb.Config.DeadTime,
@@ -1025,14 +1186,12 @@ func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
 					fmt.Sprintf("%s:%d", linkInfo.Hostname, linkInfo.Port), cb.TLSConfig)
 			}
 		} else if strings.HasSuffix(linkInfo.Hostname, ".i2p") {
-			cb.noticeOpers(fmt.Sprintf("Connecting to %s with I2P...",
+			cb.noticeOpers(SnomaskLinks, fmt.Sprintf("Connecting to %s with I2P...",
 				linkInfo.Name))
-			I2PSession, err := sam.I2PStreamSession(cb.Config.ListenI2P+"-"+linkInfo.Hostname, cb.Config.SAMAddress, cb.Config.ListenI2P+"-"+linkInfo.Hostname)
-			if err == nil {
-				conn, err = I2PSession.Dial("tcp", linkInfo.Hostname)
-			}
+			conn, err = cb.dialI2P(cb.Config.ListenI2P+"-"+linkInfo.Hostname,
+				cb.Config.i2pLinkKeysFile(linkInfo.Hostname), linkInfo.Hostname)
 		} else {
-			cb.noticeOpers(fmt.Sprintf("Connecting to %s without TLS...",
+			cb.noticeOpers(SnomaskLinks, fmt.Sprintf("Connecting to %s without TLS...",
 				linkInfo.Name))
 			conn, err = net.DialTimeout("tcp",
 				fmt.Sprintf("%s:%d", linkInfo.Hostname, linkInfo.Port),
@@ -1040,39 +1199,47 @@ func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
 		}
 
 		if err != nil {
-			cb.noticeOpers(fmt.Sprintf("Unable to connect to server [%s]: %s",
-				linkInfo.Name, err))
+			cb.noticeOpers(SnomaskLinks, fmt.Sprintf(
+				"Unable to connect to server [%s]: %s", linkInfo.Name, err))
 			return
 		}
 
 		id := cb.getClientID()
 
-		client := NewLocalClient(cb, id, conn)
+		client, err := NewLocalClient(cb, id, conn)
+		if err != nil {
+			cb.logf(LogWarn, LogLink, "Disconnecting from server %s: %s",
+				linkInfo.Name, err)
+			_ = conn.Close() // nolint: gosec
+			return
+		}
 
 		if linkInfo.TLS {
-			tlsVersion, tlsCipherSuite, err := client.getTLSState()
+			tlsVersion, tlsCipherSuite, certFP, err := client.getTLSState()
 			if err != nil {
-				log.Printf("Disconnecting from server %s: %s", linkInfo.Name, err)
+				cb.logf(LogWarn, LogLink, "Disconnecting from server %s: %s", linkInfo.Name,
+					err)
 				_ = conn.Close() // nolint: gosec
 				return
 			}
+			client.CertFP = certFP
 
 			if tlsVersion != "TLS 1.2" && tlsVersion != "TLS 1.3" {
-				cb.noticeOpers(fmt.Sprintf(
+				cb.noticeOpers(SnomaskLinks, fmt.Sprintf(
 					"Disconnecting from %s because of TLS version: %s", linkInfo.Name,
 					tlsVersion))
 				_ = conn.Close() // nolint: gosec
 				return
 			}
 
-			log.Printf("Connected to %s with %s (%s)", linkInfo.Name, tlsVersion,
-				tlsCipherSuite)
+			cb.logf(LogInfo, LogLink, "Connected to %s with %s (%s)", linkInfo.Name,
+				tlsVersion, tlsCipherSuite)
 		}
 
 		// Make sure we send to the client's write channel before telling the server
 		// about the client. It is possible otherwise that the server (if shutting
 		// down) could have closed the write channel on us.
-		client.sendServerIntro(linkInfo.Pass)
+		client.sendServerIntro(linkInfo.SendPass)
 
 		cb.newEvent(Event{Type: NewClientEvent, Client: client})
 
@@ -1103,37 +1270,35 @@ func (cb *Catbox) newEvent(evt Event) {
 	}
 }
 
-// Send a message to all operator users.
-func (cb *Catbox) noticeOpers(msg string) {
-	log.Printf("Global oper notice: %s", msg)
+// Send a message to all operator users who want notices of the given type
+// (their server notice mask).
+func (cb *Catbox) noticeOpers(snomask byte, msg string) {
+	cb.logf(LogInfo, LogOper, "Global oper notice (%c): %s", snomask, msg)
+	cb.sendOperNotice(snomask, msg)
+}
 
-	for _, user := range cb.Opers {
-		if user.isLocal() {
-			user.LocalUser.serverNotice(msg)
-			continue
-		}
+// sendOperNotice sends a message to all operator users who want notices of the
+// given type without logging it.
+//
+// Servers deliver it to their own operators. They know their server notice
+// masks.
+func (cb *Catbox) sendOperNotice(snomask byte, msg string) {
+	cb.sendSnomaskNotice(snomask, msg)
 
-		user.ClosestServer.maybeQueueMessage(irc.Message{
+	for _, server := range cb.LocalServers {
+		server.maybeQueueMessage(irc.Message{
 			Prefix:  string(cb.Config.TS6SID),
-			Command: "NOTICE",
-			Params: []string{
-				string(user.UID),
-				fmt.Sprintf("*** Notice --- %s", msg),
-			},
+			Command: "ENCAP",
+			Params:  []string{"*", "SNOTE", string(snomask), msg},
 		})
 	}
 }
 
-// Send a message to all local operator users.
-func (cb *Catbox) noticeLocalOpers(msg string) {
-	log.Printf("Local oper notice: %s", msg)
-
-	for _, user := range cb.Opers {
-		if user.isLocal() {
-			user.LocalUser.serverNotice(msg)
-			continue
-		}
-	}
+// Send a message to all local operator users who want notices of the given
+// type.
+func (cb *Catbox) noticeLocalOpers(snomask byte, msg string) {
+	cb.logf(LogInfo, LogOper, "Local oper notice (%c): %s", snomask, msg)
+	cb.sendSnomaskNotice(snomask, msg)
 }
 
 // Store a KLINE locally, and then check if any connected local users match
@@ -1141,7 +1306,7 @@ func (cb *Catbox) noticeLocalOpers(msg string) {
 //
 // This function does not propagate to any other servers.
 //
-// KLines are currently always permanent locally.
+// Temporary KLines expire in expireKLines().
 func (cb *Catbox) addAndApplyKLine(kline KLine, source, reason string) {
 	// If it's a duplicate KLINE, ignore it.
 	for _, k := range cb.KLines {
@@ -1151,15 +1316,18 @@ func (cb *Catbox) addAndApplyKLine(kline KLine, source, reason string) {
 		if k.HostMask != kline.HostMask {
 			continue
 		}
-		cb.noticeOpers(fmt.Sprintf("Ignoring duplicate K-Line for [%s@%s] from %s",
-			k.UserMask, k.HostMask, source))
+		cb.noticeOpers(SnomaskKLines, fmt.Sprintf(
+			"Ignoring duplicate K-Line for [%s@%s] from %s", k.UserMask, k.HostMask,
+			source))
 		return
 	}
 
 	cb.KLines = append(cb.KLines, kline)
+	cb.saveKLines()
 
-	cb.noticeOpers(fmt.Sprintf("%s added K-Line for [%s@%s] [%s]",
-		source, kline.UserMask, kline.HostMask, reason))
+	cb.noticeOpers(SnomaskKLines, fmt.Sprintf(
+		"%s added K-Line for [%s@%s] [%s] (%s)", source, kline.UserMask,
+		kline.HostMask, reason, kline.durationString()))
 
 	// Do we have any matching users connected? Cut them off if so.
 
@@ -1172,8 +1340,8 @@ func (cb *Catbox) addAndApplyKLine(kline KLine, source, reason string) {
 
 		user.quit(quitReason, true)
 
-		cb.noticeOpers(fmt.Sprintf("User disconnected due to K-Line: %s",
-			user.User.DisplayNick))
+		cb.noticeOpers(SnomaskKLines, fmt.Sprintf(
+			"User disconnected due to K-Line: %s", user.User.DisplayNick))
 	}
 }
 
@@ -1188,14 +1356,15 @@ func (cb *Catbox) removeKLine(userMask, hostMask, source string) bool {
 	}
 
 	if idx == -1 {
-		cb.noticeOpers(fmt.Sprintf("Not removing K-Line for [%s@%s] (not found)",
-			userMask, hostMask))
+		cb.noticeOpers(SnomaskKLines, fmt.Sprintf(
+			"Not removing K-Line for [%s@%s] (not found)", userMask, hostMask))
 		return false
 	}
 
 	cb.KLines = append(cb.KLines[:idx], cb.KLines[idx+1:]...)
+	cb.saveKLines()
 
-	cb.noticeOpers(fmt.Sprintf("%s removed K-Line for [%s@%s]",
+	cb.noticeOpers(SnomaskKLines, fmt.Sprintf("%s removed K-Line for [%s@%s]",
 		source, userMask, hostMask))
 
 	return true
@@ -1260,8 +1429,9 @@ func (cb *Catbox) issueKillToServer(ls *LocalServer, killer, killee *User,
 		sourceID = string(killer.UID)
 	}
 
-	cb.noticeOpers(fmt.Sprintf("Sending KILL message to %s for %s. From %s (%s)",
-		ls.Server.Name, killee.DisplayNick, killerName, message))
+	cb.noticeOpers(SnomaskGeneral, fmt.Sprintf(
+		"Sending KILL message to %s for %s. From %s (%s)", ls.Server.Name,
+		killee.DisplayNick, killerName, message))
 
 	return []Message{{
 		Target: ls.LocalClient,
@@ -1366,6 +1536,20 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 		})
 	}
 
+	// 330 RPL_WHOISACCOUNT. Non standard.
+	if len(user.Account) > 0 {
+		msgs = append(msgs, irc.Message{
+			Prefix:  from,
+			Command: "330",
+			Params: []string{
+				to,
+				user.DisplayNick,
+				user.Account,
+				"is logged in as",
+			},
+		})
+	}
+
 	// 313 RPL_WHOISOPERATOR
 	if user.isOperator() {
 		msgs = append(msgs, irc.Message{
@@ -1381,10 +1565,10 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 
 	// 671. Non standard. Ratbox uses it.
 	if user.isLocal() && user.LocalUser.isTLS() {
-		tlsVersion, tlsCipherSuite, err := user.LocalUser.getTLSState()
+		tlsVersion, tlsCipherSuite, _, err := user.LocalUser.getTLSState()
 		if err != nil {
-			log.Printf("Client %s: Unable to determine TLS state: %s", user.LocalUser,
-				err)
+			cb.logf(LogWarn, LogClient, "Client %s: Unable to determine TLS state: %s",
+				user.LocalUser, err)
 		} else {
 			msgs = append(msgs, irc.Message{
 				Prefix:  from,
@@ -1399,6 +1583,36 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 		}
 	}
 
+	// 276 RPL_WHOISCERTFP. Non standard. Only operators and the user see it.
+	if user.isLocal() && user.LocalUser.CertFP != "" &&
+		(replyUser.isOperator() || replyUser == user) {
+		msgs = append(msgs, irc.Message{
+			Prefix:  from,
+			Command: "276",
+			Params: []string{
+				to,
+				user.DisplayNick,
+				fmt.Sprintf("has client certificate fingerprint %s",
+					user.LocalUser.CertFP),
+			},
+		})
+	}
+
+	// 378 RPL_WHOISHOST. Non standard. Operators see the real I2P address of
+	// users connected over I2P.
+	if user.isLocal() && user.LocalUser.isI2P() && replyUser.isOperator() {
+		msgs = append(msgs, irc.Message{
+			Prefix:  from,
+			Command: "378",
+			Params: []string{
+				to,
+				user.DisplayNick,
+				fmt.Sprintf("is connecting from *@%s %s", user.LocalUser.Conn.I2PDest,
+					user.IP),
+			},
+		})
+	}
+
 	// 317 RPL_WHOISIDLE. Only if local.
 	if user.isLocal() {
 		idleDuration := time.Since(user.LocalUser.LastMessageTime)
@@ -1463,6 +1677,8 @@ func (cb *Catbox) updateCounters() {
 //
 // Forget the user from all records.
 func (cb *Catbox) quitRemoteUser(u *User, message string) {
+	cb.recordWhowas(u)
+
 	// Remove the user from each channel.
 	// Also, tell each local client that is in 1+ channel with the user that this
 	// user quit.
@@ -1515,20 +1731,43 @@ func (cb *Catbox) quitRemoteUser(u *User, message string) {
 func (cb *Catbox) rehash(byUser *User) {
 	cfg, err := checkAndParseConfig(cb.ConfigFile)
 	if err != nil {
-		cb.noticeOpers(fmt.Sprintf("Rehash: Configuration problem: %s", err))
+		cb.noticeOpers(SnomaskGeneral, fmt.Sprintf(
+			"Rehash: Configuration problem: %s", err))
 		return
 	}
 
+	oldCaps := cb.availableCaps()
+	oldISupport := cb.isupportTokens()
+
 	// Changing these requires closing/reopening listeners:
 	// ListenHost
 	// ListenPort
 	// ListenPortTLS
 
+	// We can re-create our I2P tunnels though. We keep the same destinations
+	// unless the keys files changed.
+	if cfg.ListenI2P != cb.Config.ListenI2P ||
+		cfg.ListenI2PTLS != cb.Config.ListenI2PTLS ||
+		cfg.SAMAddress != cb.Config.SAMAddress ||
+		cfg.I2PKeysFile != cb.Config.I2PKeysFile ||
+		cfg.I2PTLSKeysFile != cb.Config.I2PTLSKeysFile ||
+		cfg.I2PTunnel != cb.Config.I2PTunnel {
+		cb.Config.ListenI2P = cfg.ListenI2P
+		cb.Config.ListenI2PTLS = cfg.ListenI2PTLS
+		cb.Config.SAMAddress = cfg.SAMAddress
+		cb.Config.I2PKeysFile = cfg.I2PKeysFile
+		cb.Config.I2PTLSKeysFile = cfg.I2PTLSKeysFile
+		cb.Config.I2PTunnel = cfg.I2PTunnel
+		cb.restartI2PListeners()
+		cb.noticeOpers(SnomaskGeneral, "Rehash: Re-creating I2P tunnels")
+	}
+
 	cb.Config.CertificateFile = cfg.CertificateFile
 	cb.Config.KeyFile = cfg.KeyFile
 	if err := cb.loadCertificate(); err != nil {
-		cb.noticeOpers(fmt.Sprintf("Error loading certificate/key: %s", err))
-		log.Printf("%+v", err)
+		cb.noticeOpers(SnomaskGeneral, fmt.Sprintf(
+			"Error loading certificate/key: %s", err))
+		cb.logf(LogError, LogGeneral, "%+v", err)
 	}
 
 	// Changing these may require relinking servers as they are part of the
@@ -1538,8 +1777,15 @@ func (cb *Catbox) rehash(byUser *User) {
 
 	cb.Config.MOTD = cfg.MOTD
 
-	// MaxNickLength: I think this is not acceptable to change live. Live clients
-	// might turn out to be invalid, plus there is the issue of remote clients.
+	// MaxNickLength: I think it is not acceptable to decrease this live. Live
+	// clients might turn out to be invalid, plus there is the issue of remote
+	// clients. Increasing it is fine.
+	if cfg.MaxNickLength > cb.Config.MaxNickLength {
+		cb.Config.MaxNickLength = cfg.MaxNickLength
+	} else if cfg.MaxNickLength < cb.Config.MaxNickLength {
+		cb.noticeOpers(SnomaskGeneral,
+			"Rehash: Not decreasing max-nick-length. Restart to do so.")
+	}
 
 	cb.Config.PingTime = cfg.PingTime
 	cb.Config.DeadTime = cfg.DeadTime
@@ -1547,26 +1793,48 @@ func (cb *Catbox) rehash(byUser *User) {
 
 	// TS6SID: Changing this requires relinking. It is part of link handshake.
 
+	// AccountsFile, ChannelsFile, KLinesFile, DestBansFile: We load these only
+	// at startup.
+
+	// ControlSocket, MetricsListen: We open these only at startup.
+
+	// NickServ: It depends on the accounts store, so we only enable it at
+	// startup.
+
+	cb.Config.NickGracePeriod = cfg.NickGracePeriod
+
+	cb.Config.LogFile = cfg.LogFile
+	cb.Config.LogFormat = cfg.LogFormat
+	cb.Config.LogLevel = cfg.LogLevel
+	cb.Config.LogOperCategories = cfg.LogOperCategories
+	if err := cb.Logger.configure(cfg); err != nil {
+		cb.noticeOpers(SnomaskGeneral, fmt.Sprintf("Rehash: %s", err))
+	}
+
 	cb.Config.AdminEmail = cfg.AdminEmail
 
 	cb.Config.Opers = cfg.Opers
 	cb.Config.Servers = cfg.Servers
 	cb.Config.UserConfigs = cfg.UserConfigs
 
+	cb.notifyCapChanges(oldCaps, cb.availableCaps())
+	cb.notifyISupportChanges(oldISupport)
+
 	if byUser != nil {
-		cb.noticeOpers(fmt.Sprintf("%s rehashed configuration.",
+		cb.noticeOpers(SnomaskGeneral, fmt.Sprintf("%s rehashed configuration.",
 			byUser.DisplayNick))
 	} else {
-		cb.noticeOpers("Rehashed configuration.")
+		cb.noticeOpers(SnomaskGeneral, "Rehashed configuration.")
 	}
 }
 
 // Restart initiates shutdown and flags us so we restart our process.
 func (cb *Catbox) restart(byUser *User) {
 	if byUser != nil {
-		cb.noticeOpers(fmt.Sprintf("%s issued restart.", byUser.DisplayNick))
+		cb.noticeOpers(SnomaskGeneral, fmt.Sprintf("%s issued restart.",
+			byUser.DisplayNick))
 	} else {
-		cb.noticeOpers("Restarting.")
+		cb.noticeOpers(SnomaskGeneral, "Restarting.")
 	}
 
 	// We shutdown everything, then flag to restart. This means when we exit our
@@ -1598,6 +1866,97 @@ func (cb *Catbox) messageLocalUsersOnChannel(channel *Channel, m irc.Message) {
 	}
 }
 
+// saveUser changes a user's nick to their UID. This is TS6's SAVE. Unlike the
+// KILLs in handleCollision() it takes a nick from a user while leaving them
+// connected. We use it to enforce registered nicks.
+//
+// We tell local users and all servers.
+//
+// :<SID> SAVE <UID> <nick TS>
+//
+// If a server we link to does not support SAVE then we can't change the nick
+// network wide. We fall back to what TS6 does for collisions without SAVE and
+// KILL the user.
+func (cb *Catbox) saveUser(user *User) {
+	if !cb.linksHaveCapability("SAVE", nil) {
+		cb.issueKill(nil, user, "Nick enforcement (no SAVE)")
+		return
+	}
+
+	nickTS := user.NickTS
+
+	cb.changeNickToUID(user)
+
+	for _, server := range cb.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(cb.Config.TS6SID),
+			Command: "SAVE",
+			Params:  []string{string(user.UID), fmt.Sprintf("%d", nickTS)},
+		})
+	}
+}
+
+// linksHaveCapability checks whether all servers we link to support the given
+// capability. We don't check except if it is given.
+func (cb *Catbox) linksHaveCapability(capab string, except *LocalServer) bool {
+	for _, server := range cb.LocalServers {
+		if server == except {
+			continue
+		}
+		if !server.Server.hasCapability(capab) {
+			return false
+		}
+	}
+	return true
+}
+
+// changeNickToUID updates our records for a user that was SAVEd. Their nick
+// becomes their UID and their nick TS becomes 100, as TS6 specifies.
+//
+// This informs local users about the change, but no one else.
+func (cb *Catbox) changeNickToUID(user *User) {
+	nick := string(user.UID)
+
+	// Tell the user and our local clients who are in a channel with them. Tell
+	// each only once. This needs to come from the old nick!user@host.
+	m := irc.Message{
+		Prefix:  user.nickUhost(),
+		Command: "NICK",
+		Params:  []string{nick},
+	}
+
+	toldUsers := make(map[TS6UID]struct{})
+	if user.isLocal() {
+		user.LocalUser.maybeQueueMessage(m)
+		toldUsers[user.UID] = struct{}{}
+	}
+
+	for _, channel := range user.Channels {
+		for memberUID := range channel.Members {
+			member := cb.Users[memberUID]
+			if !member.isLocal() {
+				continue
+			}
+
+			_, exists := toldUsers[member.UID]
+			if exists {
+				continue
+			}
+			toldUsers[member.UID] = struct{}{}
+
+			member.LocalUser.maybeQueueMessage(m)
+		}
+	}
+
+	cb.recordWhowas(user)
+
+	delete(cb.Nicks, canonicalizeNick(user.DisplayNick))
+	cb.Nicks[canonicalizeNick(nick)] = user.UID
+
+	user.DisplayNick = nick
+	user.NickTS = 100
+}
+
 // Determine if there is a collision for the given nick.
 //
 // If there is, issue the appropriate kills.
@@ -1629,7 +1988,7 @@ func (cb *Catbox) handleCollision(fromServer *LocalServer, newUID TS6UID,
 	}
 
 	// Collision.
-	cb.noticeOpers(fmt.Sprintf("Collision for nick %s (%s and %s)",
+	cb.noticeOpers(SnomaskNicks, fmt.Sprintf("Collision for nick %s (%s and %s)",
 		canonicalizeNick(newNick), existingUID, newUID))
 
 	// The TS6 protocol defines the rules, including when we issue two KILLs
@@ -1647,8 +2006,9 @@ func (cb *Catbox) handleCollision(fromServer *LocalServer, newUID TS6UID,
 
 	existingUser, exists := cb.Users[existingUID]
 	if !exists {
-		log.Printf("User not found with UID %s. But UID has a nick! (%s)",
-			existingUID, canonicalizeNick(newNick))
+		cb.logf(LogWarn, LogGeneral,
+			"User not found with UID %s. But UID has a nick! (%s)", existingUID,
+			canonicalizeNick(newNick))
 		// TODO(horgh): Should we abort?
 	}
 
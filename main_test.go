@@ -70,3 +70,26 @@ func TestErrorToQuitMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestLinksHaveCapability(t *testing.T) {
+	withSave := &LocalServer{
+		Server: &Server{Capabs: map[string]struct{}{"SAVE": {}}},
+	}
+	withoutSave := &LocalServer{
+		Server: &Server{Capabs: map[string]struct{}{"TB": {}}},
+	}
+
+	cb := &Catbox{
+		LocalServers: map[uint64]*LocalServer{1: withSave, 2: withoutSave},
+	}
+
+	if cb.linksHaveCapability("SAVE", nil) {
+		t.Errorf("linksHaveCapability(SAVE, nil) = true, wanted false")
+	}
+	if !cb.linksHaveCapability("SAVE", withoutSave) {
+		t.Errorf("linksHaveCapability(SAVE, without SAVE) = false, wanted true")
+	}
+	if !cb.linksHaveCapability("TB", withSave) {
+		t.Errorf("linksHaveCapability(TB, with SAVE) = false, wanted true")
+	}
+}
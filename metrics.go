@@ -0,0 +1,230 @@
+package terrarium
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The most distinct commands we count separately. Clients may send anything as
+// a command. Beyond this many we count new commands as OTHER so a client can't
+// grow our metrics without bound.
+const maxMetricCommands = 100
+
+// How long we wait for the server goroutine to give us metrics.
+const metricsTimeout = 10 * time.Second
+
+// Metrics holds counters we serve on the metrics listener. Only the server
+// goroutine may touch these.
+type Metrics struct {
+	// Messages received from local clients, users, and servers by command.
+	Messages map[string]uint64
+
+	// Messages queued because a user hit flood control.
+	FloodQueued uint64
+
+	// Users we disconnected for excess flood.
+	ExcessFloodKills uint64
+
+	// Clients that disconnected or that we disconnected before they registered.
+	RegistrationFailures uint64
+
+	// Registrations (users and servers) by TLS version. Those not using TLS are
+	// counted as plaintext.
+	TLSVersions map[string]uint64
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		Messages:    make(map[string]uint64),
+		TLSVersions: make(map[string]uint64),
+	}
+}
+
+// countMessage records a message received from a local connection.
+func (m *Metrics) countMessage(command string) {
+	command = strings.ToUpper(command)
+	if _, exists := m.Messages[command]; !exists &&
+		len(m.Messages) >= maxMetricCommands {
+		command = "OTHER"
+	}
+	m.Messages[command]++
+}
+
+// countTLSVersion records how a client that just registered is connected.
+func (m *Metrics) countTLSVersion(c *LocalClient) {
+	if !c.isTLS() {
+		m.TLSVersions["plaintext"]++
+		return
+	}
+
+	version, _, _, err := c.getTLSState()
+	if err != nil {
+		version = "unknown"
+	}
+	m.TLSVersions[version]++
+}
+
+// listenMetrics starts serving metrics over HTTP.
+func (cb *Catbox) listenMetrics() error {
+	ln, err := net.Listen("tcp", cb.Config.MetricsListen)
+	if err != nil {
+		return errors.Wrap(err, "unable to listen for metrics")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", cb.metricsHandler)
+
+	cb.MetricsServer = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  metricsTimeout,
+		WriteTimeout: metricsTimeout,
+	}
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+
+		if err := cb.MetricsServer.Serve(ln); err != nil &&
+			err != http.ErrServerClosed {
+			cb.logf(LogError, LogGeneral, "Metrics listener failed: %s", err)
+		}
+
+		cb.logf(LogInfo, LogGeneral, "Metrics listener shutting down.")
+	}()
+
+	return nil
+}
+
+// metricsHandler serves a request for metrics. The server goroutine owns the
+// state we report, so we ask it to write them out for us.
+func (cb *Catbox) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	reply := make(chan []byte, 1)
+	cb.newEvent(Event{Type: MetricsEvent, Metrics: reply})
+
+	var buf []byte
+	select {
+	case buf = <-reply:
+	case <-cb.ShutdownChan:
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	case <-time.After(metricsTimeout):
+		http.Error(w, "timed out", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := w.Write(buf); err != nil {
+		cb.logf(LogWarn, LogGeneral, "Error writing metrics: %s", err)
+	}
+}
+
+// writeMetrics writes out our metrics in the Prometheus text format. Only the
+// server goroutine may call this.
+func (cb *Catbox) writeMetrics() []byte {
+	var buf bytes.Buffer
+
+	writeMetric(&buf, "terrarium_local_users", "gauge",
+		"Users connected to this server.", nil, uint64(len(cb.LocalUsers)))
+	writeMetric(&buf, "terrarium_global_users", "gauge",
+		"Users on the network.", nil, uint64(len(cb.Users)))
+	writeMetric(&buf, "terrarium_highest_local_users", "gauge",
+		"Most users connected to this server at once.", nil,
+		uint64(cb.HighestLocalUserCount))
+	writeMetric(&buf, "terrarium_highest_global_users", "gauge",
+		"Most users on the network at once.", nil,
+		uint64(cb.HighestGlobalUserCount))
+	writeMetric(&buf, "terrarium_local_servers", "gauge",
+		"Servers linked to this server.", nil, uint64(len(cb.LocalServers)))
+	writeMetric(&buf, "terrarium_servers", "gauge",
+		"Servers on the network, not counting this one.", nil,
+		uint64(len(cb.Servers)))
+	writeMetric(&buf, "terrarium_unregistered_clients", "gauge",
+		"Connections that have not yet registered.", nil,
+		uint64(len(cb.LocalClients)))
+	writeMetric(&buf, "terrarium_channels", "gauge",
+		"Channels on the network.", nil, uint64(len(cb.Channels)))
+	writeMetric(&buf, "terrarium_klines", "gauge",
+		"Active K-Lines.", nil, uint64(len(cb.KLines)))
+	writeMetric(&buf, "terrarium_dest_bans", "gauge",
+		"Active I2P destination bans.", nil, uint64(len(cb.DestBans)))
+
+	writeMetric(&buf, "terrarium_connections_total", "counter",
+		"User and server registrations.", nil, uint64(cb.ConnectionCount))
+	writeMetric(&buf, "terrarium_registration_failures_total", "counter",
+		"Clients that disconnected before registering.", nil,
+		cb.Metrics.RegistrationFailures)
+	writeMetric(&buf, "terrarium_flood_queued_total", "counter",
+		"Messages queued by flood control.", nil, cb.Metrics.FloodQueued)
+	writeMetric(&buf, "terrarium_excess_flood_total", "counter",
+		"Users disconnected for excess flood.", nil,
+		cb.Metrics.ExcessFloodKills)
+
+	writeMetricMap(&buf, "terrarium_messages_total", "counter",
+		"Messages received from local connections by command.", "command",
+		cb.Metrics.Messages)
+	writeMetricMap(&buf, "terrarium_tls_connections_total", "counter",
+		"User and server registrations by TLS version.", "version",
+		cb.Metrics.TLSVersions)
+
+	sendQueues := make(map[string]uint64)
+	for _, ls := range cb.LocalServers {
+		sendQueues[ls.Server.Name] = uint64(len(ls.WriteChan))
+	}
+	writeMetricMap(&buf, "terrarium_link_sendq", "gauge",
+		"Messages waiting to be sent to each linked server.", "server",
+		sendQueues)
+
+	return buf.Bytes()
+}
+
+// writeMetric writes a metric with HELP and TYPE lines.
+//
+// labels is a label name and value, or nil if the metric has none.
+func writeMetric(buf *bytes.Buffer, name, kind, help string, labels []string,
+	value uint64) {
+	_, _ = fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	_, _ = fmt.Fprintf(buf, "# TYPE %s %s\n", name, kind)
+	writeMetricValue(buf, name, labels, value)
+}
+
+// writeMetricMap writes a metric with one value per label value. We sort them so
+// the output is stable.
+func writeMetricMap(buf *bytes.Buffer, name, kind, help, label string,
+	values map[string]uint64) {
+	_, _ = fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	_, _ = fmt.Fprintf(buf, "# TYPE %s %s\n", name, kind)
+
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		writeMetricValue(buf, name, []string{label, k}, values[k])
+	}
+}
+
+func writeMetricValue(buf *bytes.Buffer, name string, labels []string,
+	value uint64) {
+	if len(labels) == 2 {
+		_, _ = fmt.Fprintf(buf, "%s{%s=\"%s\"} %d\n", name, labels[0],
+			escapeLabelValue(labels[1]), value)
+		return
+	}
+	_, _ = fmt.Fprintf(buf, "%s %d\n", name, value)
+}
+
+// escapeLabelValue escapes a label value per the Prometheus text format.
+func escapeLabelValue(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
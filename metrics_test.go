@@ -0,0 +1,72 @@
+package terrarium
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMetricsCountMessage(t *testing.T) {
+	m := newMetrics()
+
+	m.countMessage("privmsg")
+	m.countMessage("PRIVMSG")
+
+	for i := 0; len(m.Messages) < maxMetricCommands; i++ {
+		m.countMessage(fmt.Sprintf("CMD%d", i))
+	}
+
+	m.countMessage("NEWCOMMAND")
+	m.countMessage("PRIVMSG")
+
+	if m.Messages["PRIVMSG"] != 3 {
+		t.Errorf("PRIVMSG count = %d, wanted 3", m.Messages["PRIVMSG"])
+	}
+
+	if _, exists := m.Messages["NEWCOMMAND"]; exists {
+		t.Errorf("counted NEWCOMMAND separately after reaching the limit")
+	}
+
+	if m.Messages["OTHER"] != 1 {
+		t.Errorf("OTHER count = %d, wanted 1", m.Messages["OTHER"])
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	cb := &Catbox{
+		LocalClients: map[uint64]*LocalClient{},
+		LocalUsers:   map[uint64]*LocalUser{1: {}, 2: {}},
+		LocalServers: map[uint64]*LocalServer{},
+		Users:        map[TS6UID]*User{"000AAAAAA": {}, "000AAAAAB": {}, "001AAAAAA": {}},
+		Servers:      map[TS6SID]*Server{},
+		Channels:     map[string]*Channel{"#test": {}},
+		KLines:       []KLine{{UserMask: "*", HostMask: "example.com"}},
+		Metrics:      newMetrics(),
+	}
+
+	cb.Metrics.countMessage("PRIVMSG")
+	cb.Metrics.countMessage("NICK")
+	cb.Metrics.ExcessFloodKills = 4
+	cb.Metrics.TLSVersions["TLS 1.3"] = 5
+
+	output := string(cb.writeMetrics())
+
+	expected := []string{
+		"# TYPE terrarium_local_users gauge",
+		"terrarium_local_users 2",
+		"terrarium_global_users 3",
+		"terrarium_channels 1",
+		"terrarium_klines 1",
+		"terrarium_excess_flood_total 4",
+		"# TYPE terrarium_messages_total counter",
+		`terrarium_messages_total{command="NICK"} 1` + "\n" +
+			`terrarium_messages_total{command="PRIVMSG"} 1`,
+		`terrarium_tls_connections_total{version="TLS 1.3"} 5`,
+	}
+
+	for _, e := range expected {
+		if !strings.Contains(output, e+"\n") {
+			t.Errorf("writeMetrics() output is missing %q. Output:\n%s", e, output)
+		}
+	}
+}
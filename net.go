@@ -15,23 +15,38 @@ type Conn struct {
 	conn   net.Conn
 	rw     *bufio.ReadWriter
 	ioWait time.Duration
-	IP     net.IP
+
+	// The peer's IP. nil if they are connected over I2P.
+	IP net.IP
+
+	// The peer's base32 I2P address if they are connected over I2P.
+	I2PDest string
 }
 
 // NewConn initializes a Conn struct
-func NewConn(conn net.Conn, ioWait time.Duration) Conn {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", conn.RemoteAddr().String())
-	// This shouldn't happen.
-	if err != nil {
-		log.Fatalf("Unable to resolve TCP address: %s", err)
-	}
-
-	return Conn{
+func NewConn(conn net.Conn, ioWait time.Duration) (Conn, error) {
+	c := Conn{
 		conn:   conn,
 		rw:     bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
 		ioWait: ioWait,
-		IP:     tcpAddr.IP,
 	}
+
+	if isI2PAddr(conn.RemoteAddr()) {
+		dest, err := i2pDestination(conn.RemoteAddr())
+		if err != nil {
+			return Conn{}, err
+		}
+		c.I2PDest = dest
+		return c, nil
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", conn.RemoteAddr().String())
+	if err != nil {
+		return Conn{}, errors.Wrap(err, "unable to resolve TCP address")
+	}
+	c.IP = tcpAddr.IP
+
+	return c, nil
 }
 
 // Close closes the underlying connection
@@ -0,0 +1,658 @@
+package terrarium
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The nick our built-in nick service answers to. Users may not take it while
+// NickServ is enabled. See isServiceNick().
+const nickServNick = "NickServ"
+
+// The shortest password we accept when registering.
+const minPasswordLength = 6
+
+// nickServEnabled tells whether we offer NickServ.
+func (cb *Catbox) nickServEnabled() bool {
+	return cb.Config.NickServ && cb.Accounts != nil
+}
+
+// isNickServNick tells whether the nick is the one NickServ uses.
+func isNickServNick(nick string) bool {
+	return canonicalizeNick(nick) == canonicalizeNick(nickServNick)
+}
+
+// nickNeedsIdentify tells whether the user is on a registered nick without
+// being logged in to the account that owns it.
+func (cb *Catbox) nickNeedsIdentify(user *User) bool {
+	account := cb.accountForNick(user.DisplayNick)
+	if account == nil {
+		return false
+	}
+	return canonicalizeNick(account.Name) != canonicalizeNick(user.Account)
+}
+
+// Send the user a NOTICE from one of our services.
+func (u *LocalUser) serviceReply(service, text string) {
+	u.maybeQueueMessage(irc.Message{
+		Prefix: fmt.Sprintf("%s!%s@%s", service, service,
+			u.Catbox.Config.ServerName),
+		Command: "NOTICE",
+		Params:  []string{u.User.DisplayNick, text},
+	})
+}
+
+// Send the user a NOTICE from NickServ.
+func (u *LocalUser) nickServReply(text string) {
+	u.serviceReply(nickServNick, text)
+}
+
+// nickServCommand handles a request to NickServ. The user may send it with
+// NICKSERV (or NS), or by messaging NickServ.
+//
+// args is the request split into words. e.g. IDENTIFY hunter2
+func (u *LocalUser) nickServCommand(args []string) {
+	if !u.Catbox.nickServEnabled() {
+		// 421 ERR_UNKNOWNCOMMAND
+		u.messageFromServer("421", []string{"NICKSERV", "Unknown command"})
+		return
+	}
+
+	if len(args) == 0 {
+		u.nickServReply("Commands are REGISTER, IDENTIFY, GROUP, and DROP.")
+		return
+	}
+
+	subCommand := strings.ToUpper(args[0])
+	args = args[1:]
+
+	if subCommand == "REGISTER" {
+		u.nickServRegister(args)
+		return
+	}
+
+	if subCommand == "IDENTIFY" {
+		u.nickServIdentify(args)
+		return
+	}
+
+	if subCommand == "GROUP" {
+		u.nickServGroup()
+		return
+	}
+
+	if subCommand == "DROP" {
+		u.nickServDrop()
+		return
+	}
+
+	if subCommand == "HELP" {
+		u.nickServReply("REGISTER <password>: Register your current nick.")
+		u.nickServReply(
+			"IDENTIFY [account] <password>: Log in to your nick's account.")
+		u.nickServReply("GROUP: Add your current nick to your account.")
+		u.nickServReply("DROP: Remove your current nick from your account. " +
+			"If it is the account name, remove the account.")
+		return
+	}
+
+	u.nickServReply(fmt.Sprintf("Unknown command %s. Try HELP.", subCommand))
+}
+
+// Register the user's current nick as an account and log them in to it.
+//
+// REGISTER <password>
+func (u *LocalUser) nickServRegister(args []string) {
+	if len(args) == 0 {
+		u.nickServReply("Usage: REGISTER <password>")
+		return
+	}
+	password := args[0]
+
+	if len(u.User.Account) > 0 {
+		u.nickServReply(fmt.Sprintf("You are already logged in to %s.",
+			u.User.Account))
+		return
+	}
+
+	nick := u.User.DisplayNick
+
+	// Users we changed to their UID have no valid nick.
+	if !isValidNick(u.Catbox.Config.MaxNickLength, nick) {
+		u.nickServReply(fmt.Sprintf("You can't register %s.", nick))
+		return
+	}
+
+	if u.Catbox.accountForNick(nick) != nil {
+		u.nickServReply(fmt.Sprintf("%s is already registered.", nick))
+		return
+	}
+
+	if len(password) < minPasswordLength {
+		u.nickServReply(fmt.Sprintf(
+			"Your password must be at least %d characters.", minPasswordLength))
+		return
+	}
+
+	// Hashing is slow. Do it outside the server goroutine.
+	var hash []byte
+	started := u.checkPasswordAsync(
+		func() bool {
+			var err error
+			hash, err = bcrypt.GenerateFromPassword([]byte(password),
+				bcrypt.DefaultCost)
+			if err != nil {
+				u.Catbox.logf(LogError, LogGeneral, "Unable to hash password: %s",
+					err)
+				return false
+			}
+			return true
+		},
+		func(ok bool) {
+			if !ok {
+				u.nickServReply("Unable to register. Try again later.")
+				return
+			}
+			u.nickServRegistered(nick, string(hash))
+		},
+	)
+	if !started {
+		u.nickServReply("I'm still checking your last password. Try again.")
+	}
+}
+
+// nickServRegistered finishes REGISTER once we hashed the password.
+//
+// Things may have changed while we hashed. Check again.
+func (u *LocalUser) nickServRegistered(nick, hash string) {
+	if u.User.DisplayNick != nick {
+		u.nickServReply(fmt.Sprintf("You are no longer using %s.", nick))
+		return
+	}
+
+	if len(u.User.Account) > 0 {
+		u.nickServReply(fmt.Sprintf("You are already logged in to %s.",
+			u.User.Account))
+		return
+	}
+
+	if u.Catbox.accountForNick(nick) != nil {
+		u.nickServReply(fmt.Sprintf("%s is already registered.", nick))
+		return
+	}
+
+	account := &Account{
+		Name:         nick,
+		PasswordHash: hash,
+		RegisteredTS: time.Now().Unix(),
+	}
+	u.Catbox.Accounts[canonicalizeNick(nick)] = account
+	u.Catbox.saveAccounts()
+
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(u.Catbox.nickServMessage(account, "REGISTER",
+			account.PasswordHash))
+	}
+
+	u.nickServReply(fmt.Sprintf("%s is now registered.", nick))
+	u.logIn(account)
+}
+
+// Log the user in to an account.
+//
+// IDENTIFY [account] <password>
+//
+// If they don't name the account, use the one that owns their current nick.
+func (u *LocalUser) nickServIdentify(args []string) {
+	if len(args) == 0 {
+		u.nickServReply("Usage: IDENTIFY [account] <password>")
+		return
+	}
+
+	var account *Account
+	password := args[0]
+	if len(args) > 1 {
+		account = u.Catbox.getAccount(args[0])
+		password = args[1]
+	} else {
+		account = u.Catbox.accountForNick(u.User.DisplayNick)
+	}
+
+	if account == nil {
+		u.nickServReply("Invalid account or password.")
+		return
+	}
+
+	name := account.Name
+	hash := account.PasswordHash
+
+	started := u.checkPasswordAsync(
+		func() bool { return checkPasswordHash(hash, password) },
+		func(ok bool) {
+			// The account may have gone away while we checked.
+			account := u.Catbox.getAccount(name)
+			if !ok || account == nil {
+				u.nickServReply("Invalid account or password.")
+				return
+			}
+
+			if canonicalizeNick(u.User.Account) == canonicalizeNick(account.Name) {
+				u.nickServReply(fmt.Sprintf("You are already logged in to %s.",
+					account.Name))
+				return
+			}
+
+			u.nickServReply(fmt.Sprintf("You are now identified for %s.",
+				account.Name))
+			u.logIn(account)
+		},
+	)
+	if !started {
+		u.nickServReply("I'm still checking your last password. Try again.")
+	}
+}
+
+// Add the user's current nick to the account they are logged in to.
+func (u *LocalUser) nickServGroup() {
+	account := u.Catbox.getAccount(u.User.Account)
+	if account == nil {
+		u.nickServReply("You must identify first.")
+		return
+	}
+
+	nick := u.User.DisplayNick
+
+	if !isValidNick(u.Catbox.Config.MaxNickLength, nick) {
+		u.nickServReply(fmt.Sprintf("You can't group %s.", nick))
+		return
+	}
+
+	if u.Catbox.accountForNick(nick) != nil {
+		u.nickServReply(fmt.Sprintf("%s is already registered.", nick))
+		return
+	}
+
+	account.Nicks = append(account.Nicks, nick)
+	u.Catbox.saveAccounts()
+
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(u.Catbox.nickServMessage(account, "GROUP", nick))
+	}
+
+	u.nickServReply(fmt.Sprintf("%s is now grouped to %s.", nick, account.Name))
+}
+
+// Remove the user's current nick from the account they are logged in to. If
+// the nick is the account name, remove the account. Everyone logged in to it
+// gets logged out.
+func (u *LocalUser) nickServDrop() {
+	account := u.Catbox.getAccount(u.User.Account)
+	if account == nil {
+		u.nickServReply("You must identify first.")
+		return
+	}
+
+	nick := u.User.DisplayNick
+
+	if canonicalizeNick(nick) == canonicalizeNick(account.Name) {
+		for _, server := range u.Catbox.LocalServers {
+			server.maybeQueueMessage(u.Catbox.nickServMessage(account, "DROP"))
+		}
+
+		u.nickServReply(fmt.Sprintf("%s is no longer registered.", account.Name))
+		u.Catbox.dropAccount(account)
+		return
+	}
+
+	if !account.removeNick(nick) {
+		u.nickServReply(fmt.Sprintf("%s is not grouped to %s.", nick,
+			account.Name))
+		return
+	}
+	u.Catbox.saveAccounts()
+
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(u.Catbox.nickServMessage(account, "UNGROUP",
+			nick))
+	}
+
+	u.nickServReply(fmt.Sprintf("%s is no longer grouped to %s.", nick,
+		account.Name))
+}
+
+// logIn logs the user in to an account. We tell them, users with
+// account-notify, and all servers.
+func (u *LocalUser) logIn(account *Account) {
+	u.User.Account = account.Name
+	u.Catbox.notifyAccount(u.User)
+
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(suMessage(u.Catbox.Config.TS6SID, u.User))
+	}
+
+	// 900 RPL_LOGGEDIN
+	u.messageFromServer("900", []string{
+		u.User.nickUhost(),
+		account.Name,
+		fmt.Sprintf("You are now logged in as %s", account.Name),
+	})
+
+	delete(u.NickDeadlines, canonicalizeNick(account.Name))
+	u.checkNickProtection()
+}
+
+// logOut logs the user out of their account. We tell them, users with
+// account-notify, and all servers.
+func (u *LocalUser) logOut() {
+	u.User.Account = ""
+	u.Catbox.notifyAccount(u.User)
+
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(suMessage(u.Catbox.Config.TS6SID, u.User))
+	}
+
+	// 901 RPL_LOGGEDOUT
+	u.messageFromServer("901", []string{
+		u.User.nickUhost(),
+		"You are now logged out",
+	})
+
+	u.checkNickProtection()
+}
+
+// checkNickProtection decides whether the user must identify to keep their
+// nick. We call this whenever their nick or account changes.
+//
+// If they must, we give them the grace period to do so. If they are already in
+// a grace period we leave it be. enforceNicks() changes their nick once it
+// runs out.
+//
+// They get one grace period for each account's nicks until they identify. If
+// they used one of the account's nicks before, that deadline still holds, even
+// if it passed. Otherwise they could keep a nick by changing away from it and
+// back before it ran out.
+func (u *LocalUser) checkNickProtection() {
+	if !u.Catbox.nickServEnabled() || !u.Catbox.nickNeedsIdentify(u.User) {
+		u.NickEnforceTime = time.Time{}
+		return
+	}
+
+	account := canonicalizeNick(
+		u.Catbox.accountForNick(u.User.DisplayNick).Name)
+	if deadline, exists := u.NickDeadlines[account]; exists {
+		u.NickEnforceTime = deadline
+		return
+	}
+
+	if u.NickDeadlines == nil {
+		u.NickDeadlines = map[string]time.Time{}
+	}
+
+	if !u.NickEnforceTime.IsZero() {
+		u.NickDeadlines[account] = u.NickEnforceTime
+		return
+	}
+
+	u.NickEnforceTime = time.Now().Add(u.Catbox.Config.NickGracePeriod)
+	u.NickDeadlines[account] = u.NickEnforceTime
+
+	u.nickServReply(fmt.Sprintf(
+		"%s is registered. If it is yours, identify with /msg %s IDENTIFY <password>.",
+		u.User.DisplayNick, nickServNick))
+	u.nickServReply(fmt.Sprintf(
+		"If you do not identify within %s, I will change your nick.",
+		u.Catbox.Config.NickGracePeriod))
+}
+
+// checkNickProtections checks every local user's nick. We call this when
+// accounts change in a way that may protect or free nicks.
+func (cb *Catbox) checkNickProtections() {
+	for _, lu := range cb.LocalUsers {
+		lu.checkNickProtection()
+	}
+}
+
+// enforceNicks changes the nick of local users whose grace period ran out
+// without them identifying. Their nick becomes their UID.
+//
+// Each server enforces nicks for its own users.
+func (cb *Catbox) enforceNicks() {
+	if !cb.nickServEnabled() {
+		return
+	}
+
+	now := time.Now()
+	for _, lu := range cb.LocalUsers {
+		if lu.NickEnforceTime.IsZero() || now.Before(lu.NickEnforceTime) {
+			continue
+		}
+		lu.NickEnforceTime = time.Time{}
+
+		if !cb.nickNeedsIdentify(lu.User) {
+			continue
+		}
+
+		lu.nickServReply(fmt.Sprintf(
+			"You did not identify for %s. Changing your nick.", lu.User.DisplayNick))
+		cb.noticeLocalOpers(SnomaskNicks, fmt.Sprintf(
+			"Changing nick of %s as they did not identify", lu.User.DisplayNick))
+		cb.saveUser(lu.User)
+	}
+}
+
+// dropAccount removes an account. Local users logged in to it get logged out.
+//
+// This does not tell other servers. Their servers log out their users.
+func (cb *Catbox) dropAccount(account *Account) {
+	delete(cb.Accounts, canonicalizeNick(account.Name))
+	cb.saveAccounts()
+
+	for _, lu := range cb.LocalUsers {
+		if canonicalizeNick(lu.User.Account) == canonicalizeNick(account.Name) {
+			lu.logOut()
+		}
+	}
+}
+
+// Build an ENCAP NICKSERV message. This tells servers about a change to an
+// account.
+//
+// :<SID> ENCAP * NICKSERV <subcommand> <account> <account TS> [parameter]
+//
+// The subcommands are:
+//
+// REGISTER <account> <account TS> <password hash>
+// GROUP <account> <account TS> <nick>
+// UNGROUP <account> <account TS> <nick>
+// DROP <account> <account TS>
+//
+// The account TS identifies which registration of the account the change is
+// for.
+func (cb *Catbox) nickServMessage(account *Account, subCommand string,
+	params ...string) irc.Message {
+	return irc.Message{
+		Prefix:  string(cb.Config.TS6SID),
+		Command: "ENCAP",
+		Params: append([]string{
+			"*",
+			"NICKSERV",
+			subCommand,
+			account.Name,
+			fmt.Sprintf("%d", account.RegisteredTS),
+		}, params...),
+	}
+}
+
+// nickServBurst tells a server about our accounts. This is how both sides of a
+// new link come to agree about accounts.
+func (cb *Catbox) nickServBurst() []irc.Message {
+	var msgs []irc.Message
+	for _, account := range cb.Accounts {
+		msgs = append(msgs, cb.nickServMessage(account, "REGISTER",
+			account.PasswordHash))
+		for _, nick := range account.Nicks {
+			msgs = append(msgs, cb.nickServMessage(account, "GROUP", nick))
+		}
+	}
+	return msgs
+}
+
+// The NICKSERV command comes only in ENCAP messages. It tells us about a change
+// to an account. See nickServMessage() for its format.
+//
+// If we don't offer NickServ we ignore it. It was already propagated.
+func (s *LocalServer) nickServEncapCommand(m irc.Message) {
+	if !s.Catbox.nickServEnabled() {
+		return
+	}
+
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"NICKSERV", "Not enough parameters"})
+		return
+	}
+
+	subCommand := strings.ToUpper(m.Params[0])
+	name := m.Params[1]
+
+	accountTS, err := strconv.ParseInt(m.Params[2], 10, 64)
+	if err != nil {
+		s.Catbox.logf(LogWarn, LogLink, "Invalid NICKSERV account TS from %s: %s",
+			m.Prefix, m.Params[2])
+		return
+	}
+
+	existing := s.Catbox.getAccount(name)
+
+	if subCommand == "REGISTER" {
+		if len(m.Params) < 4 {
+			// 461 ERR_NEEDMOREPARAMS
+			s.messageFromServer("461", []string{"NICKSERV", "Not enough parameters"})
+			return
+		}
+
+		// The older registration wins. If it's ours, the other side drops theirs
+		// when it hears about ours.
+		if existing != nil && existing.RegisteredTS <= accountTS {
+			return
+		}
+
+		if existing != nil {
+			s.Catbox.noticeOpers(SnomaskGeneral, fmt.Sprintf(
+				"Replacing account %s with an older registration from %s", name,
+				s.Server.Name))
+			s.Catbox.dropAccount(existing)
+		}
+
+		s.Catbox.Accounts[canonicalizeNick(name)] = &Account{
+			Name:         name,
+			PasswordHash: m.Params[3],
+			RegisteredTS: accountTS,
+		}
+		s.Catbox.saveAccounts()
+		s.Catbox.checkNickProtections()
+		return
+	}
+
+	// The rest apply only to the registration we know.
+	if existing == nil || existing.RegisteredTS != accountTS {
+		return
+	}
+
+	if subCommand == "GROUP" {
+		if len(m.Params) < 4 {
+			// 461 ERR_NEEDMOREPARAMS
+			s.messageFromServer("461", []string{"NICKSERV", "Not enough parameters"})
+			return
+		}
+
+		if s.Catbox.accountForNick(m.Params[3]) != nil {
+			return
+		}
+
+		existing.Nicks = append(existing.Nicks, m.Params[3])
+		s.Catbox.saveAccounts()
+		s.Catbox.checkNickProtections()
+		return
+	}
+
+	if subCommand == "UNGROUP" {
+		if len(m.Params) < 4 {
+			// 461 ERR_NEEDMOREPARAMS
+			s.messageFromServer("461", []string{"NICKSERV", "Not enough parameters"})
+			return
+		}
+
+		if !existing.removeNick(m.Params[3]) {
+			return
+		}
+		s.Catbox.saveAccounts()
+		s.Catbox.checkNickProtections()
+		return
+	}
+
+	if subCommand == "DROP" {
+		s.Catbox.dropAccount(existing)
+		s.Catbox.checkNickProtections()
+		return
+	}
+
+	s.Catbox.logf(LogWarn, LogLink, "Unknown NICKSERV subcommand from %s: %s",
+		m.Prefix, subCommand)
+}
+
+// SAVE changes a user's nick to their UID. The server enforcing a nick sends
+// it. See saveUser().
+//
+// Parameters: <UID> <nick TS>
+// e.g. :000 SAVE 000AAAAAB 1475024621
+func (s *LocalServer) saveCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SAVE", "Not enough parameters"})
+		return
+	}
+
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists {
+		// The user may have quit while this was on its way. Ignore it.
+		s.Catbox.logf(LogWarn, LogLink, "SAVE for unknown user %s", m.Params[0])
+		return
+	}
+
+	nickTS, err := strconv.ParseInt(m.Params[1], 10, 64)
+	if err != nil {
+		s.quit("Invalid TS (SAVE)")
+		return
+	}
+
+	// If the TS differs then the user changed nick since the SAVE was sent. It
+	// does not apply to their current nick.
+	if nickTS != user.NickTS {
+		s.Catbox.logf(LogInfo, LogLink, "Ignoring SAVE for %s with old TS",
+			user.DisplayNick)
+		return
+	}
+
+	// We can't pass the SAVE on to servers that don't support it. Fall back to
+	// a KILL, as saveUser() does. This goes to the server that sent the SAVE
+	// too.
+	if !s.Catbox.linksHaveCapability("SAVE", s) {
+		s.Catbox.issueKill(nil, user, "Nick enforcement (no SAVE)")
+		return
+	}
+
+	s.Catbox.changeNickToUID(user)
+
+	for _, server := range s.Catbox.LocalServers {
+		if server == s {
+			continue
+		}
+		server.maybeQueueMessage(m)
+	}
+}
@@ -0,0 +1,157 @@
+package terrarium
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestAccountForNick(t *testing.T) {
+	cb := &Catbox{
+		Accounts: map[string]*Account{
+			"horgh": {Name: "horgh", Nicks: []string{"Horgh_", "will"}},
+			"other": {Name: "other"},
+		},
+	}
+
+	tests := []struct {
+		Nick    string
+		Account string
+	}{
+		{"horgh", "horgh"},
+		{"HORGH", "horgh"},
+		{"horgh_", "horgh"},
+		{"Will", "horgh"},
+		{"other", "other"},
+		{"nobody", ""},
+	}
+
+	for _, test := range tests {
+		account := cb.accountForNick(test.Nick)
+		name := ""
+		if account != nil {
+			name = account.Name
+		}
+		if name != test.Account {
+			t.Errorf("accountForNick(%s) = %s, wanted %s", test.Nick, name,
+				test.Account)
+		}
+	}
+}
+
+func TestNickNeedsIdentify(t *testing.T) {
+	cb := &Catbox{
+		Accounts: map[string]*Account{
+			"horgh": {Name: "horgh", Nicks: []string{"will"}},
+		},
+	}
+
+	tests := []struct {
+		User   *User
+		Output bool
+	}{
+		{&User{DisplayNick: "horgh"}, true},
+		{&User{DisplayNick: "horgh", Account: "Horgh"}, false},
+		{&User{DisplayNick: "will", Account: "horgh"}, false},
+		{&User{DisplayNick: "will", Account: "other"}, true},
+		{&User{DisplayNick: "nobody"}, false},
+	}
+
+	for _, test := range tests {
+		output := cb.nickNeedsIdentify(test.User)
+		if output != test.Output {
+			t.Errorf("nickNeedsIdentify(%s, %s) = %v, wanted %v",
+				test.User.DisplayNick, test.User.Account, output, test.Output)
+		}
+	}
+}
+
+func TestCheckNickProtection(t *testing.T) {
+	u := &LocalUser{
+		LocalClient: &LocalClient{
+			WriteChan: make(chan irc.Message, 100),
+			Catbox: &Catbox{
+				Config: &Config{
+					ServerName:      "irc.example.com",
+					NickServ:        true,
+					NickGracePeriod: time.Minute,
+				},
+				Accounts: map[string]*Account{
+					"horgh": {Name: "horgh", Nicks: []string{"will"}},
+				},
+			},
+		},
+		User: &User{DisplayNick: "horgh"},
+	}
+	u.User.LocalUser = u
+
+	u.checkNickProtection()
+	deadline := u.NickEnforceTime
+	if deadline.IsZero() {
+		t.Fatalf("no grace period on a registered nick")
+	}
+
+	// Changing to a nick that is not registered and back does not give them a
+	// new grace period. Nor does changing to another of the account's nicks.
+	for _, nick := range []string{"other", "horgh", "other", "will", "horgh"} {
+		u.User.DisplayNick = nick
+		u.checkNickProtection()
+
+		if nick == "other" {
+			if !u.NickEnforceTime.IsZero() {
+				t.Errorf("grace period on %s, wanted none", nick)
+			}
+			continue
+		}
+		if !u.NickEnforceTime.Equal(deadline) {
+			t.Errorf("grace period on %s ends %s, wanted %s", nick,
+				u.NickEnforceTime, deadline)
+		}
+	}
+
+	// Identifying forgets the deadline.
+	u.logIn(u.Catbox.Accounts["horgh"])
+	if !u.NickEnforceTime.IsZero() || len(u.NickDeadlines) != 0 {
+		t.Errorf("grace period after identifying, wanted none")
+	}
+}
+
+func TestSaveAccounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terrarium-accounts-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "accounts.json")
+
+	cb := &Catbox{
+		Config: &Config{AccountsFile: file},
+		Accounts: map[string]*Account{
+			"horgh": {Name: "horgh", PasswordHash: "hash", Nicks: []string{"will"},
+				RegisteredTS: 1234},
+		},
+	}
+	cb.saveAccounts()
+
+	accounts, err := loadAccounts(file)
+	if err != nil {
+		t.Fatalf("loadAccounts() failed: %s", err)
+	}
+
+	account, exists := accounts["horgh"]
+	if !exists {
+		t.Fatalf("loadAccounts() did not load horgh")
+	}
+
+	if account.PasswordHash != "hash" || account.RegisteredTS != 1234 ||
+		len(account.Nicks) != 1 || account.Nicks[0] != "will" {
+		t.Errorf("loadAccounts() = %+v, wanted what we saved", account)
+	}
+}
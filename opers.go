@@ -0,0 +1,302 @@
+package terrarium
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Operator privileges. An operator's class lists the ones they have.
+const (
+	// DIE.
+	PrivDie = "die"
+
+	// RESTART.
+	PrivRestart = "restart"
+
+	// REHASH.
+	PrivRehash = "rehash"
+
+	// KLINE and UNKLINE.
+	PrivKLine = "kline"
+
+	// KILL.
+	PrivKill = "kill"
+
+	// CONNECT.
+	PrivConnect = "connect"
+
+	// SQUIT.
+	PrivSquit = "squit"
+
+	// OPME.
+	PrivOpme = "opme"
+
+	// Operspy WHO and seeing secret channels in LIST.
+	PrivOperspy = "operspy"
+
+	// WALLOPS.
+	PrivWallops = "wallops"
+
+	// STATS.
+	PrivStats = "stats"
+
+	// DUMPSTATE.
+	PrivDumpState = "dumpstate"
+
+	// Overriding ChanServ: Dropping others' channels and viewing their access
+	// lists.
+	PrivServices = "services"
+)
+
+// All privileges we know.
+var allPrivileges = []string{PrivDie, PrivRestart, PrivRehash, PrivKLine,
+	PrivKill, PrivConnect, PrivSquit, PrivOpme, PrivOperspy, PrivWallops,
+	PrivStats, PrivDumpState, PrivServices}
+
+// The class operators defined in the old name = password format get. They may
+// do everything, as all operators could before classes.
+const legacyOperClass = "admin"
+
+// The prefix of keys in opers.conf that define classes.
+const operClassPrefix = "class:"
+
+// OperConfig defines an operator.
+type OperConfig struct {
+	// The name they give to OPER.
+	Name string
+
+	// A bcrypt hash of their password. If it does not look like a bcrypt hash
+	// we treat it as the password. It may be blank if they have a certificate
+	// fingerprint.
+	Password string
+
+	// If set, they must present a TLS client certificate with this SHA-256
+	// fingerprint (lowercase hex) to OPER.
+	CertFP string
+
+	// They must match <user mask>@<host mask> to OPER.
+	UserMask string
+	HostMask string
+
+	// Their class, and the privileges it gives.
+	Class      string
+	Privileges map[string]struct{}
+}
+
+// parseOpersConfig parses opers.conf.
+//
+// Classes look like this:
+// class:<class name> = <privilege>,<privilege>,...
+//
+// Operators look like this:
+// <name> = <password hash>,<user mask>@<host mask>,<class name>[,<certfp>]
+//
+// With a certificate fingerprint, the password hash may be blank. Then the
+// certificate is enough.
+//
+// We also accept the old format, <name> = <password>. These operators may OPER
+// from anywhere and have every privilege.
+func parseOpersConfig(m map[string]string) (map[string]*OperConfig, error) {
+	classes := map[string]map[string]struct{}{}
+	for k, v := range m {
+		if !strings.HasPrefix(k, operClassPrefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(k, operClassPrefix)
+		if len(name) == 0 {
+			return nil, fmt.Errorf("class with no name")
+		}
+
+		privileges, err := parsePrivileges(v)
+		if err != nil {
+			return nil, fmt.Errorf("class %s: %s", name, err)
+		}
+		classes[name] = privileges
+	}
+
+	if _, exists := classes[legacyOperClass]; !exists {
+		classes[legacyOperClass] = privilegeSet(allPrivileges)
+	}
+
+	opers := map[string]*OperConfig{}
+	for k, v := range m {
+		if strings.HasPrefix(k, operClassPrefix) {
+			continue
+		}
+
+		oper, err := parseOperConfig(k, v, classes)
+		if err != nil {
+			return nil, fmt.Errorf("oper %s: %s", k, err)
+		}
+		opers[k] = oper
+	}
+
+	return opers, nil
+}
+
+// parseOperConfig parses the value side of an operator definition.
+func parseOperConfig(name, s string,
+	classes map[string]map[string]struct{}) (*OperConfig, error) {
+	pieces := strings.Split(s, ",")
+
+	// Old format: The value is the password.
+	if len(pieces) == 1 {
+		if len(s) == 0 {
+			return nil, fmt.Errorf("you must specify a password")
+		}
+		return &OperConfig{
+			Name:       name,
+			Password:   s,
+			UserMask:   "*",
+			HostMask:   "*",
+			Class:      legacyOperClass,
+			Privileges: classes[legacyOperClass],
+		}, nil
+	}
+
+	if len(pieces) != 3 && len(pieces) != 4 {
+		return nil, fmt.Errorf("unexpected number of fields")
+	}
+
+	certFP := ""
+	if len(pieces) == 4 {
+		fp, err := parseCertFP(pieces[3])
+		if err != nil {
+			return nil, err
+		}
+		certFP = fp
+	}
+
+	password := strings.TrimSpace(pieces[0])
+	if len(password) == 0 && certFP == "" {
+		return nil, fmt.Errorf("you must specify a password")
+	}
+
+	mask := strings.Split(strings.TrimSpace(pieces[1]), "@")
+	if len(mask) != 2 || !isValidUserMask(mask[0]) ||
+		!isValidHostMask(mask[1]) {
+		return nil, fmt.Errorf("invalid mask: %s", pieces[1])
+	}
+
+	class := strings.TrimSpace(pieces[2])
+	privileges, exists := classes[class]
+	if !exists {
+		return nil, fmt.Errorf("unknown class: %s", class)
+	}
+
+	return &OperConfig{
+		Name:       name,
+		Password:   password,
+		CertFP:     certFP,
+		UserMask:   mask[0],
+		HostMask:   mask[1],
+		Class:      class,
+		Privileges: privileges,
+	}, nil
+}
+
+// parsePrivileges parses a comma separated list of privileges.
+func parsePrivileges(s string) (map[string]struct{}, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if len(name) == 0 {
+			continue
+		}
+
+		known := false
+		for _, p := range allPrivileges {
+			if p == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown privilege: %s", name)
+		}
+
+		names = append(names, name)
+	}
+
+	return privilegeSet(names), nil
+}
+
+func privilegeSet(names []string) map[string]struct{} {
+	privileges := map[string]struct{}{}
+	for _, name := range names {
+		privileges[name] = struct{}{}
+	}
+	return privileges
+}
+
+// checkPassword says whether the password is the operator's.
+func (o *OperConfig) checkPassword(password string) bool {
+	return checkPassword(o.Password, password)
+}
+
+// checkCredentials says whether a user may OPER as the operator with the
+// password they gave and the fingerprint of their certificate. The fingerprint
+// is blank if they have no certificate.
+func (o *OperConfig) checkCredentials(password, certFP string) bool {
+	if o.CertFP != "" && o.CertFP != certFP {
+		return false
+	}
+
+	if o.Password == "" {
+		return true
+	}
+
+	return o.checkPassword(password)
+}
+
+func (o *OperConfig) hasPrivilege(privilege string) bool {
+	_, exists := o.Privileges[privilege]
+	return exists
+}
+
+// privilegesString lists an operator's privileges.
+func (o *OperConfig) privilegesString() string {
+	var privileges []string
+	for p := range o.Privileges {
+		privileges = append(privileges, p)
+	}
+	sort.Strings(privileges)
+	return strings.Join(privileges, " ")
+}
+
+// hasPrivilege says whether the user is an operator with the given privilege.
+//
+// We look up their operator definition each time so a rehash changes what they
+// may do.
+func (u *LocalUser) hasPrivilege(privilege string) bool {
+	if !u.User.isOperator() {
+		return false
+	}
+
+	oper, exists := u.Catbox.Config.Opers[u.OperName]
+	if !exists {
+		return false
+	}
+	return oper.hasPrivilege(privilege)
+}
+
+// checkPrivilege says whether the user is an operator with the given
+// privilege. If they are not, we tell them.
+func (u *LocalUser) checkPrivilege(privilege string) bool {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return false
+	}
+
+	if !u.hasPrivilege(privilege) {
+		// 723 ERR_NOPRIVS
+		u.messageFromServer("723", []string{privilege,
+			"Insufficient oper privileges"})
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,127 @@
+package terrarium
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseOpersConfig(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("error hashing password: %s", err)
+	}
+
+	opers, err := parseOpersConfig(map[string]string{
+		"class:moderator": "kline, kill",
+		"horgh":           "testing",
+		"will":            string(hash) + ",*@*.example.com,moderator",
+	})
+	if err != nil {
+		t.Fatalf("parseOpersConfig() failed: %s", err)
+	}
+
+	tests := []struct {
+		Name      string
+		Password  string
+		Privilege string
+		Output    bool
+	}{
+		{"horgh", "testing", PrivDie, true},
+		{"horgh", "testing", PrivKLine, true},
+		{"will", "hunter2", PrivKLine, true},
+		{"will", "hunter2", PrivKill, true},
+		{"will", "hunter2", PrivDie, false},
+		{"will", "hunter2", PrivRehash, false},
+	}
+
+	for _, test := range tests {
+		oper, exists := opers[test.Name]
+		if !exists {
+			t.Errorf("parseOpersConfig() did not define %s", test.Name)
+			continue
+		}
+
+		if !oper.checkPassword(test.Password) {
+			t.Errorf("%s checkPassword(%s) = false, wanted true", test.Name,
+				test.Password)
+		}
+		if oper.checkPassword(test.Password + "x") {
+			t.Errorf("%s checkPassword(%sx) = true, wanted false", test.Name,
+				test.Password)
+		}
+
+		if oper.hasPrivilege(test.Privilege) != test.Output {
+			t.Errorf("%s hasPrivilege(%s) = %v, wanted %v", test.Name,
+				test.Privilege, !test.Output, test.Output)
+		}
+	}
+
+	if opers["will"].HostMask != "*.example.com" {
+		t.Errorf("will's host mask = %s, wanted *.example.com",
+			opers["will"].HostMask)
+	}
+
+	bad := []map[string]string{
+		{"horgh": "testing,*@*"},
+		{"horgh": "testing,*@*,nosuchclass"},
+		{"horgh": "testing,nomask,admin"},
+		{"class:bad": "kline,fly"},
+		{"horgh": ""},
+	}
+	for _, m := range bad {
+		if _, err := parseOpersConfig(m); err == nil {
+			t.Errorf("parseOpersConfig(%v) succeeded, wanted error", m)
+		}
+	}
+}
+
+func TestOperCheckCredentials(t *testing.T) {
+	fp := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	other := "f" + fp[1:]
+
+	opers, err := parseOpersConfig(map[string]string{
+		"horgh": "testing",
+		"will":  "testing,*@*,admin," + fp,
+		"ada":   ",*@*,admin," + fp,
+	})
+	if err != nil {
+		t.Fatalf("parseOpersConfig() failed: %s", err)
+	}
+
+	tests := []struct {
+		Name     string
+		Password string
+		CertFP   string
+		Output   bool
+	}{
+		{"horgh", "testing", "", true},
+		{"horgh", "testing", fp, true},
+		{"horgh", "wrong", fp, false},
+		{"will", "testing", fp, true},
+		{"will", "testing", other, false},
+		{"will", "testing", "", false},
+		{"will", "wrong", fp, false},
+		{"ada", "anything", fp, true},
+		{"ada", "anything", other, false},
+		{"ada", "anything", "", false},
+	}
+
+	for _, test := range tests {
+		output := opers[test.Name].checkCredentials(test.Password, test.CertFP)
+		if output != test.Output {
+			t.Errorf("%s checkCredentials(%s, %s) = %v, wanted %v", test.Name,
+				test.Password, test.CertFP, output, test.Output)
+		}
+	}
+
+	bad := []string{
+		",*@*,admin",
+		"testing,*@*,admin,nothex",
+	}
+	for _, v := range bad {
+		if _, err := parseOpersConfig(map[string]string{"horgh": v}); err == nil {
+			t.Errorf("parseOpersConfig(%s) succeeded, wanted error", v)
+		}
+	}
+}
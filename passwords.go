@@ -0,0 +1,48 @@
+package terrarium
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// isPasswordHash says whether a password from a config looks like a bcrypt
+// hash rather than the password itself.
+func isPasswordHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") ||
+		strings.HasPrefix(s, "$2y$")
+}
+
+// checkPassword says whether a password matches one from a config. The one
+// from the config may be a bcrypt hash or the password itself. Either way the
+// comparison takes the same time however much of the password is right.
+func checkPassword(configured, password string) bool {
+	if isPasswordHash(configured) {
+		return bcrypt.CompareHashAndPassword([]byte(configured),
+			[]byte(password)) == nil
+	}
+
+	return subtle.ConstantTimeCompare([]byte(configured), []byte(password)) == 1
+}
+
+// HashPassword makes a bcrypt hash of a password for a config. terrarium
+// mkpasswd uses this.
+//
+// Cost is the bcrypt cost. 0 means the default.
+func HashPassword(password string, cost int) (string, error) {
+	if len(password) == 0 {
+		return "", errors.New("password may not be blank")
+	}
+
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to hash password")
+	}
+	return string(hash), nil
+}
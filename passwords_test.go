@@ -0,0 +1,130 @@
+package terrarium
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("hunter2", 4)
+	if err != nil {
+		t.Fatalf("HashPassword() failed: %s", err)
+	}
+
+	tests := []struct {
+		Configured string
+		Password   string
+		Output     bool
+	}{
+		{hash, "hunter2", true},
+		{hash, "hunter3", false},
+		{hash, hash, false},
+		{hash, "", false},
+		{"testing", "testing", true},
+		{"testing", "testin", false},
+		{"testing", "", false},
+	}
+
+	for _, test := range tests {
+		output := checkPassword(test.Configured, test.Password)
+		if output != test.Output {
+			t.Errorf("checkPassword(%s, %s) = %v, wanted %v", test.Configured,
+				test.Password, output, test.Output)
+		}
+	}
+
+	if _, err := HashPassword("", 0); err == nil {
+		t.Errorf("HashPassword() of a blank password succeeded, wanted error")
+	}
+}
+
+func TestParseLink(t *testing.T) {
+	hash, err := HashPassword("hunter2", 4)
+	if err != nil {
+		t.Fatalf("HashPassword() failed: %s", err)
+	}
+
+	tests := []struct {
+		Value      string
+		SendPass   string
+		AcceptPass string
+		TLS        bool
+		Success    bool
+	}{
+		{"127.0.0.1,6697,testing,1", "testing", "testing", true, true},
+		{"127.0.0.1,6667,testing,0,other", "testing", "other", false, true},
+		{"127.0.0.1,6697,testing,1," + hash, "testing", hash, true, true},
+		{"127.0.0.1,6697," + hash + ",1", "", "", false, false},
+		{"127.0.0.1,6697,testing,1,", "", "", false, false},
+		{"127.0.0.1,6697,,1", "", "", false, false},
+		{"127.0.0.1,6697,testing", "", "", false, false},
+		{"127.0.0.1,6697,testing,1,testing,abc", "", "", false, false},
+	}
+
+	for _, test := range tests {
+		link, err := parseLink("irc.example.com", test.Value)
+		if !test.Success {
+			if err == nil {
+				t.Errorf("parseLink(%s) succeeded, wanted error", test.Value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLink(%s) failed: %s", test.Value, err)
+			continue
+		}
+
+		if link.SendPass != test.SendPass || link.AcceptPass != test.AcceptPass ||
+			link.TLS != test.TLS {
+			t.Errorf("parseLink(%s) = %s/%s/%v, wanted %s/%s/%v", test.Value,
+				link.SendPass, link.AcceptPass, link.TLS, test.SendPass,
+				test.AcceptPass, test.TLS)
+		}
+	}
+}
+
+func TestParseCertFP(t *testing.T) {
+	fp := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		Input   string
+		Output  string
+		Success bool
+	}{
+		{fp, fp, true},
+		{strings.ToUpper(fp), fp, true},
+		{" 01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF ",
+			fp, true},
+		{fp[1:], "", false},
+		{"z" + fp[1:], "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		output, err := parseCertFP(test.Input)
+		if !test.Success {
+			if err == nil {
+				t.Errorf("parseCertFP(%s) succeeded, wanted error", test.Input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCertFP(%s) failed: %s", test.Input, err)
+			continue
+		}
+		if output != test.Output {
+			t.Errorf("parseCertFP(%s) = %s, wanted %s", test.Input, output,
+				test.Output)
+		}
+	}
+
+	link, err := parseLink("irc.example.com",
+		"127.0.0.1,6697,testing,1,testing,"+strings.ToUpper(fp))
+	if err != nil {
+		t.Fatalf("parseLink() failed: %s", err)
+	}
+	if link.CertFP != fp {
+		t.Errorf("parseLink() certificate fingerprint = %s, wanted %s",
+			link.CertFP, fp)
+	}
+}
@@ -0,0 +1,677 @@
+package terrarium
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eyedeekay/sam3"
+	"github.com/eyedeekay/sam3/i2pkeys"
+	"github.com/pkg/errors"
+)
+
+// I2PTunnelConfig holds the settings for our I2P tunnels. We pass them to the
+// SAM bridge when we create sessions, both for listening and for linking to
+// servers.
+type I2PTunnelConfig struct {
+	// Hops in each inbound and outbound tunnel.
+	Length int
+
+	// Tunnels in each direction.
+	Quantity int
+
+	// Standby tunnels in each direction.
+	BackupQuantity int
+
+	// How much the router may randomly vary the length of tunnels.
+	LengthVariance int
+
+	// Lease set encryption types, such as 4,0.
+	LeaseSetEncType string
+}
+
+// parseI2PTunnelConfig reads the I2P tunnel settings from the config.
+func parseI2PTunnelConfig(m map[string]string) (I2PTunnelConfig, error) {
+	c := I2PTunnelConfig{
+		Length:          3,
+		Quantity:        3,
+		BackupQuantity:  2,
+		LengthVariance:  0,
+		LeaseSetEncType: "4,0",
+	}
+
+	ints := []struct {
+		Key   string
+		Value *int
+		Min   int
+		Max   int
+	}{
+		{"i2p-tunnel-length", &c.Length, 0, 7},
+		{"i2p-tunnel-quantity", &c.Quantity, 1, 16},
+		{"i2p-tunnel-backup-quantity", &c.BackupQuantity, 0, 16},
+		{"i2p-tunnel-variance", &c.LengthVariance, -7, 7},
+	}
+	for _, i := range ints {
+		if m[i.Key] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(m[i.Key])
+		if err != nil || n < i.Min || n > i.Max {
+			return I2PTunnelConfig{}, fmt.Errorf(
+				"%s must be a number from %d to %d", i.Key, i.Min, i.Max)
+		}
+		*i.Value = n
+	}
+
+	if m["i2p-lease-set-enc-type"] != "" {
+		for _, t := range strings.Split(m["i2p-lease-set-enc-type"], ",") {
+			if _, err := strconv.Atoi(strings.TrimSpace(t)); err != nil {
+				return I2PTunnelConfig{}, fmt.Errorf(
+					"i2p-lease-set-enc-type must be a list of numbers: %s",
+					m["i2p-lease-set-enc-type"])
+			}
+		}
+		c.LeaseSetEncType = strings.Replace(m["i2p-lease-set-enc-type"], " ", "",
+			-1)
+	}
+
+	return c, nil
+}
+
+// samOptions turns the settings into SAM session options.
+func (c I2PTunnelConfig) samOptions() []string {
+	return []string{
+		fmt.Sprintf("inbound.length=%d", c.Length),
+		fmt.Sprintf("outbound.length=%d", c.Length),
+		fmt.Sprintf("inbound.quantity=%d", c.Quantity),
+		fmt.Sprintf("outbound.quantity=%d", c.Quantity),
+		fmt.Sprintf("inbound.backupQuantity=%d", c.BackupQuantity),
+		fmt.Sprintf("outbound.backupQuantity=%d", c.BackupQuantity),
+		fmt.Sprintf("inbound.lengthVariance=%d", c.LengthVariance),
+		fmt.Sprintf("outbound.lengthVariance=%d", c.LengthVariance),
+		"i2cp.leaseSetEncType=" + c.LeaseSetEncType,
+	}
+}
+
+// The sam3 helper, which earlier versions used, named keys files with this
+// suffix.
+const i2pKeysSuffix = ".i2p.private"
+
+// i2pLinkKeysFile tells where we keep the keys for a link to a server over
+// I2P. They go beside our own keys, named after the link, as earlier versions
+// kept them: <listen-i2p>-<name>.i2p.private.
+func (c *Config) i2pLinkKeysFile(name string) string {
+	return strings.TrimSuffix(c.I2PKeysFile, i2pKeysSuffix) + "-" + name +
+		i2pKeysSuffix
+}
+
+// loadI2PKeys loads I2P keys from a file. If the file does not exist, we have
+// the SAM bridge make new keys and we save them there. Either way the
+// destination stays the same from then on.
+func loadI2PKeys(s *sam3.SAM, file string) (i2pkeys.I2PKeys, error) {
+	_, err := os.Stat(file)
+	if err == nil {
+		keys, err := i2pkeys.LoadKeys(file)
+		if err != nil {
+			return i2pkeys.I2PKeys{}, errors.Wrapf(err,
+				"unable to load I2P keys from %s", file)
+		}
+		return keys, nil
+	}
+	if !os.IsNotExist(err) {
+		return i2pkeys.I2PKeys{}, errors.Wrap(err, "unable to check I2P keys file")
+	}
+
+	keys, err := s.NewKeys()
+	if err != nil {
+		return i2pkeys.I2PKeys{}, errors.Wrap(err, "unable to create I2P keys")
+	}
+
+	// We must not leave a partial file behind. We would fail to load it next
+	// time. writeFileAtomic() also makes it so only we may read them. The keys
+	// are our identity.
+	buf := &bytes.Buffer{}
+	if err := i2pkeys.StoreKeysIncompat(keys, buf); err != nil {
+		return i2pkeys.I2PKeys{}, errors.Wrap(err, "unable to encode I2P keys")
+	}
+
+	if err := writeFileAtomic(file, buf.Bytes()); err != nil {
+		return i2pkeys.I2PKeys{}, errors.Wrap(err, "unable to save I2P keys")
+	}
+
+	return keys, nil
+}
+
+const (
+	// How long we wait before trying to reconnect to the SAM bridge again after
+	// failing to. We double it each time we fail, up to the maximum.
+	i2pMinReconnectDelay = 5 * time.Second
+	i2pMaxReconnectDelay = 5 * time.Minute
+
+	// How many times in a row accepting an I2P connection may fail before we
+	// decide the session is gone. One failure may only mean a peer gave up while
+	// connecting.
+	i2pMaxAcceptFailures = 3
+
+	// How long we wait after accepting fails before trying again.
+	i2pAcceptRetryDelay = time.Second
+)
+
+// i2pTunnel is a session with the SAM bridge. We accept connections on it if
+// it is one of our listeners, or dial out on it to link to a server.
+//
+// Any goroutine may use it.
+type i2pTunnel struct {
+	// The session's nickname with the SAM bridge.
+	name string
+
+	keysFile   string
+	samAddress string
+	options    []string
+
+	// If set, we speak TLS on connections we accept.
+	tlsConfig *tls.Config
+
+	// How long we wait between attempts to reconnect to the SAM bridge, and
+	// between attempts to accept a connection.
+	minReconnectDelay time.Duration
+	maxReconnectDelay time.Duration
+	acceptRetryDelay  time.Duration
+
+	// Closed when we close the tunnel. This wakes up anything waiting on it.
+	done chan struct{}
+
+	mutex    sync.Mutex
+	sam      *sam3.SAM
+	session  *sam3.StreamSession
+	listener net.Listener
+	closed   bool
+}
+
+// newI2PTunnel sets up a tunnel using our config. Nothing happens until it is
+// opened.
+func (cb *Catbox) newI2PTunnel(name, keysFile string,
+	tlsConfig *tls.Config) *i2pTunnel {
+	return &i2pTunnel{
+		name:       name,
+		keysFile:   keysFile,
+		samAddress: cb.Config.SAMAddress,
+		options:    cb.Config.I2PTunnel.samOptions(),
+		tlsConfig:  tlsConfig,
+
+		minReconnectDelay: i2pMinReconnectDelay,
+		maxReconnectDelay: i2pMaxReconnectDelay,
+		acceptRetryDelay:  i2pAcceptRetryDelay,
+
+		done: make(chan struct{}),
+	}
+}
+
+// openSession connects to the SAM bridge and creates the session. This may
+// take a while as the router builds tunnels.
+func (t *i2pTunnel) openSession() error {
+	s, err := sam3.NewSAM(t.samAddress)
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to SAM bridge")
+	}
+
+	keys, err := loadI2PKeys(s, t.keysFile)
+	if err != nil {
+		_ = s.Close()
+		return err
+	}
+
+	session, err := s.NewStreamSession(t.name, keys, t.options)
+	if err != nil {
+		_ = s.Close()
+		return errors.Wrap(err, "unable to create I2P session")
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// We may have been closed while we waited on the bridge.
+	if t.closed {
+		_ = session.Close()
+		_ = s.Close()
+		return fmt.Errorf("tunnel %s closed", t.name)
+	}
+
+	t.sam = s
+	t.session = session
+	return nil
+}
+
+// open creates the session and starts listening on it.
+func (t *i2pTunnel) open() error {
+	if err := t.openSession(); err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return fmt.Errorf("tunnel %s closed", t.name)
+	}
+
+	ln, err := t.session.Listen()
+	if err != nil {
+		return errors.Wrap(err, "unable to listen on I2P session")
+	}
+
+	t.listener = ln
+	if t.tlsConfig != nil {
+		t.listener = tls.NewListener(ln, t.tlsConfig)
+	}
+	return nil
+}
+
+// dial opens a connection over the tunnel's session.
+func (t *i2pTunnel) dial(address string) (net.Conn, error) {
+	t.mutex.Lock()
+	session := t.session
+	t.mutex.Unlock()
+
+	if session == nil {
+		return nil, fmt.Errorf("tunnel %s is not open", t.name)
+	}
+
+	return session.Dial("tcp", address)
+}
+
+// destination is the base64 destination we accept connections on.
+func (t *i2pTunnel) destination() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.listener == nil {
+		return ""
+	}
+	return t.listener.Addr().String()
+}
+
+func (t *i2pTunnel) isClosed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.closed
+}
+
+// isOpen says whether we have a session we are listening on.
+func (t *i2pTunnel) isOpen() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.listener != nil
+}
+
+// accept waits for a connection on the listener.
+//
+// sam3 waits for connections on a connection of its own to the SAM bridge, so
+// closing the session does not wake it up. We wait in another goroutine so
+// that closing the tunnel does. sam3 also panics if it can't reach the bridge.
+// We turn that into an error.
+func (t *i2pTunnel) accept() (net.Conn, error) {
+	t.mutex.Lock()
+	ln := t.listener
+	t.mutex.Unlock()
+
+	if ln == nil {
+		return nil, fmt.Errorf("tunnel %s is not open", t.name)
+	}
+
+	type acceptResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	resultChan := make(chan acceptResult, 1)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				resultChan <- acceptResult{err: fmt.Errorf("accept failed: %v", r)}
+			}
+		}()
+
+		// On error, sam3 gives us a nil *SAMConn, which is not a nil net.Conn.
+		conn, err := ln.Accept()
+		if err != nil {
+			resultChan <- acceptResult{err: err}
+			return
+		}
+		resultChan <- acceptResult{conn: conn}
+	}()
+
+	select {
+	case r := <-resultChan:
+		return r.conn, r.err
+	case <-t.done:
+		// If a connection shows up after all, nobody wants it.
+		go func() {
+			if r := <-resultChan; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("tunnel %s closed", t.name)
+	}
+}
+
+// wait waits for the given time. It returns false if we close the tunnel in
+// the meantime.
+func (t *i2pTunnel) wait(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+// reset closes the listener, the session, and our connection to the SAM
+// bridge, but leaves the tunnel usable. We open it again to reconnect.
+func (t *i2pTunnel) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.closeSession()
+}
+
+// closeSession closes whatever we have open. The caller must hold the mutex.
+func (t *i2pTunnel) closeSession() {
+	if t.listener != nil {
+		_ = t.listener.Close()
+		t.listener = nil
+	}
+	if t.session != nil {
+		_ = t.session.Close()
+		t.session = nil
+	}
+	if t.sam != nil {
+		_ = t.sam.Close()
+		t.sam = nil
+	}
+}
+
+// close closes the listener, the session, and our connection to the SAM
+// bridge. The tunnel is done after this.
+func (t *i2pTunnel) close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+
+	t.closeSession()
+}
+
+// i2pConn is a connection we dialed on a tunnel of its own. Closing it closes
+// the tunnel.
+type i2pConn struct {
+	net.Conn
+	tunnel *i2pTunnel
+}
+
+func (c *i2pConn) Close() error {
+	err := c.Conn.Close()
+	c.tunnel.close()
+	return err
+}
+
+// dialI2P connects to a server over I2P. Each link gets its own session and
+// keys, named after the server.
+//
+// This blocks. Don't call it from the server goroutine.
+func (cb *Catbox) dialI2P(name, keysFile, address string) (net.Conn, error) {
+	t := cb.newI2PTunnel(name, keysFile, nil)
+	if err := t.openSession(); err != nil {
+		return nil, err
+	}
+
+	conn, err := t.dial(address)
+	if err != nil {
+		t.close()
+		return nil, errors.Wrap(err, "unable to dial over I2P")
+	}
+
+	return &i2pConn{Conn: conn, tunnel: t}, nil
+}
+
+// newI2PListeners sets up the tunnels we listen on according to our config.
+// They become our I2P listeners. The caller opens them.
+//
+// The plaintext and TLS listeners are separate sessions, each with its own
+// keys and so its own destination.
+func (cb *Catbox) newI2PListeners() []*i2pTunnel {
+	tunnels := []*i2pTunnel{}
+
+	if cb.Config.ListenI2P != "-1" {
+		tunnels = append(tunnels, cb.newI2PTunnel(cb.Config.ListenI2P,
+			cb.Config.I2PKeysFile, nil))
+	}
+
+	if cb.Config.ListenI2PTLS != "-1" {
+		// We set up TLS when we start. If we didn't, such as when a rehash added
+		// this listener, we can't use it until we restart.
+		if cb.TLSConfig == nil {
+			cb.logf(LogError, LogGeneral,
+				"Not listening on I2P (%s): TLS is not set up. Restart to listen.",
+				cb.Config.ListenI2PTLS)
+		} else {
+			tunnels = append(tunnels, cb.newI2PTunnel(cb.Config.ListenI2PTLS,
+				cb.Config.I2PTLSKeysFile, cb.TLSConfig))
+		}
+	}
+
+	cb.I2PTunnels = tunnels
+	return tunnels
+}
+
+// restartI2PListeners closes our I2P listeners and opens new ones using the
+// current config. We open them in the background as building tunnels takes a
+// while.
+func (cb *Catbox) restartI2PListeners() {
+	for _, t := range cb.I2PTunnels {
+		t.close()
+	}
+
+	for _, t := range cb.newI2PListeners() {
+		cb.WG.Add(1)
+		go cb.superviseI2PListener(t, cb.i2pAddressHelperHosts(t.name))
+	}
+}
+
+// startI2PListener opens a tunnel to listen on and starts accepting
+// connections on it.
+//
+// This blocks while the router builds tunnels.
+func (cb *Catbox) startI2PListener(t *i2pTunnel, hosts []string) error {
+	if err := cb.openI2PListener(t, hosts); err != nil {
+		return err
+	}
+
+	cb.WG.Add(1)
+	go cb.superviseI2PListener(t, hosts)
+	return nil
+}
+
+// openI2PListener opens a tunnel to listen on and writes address helper links
+// for it.
+func (cb *Catbox) openI2PListener(t *i2pTunnel, hosts []string) error {
+	if err := t.open(); err != nil {
+		t.reset()
+		return err
+	}
+
+	for _, host := range hosts {
+		if err := writeI2PAddressHelper(host, t.destination()); err != nil {
+			t.reset()
+			return err
+		}
+	}
+
+	cb.logf(LogInfo, LogGeneral, "Listening on I2P (%s)", t.name)
+	return nil
+}
+
+// superviseI2PListener keeps an I2P listener going until we close it.
+//
+// We accept connections on it. If its session fails, such as when the SAM
+// bridge restarts, we reconnect. We use the same keys each time, so we come
+// back with the same destination.
+//
+// If the tunnel is not open yet, we open it first.
+func (cb *Catbox) superviseI2PListener(t *i2pTunnel, hosts []string) {
+	defer cb.WG.Done()
+
+	for {
+		if !t.isOpen() {
+			if !cb.reopenI2PListener(t, hosts) {
+				break
+			}
+		}
+
+		err := cb.acceptI2PConnections(t)
+		if err == nil {
+			break
+		}
+
+		cb.newEvent(Event{
+			Type: OperNoticeEvent,
+			Notice: fmt.Sprintf("I2P listener (%s) lost its session: %s",
+				t.name, err),
+		})
+		t.reset()
+	}
+
+	cb.logf(LogInfo, LogGeneral, "I2P connection accepter (%s) shutting down.",
+		t.name)
+}
+
+// reopenI2PListener opens a tunnel to listen on, trying until it works or we
+// close the tunnel. We wait longer each time we fail. It returns false if we
+// closed the tunnel.
+func (cb *Catbox) reopenI2PListener(t *i2pTunnel, hosts []string) bool {
+	delay := t.minReconnectDelay
+
+	for attempts := 1; ; attempts++ {
+		if t.isClosed() || cb.isShuttingDown() {
+			return false
+		}
+
+		err := cb.openI2PListener(t, hosts)
+		if err == nil {
+			cb.newEvent(Event{
+				Type: OperNoticeEvent,
+				Notice: fmt.Sprintf("I2P listener (%s) is up (attempt %d)", t.name,
+					attempts),
+			})
+			return true
+		}
+
+		if t.isClosed() || cb.isShuttingDown() {
+			return false
+		}
+
+		cb.logf(LogWarn, LogGeneral,
+			"Unable to listen on I2P (%s): %s. Trying again in %s", t.name, err,
+			delay)
+
+		if attempts == 1 {
+			cb.newEvent(Event{
+				Type: OperNoticeEvent,
+				Notice: fmt.Sprintf(
+					"I2P listener (%s) is down: %s. Trying to reconnect to the SAM bridge",
+					t.name, err),
+			})
+		}
+
+		if !t.wait(delay) {
+			return false
+		}
+
+		delay *= 2
+		if delay > t.maxReconnectDelay {
+			delay = t.maxReconnectDelay
+		}
+	}
+}
+
+// acceptI2PConnections accepts connections on an I2P tunnel.
+//
+// It returns nil once we close the tunnel. If accepting keeps failing, we
+// decide the session is gone and return the error.
+func (cb *Catbox) acceptI2PConnections(t *i2pTunnel) error {
+	failures := 0
+
+	for {
+		if cb.isShuttingDown() || t.isClosed() {
+			return nil
+		}
+
+		conn, err := t.accept()
+		if err != nil {
+			if cb.isShuttingDown() || t.isClosed() {
+				return nil
+			}
+
+			failures++
+			if failures >= i2pMaxAcceptFailures {
+				return err
+			}
+
+			cb.logf(LogWarn, LogClient, "Failed to accept I2P connection: %s", err)
+
+			if !t.wait(t.acceptRetryDelay) {
+				return nil
+			}
+			continue
+		}
+
+		failures = 0
+		cb.introduceClient(conn)
+	}
+}
+
+// i2pAddressHelperHosts lists the hosts we write address helper links for
+// for an I2P listener: Its name, and our server name if it is an I2P name.
+//
+// Our server name goes with the plaintext listener, or with the TLS listener
+// if that is the only one.
+func (cb *Catbox) i2pAddressHelperHosts(name string) []string {
+	hosts := []string{name}
+
+	serverListener := cb.Config.ListenI2P
+	if serverListener == "-1" {
+		serverListener = cb.Config.ListenI2PTLS
+	}
+
+	if name == serverListener &&
+		strings.HasSuffix(cb.Config.ServerName, ".i2p") &&
+		cb.Config.ServerName != name {
+		hosts = append(hosts, cb.Config.ServerName)
+	}
+	return hosts
+}
+
+// writeI2PAddressHelper writes a file with an address helper link for a host.
+// Users visit it to add the host to their I2P address book.
+func writeI2PAddressHelper(host, destination string) error {
+	err := ioutil.WriteFile(host+".i2paddresshelper",
+		[]byte("http://"+host+"/?i2paddresshelper="+destination), 0644)
+	if err != nil {
+		return errors.Wrap(err,
+			"unable to write I2P addresshelper link to file")
+	}
+	return nil
+}
@@ -0,0 +1,584 @@
+package terrarium
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestI2PLinkKeysFile(t *testing.T) {
+	tests := []struct {
+		KeysFile string
+		Output   string
+	}{
+		{"terrarium.i2p.i2p.private", "terrarium.i2p-irc.example.i2p.i2p.private"},
+		{"keys", "keys-irc.example.i2p.i2p.private"},
+	}
+
+	for _, test := range tests {
+		c := &Config{I2PKeysFile: test.KeysFile}
+		output := c.i2pLinkKeysFile("irc.example.i2p")
+		if output != test.Output {
+			t.Errorf("i2pLinkKeysFile() with keys %s = %s, wanted %s",
+				test.KeysFile, output, test.Output)
+		}
+	}
+}
+
+func TestParseI2PTunnelConfig(t *testing.T) {
+	tests := []struct {
+		Input   map[string]string
+		Output  I2PTunnelConfig
+		Success bool
+	}{
+		{
+			map[string]string{},
+			I2PTunnelConfig{Length: 3, Quantity: 3, BackupQuantity: 2,
+				LeaseSetEncType: "4,0"},
+			true,
+		},
+		{
+			map[string]string{
+				"i2p-tunnel-length":          "1",
+				"i2p-tunnel-quantity":        "5",
+				"i2p-tunnel-backup-quantity": "0",
+				"i2p-tunnel-variance":        "-1",
+				"i2p-lease-set-enc-type":     "4, 0",
+			},
+			I2PTunnelConfig{Length: 1, Quantity: 5, BackupQuantity: 0,
+				LengthVariance: -1, LeaseSetEncType: "4,0"},
+			true,
+		},
+		{map[string]string{"i2p-tunnel-length": "8"}, I2PTunnelConfig{}, false},
+		{map[string]string{"i2p-tunnel-quantity": "0"}, I2PTunnelConfig{}, false},
+		{map[string]string{"i2p-tunnel-variance": "x"}, I2PTunnelConfig{}, false},
+		{map[string]string{"i2p-lease-set-enc-type": "4,x"}, I2PTunnelConfig{},
+			false},
+	}
+
+	for _, test := range tests {
+		output, err := parseI2PTunnelConfig(test.Input)
+		if !test.Success {
+			if err == nil {
+				t.Errorf("parseI2PTunnelConfig(%v) succeeded, wanted error",
+					test.Input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseI2PTunnelConfig(%v) failed: %s", test.Input, err)
+			continue
+		}
+		if output != test.Output {
+			t.Errorf("parseI2PTunnelConfig(%v) = %+v, wanted %+v", test.Input,
+				output, test.Output)
+		}
+	}
+
+	options := I2PTunnelConfig{Length: 2, Quantity: 4, BackupQuantity: 1,
+		LengthVariance: 1, LeaseSetEncType: "4"}.samOptions()
+	wanted := []string{
+		"inbound.length=2",
+		"outbound.length=2",
+		"inbound.quantity=4",
+		"outbound.quantity=4",
+		"inbound.backupQuantity=1",
+		"outbound.backupQuantity=1",
+		"inbound.lengthVariance=1",
+		"outbound.lengthVariance=1",
+		"i2cp.leaseSetEncType=4",
+	}
+	if !reflect.DeepEqual(options, wanted) {
+		t.Errorf("samOptions() = %v, wanted %v", options, wanted)
+	}
+}
+
+// fakeSAMBridge speaks enough of the SAM protocol for us to create a stream
+// session and accept connections on it. Stopping it and starting another at
+// the same address is like the bridge restarting.
+type fakeSAMBridge struct {
+	listener net.Listener
+
+	mutex sync.Mutex
+
+	conns []net.Conn
+
+	// How many times we generated keys.
+	generated int
+
+	// Session ID to the keys it was created with.
+	sessions map[string]string
+
+	// Connections waiting in STREAM ACCEPT, by session ID.
+	accepts map[string]chan net.Conn
+}
+
+// fakeSAMAddress is where the fake bridge listens. sam3 accepts connections by
+// connecting to the bridge at the default address no matter what address we
+// give it, so that is where we must be.
+const fakeSAMAddress = "127.0.0.1:7656"
+
+func newFakeSAMBridge(t *testing.T) *fakeSAMBridge {
+	ln, err := net.Listen("tcp", fakeSAMAddress)
+	if err != nil {
+		t.Skipf("unable to listen on %s, is a SAM bridge running? %s",
+			fakeSAMAddress, err)
+	}
+
+	b := &fakeSAMBridge{
+		listener: ln,
+		sessions: map[string]string{},
+		accepts:  map[string]chan net.Conn{},
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			b.mutex.Lock()
+			b.conns = append(b.conns, conn)
+			b.mutex.Unlock()
+
+			go b.handle(conn)
+		}
+	}()
+
+	return b
+}
+
+func (b *fakeSAMBridge) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			_ = conn.Close()
+			return
+		}
+
+		switch fields[0] + " " + fields[1] {
+		case "HELLO VERSION":
+			_, _ = fmt.Fprintf(conn, "HELLO REPLY RESULT=OK VERSION=3.1\n")
+		case "DEST GENERATE":
+			b.mutex.Lock()
+			b.generated++
+			n := byte(b.generated)
+			b.mutex.Unlock()
+
+			// Each destination is different.
+			pub := i2pBase64.EncodeToString(bytes.Repeat([]byte{n, 0x20, 0x30}, 129))
+			priv := i2pBase64.EncodeToString(bytes.Repeat([]byte{n, 0x50, 0x60}, 221))
+			_, _ = fmt.Fprintf(conn, "DEST REPLY PUB=%s PRIV=%s\n", pub, priv)
+		case "SESSION CREATE":
+			session := samArg(fields, "ID")
+			keys := samArg(fields, "DESTINATION")
+
+			b.mutex.Lock()
+			b.sessions[session] = keys
+			b.mutex.Unlock()
+
+			_, _ = fmt.Fprintf(conn, "SESSION STATUS RESULT=OK DESTINATION=%s\n",
+				keys)
+
+			// The session lasts as long as this connection.
+			_, _ = r.ReadString('\n')
+
+			b.mutex.Lock()
+			delete(b.sessions, session)
+			b.mutex.Unlock()
+
+			_ = conn.Close()
+			return
+		case "STREAM ACCEPT":
+			id := samArg(fields, "ID")
+
+			b.mutex.Lock()
+			_, exists := b.sessions[id]
+			if exists && b.accepts[id] == nil {
+				b.accepts[id] = make(chan net.Conn, 10)
+			}
+			accepts := b.accepts[id]
+			b.mutex.Unlock()
+
+			if !exists {
+				_, _ = fmt.Fprintf(conn, "STREAM STATUS RESULT=INVALID_ID\n")
+				_ = conn.Close()
+				return
+			}
+
+			_, _ = fmt.Fprintf(conn, "STREAM STATUS RESULT=OK\n")
+
+			// The connection is the peer's from here on. See connect().
+			accepts <- conn
+			return
+		default:
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// samArg finds the value of a KEY=value argument.
+func samArg(fields []string, key string) string {
+	for _, field := range fields {
+		if strings.HasPrefix(field, key+"=") {
+			return strings.TrimPrefix(field, key+"=")
+		}
+	}
+	return ""
+}
+
+// connect connects a peer to a session that is accepting connections. We
+// return the peer's side of the connection.
+func (b *fakeSAMBridge) connect(t *testing.T, session, peer string) net.Conn {
+	var accepts chan net.Conn
+	timeout := time.After(5 * time.Second)
+	for accepts == nil {
+		b.mutex.Lock()
+		accepts = b.accepts[session]
+		b.mutex.Unlock()
+
+		select {
+		case <-timeout:
+			t.Fatalf("session %s is not accepting connections", session)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	select {
+	case conn := <-accepts:
+		_, _ = fmt.Fprintf(conn, "%s\n", peer)
+
+		// sam3 drops anything that arrives along with the destination line. Give
+		// it time to read it before the peer says anything.
+		time.Sleep(100 * time.Millisecond)
+
+		return conn
+	case <-timeout:
+		t.Fatalf("session %s is not accepting connections", session)
+	}
+	return nil
+}
+
+// sessionKeys tells what keys a session was created with. Blank if there is no
+// such session.
+func (b *fakeSAMBridge) sessionKeys(session string) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.sessions[session]
+}
+
+func (b *fakeSAMBridge) generatedKeys() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.generated
+}
+
+// stop closes the listener and every connection, as if the bridge died.
+func (b *fakeSAMBridge) stop() {
+	_ = b.listener.Close()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, conn := range b.conns {
+		_ = conn.Close()
+	}
+	b.conns = nil
+}
+
+// waitForEvent waits for an event the server goroutine would receive. We skip
+// events that don't match.
+func waitForEvent(t *testing.T, ch <-chan Event, match func(Event) bool,
+	what string) {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case evt := <-ch:
+			if match(evt) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestI2PListenerReconnects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terrarium-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	bridge := newFakeSAMBridge(t)
+
+	cb := &Catbox{
+		Config: &Config{
+			ServerName: "irc.example.i2p",
+			SAMAddress: fakeSAMAddress,
+			DeadTime:   time.Minute,
+		},
+		ToServerChan: make(chan Event, 1024),
+		ShutdownChan: make(chan struct{}),
+	}
+	defer close(cb.ShutdownChan)
+
+	tunnel := cb.newI2PTunnel("irc.example.i2p", filepath.Join(dir, "keys"), nil)
+	tunnel.minReconnectDelay = 10 * time.Millisecond
+	tunnel.maxReconnectDelay = 50 * time.Millisecond
+	tunnel.acceptRetryDelay = 10 * time.Millisecond
+
+	hosts := []string{filepath.Join(dir, "irc.example.i2p")}
+
+	if err := cb.openI2PListener(tunnel, hosts); err != nil {
+		t.Fatalf("error opening I2P listener: %s", err)
+	}
+	keys := bridge.sessionKeys("irc.example.i2p")
+	destination := tunnel.destination()
+	if keys == "" || destination == "" {
+		t.Fatalf("no session created")
+	}
+
+	done := make(chan struct{})
+	cb.WG.Add(1)
+	go func() {
+		cb.superviseI2PListener(tunnel, hosts)
+		close(done)
+	}()
+
+	peer := i2pBase64.EncodeToString(bytes.Repeat([]byte{0x01, 0x02, 0x03}, 129))
+	peerB32, err := i2pDestination(i2pAddr(peer))
+	if err != nil {
+		t.Fatalf("i2pDestination() failed: %s", err)
+	}
+	isPeer := func(evt Event) bool {
+		return evt.Type == NewClientEvent && evt.Client.Conn.I2PDest == peerB32
+	}
+	isNotice := func(s string) func(Event) bool {
+		return func(evt Event) bool {
+			return evt.Type == OperNoticeEvent && strings.Contains(evt.Notice, s)
+		}
+	}
+
+	bridge.connect(t, "irc.example.i2p", peer)
+	waitForEvent(t, cb.ToServerChan, isPeer, "client from the peer")
+
+	// The bridge restarts. We notice we lost the session, and once the bridge is
+	// back, we create it again with the same keys.
+	bridge.stop()
+	waitForEvent(t, cb.ToServerChan, isNotice("lost its session"),
+		"notice about losing the session")
+
+	bridge = newFakeSAMBridge(t)
+	defer bridge.stop()
+
+	waitForEvent(t, cb.ToServerChan, isNotice("is up"),
+		"notice about being back up")
+
+	if bridge.sessionKeys("irc.example.i2p") != keys {
+		t.Errorf("session created with keys %s, wanted %s",
+			bridge.sessionKeys("irc.example.i2p"), keys)
+	}
+	if bridge.generatedKeys() != 0 {
+		t.Errorf("generated new keys, wanted to reuse ours")
+	}
+	if tunnel.destination() != destination {
+		t.Errorf("destination is %s, wanted %s", tunnel.destination(),
+			destination)
+	}
+
+	bridge.connect(t, "irc.example.i2p", peer)
+	waitForEvent(t, cb.ToServerChan, isPeer, "client from the peer")
+
+	// Closing the tunnel stops the supervisor even as it waits for a
+	// connection.
+	tunnel.close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("supervisor did not stop")
+	}
+}
+
+// newTestTLSConfig makes a TLS config with a self-signed certificate.
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "irc.example.i2p"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der},
+			PrivateKey: key}},
+	}
+}
+
+func TestI2PListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terrarium-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// We write address helper links to the current directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("error getting working directory: %s", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("error changing directory: %s", err)
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	bridge := newFakeSAMBridge(t)
+	defer bridge.stop()
+
+	cb := &Catbox{
+		Config: &Config{
+			ServerName:     "terrarium.i2p",
+			ListenI2P:      "irc.example.i2p",
+			ListenI2PTLS:   "ircs.example.i2p",
+			SAMAddress:     fakeSAMAddress,
+			I2PKeysFile:    "keys",
+			I2PTLSKeysFile: "tls-keys",
+			DeadTime:       time.Minute,
+		},
+		TLSConfig:    newTestTLSConfig(t),
+		ToServerChan: make(chan Event, 1024),
+		ShutdownChan: make(chan struct{}),
+	}
+	defer close(cb.ShutdownChan)
+
+	tunnels := cb.newI2PListeners()
+	if len(tunnels) != 2 {
+		t.Fatalf("got %d I2P listeners, wanted 2", len(tunnels))
+	}
+	defer func() {
+		for _, tunnel := range tunnels {
+			tunnel.close()
+		}
+	}()
+
+	for _, tunnel := range tunnels {
+		if err := cb.startI2PListener(tunnel,
+			cb.i2pAddressHelperHosts(tunnel.name)); err != nil {
+			t.Fatalf("error starting I2P listener %s: %s", tunnel.name, err)
+		}
+	}
+
+	plain, secure := tunnels[0], tunnels[1]
+	if plain.name != "irc.example.i2p" || secure.name != "ircs.example.i2p" {
+		t.Fatalf("listeners are %s and %s, wanted irc.example.i2p and "+
+			"ircs.example.i2p", plain.name, secure.name)
+	}
+
+	// Each listener has its own keys, and so its own destination.
+	if bridge.generatedKeys() != 2 {
+		t.Errorf("generated %d keys, wanted 2", bridge.generatedKeys())
+	}
+	if plain.destination() == secure.destination() {
+		t.Errorf("listeners share destination %s", plain.destination())
+	}
+	for _, file := range []string{"keys", "tls-keys"} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Errorf("keys file %s: %s", file, err)
+			continue
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("keys file %s permissions = %o, wanted 600", file,
+				fi.Mode().Perm())
+		}
+	}
+
+	helpers := []struct {
+		Host        string
+		Destination string
+	}{
+		{"irc.example.i2p", plain.destination()},
+		{"ircs.example.i2p", secure.destination()},
+		{"terrarium.i2p", plain.destination()},
+	}
+	for _, helper := range helpers {
+		buf, err := ioutil.ReadFile(helper.Host + ".i2paddresshelper")
+		if err != nil {
+			t.Errorf("error reading address helper: %s", err)
+			continue
+		}
+		wanted := "http://" + helper.Host + "/?i2paddresshelper=" +
+			helper.Destination
+		if string(buf) != wanted {
+			t.Errorf("address helper for %s is %s, wanted %s", helper.Host, buf,
+				wanted)
+		}
+	}
+
+	peer := i2pBase64.EncodeToString(bytes.Repeat([]byte{0x01, 0x02, 0x03}, 129))
+	peerB32, err := i2pDestination(i2pAddr(peer))
+	if err != nil {
+		t.Fatalf("i2pDestination() failed: %s", err)
+	}
+	isPeer := func(tls bool) func(Event) bool {
+		return func(evt Event) bool {
+			return evt.Type == NewClientEvent &&
+				evt.Client.Conn.I2PDest == peerB32 && evt.Client.isTLS() == tls
+		}
+	}
+
+	bridge.connect(t, "irc.example.i2p", peer)
+	waitForEvent(t, cb.ToServerChan, isPeer(false), "plaintext client")
+
+	conn := bridge.connect(t, "ircs.example.i2p", peer)
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	go func() {
+		_ = tlsConn.Handshake()
+	}()
+	waitForEvent(t, cb.ToServerChan, isPeer(true), "TLS client")
+}
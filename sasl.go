@@ -0,0 +1,280 @@
+package terrarium
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// SASL mechanisms we support.
+const (
+	saslExternal = "EXTERNAL"
+	saslPlain    = "PLAIN"
+)
+
+// AUTHENTICATE payloads arrive in chunks of this size. A chunk of exactly this
+// size means more is coming.
+const saslChunkSize = 400
+
+// The most payload we'll accept for one authentication attempt.
+const maxSASLPayloadLength = 2048
+
+// authenticateCommand handles AUTHENTICATE. This is SASL authentication. We
+// support it only before registration. The client must have requested the sasl
+// capability.
+//
+// The first AUTHENTICATE names the mechanism. We reply with AUTHENTICATE +.
+// The client then sends its base64 encoded payload, possibly over several
+// messages.
+//
+// If authentication succeeds, we remember the account. We log the user in to
+// it when it completes registration.
+//
+// See https://ircv3.net/specs/extensions/sasl-3.1
+func (c *LocalClient) authenticateCommand(m irc.Message) {
+	nick := c.saslNick()
+
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		c.capReply(nick, "461", []string{m.Command, "Not enough parameters"})
+		return
+	}
+
+	if !c.hasCap(capSASL) {
+		// 904 ERR_SASLFAIL
+		c.capReply(nick, "904", []string{"SASL authentication failed"})
+		return
+	}
+
+	if len(c.PreRegAccount) > 0 {
+		// 907 ERR_SASLALREADY
+		c.capReply(nick, "907", []string{
+			"You have already authenticated using SASL"})
+		return
+	}
+
+	if m.Params[0] == "*" {
+		c.resetSASL()
+		// 906 ERR_SASLABORTED
+		c.capReply(nick, "906", []string{"SASL authentication aborted"})
+		return
+	}
+
+	// Starting an attempt. The parameter is the mechanism.
+	if len(c.SASLMechanism) == 0 {
+		mechanism := strings.ToUpper(m.Params[0])
+		if mechanism != saslPlain && mechanism != saslExternal {
+			// 908 RPL_SASLMECHS
+			c.capReply(nick, "908", []string{c.Catbox.saslMechanisms(),
+				"are available SASL mechanisms"})
+			// 904 ERR_SASLFAIL
+			c.capReply(nick, "904", []string{"SASL authentication failed"})
+			return
+		}
+
+		c.SASLMechanism = mechanism
+		c.maybeQueueMessage(irc.Message{
+			Command: "AUTHENTICATE",
+			Params:  []string{"+"},
+		})
+		return
+	}
+
+	// Otherwise it is payload. + means an empty chunk.
+	if m.Params[0] != "+" {
+		c.SASLBuffer += m.Params[0]
+	}
+
+	if len(c.SASLBuffer) > maxSASLPayloadLength {
+		c.resetSASL()
+		// 905 ERR_SASLTOOLONG
+		c.capReply(nick, "905", []string{"SASL message too long"})
+		return
+	}
+
+	// More is coming.
+	if len(m.Params[0]) == saslChunkSize {
+		return
+	}
+
+	mechanism := c.SASLMechanism
+	payload, err := base64.StdEncoding.DecodeString(c.SASLBuffer)
+	c.resetSASL()
+	if err != nil {
+		// 904 ERR_SASLFAIL
+		c.capReply(nick, "904", []string{"SASL authentication failed"})
+		return
+	}
+
+	if mechanism == saslPlain {
+		c.saslPlainCheck(payload)
+		return
+	}
+
+	account := c.saslExternal(payload)
+	if account == nil {
+		// 904 ERR_SASLFAIL
+		c.capReply(nick, "904", []string{"SASL authentication failed"})
+		return
+	}
+
+	c.saslLoggedIn(account)
+}
+
+// saslPlainCheck checks the password in a PLAIN payload. bcrypt is slow, so we
+// do it in another goroutine and finish up when we have the result.
+func (c *LocalClient) saslPlainCheck(payload []byte) {
+	account, password := c.saslPlain(payload)
+	if account == nil {
+		// 904 ERR_SASLFAIL
+		c.capReply(c.saslNick(), "904", []string{"SASL authentication failed"})
+		return
+	}
+
+	name := account.Name
+	hash := account.PasswordHash
+
+	started := c.checkPasswordAsync(
+		func() bool { return checkPasswordHash(hash, password) },
+		func(ok bool) {
+			// They may have registered or logged in some other way while we
+			// checked. The account may have gone away too.
+			if _, exists := c.Catbox.LocalClients[c.ID]; !exists ||
+				len(c.PreRegAccount) > 0 {
+				return
+			}
+
+			account := c.Catbox.getAccount(name)
+			if !ok || account == nil {
+				// 904 ERR_SASLFAIL
+				c.capReply(c.saslNick(), "904",
+					[]string{"SASL authentication failed"})
+				return
+			}
+
+			c.saslLoggedIn(account)
+		},
+	)
+	if !started {
+		// 904 ERR_SASLFAIL
+		c.capReply(c.saslNick(), "904", []string{
+			"SASL authentication failed: Already checking a password"})
+	}
+}
+
+// saslNick is the nick to use in SASL replies.
+func (c *LocalClient) saslNick() string {
+	if len(c.PreRegDisplayNick) > 0 {
+		return c.PreRegDisplayNick
+	}
+	return "*"
+}
+
+// saslLoggedIn finishes SASL authentication. We remember the account and tell
+// the client.
+func (c *LocalClient) saslLoggedIn(account *Account) {
+	nick := c.saslNick()
+
+	c.PreRegAccount = account.Name
+
+	user := "*"
+	if len(c.PreRegUser) > 0 {
+		user = c.PreRegUser
+	}
+	host := c.address()
+	if len(c.Hostname) > 0 {
+		host = c.Hostname
+	}
+
+	// 900 RPL_LOGGEDIN
+	c.capReply(nick, "900", []string{
+		fmt.Sprintf("%s!%s@%s", nick, user, host),
+		account.Name,
+		fmt.Sprintf("You are now logged in as %s", account.Name),
+	})
+	// 903 RPL_SASLSUCCESS
+	c.capReply(nick, "903", []string{"SASL authentication successful"})
+}
+
+// Forget about any SASL attempt in progress.
+func (c *LocalClient) resetSASL() {
+	c.SASLMechanism = ""
+	c.SASLBuffer = ""
+}
+
+// saslPlain parses a PLAIN payload. It looks like this:
+// <authorization identity>\0<authentication identity>\0<password>
+//
+// We don't support acting as another identity, so the authorization identity
+// must be blank or the same as the authentication identity.
+//
+// Returns the account and the password to check against it. The account is nil
+// if the payload is invalid or the account does not exist.
+func (c *LocalClient) saslPlain(payload []byte) (*Account, string) {
+	pieces := bytes.Split(payload, []byte{0})
+	if len(pieces) != 3 {
+		return nil, ""
+	}
+
+	authzid := string(pieces[0])
+	authcid := string(pieces[1])
+	password := string(pieces[2])
+
+	if len(authzid) > 0 &&
+		canonicalizeNick(authzid) != canonicalizeNick(authcid) {
+		return nil, ""
+	}
+
+	return c.Catbox.getAccount(authcid), password
+}
+
+// saslExternal logs the client in using its TLS client certificate. The payload
+// is optionally the account they want. If they don't say, use whichever
+// account has the certificate's fingerprint.
+//
+// Returns the account if the certificate may log in to it.
+func (c *LocalClient) saslExternal(payload []byte) *Account {
+	if !c.isTLS() {
+		return nil
+	}
+
+	_, _, certFP, err := c.getTLSState()
+	if err != nil || len(certFP) == 0 {
+		return nil
+	}
+
+	if len(payload) == 0 {
+		return c.Catbox.getAccountByCertFP(certFP)
+	}
+
+	account := c.Catbox.getAccount(string(payload))
+	if account == nil || !account.hasCertFP(certFP) {
+		return nil
+	}
+	return account
+}
+
+// saslMechanisms lists the mechanisms we support, comma separated.
+func (cb *Catbox) saslMechanisms() string {
+	return saslExternal + "," + saslPlain
+}
+
+// Build an ENCAP SU message. This tells servers what account a user is logged
+// in to. If they are not logged in to one, the account parameter is absent.
+//
+// :<SID> ENCAP * SU <UID> [account]
+func suMessage(sid TS6SID, user *User) irc.Message {
+	params := []string{"*", "SU", string(user.UID)}
+	if len(user.Account) > 0 {
+		params = append(params, user.Account)
+	}
+
+	return irc.Message{
+		Prefix:  string(sid),
+		Command: "ENCAP",
+		Params:  params,
+	}
+}
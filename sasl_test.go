@@ -0,0 +1,218 @@
+package terrarium
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSASLPlain(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("error generating hash: %s", err)
+	}
+
+	c := &LocalClient{
+		Catbox: &Catbox{
+			Accounts: map[string]*Account{
+				"horgh": {Name: "horgh", PasswordHash: string(hash)},
+			},
+		},
+	}
+
+	tests := []struct {
+		Payload string
+		Account string
+	}{
+		{"\x00horgh\x00hunter2", "horgh"},
+		{"horgh\x00horgh\x00hunter2", "horgh"},
+		{"\x00HORGH\x00hunter2", "horgh"},
+		{"\x00horgh\x00hunter3", ""},
+		{"other\x00horgh\x00hunter2", ""},
+		{"\x00nobody\x00hunter2", ""},
+		{"horgh\x00hunter2", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		account, password := c.saslPlain([]byte(test.Payload))
+
+		name := ""
+		if account != nil && account.checkPassword(password) {
+			name = account.Name
+		}
+
+		if name != test.Account {
+			t.Errorf("saslPlain(%q) = %s, wanted %s", test.Payload, name,
+				test.Account)
+		}
+	}
+}
+
+func TestCheckPasswordAsync(t *testing.T) {
+	cb := &Catbox{
+		LocalClients: map[uint64]*LocalClient{},
+		LocalUsers:   map[uint64]*LocalUser{},
+		ToServerChan: make(chan Event, 10),
+		ShutdownChan: make(chan struct{}),
+	}
+	c := &LocalClient{ID: 1, Catbox: cb}
+	cb.LocalClients[c.ID] = c
+
+	var results []bool
+	done := func(ok bool) { results = append(results, ok) }
+
+	if !c.checkPasswordAsync(func() bool { return true }, done) {
+		t.Fatalf("checkPasswordAsync() did not start a check")
+	}
+	if c.checkPasswordAsync(func() bool { return true }, done) {
+		t.Errorf("checkPasswordAsync() started a second check at once")
+	}
+
+	evt := <-cb.ToServerChan
+	if evt.Type != PasswordCheckedEvent || evt.Client != c {
+		t.Fatalf("got event %d, wanted PasswordCheckedEvent", evt.Type)
+	}
+	cb.passwordChecked(evt.Client, evt.PasswordCheck)
+
+	if len(results) != 1 || !results[0] {
+		t.Errorf("done called with %v, wanted [true]", results)
+	}
+	if c.PasswordCheckPending {
+		t.Errorf("check still pending after we got the result")
+	}
+
+	// If the client goes away first, nobody hears about the result.
+	if !c.checkPasswordAsync(func() bool { return false }, done) {
+		t.Fatalf("checkPasswordAsync() did not start a check")
+	}
+	delete(cb.LocalClients, c.ID)
+
+	evt = <-cb.ToServerChan
+	cb.passwordChecked(evt.Client, evt.PasswordCheck)
+
+	if len(results) != 1 {
+		t.Errorf("done called for a client that went away")
+	}
+}
+
+func TestPasswordCheckHoldsMessages(t *testing.T) {
+	cb := &Catbox{
+		Config:       &Config{ServerName: "irc.example.com"},
+		LocalClients: map[uint64]*LocalClient{},
+		LocalUsers:   map[uint64]*LocalUser{},
+		LocalServers: map[uint64]*LocalServer{},
+		ToServerChan: make(chan Event, 10),
+		ShutdownChan: make(chan struct{}),
+	}
+	c := &LocalClient{
+		ID:        1,
+		Catbox:    cb,
+		WriteChan: make(chan irc.Message, 10),
+		Caps:      map[string]struct{}{},
+	}
+	cb.LocalClients[c.ID] = c
+
+	checked := false
+	if !c.checkPasswordAsync(func() bool { return true },
+		func(ok bool) { checked = true }) {
+		t.Fatalf("checkPasswordAsync() did not start a check")
+	}
+
+	c.handleMessage(irc.Message{Command: "CAP", Params: []string{"LS"}})
+	if len(c.WriteChan) != 0 {
+		t.Fatalf("handled a message while checking a password")
+	}
+
+	evt := <-cb.ToServerChan
+	cb.passwordChecked(evt.Client, evt.PasswordCheck)
+
+	if !checked {
+		t.Errorf("done not called")
+	}
+	if len(c.HeldMessages) != 0 || len(c.WriteChan) != 1 {
+		t.Errorf("held messages not handled after the check")
+	}
+}
+
+func TestPasswordCheckHoldsServerBurst(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("error generating hash: %s", err)
+	}
+
+	cb := &Catbox{
+		Config: &Config{
+			ServerName:    "irc1.example.com",
+			ServerInfo:    "one",
+			TS6SID:        "000",
+			MaxNickLength: 9,
+			Servers: map[string]*ServerDefinition{
+				"irc2.example.com": {Name: "irc2.example.com", SendPass: "hunter2",
+					AcceptPass: string(hash)},
+			},
+		},
+		LocalClients: map[uint64]*LocalClient{},
+		LocalUsers:   map[uint64]*LocalUser{},
+		LocalServers: map[uint64]*LocalServer{},
+		Opers:        map[TS6UID]*User{},
+		Nicks:        map[string]TS6UID{},
+		Users:        map[TS6UID]*User{},
+		Servers:      map[TS6SID]*Server{},
+		Channels:     map[string]*Channel{},
+		ToServerChan: make(chan Event, 10),
+		ShutdownChan: make(chan struct{}),
+		Metrics:      newMetrics(),
+	}
+	c := &LocalClient{
+		ID:        1,
+		Catbox:    cb,
+		WriteChan: make(chan irc.Message, 1000),
+	}
+	cb.LocalClients[c.ID] = c
+
+	// A server sends all of this without waiting for us to reply.
+	messages := []irc.Message{
+		{Command: "PASS", Params: []string{"hunter2", "TS", "6", "001"}},
+		{Command: "CAPAB", Params: []string{"QS ENCAP"}},
+		{Command: "SERVER", Params: []string{"irc2.example.com", "1", "two"}},
+		{Command: "SVINFO", Params: []string{"6", "6", "0",
+			fmt.Sprintf("%d", time.Now().Unix())}},
+	}
+	users := 5 * MaxAllowedPreRegisterMessageCount
+	for i := 0; i < users; i++ {
+		uid := fmt.Sprintf("001AAA%03d", i)
+		messages = append(messages, irc.Message{
+			Prefix:  "001",
+			Command: "UID",
+			Params: []string{fmt.Sprintf("user%d", i), "1", "1", "+i", "user",
+				"example.com", "127.0.0.1", uid, "real name"},
+		})
+	}
+
+	for _, m := range messages {
+		cb.messageFromClient(c, m)
+	}
+
+	if _, exists := cb.LocalClients[c.ID]; !exists {
+		t.Fatalf("client quit while we checked its password")
+	}
+	if len(c.HeldMessages) != len(messages)-3 {
+		t.Fatalf("held %d messages, wanted %d", len(c.HeldMessages),
+			len(messages)-3)
+	}
+
+	evt := <-cb.ToServerChan
+	cb.passwordChecked(evt.Client, evt.PasswordCheck)
+
+	if len(cb.LocalServers) != 1 {
+		t.Fatalf("server did not link after the check")
+	}
+	if len(cb.Users) != users {
+		t.Errorf("have %d users after the burst, wanted %d", len(cb.Users),
+			users)
+	}
+}
@@ -0,0 +1,164 @@
+package terrarium
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// Server notice mask characters. Operators choose which of these they see
+// with user mode +s.
+const (
+	// Client connections.
+	SnomaskConnects = 'c'
+
+	// Debugging information, such as protocol problems.
+	SnomaskDebug = 'd'
+
+	// Flood control.
+	SnomaskFloods = 'f'
+
+	// K-Lines and destination bans.
+	SnomaskKLines = 'k'
+
+	// Server links.
+	SnomaskLinks = 'l'
+
+	// Nick changes.
+	SnomaskNicks = 'n'
+
+	// Client quits.
+	SnomaskQuits = 'q'
+
+	// Anything else: Operator actions, rehashes, errors.
+	SnomaskGeneral = 's'
+)
+
+// All server notice mask characters we know.
+const snomaskChars = "cdfklnqs"
+
+// The server notice mask operators get when they use OPER or set +s without
+// a mask.
+const defaultSnomask = "kls"
+
+// Server notice mask characters for log categories. See logNotice().
+var logCategorySnomasks = map[LogCategory]byte{
+	LogGeneral: SnomaskGeneral,
+	LogLink:    SnomaskLinks,
+	LogClient:  SnomaskConnects,
+	LogKLine:   SnomaskKLines,
+	LogFlood:   SnomaskFloods,
+	LogOper:    SnomaskGeneral,
+}
+
+// applySnomaskChanges applies changes such as +cf-q to a server notice mask.
+// Characters without a + or - before them are added. We ignore characters we
+// don't know.
+func applySnomaskChanges(current map[byte]struct{},
+	changes string) map[byte]struct{} {
+	snomask := make(map[byte]struct{})
+	for c := range current {
+		snomask[c] = struct{}{}
+	}
+
+	add := true
+	for _, c := range changes {
+		if c == '+' {
+			add = true
+			continue
+		}
+		if c == '-' {
+			add = false
+			continue
+		}
+
+		if !strings.ContainsRune(snomaskChars, c) {
+			continue
+		}
+
+		if add {
+			snomask[byte(c)] = struct{}{}
+			continue
+		}
+		delete(snomask, byte(c))
+	}
+
+	return snomask
+}
+
+// snomaskString makes a string such as +ckl out of a server notice mask.
+func snomaskString(snomask map[byte]struct{}) string {
+	var chars []string
+	for c := range snomask {
+		chars = append(chars, string(c))
+	}
+	sort.Strings(chars)
+	return "+" + strings.Join(chars, "")
+}
+
+// hasSnomask says whether the user wants server notices of the given type.
+//
+// Client connection notices also go to users with +C. It is the older way to
+// ask for them.
+func (u *LocalUser) hasSnomask(c byte) bool {
+	if c == SnomaskConnects {
+		if _, exists := u.User.Modes['C']; exists {
+			return true
+		}
+	}
+
+	_, exists := u.Snomask[c]
+	return exists
+}
+
+// setSnomask changes the user's server notice mask. We set or unset user mode
+// +s to match. Tell them with 008 RPL_SNOMASK.
+func (u *LocalUser) setSnomask(snomask map[byte]struct{}) {
+	u.Snomask = snomask
+
+	if len(snomask) == 0 {
+		delete(u.User.Modes, 's')
+		return
+	}
+
+	u.User.Modes['s'] = struct{}{}
+
+	// 008 RPL_SNOMASK
+	u.messageFromServer("008", []string{snomaskString(snomask),
+		"Server notice mask"})
+}
+
+// sendSnomaskNotice sends a server notice to all local operators who want
+// notices of the given type.
+func (cb *Catbox) sendSnomaskNotice(c byte, msg string) {
+	for _, user := range cb.Opers {
+		if !user.isLocal() || !user.LocalUser.hasSnomask(c) {
+			continue
+		}
+		user.LocalUser.serverNotice(msg)
+	}
+}
+
+// snoteCommand handles an ENCAP SNOTE message. It carries a server notice from
+// another server for operators who want notices of its type.
+//
+// Parameters: <snomask character> <text>
+// Example (with ENCAP portion dropped):
+// :8ZZ SNOTE l :Burst with irc3.example.com over.
+func (s *LocalServer) snoteCommand(m irc.Message) {
+	if len(m.Params) < 2 || len(m.Params[0]) != 1 {
+		s.Catbox.logf(LogWarn, LogLink, "Invalid SNOTE from %s", s.Server.Name)
+		return
+	}
+
+	source, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+	if !exists {
+		s.Catbox.logf(LogWarn, LogLink, "SNOTE from unknown server %s", m.Prefix)
+		return
+	}
+
+	s.Catbox.sendSnomaskNotice(m.Params[0][0], fmt.Sprintf("from %s: %s",
+		source.Name, m.Params[1]))
+}
@@ -0,0 +1,83 @@
+package terrarium
+
+import (
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestApplySnomaskChanges(t *testing.T) {
+	tests := []struct {
+		Current string
+		Changes string
+		Output  string
+	}{
+		{"", "+cklf", "+cfkl"},
+		{"", "cklf", "+cfkl"},
+		{"kls", "+f-s", "+fkl"},
+		{"kls", "-kls", "+"},
+		{"kls", "+xyz", "+kls"},
+		{"c", "-c+q", "+q"},
+	}
+
+	for _, test := range tests {
+		current := applySnomaskChanges(nil, test.Current)
+		output := snomaskString(applySnomaskChanges(current, test.Changes))
+		if output != test.Output {
+			t.Errorf("applySnomaskChanges(%s, %s) = %s, wanted %s", test.Current,
+				test.Changes, output, test.Output)
+		}
+
+		if snomaskString(current) != snomaskString(applySnomaskChanges(nil,
+			test.Current)) {
+			t.Errorf("applySnomaskChanges(%s, %s) changed its input", test.Current,
+				test.Changes)
+		}
+	}
+}
+
+func TestUserModeCommandSnomask(t *testing.T) {
+	tests := []struct {
+		Snomask string
+		Modes   string
+		Params  []string
+		Output  bool
+	}{
+		{"", "+s", nil, true},
+		{"", "+s", []string{"+k"}, true},
+		{"", "+s", []string{"-c"}, false},
+		{"c", "+s", []string{"-c"}, false},
+		{"ck", "+s", []string{"-c"}, true},
+		{"ck", "-s", nil, false},
+	}
+
+	for _, test := range tests {
+		u := &LocalUser{
+			LocalClient: &LocalClient{
+				WriteChan: make(chan irc.Message, 10),
+				Catbox: &Catbox{
+					Config: &Config{ServerName: "irc.example.com"},
+					Opers:  map[TS6UID]*User{},
+				},
+			},
+			User: &User{
+				DisplayNick: "horgh",
+				Modes:       map[byte]struct{}{'o': {}},
+			},
+		}
+		u.User.LocalUser = u
+		if test.Snomask != "" {
+			u.User.Modes['s'] = struct{}{}
+			u.Snomask = applySnomaskChanges(nil, test.Snomask)
+		}
+
+		u.userModeCommand(u.User, test.Modes, test.Params)
+
+		_, hasMode := u.User.Modes['s']
+		if hasMode != test.Output || (len(u.Snomask) > 0) != test.Output {
+			t.Errorf("MODE %s %v with snomask %s: +s = %v, snomask = %s, wanted %v",
+				test.Modes, test.Params, test.Snomask, hasMode,
+				snomaskString(u.Snomask), test.Output)
+		}
+	}
+}
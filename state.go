@@ -0,0 +1,520 @@
+package terrarium
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/horgh/irc"
+	"github.com/pkg/errors"
+)
+
+// How many bytes of the dump we send in each NOTICE.
+const stateChunkSize = 350
+
+// StateDump is a server's view of the network. Every server should have the
+// same view, so comparing the dumps of two servers shows where they are out of
+// sync.
+//
+// Everything is sorted so the same state always encodes the same way. We leave
+// out what we expect to differ between servers, such as hop counts.
+type StateDump struct {
+	// The server that made the dump.
+	Server string `json:"server"`
+
+	Servers  []ServerState  `json:"servers"`
+	Users    []UserState    `json:"users"`
+	Channels []ChannelState `json:"channels"`
+	KLines   []KLineState   `json:"klines"`
+}
+
+// ServerState is a server in a StateDump.
+type ServerState struct {
+	SID         string `json:"sid"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// Name of the server it is linked to. Blank if it is the server that made
+	// the dump.
+	//
+	// This is as the server that made the dump sees it: the server it reaches
+	// the other through. It differs between servers even when they agree, so
+	// diffStates() does not compare it.
+	LinkedTo string `json:"linked_to,omitempty"`
+}
+
+// UserState is a user in a StateDump.
+type UserState struct {
+	UID      string `json:"uid"`
+	Nick     string `json:"nick"`
+	NickTS   int64  `json:"nick_ts"`
+	Modes    string `json:"modes"`
+	Username string `json:"username"`
+	Hostname string `json:"hostname"`
+	IP       string `json:"ip"`
+	RealName string `json:"real_name"`
+	Server   string `json:"server"`
+	Account  string `json:"account,omitempty"`
+	Away     string `json:"away,omitempty"`
+}
+
+// ChannelState is a channel in a StateDump.
+type ChannelState struct {
+	Name        string              `json:"name"`
+	TS          int64               `json:"ts"`
+	Modes       string              `json:"modes"`
+	Key         string              `json:"key,omitempty"`
+	Limit       int                 `json:"limit,omitempty"`
+	Topic       string              `json:"topic,omitempty"`
+	TopicTS     int64               `json:"topic_ts,omitempty"`
+	TopicSetter string              `json:"topic_setter,omitempty"`
+	Members     []string            `json:"members"`
+	Ops         []string            `json:"ops"`
+	Voices      []string            `json:"voices"`
+	Lists       map[string][]string `json:"lists,omitempty"`
+}
+
+// The user modes servers tell each other about. Others, such as +s and +C,
+// matter only on the user's own server. We leave those out of dumps.
+const stateUserModes = "io"
+
+// userStateModes makes a string of the user's modes for a StateDump.
+func userStateModes(u *User) string {
+	s := "+"
+	for _, mode := range []byte(stateUserModes) {
+		if _, exists := u.Modes[mode]; exists {
+			s += string(mode)
+		}
+	}
+	return s
+}
+
+// KLineState is a K-Line in a StateDump. Servers hear about K-Lines at
+// different times, so we don't include when it was set or when it expires.
+type KLineState struct {
+	UserMask  string `json:"user_mask"`
+	HostMask  string `json:"host_mask"`
+	Reason    string `json:"reason"`
+	Permanent bool   `json:"permanent"`
+}
+
+// dumpState builds our view of the network.
+func (cb *Catbox) dumpState() *StateDump {
+	dump := &StateDump{
+		Server:   cb.Config.ServerName,
+		Servers:  []ServerState{},
+		Users:    []UserState{},
+		Channels: []ChannelState{},
+		KLines:   []KLineState{},
+	}
+
+	dump.Servers = append(dump.Servers, ServerState{
+		SID:         string(cb.Config.TS6SID),
+		Name:        cb.Config.ServerName,
+		Description: cb.Config.ServerInfo,
+	})
+	for _, server := range cb.Servers {
+		linkedTo := cb.Config.ServerName
+		if server.LinkedTo != nil {
+			linkedTo = server.LinkedTo.Name
+		}
+		dump.Servers = append(dump.Servers, ServerState{
+			SID:         string(server.SID),
+			Name:        server.Name,
+			Description: server.Description,
+			LinkedTo:    linkedTo,
+		})
+	}
+	sort.Slice(dump.Servers, func(i, j int) bool {
+		return dump.Servers[i].SID < dump.Servers[j].SID
+	})
+
+	for _, user := range cb.Users {
+		serverName := cb.Config.ServerName
+		if user.Server != nil {
+			serverName = user.Server.Name
+		}
+		dump.Users = append(dump.Users, UserState{
+			UID:      string(user.UID),
+			Nick:     user.DisplayNick,
+			NickTS:   user.NickTS,
+			Modes:    userStateModes(user),
+			Username: user.Username,
+			Hostname: user.Hostname,
+			IP:       user.IP,
+			RealName: user.RealName,
+			Server:   serverName,
+			Account:  user.Account,
+			Away:     user.AwayMessage,
+		})
+	}
+	sort.Slice(dump.Users, func(i, j int) bool {
+		return dump.Users[i].UID < dump.Users[j].UID
+	})
+
+	for _, channel := range cb.Channels {
+		modes, _ := channel.modesString()
+		channelState := ChannelState{
+			Name:        channel.Name,
+			TS:          channel.TS,
+			Modes:       modes,
+			Key:         channel.Key,
+			Limit:       channel.Limit,
+			Topic:       channel.Topic,
+			TopicTS:     channel.TopicTS,
+			TopicSetter: channel.TopicSetter,
+			Members:     []string{},
+			Ops:         []string{},
+			Voices:      []string{},
+		}
+
+		for uid := range channel.Members {
+			channelState.Members = append(channelState.Members, string(uid))
+		}
+		sort.Strings(channelState.Members)
+
+		for uid := range channel.Ops {
+			channelState.Ops = append(channelState.Ops, string(uid))
+		}
+		sort.Strings(channelState.Ops)
+
+		for uid := range channel.Voices {
+			channelState.Voices = append(channelState.Voices, string(uid))
+		}
+		sort.Strings(channelState.Voices)
+
+		for _, mode := range []byte(channelListModes) {
+			if len(channel.Lists[mode]) == 0 {
+				continue
+			}
+			if channelState.Lists == nil {
+				channelState.Lists = map[string][]string{}
+			}
+			var masks []string
+			for _, listMask := range channel.Lists[mode] {
+				masks = append(masks, listMask.Mask)
+			}
+			sort.Strings(masks)
+			channelState.Lists[string(mode)] = masks
+		}
+
+		dump.Channels = append(dump.Channels, channelState)
+	}
+	sort.Slice(dump.Channels, func(i, j int) bool {
+		return dump.Channels[i].Name < dump.Channels[j].Name
+	})
+
+	for _, kline := range cb.KLines {
+		dump.KLines = append(dump.KLines, KLineState{
+			UserMask:  kline.UserMask,
+			HostMask:  kline.HostMask,
+			Reason:    kline.Reason,
+			Permanent: kline.ExpireTime.IsZero(),
+		})
+	}
+	sort.Slice(dump.KLines, func(i, j int) bool {
+		if dump.KLines[i].UserMask != dump.KLines[j].UserMask {
+			return dump.KLines[i].UserMask < dump.KLines[j].UserMask
+		}
+		return dump.KLines[i].HostMask < dump.KLines[j].HostMask
+	})
+
+	return dump
+}
+
+// splitStateChunks splits an encoded dump into pieces small enough to send in
+// a NOTICE. We don't split in the middle of a UTF-8 sequence.
+func splitStateChunks(buf []byte) []string {
+	var chunks []string
+	for len(buf) > 0 {
+		size := stateChunkSize
+		if size > len(buf) {
+			size = len(buf)
+		}
+		for size < len(buf) && size > 0 && !utf8.RuneStart(buf[size]) {
+			size--
+		}
+		if size == 0 {
+			size = stateChunkSize
+		}
+
+		chunks = append(chunks, string(buf[:size]))
+		buf = buf[size:]
+	}
+	return chunks
+}
+
+// sendStateDump sends our view of the network to a user. They may be local or
+// remote.
+//
+// The dump is compact JSON split across NOTICEs. Each looks like this:
+//
+// STATE <server name> <chunk number>/<chunk count> <chunk>
+//
+// Concatenating the chunks in order, with nothing between them, gives the
+// dump.
+func (cb *Catbox) sendStateDump(to *User) {
+	buf, err := json.Marshal(cb.dumpState())
+	if err != nil {
+		cb.noticeOpers(SnomaskGeneral, fmt.Sprintf("Unable to encode state: %s", err))
+		return
+	}
+
+	chunks := splitStateChunks(buf)
+	for i, chunk := range chunks {
+		text := fmt.Sprintf("STATE %s %d/%d %s", cb.Config.ServerName, i+1,
+			len(chunks), chunk)
+
+		if to.isLocal() {
+			to.LocalUser.messageFromServer("NOTICE", []string{to.DisplayNick, text})
+			continue
+		}
+
+		to.ClosestServer.maybeQueueMessage(irc.Message{
+			Prefix:  string(cb.Config.TS6SID),
+			Command: "NOTICE",
+			Params:  []string{string(to.UID), text},
+		})
+	}
+}
+
+// dumpStateCommand handles DUMPSTATE. It's an operator only command that sends
+// them a server's view of the network. See sendStateDump().
+//
+// DUMPSTATE [server name]
+//
+// If they name a different server we ask it with ENCAP DUMPSTATE.
+func (u *LocalUser) dumpStateCommand(m irc.Message) {
+	if !u.checkPrivilege(PrivDumpState) {
+		return
+	}
+
+	if len(m.Params) == 0 ||
+		strings.EqualFold(m.Params[0], u.Catbox.Config.ServerName) {
+		u.Catbox.sendStateDump(u.User)
+		return
+	}
+
+	server := u.Catbox.getServerByName(m.Params[0])
+	if server == nil {
+		// 402 ERR_NOSUCHSERVER
+		u.messageFromServer("402", []string{m.Params[0], "No such server"})
+		return
+	}
+
+	// :<UID> ENCAP <server name> DUMPSTATE
+	for _, ls := range u.Catbox.LocalServers {
+		ls.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "ENCAP",
+			Params:  []string{server.Name, "DUMPSTATE"},
+		})
+	}
+}
+
+// The DUMPSTATE command comes only in ENCAP messages. An operator on another
+// server wants our view of the network. We only answer if the ENCAP is for us.
+//
+// destination is the server the ENCAP is for.
+func (s *LocalServer) dumpStateCommand(m irc.Message, destination string) {
+	if !strings.EqualFold(destination, s.Catbox.Config.ServerName) {
+		return
+	}
+
+	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists {
+		s.Catbox.logf(LogWarn, LogLink, "DUMPSTATE from unknown user %s", m.Prefix)
+		return
+	}
+
+	if !user.isOperator() {
+		s.Catbox.logf(LogWarn, LogOper, "DUMPSTATE from non-operator %s",
+			user.DisplayNick)
+		return
+	}
+
+	s.Catbox.noticeLocalOpers(SnomaskGeneral, fmt.Sprintf(
+		"%s requested a state dump", user.DisplayNick))
+	s.Catbox.sendStateDump(user)
+}
+
+// loadStateDump reads a dump from a file. This is a dump an operator saved
+// from the NOTICEs we sent them.
+func loadStateDump(file string) (*StateDump, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading state dump")
+	}
+
+	var dump StateDump
+	if err := json.Unmarshal(buf, &dump); err != nil {
+		return nil, errors.Wrap(err, "error parsing state dump")
+	}
+
+	return &dump, nil
+}
+
+// DiffStateFiles compares two state dumps. It returns a description of each
+// difference. If there are none, the servers agree about the network.
+func DiffStateFiles(fileA, fileB string) ([]string, error) {
+	a, err := loadStateDump(fileA)
+	if err != nil {
+		return nil, errors.Wrap(err, fileA)
+	}
+
+	b, err := loadStateDump(fileB)
+	if err != nil {
+		return nil, errors.Wrap(err, fileB)
+	}
+
+	return diffStates(a, b), nil
+}
+
+// diffStates compares two state dumps item by item.
+func diffStates(a, b *StateDump) []string {
+	nameA := a.Server
+	if nameA == "" {
+		nameA = "first"
+	}
+	nameB := b.Server
+	if nameB == "" || nameB == nameA {
+		nameB = "second"
+	}
+
+	var diffs []string
+
+	// Each server records links from its own point of view. Leave them out.
+	serversA := map[string]interface{}{}
+	for _, server := range a.Servers {
+		server.LinkedTo = ""
+		serversA[server.SID] = server
+	}
+	serversB := map[string]interface{}{}
+	for _, server := range b.Servers {
+		server.LinkedTo = ""
+		serversB[server.SID] = server
+	}
+	diffs = append(diffs, diffStateSection("server", nameA, nameB, serversA,
+		serversB)...)
+
+	usersA := map[string]interface{}{}
+	for _, user := range a.Users {
+		usersA[user.UID] = user
+	}
+	usersB := map[string]interface{}{}
+	for _, user := range b.Users {
+		usersB[user.UID] = user
+	}
+	diffs = append(diffs, diffStateSection("user", nameA, nameB, usersA,
+		usersB)...)
+
+	channelsA := map[string]interface{}{}
+	for _, channel := range a.Channels {
+		channelsA[channel.Name] = channel
+	}
+	channelsB := map[string]interface{}{}
+	for _, channel := range b.Channels {
+		channelsB[channel.Name] = channel
+	}
+	diffs = append(diffs, diffStateSection("channel", nameA, nameB, channelsA,
+		channelsB)...)
+
+	klinesA := map[string]interface{}{}
+	for _, kline := range a.KLines {
+		klinesA[kline.UserMask+"@"+kline.HostMask] = kline
+	}
+	klinesB := map[string]interface{}{}
+	for _, kline := range b.KLines {
+		klinesB[kline.UserMask+"@"+kline.HostMask] = kline
+	}
+	diffs = append(diffs, diffStateSection("K-Line", nameA, nameB, klinesA,
+		klinesB)...)
+
+	return diffs
+}
+
+// diffStateSection compares the items of one kind in two dumps. The items are
+// keyed by what identifies them, such as UID.
+func diffStateSection(kind, nameA, nameB string,
+	a, b map[string]interface{}) []string {
+	keys := map[string]struct{}{}
+	for key := range a {
+		keys[key] = struct{}{}
+	}
+	for key := range b {
+		keys[key] = struct{}{}
+	}
+
+	sortedKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	var diffs []string
+	for _, key := range sortedKeys {
+		itemA, inA := a[key]
+		itemB, inB := b[key]
+
+		if !inB {
+			diffs = append(diffs, fmt.Sprintf("%s %s: only on %s", kind, key,
+				nameA))
+			continue
+		}
+		if !inA {
+			diffs = append(diffs, fmt.Sprintf("%s %s: only on %s", kind, key,
+				nameB))
+			continue
+		}
+
+		fieldsA := stateFields(itemA)
+		fieldsB := stateFields(itemB)
+
+		fieldNames := map[string]struct{}{}
+		for field := range fieldsA {
+			fieldNames[field] = struct{}{}
+		}
+		for field := range fieldsB {
+			fieldNames[field] = struct{}{}
+		}
+
+		sortedFields := make([]string, 0, len(fieldNames))
+		for field := range fieldNames {
+			sortedFields = append(sortedFields, field)
+		}
+		sort.Strings(sortedFields)
+
+		for _, field := range sortedFields {
+			if fieldsA[field] == fieldsB[field] {
+				continue
+			}
+			diffs = append(diffs, fmt.Sprintf("%s %s: %s differs: %s has %s, %s has %s",
+				kind, key, field, nameA, fieldsA[field], nameB, fieldsB[field]))
+		}
+	}
+
+	return diffs
+}
+
+// stateFields turns an item of a dump into its JSON fields, each encoded as
+// JSON. This lets us compare any kind of item field by field.
+func stateFields(item interface{}) map[string]string {
+	buf, err := json.Marshal(item)
+	if err != nil {
+		return nil
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return nil
+	}
+
+	fields := map[string]string{}
+	for field, value := range raw {
+		fields[field] = string(value)
+	}
+	return fields
+}
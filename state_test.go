@@ -0,0 +1,171 @@
+package terrarium
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitStateChunks(t *testing.T) {
+	tests := []struct {
+		Input  string
+		Chunks int
+	}{
+		{"", 0},
+		{"{}", 1},
+		{strings.Repeat("a", stateChunkSize), 1},
+		{strings.Repeat("a", stateChunkSize+1), 2},
+		{strings.Repeat("€", stateChunkSize), 4},
+	}
+
+	for _, test := range tests {
+		chunks := splitStateChunks([]byte(test.Input))
+		if len(chunks) != test.Chunks {
+			t.Errorf("splitStateChunks(%d bytes) = %d chunks, wanted %d",
+				len(test.Input), len(chunks), test.Chunks)
+			continue
+		}
+
+		for _, chunk := range chunks {
+			if !utf8.ValidString(chunk) || len(chunk) > stateChunkSize {
+				t.Errorf("splitStateChunks(%d bytes) gave bad chunk %q",
+					len(test.Input), chunk)
+			}
+		}
+
+		if strings.Join(chunks, "") != test.Input {
+			t.Errorf("splitStateChunks(%d bytes) chunks do not join to the input",
+				len(test.Input))
+		}
+	}
+}
+
+func TestDiffStates(t *testing.T) {
+	a := &StateDump{
+		Server: "irc1.example.com",
+		Channels: []ChannelState{
+			{Name: "#same", TS: 1, Modes: "+ns", Members: []string{"000AAAAAA"}},
+			{Name: "#test", TS: 1, Modes: "+ns",
+				Members: []string{"000AAAAAA", "001AAAAAA"},
+				Ops:     []string{"000AAAAAA", "001AAAAAA"}},
+		},
+		Users: []UserState{{UID: "000AAAAAA", Nick: "horgh"}},
+	}
+
+	b := &StateDump{
+		Server: "irc2.example.com",
+		Channels: []ChannelState{
+			{Name: "#same", TS: 1, Modes: "+ns", Members: []string{"000AAAAAA"}},
+			{Name: "#test", TS: 1, Modes: "+ns",
+				Members: []string{"000AAAAAA", "001AAAAAA"},
+				Ops:     []string{"001AAAAAA"}},
+		},
+		KLines: []KLineState{{UserMask: "*", HostMask: "example.com"}},
+	}
+
+	diffs := diffStates(a, b)
+
+	expected := []string{
+		"user 000AAAAAA: only on irc1.example.com",
+		`channel #test: ops differs: irc1.example.com has ["000AAAAAA","001AAAAAA"], irc2.example.com has ["001AAAAAA"]`,
+		"K-Line *@example.com: only on irc2.example.com",
+	}
+
+	if len(diffs) != len(expected) {
+		t.Fatalf("diffStates() = %q, wanted %q", diffs, expected)
+	}
+
+	for i := range expected {
+		if diffs[i] != expected[i] {
+			t.Errorf("diffStates() difference %d = %s, wanted %s", i, diffs[i],
+				expected[i])
+		}
+	}
+
+	if diffs := diffStates(a, a); len(diffs) != 0 {
+		t.Errorf("diffStates() of a dump with itself = %q, wanted none", diffs)
+	}
+}
+
+func TestDiffStatesServers(t *testing.T) {
+	// Three servers linked in a line: irc1 - irc2 - irc3. irc1 and irc2 agree
+	// about the network.
+	irc3 := &Server{SID: "002", Name: "irc3.example.com", Description: "three"}
+
+	irc2OnIRC1 := &Server{SID: "001", Name: "irc2.example.com",
+		Description: "two"}
+	cb1 := &Catbox{
+		Config: &Config{ServerName: "irc1.example.com", TS6SID: "000",
+			ServerInfo: "one"},
+		Servers: map[TS6SID]*Server{
+			"001": irc2OnIRC1,
+			"002": {SID: irc3.SID, Name: irc3.Name, Description: irc3.Description,
+				LinkedTo: irc2OnIRC1},
+		},
+	}
+
+	cb2 := &Catbox{
+		Config: &Config{ServerName: "irc2.example.com", TS6SID: "001",
+			ServerInfo: "two"},
+		Servers: map[TS6SID]*Server{
+			"000": {SID: "000", Name: "irc1.example.com", Description: "one"},
+			"002": irc3,
+		},
+	}
+
+	if diffs := diffStates(cb1.dumpState(), cb2.dumpState()); len(diffs) != 0 {
+		t.Errorf("diffStates() of consistent servers = %q, wanted none", diffs)
+	}
+
+	irc3.Description = "changed"
+	diffs := diffStates(cb1.dumpState(), cb2.dumpState())
+	expected := []string{
+		`server 002: description differs: irc1.example.com has "three", irc2.example.com has "changed"`,
+	}
+	if len(diffs) != len(expected) || diffs[0] != expected[0] {
+		t.Errorf("diffStates() = %q, wanted %q", diffs, expected)
+	}
+}
+
+func TestDiffStatesUserModes(t *testing.T) {
+	// An oper on irc1. Only irc1 knows about their +s. irc2 saw the modes in a
+	// different order.
+	cb1 := &Catbox{
+		Config: &Config{ServerName: "irc1.example.com", TS6SID: "000"},
+		Servers: map[TS6SID]*Server{
+			"001": {SID: "001", Name: "irc2.example.com"},
+		},
+		Users: map[TS6UID]*User{
+			"000AAAAAA": {UID: "000AAAAAA", DisplayNick: "will",
+				Modes: map[byte]struct{}{'s': {}, 'o': {}, 'i': {}, 'C': {}}},
+		},
+	}
+
+	irc1 := &Server{SID: "000", Name: "irc1.example.com"}
+	cb2 := &Catbox{
+		Config:  &Config{ServerName: "irc2.example.com", TS6SID: "001"},
+		Servers: map[TS6SID]*Server{"000": irc1},
+		Users: map[TS6UID]*User{
+			"000AAAAAA": {UID: "000AAAAAA", DisplayNick: "will", Server: irc1,
+				Modes: map[byte]struct{}{'o': {}, 'i': {}}},
+		},
+	}
+
+	// Map iteration order varies, so dump a few times.
+	for i := 0; i < 10; i++ {
+		diffs := diffStates(cb1.dumpState(), cb2.dumpState())
+		if len(diffs) != 0 {
+			t.Fatalf("diffStates() with local user modes = %q, wanted none",
+				diffs)
+		}
+	}
+
+	delete(cb2.Users["000AAAAAA"].Modes, 'o')
+	diffs := diffStates(cb1.dumpState(), cb2.dumpState())
+	expected := []string{
+		`user 000AAAAAA: modes differs: irc1.example.com has "+io", irc2.example.com has "+i"`,
+	}
+	if len(diffs) != len(expected) || diffs[0] != expected[0] {
+		t.Errorf("diffStates() = %q, wanted %q", diffs, expected)
+	}
+}
@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that a channel operator on one server can kick a user on another
+// server.
+func TestKICK(t *testing.T) {
+	terrarium1, err := harnessCatbox("irc1.example.org", "001")
+	require.NoError(t, err, "harness terrarium")
+	defer terrarium1.stop()
+
+	terrarium2, err := harnessCatbox("irc2.example.org", "002")
+	require.NoError(t, err, "harness terrarium")
+	defer terrarium2.stop()
+
+	err = terrarium1.linkServer(terrarium2)
+	require.NoError(t, err, "link terrarium1 to terrarium2")
+	err = terrarium2.linkServer(terrarium1)
+	require.NoError(t, err, "link terrarium2 to terrarium1")
+
+	linkRE := regexp.MustCompile(`Established link to irc2\.`)
+	require.True(t, waitForLog(terrarium1.LogChan, linkRE), "servers link")
+
+	client1 := NewClient("client1", "127.0.0.1", terrarium1.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	require.NoError(t, err, "start client 1")
+	defer client1.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(
+			t,
+			recvChan1,
+			irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s",
+			client1.GetNick(),
+		),
+		"client 1 gets welcome",
+	)
+
+	// client1 creates the channel so they have ops.
+	sendChan1 <- irc.Message{
+		Command: "JOIN",
+		Params:  []string{"#test"},
+	}
+	require.NotNil(
+		t,
+		waitForMessage(
+			t,
+			recvChan1,
+			irc.Message{Command: "JOIN"},
+			"%s received JOIN #test",
+			client1.GetNick(),
+		),
+		"client 1 gets JOIN message",
+	)
+
+	client2 := NewClient("client2", "127.0.0.1", terrarium2.Port)
+	recvChan2, sendChan2, _, err := client2.Start()
+	require.NoError(t, err, "start client 2")
+	defer client2.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(
+			t,
+			recvChan2,
+			irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s",
+			client2.GetNick(),
+		),
+		"client 2 gets welcome",
+	)
+
+	sendChan2 <- irc.Message{
+		Command: "JOIN",
+		Params:  []string{"#test"},
+	}
+	require.NotNil(
+		t,
+		waitForMessage(
+			t,
+			recvChan2,
+			irc.Message{Command: "JOIN"},
+			"%s received JOIN #test",
+			client2.GetNick(),
+		),
+		"client 2 gets JOIN message",
+	)
+
+	// Wait for client1 to see client2 join so we know the join propagated.
+	require.NotNil(
+		t,
+		waitForMessage(
+			t,
+			recvChan1,
+			irc.Message{Command: "JOIN"},
+			"%s received JOIN from %s",
+			client1.GetNick(),
+			client2.GetNick(),
+		),
+		"client 1 sees client 2 join",
+	)
+
+	sendChan1 <- irc.Message{
+		Command: "KICK",
+		Params:  []string{"#test", client2.GetNick(), "bye"},
+	}
+
+	kickMessage := waitForMessage(
+		t,
+		recvChan2,
+		irc.Message{Command: "KICK"},
+		"%s received KICK",
+		client2.GetNick(),
+	)
+	require.NotNil(t, kickMessage, "client 2 gets KICK message")
+	require.Equal(
+		t,
+		[]string{"#test", client2.GetNick(), "bye"},
+		kickMessage.Params,
+		"KICK parameters",
+	)
+}
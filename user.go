@@ -3,6 +3,7 @@ package terrarium
 import (
 	"fmt"
 	"log"
+	"sort"
 )
 
 // User holds information about a user. It may be remote or local.
@@ -39,6 +40,9 @@ type User struct {
 	// Away message. If blank, they're not away.
 	AwayMessage string
 
+	// The account the user is logged in to. If blank, they're not logged in.
+	Account string
+
 	// Channel name (canonicalized) to Channel. The channels it is in.
 	Channels map[string]*Channel
 
@@ -78,13 +82,25 @@ func (u *User) onChannel(channel *Channel) bool {
 	return exists
 }
 
-// Make a string of their user modes. + if no modes.
+// Check whether the user matches a nick!user@host mask.
+func (u *User) matchesHostmask(mask string) bool {
+	re, err := maskToRegex(mask)
+	if err != nil {
+		log.Printf("matchesHostmask: %s", err)
+		return false
+	}
+	return re.MatchString(u.nickUhost())
+}
+
+// Make a string of their user modes. + if no modes. The modes are sorted so
+// the same modes always give the same string.
 func (u *User) modesString() string {
-	s := "+"
+	modes := make([]byte, 0, len(u.Modes))
 	for m := range u.Modes {
-		s += string(m)
+		modes = append(modes, m)
 	}
-	return s
+	sort.Slice(modes, func(i, j int) bool { return modes[i] < modes[j] })
+	return "+" + string(modes)
 }
 
 func (u *User) isLocal() bool {
@@ -4,11 +4,15 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"regexp"
 	"sort"
 	"strings"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // 50 from RFC
@@ -17,6 +21,9 @@ const maxChannelLength = 50
 // Arbitrary. Something low enough we won't hit message limit.
 const maxTopicLength = 300
 
+// Arbitrary, like the topic length.
+const maxKickLength = 180
+
 // There is no limit defined in any RFC that I see. However, ratbox has username
 // length hardcoded to 10, and truncates at that.
 // It counts ~ in its length.
@@ -380,7 +387,8 @@ func maskToRegex(mask string) (*regexp.Regexp, error) {
 	regex = strings.Replace(regex, "\\*", ".*", -1)
 	regex = strings.Replace(regex, "\\?", ".", -1)
 
-	re, err := regexp.Compile(regex)
+	// Masks match the whole string, and without regard to case.
+	re, err := regexp.Compile("(?i)^" + regex + "$")
 	if err != nil {
 		return nil, err
 	}
@@ -388,6 +396,102 @@ func maskToRegex(mask string) (*regexp.Regexp, error) {
 	return re, nil
 }
 
+// normalizeMask fills in the parts of a nick!user@host mask that are missing.
+// e.g., nick becomes nick!*@*, and user@host becomes *!user@host.
+func normalizeMask(mask string) string {
+	nickUser := mask
+	host := "*"
+	if idx := strings.Index(mask, "@"); idx != -1 {
+		nickUser = mask[:idx]
+		host = mask[idx+1:]
+	}
+
+	nick := nickUser
+	user := "*"
+	if idx := strings.Index(nickUser, "!"); idx != -1 {
+		nick = nickUser[:idx]
+		user = nickUser[idx+1:]
+	} else if strings.Contains(mask, "@") {
+		// user@host
+		nick = "*"
+		user = nickUser
+	}
+
+	if nick == "" {
+		nick = "*"
+	}
+	if user == "" {
+		user = "*"
+	}
+	if host == "" {
+		host = "*"
+	}
+
+	return nick + "!" + user + "@" + host
+}
+
+// isValidChannelKey checks a key is something we accept for +k.
+func isValidChannelKey(key string) bool {
+	if len(key) == 0 || len(key) > maxChannelKeyLength {
+		return false
+	}
+
+	for _, char := range key {
+		if char <= ' ' || char == ',' || char == ':' || char == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// stripColours removes mIRC colour codes and formatting (bold, underline, etc)
+// from a message.
+func stripColours(s string) string {
+	stripped := make([]byte, 0, len(s))
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		// Bold, italics, strikethrough, monospace, reverse, underline, reset.
+		case 0x02, 0x1d, 0x1e, 0x11, 0x16, 0x1f, 0x0f:
+			continue
+		// Colour. Optionally followed by <fg>[,<bg>] where each is 1-2 digits.
+		case 0x03:
+			next := skipColourDigits(s, i+1)
+			// A background colour only counts if there was a foreground colour.
+			if next > i+1 && next+1 < len(s) && s[next] == ',' &&
+				isDigit(s[next+1]) {
+				next = skipColourDigits(s, next+1)
+			}
+			i = next - 1
+			continue
+		}
+		stripped = append(stripped, s[i])
+	}
+
+	return string(stripped)
+}
+
+// skipColourDigits returns the index after up to two digits starting at i.
+func skipColourDigits(s string, i int) int {
+	for count := 0; count < 2 && i < len(s) && isDigit(s[i]); count++ {
+		i++
+	}
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isValidListMask checks a mask is something we accept in a channel list. It
+// must be a normalized nick!user@host mask.
+func isValidListMask(mask string) bool {
+	if len(mask) > 100 {
+		return false
+	}
+	return !strings.ContainsAny(mask, " ,:\x00")
+}
+
 var resolver = net.Resolver{
 	PreferGo:     true,
 	StrictErrors: true,
@@ -550,13 +654,13 @@ func parseAndResolveUmodeChanges(modes string,
 	unknownModes := make(map[byte]struct{})
 
 	for mode := range requestSetModes {
-		if mode != 'i' && mode != 'o' && mode != 'C' {
+		if mode != 'i' && mode != 'o' && mode != 'C' && mode != 's' {
 			delete(requestSetModes, mode)
 			unknownModes[mode] = struct{}{}
 		}
 	}
 	for mode := range requestUnsetModes {
-		if mode != 'i' && mode != 'o' && mode != 'C' {
+		if mode != 'i' && mode != 'o' && mode != 'C' && mode != 's' {
 			delete(requestUnsetModes, mode)
 			unknownModes[mode] = struct{}{}
 		}
@@ -565,13 +669,12 @@ func parseAndResolveUmodeChanges(modes string,
 	// Unsetting certain modes triggers unsetting others. They're dependent.
 	for mode := range requestUnsetModes {
 		if mode == 'o' {
-			// Must be operator to have +C.
+			// Must be operator to have +C or +s.
 			requestUnsetModes['C'] = struct{}{}
-			// Block any request to set it.
-			_, exists := requestSetModes['C']
-			if exists {
-				delete(requestSetModes, 'C')
-			}
+			requestUnsetModes['s'] = struct{}{}
+			// Block any request to set them.
+			delete(requestSetModes, 'C')
+			delete(requestSetModes, 's')
 		}
 	}
 
@@ -615,8 +718,8 @@ func parseAndResolveUmodeChanges(modes string,
 			continue
 		}
 
-		// Must be +o to have +C.
-		if mode == 'C' {
+		// Must be +o to have +C or +s.
+		if mode == 'C' || mode == 's' {
 			_, exists := currentModes['o']
 			if exists {
 				currentModes[mode] = struct{}{}
@@ -740,3 +843,20 @@ func serverToMapLine(name string, sid TS6SID, localUsers, globalUsers,
 	// irc.example.com[000] ---------- | Users: n (100.0%)
 	return serverName + dashes + users
 }
+
+// writeFileAtomic writes the file by writing a temporary file beside it and
+// renaming that into place. This way we don't leave a partially written file if
+// we die while writing.
+func writeFileAtomic(file string, buf []byte) error {
+	tmpFile := file + ".tmp"
+
+	if err := ioutil.WriteFile(tmpFile, buf, 0600); err != nil {
+		return errors.Wrap(err, "error writing file")
+	}
+
+	if err := os.Rename(tmpFile, file); err != nil {
+		return errors.Wrap(err, "error renaming file")
+	}
+
+	return nil
+}
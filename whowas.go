@@ -0,0 +1,117 @@
+package terrarium
+
+import (
+	"time"
+)
+
+// How many entries we keep for each nick.
+const whowasEntriesPerNick = 5
+
+// How many nicks we keep history for. When we exceed this we forget the nick
+// that was least recently recorded.
+const maxWhowasNicks = 1000
+
+// WhowasEntry records a user as they were when they quit or changed nick.
+type WhowasEntry struct {
+	Nick        string
+	Username    string
+	Hostname    string
+	RealName    string
+	ServerName  string
+	SignoffTime time.Time
+}
+
+// whowasRing holds the most recent entries for a nick. Once it is full, new
+// entries overwrite the oldest.
+type whowasRing struct {
+	entries [whowasEntriesPerNick]WhowasEntry
+
+	// Where we write the next entry.
+	next int
+
+	// How many entries we have. At most whowasEntriesPerNick.
+	count int
+}
+
+// add records an entry, overwriting the oldest if the ring is full.
+func (r *whowasRing) add(entry WhowasEntry) {
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % whowasEntriesPerNick
+	if r.count < whowasEntriesPerNick {
+		r.count++
+	}
+}
+
+// newest returns the entries with the most recent first.
+func (r *whowasRing) newest() []WhowasEntry {
+	entries := make([]WhowasEntry, 0, r.count)
+	for i := 1; i <= r.count; i++ {
+		idx := (r.next - i + whowasEntriesPerNick) % whowasEntriesPerNick
+		entries = append(entries, r.entries[idx])
+	}
+	return entries
+}
+
+// lastSignoff tells when the most recent entry was recorded.
+func (r *whowasRing) lastSignoff() time.Time {
+	idx := (r.next - 1 + whowasEntriesPerNick) % whowasEntriesPerNick
+	return r.entries[idx].SignoffTime
+}
+
+// recordWhowas remembers a user as they are now. We call this when they quit
+// or change nick. They may be local or remote.
+func (cb *Catbox) recordWhowas(u *User) {
+	entry := WhowasEntry{
+		Nick:        u.DisplayNick,
+		Username:    u.Username,
+		Hostname:    u.Hostname,
+		RealName:    u.RealName,
+		ServerName:  cb.Config.ServerName,
+		SignoffTime: time.Now(),
+	}
+	if !u.isLocal() && u.Server != nil {
+		entry.ServerName = u.Server.Name
+	}
+
+	nick := canonicalizeNick(u.DisplayNick)
+
+	ring, exists := cb.Whowas[nick]
+	if !exists {
+		if len(cb.Whowas) >= maxWhowasNicks {
+			cb.forgetOldestWhowas()
+		}
+		ring = &whowasRing{}
+		cb.Whowas[nick] = ring
+	}
+
+	ring.add(entry)
+}
+
+// forgetOldestWhowas drops the history of the nick recorded least recently.
+func (cb *Catbox) forgetOldestWhowas() {
+	oldestNick := ""
+	var oldestTime time.Time
+	for nick, ring := range cb.Whowas {
+		if oldestNick == "" || ring.lastSignoff().Before(oldestTime) {
+			oldestNick = nick
+			oldestTime = ring.lastSignoff()
+		}
+	}
+
+	delete(cb.Whowas, oldestNick)
+}
+
+// getWhowas returns the history for a nick, most recent first. Returns at most
+// count entries, or all of them if count is not positive.
+func (cb *Catbox) getWhowas(nick string, count int) []WhowasEntry {
+	ring, exists := cb.Whowas[canonicalizeNick(nick)]
+	if !exists {
+		return nil
+	}
+
+	entries := ring.newest()
+	if count > 0 && count < len(entries) {
+		entries = entries[:count]
+	}
+	return entries
+}
@@ -0,0 +1,63 @@
+package terrarium
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWhowas(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{ServerName: "irc.example.com"},
+		Whowas: make(map[string]*whowasRing),
+	}
+
+	// Record more than a ring holds so we overwrite the oldest.
+	for i := 0; i < whowasEntriesPerNick+2; i++ {
+		cb.recordWhowas(&User{
+			DisplayNick: "Alice",
+			Username:    fmt.Sprintf("user%d", i),
+			Hostname:    "example.com",
+		})
+	}
+
+	entries := cb.getWhowas("alice", 0)
+	if len(entries) != whowasEntriesPerNick {
+		t.Fatalf("got %d entries, wanted %d", len(entries), whowasEntriesPerNick)
+	}
+
+	// Most recent first.
+	for i, entry := range entries {
+		wanted := fmt.Sprintf("user%d", whowasEntriesPerNick+1-i)
+		if entry.Username != wanted {
+			t.Errorf("entry %d username = %s, wanted %s", i, entry.Username, wanted)
+		}
+		if entry.ServerName != "irc.example.com" {
+			t.Errorf("entry %d server = %s, wanted irc.example.com", i,
+				entry.ServerName)
+		}
+	}
+
+	if entries := cb.getWhowas("alice", 2); len(entries) != 2 {
+		t.Errorf("got %d entries with count 2, wanted 2", len(entries))
+	}
+
+	if entries := cb.getWhowas("bob", 0); len(entries) != 0 {
+		t.Errorf("got %d entries for unknown nick, wanted 0", len(entries))
+	}
+}
+
+func TestWhowasMaxNicks(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{ServerName: "irc.example.com"},
+		Whowas: make(map[string]*whowasRing),
+	}
+
+	for i := 0; i < maxWhowasNicks+10; i++ {
+		cb.recordWhowas(&User{DisplayNick: fmt.Sprintf("nick%d", i)})
+	}
+
+	if len(cb.Whowas) != maxWhowasNicks {
+		t.Errorf("have history for %d nicks, wanted %d", len(cb.Whowas),
+			maxWhowasNicks)
+	}
+}